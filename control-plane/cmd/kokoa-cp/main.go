@@ -2,21 +2,53 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"time"
 
+	"github.com/neo/kokoa-proxy/control-plane/internal/acme"
 	"github.com/neo/kokoa-proxy/control-plane/internal/api"
 	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+	"github.com/neo/kokoa-proxy/control-plane/internal/events"
+	"github.com/neo/kokoa-proxy/control-plane/internal/ipam"
+	"github.com/neo/kokoa-proxy/control-plane/internal/secrets"
+	"github.com/neo/kokoa-proxy/control-plane/internal/signing"
+	"github.com/neo/kokoa-proxy/control-plane/internal/webhooks"
 )
 
 type config struct {
 	ListenAddr     string
 	DBPath         string
 	BootstrapToken string
+	AdminAPIKey    string
+	SecretsKey     string
+	SecretsKeyFile string
+	// SecretsPreviousKeys are retired key-encryption keys kept until
+	// "kokoa-cp reencrypt" has rewrapped every value.
+	SecretsPreviousKeys string
+	SigningKeyFile      string
+	EdgeStaleAfter      time.Duration
+	EdgeTokenTTL        time.Duration
+	// RequireEdgeApproval registers every new edge as pending.
+	RequireEdgeApproval bool
+	// EdgeDrainPeriod is how long draining edges serve before retirement.
+	EdgeDrainPeriod time.Duration
+	// TunnelCIDR lists the IPv4 and/or IPv6 networks tunnel addresses are
+	// allocated from, comma separated.
+	TunnelCIDR string
+
+	ACMEDirectoryURL     string
+	ACMEEmail            string
+	ACMEDNSProvider      string
+	ACMEDNSTarget        string
+	ACMECAFile           string
+	ACMEPropagationDelay time.Duration
 }
 
 func main() {
@@ -40,11 +72,91 @@ func main() {
 		logger.Fatalf("failed to migrate database: %v", err)
 	}
 
+	pools, err := ipam.ParsePools(cfg.TunnelCIDR)
+	if err != nil {
+		logger.Fatalf("invalid CP_TUNNEL_CIDR: %v", err)
+	}
+	store.SetTunnelPools(pools)
+
+	box, err := loadSecrets(cfg)
+	if err != nil {
+		logger.Fatalf("invalid secrets key: %v", err)
+	}
+	if box != nil {
+		store.SetSecrets(box)
+		logger.Printf("secrets are sealed with key %s", box.PrimaryKeyID())
+	} else {
+		logger.Println("CP_SECRETS_KEY is not set; origin private keys are refused and webhook secrets are stored unencrypted")
+	}
+
+	if len(os.Args) > 1 {
+		if err := runCommand(ctx, os.Args[1], store, logger); err != nil {
+			logger.Fatalf("%s: %v", os.Args[1], err)
+		}
+		return
+	}
+
+	if cfg.AdminAPIKey != "" {
+		if err := store.EnsureAPIKey(ctx, db.CreateAPIKeyParams{Name: "admin", KeyPlain: cfg.AdminAPIKey}); err != nil {
+			logger.Fatalf("failed to seed admin api key: %v", err)
+		}
+	} else {
+		logger.Println("CP_ADMIN_API_KEY is not set; management API accepts only keys already stored in the database")
+	}
+
+	if cfg.ACMEDirectoryURL != "" {
+		if box == nil {
+			logger.Fatalf("CP_ACME_DIRECTORY_URL requires CP_SECRETS_KEY to encrypt certificate keys")
+		}
+		provider, err := acme.NewDNSProvider(cfg.ACMEDNSProvider, cfg.ACMEDNSTarget)
+		if err != nil {
+			logger.Fatalf("invalid acme dns provider: %v", err)
+		}
+		manager, err := acme.NewManager(acme.Config{
+			DirectoryURL:     cfg.ACMEDirectoryURL,
+			Email:            cfg.ACMEEmail,
+			Provider:         provider,
+			CAFile:           cfg.ACMECAFile,
+			PropagationDelay: cfg.ACMEPropagationDelay,
+			Logger:           logger,
+		}, store, box)
+		if err != nil {
+			logger.Fatalf("failed to set up acme: %v", err)
+		}
+		go manager.Run(ctx)
+	}
+
+	signingKeyFile := cfg.SigningKeyFile
+	if signingKeyFile == "" {
+		signingKeyFile = filepath.Join(filepath.Dir(cfg.DBPath), "signing.key")
+	}
+	signer, err := signing.LoadOrCreate(signingKeyFile)
+	if err != nil {
+		logger.Fatalf("failed to load config signing key: %v", err)
+	}
+	logger.Printf("edge configs are signed with key %s (sha256 fingerprint %s)", signingKeyFile, signer.Fingerprint())
+
+	bus := events.NewBus(store)
+	if cfg.EdgeStaleAfter > 0 {
+		go bus.WatchStaleEdges(ctx, cfg.EdgeStaleAfter, logger)
+	}
+	go webhooks.NewWorker(store, bus, logger).Run(ctx)
+
+	if cfg.BootstrapToken != "" {
+		logger.Printf("CP_BOOTSTRAP_TOKEN is deprecated; issue join tokens with POST /api/v1/join-tokens instead")
+	}
 	server := api.NewServer(api.ServerConfig{
-		Store:          store,
-		BootstrapToken: cfg.BootstrapToken,
-		Logger:         logger,
+		Store:               store,
+		BootstrapToken:      cfg.BootstrapToken,
+		Logger:              logger,
+		Secrets:             box,
+		Events:              bus,
+		Signer:              signer,
+		EdgeTokenTTL:        cfg.EdgeTokenTTL,
+		RequireEdgeApproval: cfg.RequireEdgeApproval,
+		EdgeDrainPeriod:     cfg.EdgeDrainPeriod,
 	})
+	go server.WatchDrainingEdges(ctx)
 
 	srv := &http.Server{
 		Addr:         cfg.ListenAddr,
@@ -67,11 +179,83 @@ func main() {
 	_ = srv.Shutdown(shutdownCtx)
 }
 
+// runCommand runs a one-off maintenance command instead of the server.
+func runCommand(ctx context.Context, name string, store *db.Store, logger *log.Logger) error {
+	switch name {
+	case "reencrypt":
+		stats, err := store.ReencryptSecrets(ctx)
+		if err != nil {
+			return err
+		}
+		logger.Printf("reencrypt: sealed %d plaintext values, rewrapped %d values", stats.Sealed, stats.Rotated)
+		return nil
+	default:
+		return errors.New("unknown command (available: reencrypt)")
+	}
+}
+
+// loadSecrets builds the secrets box from CP_SECRETS_KEY or the first key of
+// CP_SECRETS_KEY_FILE, plus any previous keys listed after it in the file or
+// in CP_SECRETS_PREVIOUS_KEYS. It returns nil when no key is configured.
+func loadSecrets(cfg config) (*secrets.Box, error) {
+	var keys [][]byte
+	if cfg.SecretsKey != "" {
+		key, err := secrets.ParseKey(cfg.SecretsKey)
+		if err != nil {
+			return nil, fmt.Errorf("CP_SECRETS_KEY: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if cfg.SecretsKeyFile != "" {
+		if cfg.SecretsKey != "" {
+			return nil, errors.New("set only one of CP_SECRETS_KEY and CP_SECRETS_KEY_FILE")
+		}
+		data, err := os.ReadFile(cfg.SecretsKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("CP_SECRETS_KEY_FILE: %w", err)
+		}
+		if keys, err = secrets.ParseKeys(string(data)); err != nil {
+			return nil, fmt.Errorf("CP_SECRETS_KEY_FILE: %w", err)
+		}
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("CP_SECRETS_KEY_FILE: %s holds no key", cfg.SecretsKeyFile)
+		}
+	}
+	previous, err := secrets.ParseKeys(cfg.SecretsPreviousKeys)
+	if err != nil {
+		return nil, fmt.Errorf("CP_SECRETS_PREVIOUS_KEYS: %w", err)
+	}
+	if len(keys) == 0 {
+		if len(previous) > 0 {
+			return nil, errors.New("CP_SECRETS_PREVIOUS_KEYS requires a primary key")
+		}
+		return nil, nil
+	}
+	return secrets.NewBox(keys[0], append(keys[1:], previous...)...)
+}
+
 func loadConfig() config {
 	return config{
-		ListenAddr:     envDefault("CP_LISTEN_ADDR", ":8080"),
-		DBPath:         envDefault("CP_DB_PATH", filepath.Join("data", "kokoa.db")),
-		BootstrapToken: envDefault("CP_BOOTSTRAP_TOKEN", ""),
+		ListenAddr:          envDefault("CP_LISTEN_ADDR", ":8080"),
+		DBPath:              envDefault("CP_DB_PATH", filepath.Join("data", "kokoa.db")),
+		BootstrapToken:      envDefault("CP_BOOTSTRAP_TOKEN", ""),
+		AdminAPIKey:         envDefault("CP_ADMIN_API_KEY", ""),
+		SecretsKey:          envDefault("CP_SECRETS_KEY", ""),
+		SecretsKeyFile:      envDefault("CP_SECRETS_KEY_FILE", ""),
+		SecretsPreviousKeys: envDefault("CP_SECRETS_PREVIOUS_KEYS", ""),
+		SigningKeyFile:      envDefault("CP_SIGNING_KEY_FILE", ""),
+		EdgeStaleAfter:      time.Duration(envInt("CP_EDGE_STALE_SECONDS", 300)) * time.Second,
+		EdgeTokenTTL:        time.Duration(envInt("CP_EDGE_TOKEN_TTL_SECONDS", 0)) * time.Second,
+		RequireEdgeApproval: envBool("CP_EDGE_REQUIRE_APPROVAL", false),
+		EdgeDrainPeriod:     time.Duration(envInt("CP_EDGE_DRAIN_SECONDS", 300)) * time.Second,
+		TunnelCIDR:          envDefault("CP_TUNNEL_CIDR", "10.20.0.0/24"),
+
+		ACMEDirectoryURL:     envDefault("CP_ACME_DIRECTORY_URL", ""),
+		ACMEEmail:            envDefault("CP_ACME_EMAIL", ""),
+		ACMEDNSProvider:      envDefault("CP_ACME_DNS_PROVIDER", "exec"),
+		ACMEDNSTarget:        envDefault("CP_ACME_DNS_TARGET", ""),
+		ACMECAFile:           envDefault("CP_ACME_CA_FILE", ""),
+		ACMEPropagationDelay: time.Duration(envInt("CP_ACME_PROPAGATION_SECONDS", 0)) * time.Second,
 	}
 }
 
@@ -81,3 +265,19 @@ func envDefault(key, fallback string) string {
 	}
 	return fallback
 }
+
+func envBool(key string, fallback bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+func envInt(key string, fallback int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
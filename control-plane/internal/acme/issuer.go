@@ -0,0 +1,225 @@
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+	"github.com/neo/kokoa-proxy/control-plane/internal/secrets"
+)
+
+// Bundle is an issued certificate chain and its private key, both PEM encoded.
+type Bundle struct {
+	CertPEM  []byte
+	KeyPEM   []byte
+	NotAfter time.Time
+}
+
+// acmeIssuer obtains certificates from an RFC 8555 directory using DNS-01.
+// The account key is created on first use and kept encrypted in the store.
+type acmeIssuer struct {
+	directoryURL     string
+	email            string
+	httpClient       *http.Client
+	provider         DNSProvider
+	propagationDelay time.Duration
+	store            *db.Store
+	box              *secrets.Box
+
+	mu     sync.Mutex
+	client *acme.Client
+}
+
+func (i *acmeIssuer) Issue(ctx context.Context, hostnames []string) (Bundle, error) {
+	client, err := i.acmeClient(ctx)
+	if err != nil {
+		return Bundle{}, err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(hostnames...))
+	if err != nil {
+		return Bundle{}, fmt.Errorf("new order: %w", err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := i.authorize(ctx, client, authzURL); err != nil {
+			return Bundle{}, err
+		}
+	}
+	if _, err := client.WaitOrder(ctx, order.URI); err != nil {
+		return Bundle{}, fmt.Errorf("wait order: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return Bundle{}, fmt.Errorf("generate key: %w", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: hostnames}, key)
+	if err != nil {
+		return Bundle{}, fmt.Errorf("create csr: %w", err)
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return Bundle{}, fmt.Errorf("finalize order: %w", err)
+	}
+	if len(chain) == 0 {
+		return Bundle{}, errors.New("finalize order: empty certificate chain")
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return Bundle{}, fmt.Errorf("parse certificate: %w", err)
+	}
+
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return Bundle{}, err
+	}
+	return Bundle{CertPEM: certPEM, KeyPEM: keyPEM, NotAfter: leaf.NotAfter}, nil
+}
+
+// authorize completes the DNS-01 challenge of one authorization. Wildcard
+// names are validated on the base domain, as required by RFC 8555.
+func (i *acmeIssuer) authorize(ctx context.Context, client *acme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("get authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("no dns-01 challenge offered for %s", authz.Identifier.Value)
+	}
+	value, err := client.DNS01ChallengeRecord(challenge.Token)
+	if err != nil {
+		return fmt.Errorf("dns-01 record: %w", err)
+	}
+	fqdn := "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.") + "."
+	if err := i.provider.Present(ctx, fqdn, value); err != nil {
+		return fmt.Errorf("present %s: %w", fqdn, err)
+	}
+	defer func() {
+		// Clean up even when ctx was cancelled mid-challenge.
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		_ = i.provider.CleanUp(cleanupCtx, fqdn, value)
+	}()
+
+	if i.propagationDelay > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(i.propagationDelay):
+		}
+	}
+	if _, err := client.Accept(ctx, challenge); err != nil {
+		return fmt.Errorf("accept challenge: %w", err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("authorization for %s: %w", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+// acmeClient returns a registered client, loading or creating the account key.
+func (i *acmeIssuer) acmeClient(ctx context.Context) (*acme.Client, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.client != nil {
+		return i.client, nil
+	}
+
+	key, err := i.accountKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := &acme.Client{Key: key, DirectoryURL: i.directoryURL, HTTPClient: i.httpClient, UserAgent: "kokoa-proxy"}
+	account := &acme.Account{}
+	if i.email != "" {
+		account.Contact = []string{"mailto:" + i.email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("register acme account: %w", err)
+	}
+	i.client = client
+	return client, nil
+}
+
+func (i *acmeIssuer) accountKey(ctx context.Context) (crypto.Signer, error) {
+	account, err := i.store.ACMEAccountByDirectory(ctx, i.directoryURL)
+	if err == nil {
+		keyPEM, err := i.box.Open(account.KeyEncrypted)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt acme account key: %w", err)
+		}
+		return decodeKey(keyPEM)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate account key: %w", err)
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := i.box.Seal(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if err := i.store.SaveACMEAccount(ctx, db.ACMEAccount{DirectoryURL: i.directoryURL, Email: i.email, KeyEncrypted: sealed}); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("marshal key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func decodeKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("decode key: no PEM block")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("parse key: not a signing key")
+	}
+	return signer, nil
+}
@@ -0,0 +1,223 @@
+// Package acme issues and renews certificates for route hostnames on the
+// control plane, so edges only have to download them.
+package acme
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+	"github.com/neo/kokoa-proxy/control-plane/internal/secrets"
+)
+
+const (
+	defaultRenewBefore   = 30 * 24 * time.Hour
+	defaultCheckInterval = time.Hour
+	minRetryDelay        = 5 * time.Minute
+	maxRetryDelay        = 24 * time.Hour
+)
+
+type Config struct {
+	// DirectoryURL is the ACME directory, e.g. Let's Encrypt or a local Pebble.
+	DirectoryURL string
+	Email        string
+	Provider     DNSProvider
+	// CAFile optionally adds a PEM bundle to the roots trusted for the
+	// directory, which Pebble needs.
+	CAFile string
+	// PropagationDelay is waited after publishing TXT records.
+	PropagationDelay time.Duration
+	RenewBefore      time.Duration
+	CheckInterval    time.Duration
+	Logger           *log.Logger
+}
+
+type issuer interface {
+	Issue(ctx context.Context, hostnames []string) (Bundle, error)
+}
+
+// Manager keeps a certificate for every route hostname: it issues missing
+// certificates, renews those expiring within RenewBefore and backs off
+// exponentially per hostname after failures.
+type Manager struct {
+	store         *db.Store
+	box           *secrets.Box
+	issuer        issuer
+	renewBefore   time.Duration
+	checkInterval time.Duration
+	logger        *log.Logger
+	now           func() time.Time
+}
+
+func NewManager(cfg Config, store *db.Store, box *secrets.Box) (*Manager, error) {
+	if cfg.DirectoryURL == "" {
+		return nil, errors.New("acme: directory url is required")
+	}
+	if cfg.Provider == nil {
+		return nil, errors.New("acme: dns provider is required")
+	}
+	httpClient := http.DefaultClient
+	if cfg.CAFile != "" {
+		pemData, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("acme: read ca file: %w", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pemData) {
+			return nil, errors.New("acme: ca file contains no certificates")
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		httpClient = &http.Client{Transport: transport, Timeout: time.Minute}
+	}
+	m := newManager(store, box, &acmeIssuer{
+		directoryURL:     cfg.DirectoryURL,
+		email:            cfg.Email,
+		httpClient:       httpClient,
+		provider:         cfg.Provider,
+		propagationDelay: cfg.PropagationDelay,
+		store:            store,
+		box:              box,
+	}, cfg.Logger)
+	if cfg.RenewBefore > 0 {
+		m.renewBefore = cfg.RenewBefore
+	}
+	if cfg.CheckInterval > 0 {
+		m.checkInterval = cfg.CheckInterval
+	}
+	return m, nil
+}
+
+func newManager(store *db.Store, box *secrets.Box, iss issuer, logger *log.Logger) *Manager {
+	if logger == nil {
+		logger = log.New(os.Stdout, "acme ", log.LstdFlags|log.LUTC)
+	}
+	return &Manager{
+		store:         store,
+		box:           box,
+		issuer:        iss,
+		renewBefore:   defaultRenewBefore,
+		checkInterval: defaultCheckInterval,
+		logger:        logger,
+		now:           time.Now,
+	}
+}
+
+// Run checks for due certificates immediately and then every CheckInterval
+// until ctx is cancelled.
+func (m *Manager) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.checkInterval)
+	defer ticker.Stop()
+	for {
+		if err := m.RenewDue(ctx); err != nil && ctx.Err() == nil {
+			m.logger.Printf("certificate check failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RenewDue issues certificates for route hostnames that have none or whose
+// certificate expires within the renewal window. Per-hostname failures are
+// recorded in the store and do not stop the remaining hostnames.
+func (m *Manager) RenewDue(ctx context.Context) error {
+	routes, err := m.store.ListRoutes(ctx)
+	if err != nil {
+		return err
+	}
+	certs, err := m.store.ListCertificates(ctx)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]db.Certificate, len(certs))
+	for _, c := range certs {
+		existing[c.Hostname] = c
+	}
+
+	seen := make(map[string]bool)
+	var hostnames []string
+	for _, r := range routes {
+		if !seen[r.Hostname] {
+			seen[r.Hostname] = true
+			hostnames = append(hostnames, r.Hostname)
+		}
+	}
+	sort.Strings(hostnames)
+
+	for _, hostname := range hostnames {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		cert, ok := existing[hostname]
+		if ok && !m.due(cert) {
+			continue
+		}
+		if err := m.issue(ctx, hostname); err != nil {
+			delay := retryDelay(cert.Failures + 1)
+			m.logger.Printf("issuing certificate for %s failed, retrying in %s: %v", hostname, delay, err)
+			if err := m.store.RecordCertificateFailure(ctx, hostname, err.Error(), m.now().Add(delay)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Manager) due(cert db.Certificate) bool {
+	now := m.now()
+	if cert.RetryAt.Valid && now.Before(cert.RetryAt.Time) {
+		return false
+	}
+	if !cert.Issued() || !cert.NotAfter.Valid {
+		return true
+	}
+	return cert.NotAfter.Time.Sub(now) < m.renewBefore
+}
+
+func (m *Manager) issue(ctx context.Context, hostname string) error {
+	bundle, err := m.issuer.Issue(ctx, []string{hostname})
+	if err != nil {
+		return err
+	}
+	sealed, err := m.box.Seal(bundle.KeyPEM)
+	if err != nil {
+		return err
+	}
+	if err := m.store.SaveCertificate(ctx, db.SaveCertificateParams{
+		Hostname:     hostname,
+		CertPEM:      string(bundle.CertPEM),
+		KeyEncrypted: sealed,
+		NotAfter:     bundle.NotAfter,
+		IssuedAt:     m.now(),
+	}); err != nil {
+		return err
+	}
+	m.logger.Printf("issued certificate for %s (expires %s)", hostname, bundle.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// retryDelay doubles from minRetryDelay with each consecutive failure.
+func retryDelay(failures int) time.Duration {
+	delay := minRetryDelay
+	for i := 1; i < failures && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		return maxRetryDelay
+	}
+	return delay
+}
@@ -0,0 +1,164 @@
+package acme
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+	"github.com/neo/kokoa-proxy/control-plane/internal/secrets"
+)
+
+type fakeIssuer struct {
+	calls    []string
+	fail     bool
+	notAfter time.Time
+}
+
+func (f *fakeIssuer) Issue(_ context.Context, hostnames []string) (Bundle, error) {
+	f.calls = append(f.calls, hostnames...)
+	if f.fail {
+		return Bundle{}, errors.New("dns provider unavailable")
+	}
+	return Bundle{CertPEM: []byte("cert " + hostnames[0]), KeyPEM: []byte("key " + hostnames[0]), NotAfter: f.notAfter}, nil
+}
+
+func newTestManager(t *testing.T, iss issuer) (*Manager, *db.Store, *secrets.Box) {
+	t.Helper()
+	store, err := db.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	box, err := secrets.NewBox(make([]byte, 32))
+	if err != nil {
+		t.Fatalf("new box: %v", err)
+	}
+	return newManager(store, box, iss, log.New(io.Discard, "", 0)), store, box
+}
+
+func createRoute(t *testing.T, store *db.Store, hostname, wgIP string) {
+	t.Helper()
+	ctx := context.Background()
+	origin, err := store.CreateOrigin(ctx, db.CreateOriginParams{Name: "o-" + hostname, WireguardIP: wgIP})
+	if err != nil {
+		t.Fatalf("create origin: %v", err)
+	}
+	if _, err := store.CreateRoute(ctx, db.CreateRouteParams{Hostname: hostname, OriginID: origin.ID, TargetPort: 8080}); err != nil {
+		t.Fatalf("create route: %v", err)
+	}
+}
+
+func TestRenewDueIssuesAndRenews(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	iss := &fakeIssuer{notAfter: now.Add(90 * 24 * time.Hour)}
+	m, store, box := newTestManager(t, iss)
+	m.now = func() time.Time { return now }
+	ctx := context.Background()
+	createRoute(t, store, "app.example.com", "10.0.0.2")
+	createRoute(t, store, "*.dev.example.com", "10.0.0.3")
+
+	if err := m.RenewDue(ctx); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+	if len(iss.calls) != 2 {
+		t.Fatalf("expected two issuances, got %v", iss.calls)
+	}
+	cert, err := store.CertificateByHostname(ctx, "app.example.com")
+	if err != nil {
+		t.Fatalf("certificate: %v", err)
+	}
+	if key, err := box.Open(cert.KeyEncrypted); err != nil || string(key) != "key app.example.com" {
+		t.Fatalf("stored key does not decrypt: %q, %v", key, err)
+	}
+
+	// Nothing is due until the renewal window opens.
+	if err := m.RenewDue(ctx); err != nil || len(iss.calls) != 2 {
+		t.Fatalf("unexpected reissue: %v, %v", iss.calls, err)
+	}
+	now = now.Add(61 * 24 * time.Hour)
+	if err := m.RenewDue(ctx); err != nil || len(iss.calls) != 4 {
+		t.Fatalf("expected renewal inside window: %v, %v", iss.calls, err)
+	}
+}
+
+func TestRenewDueBacksOffAfterFailure(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	iss := &fakeIssuer{fail: true}
+	m, store, _ := newTestManager(t, iss)
+	m.now = func() time.Time { return now }
+	ctx := context.Background()
+	createRoute(t, store, "app.example.com", "10.0.0.2")
+
+	if err := m.RenewDue(ctx); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+	cert, err := store.CertificateByHostname(ctx, "app.example.com")
+	if err != nil {
+		t.Fatalf("certificate: %v", err)
+	}
+	if cert.Issued() || cert.Failures != 1 || !cert.LastError.Valid {
+		t.Fatalf("failure not recorded: %+v", cert)
+	}
+
+	if err := m.RenewDue(ctx); err != nil || len(iss.calls) != 1 {
+		t.Fatalf("retried before backoff elapsed: %v", iss.calls)
+	}
+	now = now.Add(minRetryDelay)
+	if err := m.RenewDue(ctx); err != nil || len(iss.calls) != 2 {
+		t.Fatalf("expected retry after backoff: %v", iss.calls)
+	}
+	if got := retryDelay(2); got != 2*minRetryDelay {
+		t.Fatalf("retry delay should double, got %s", got)
+	}
+	if got := retryDelay(100); got != maxRetryDelay {
+		t.Fatalf("retry delay should be capped, got %s", got)
+	}
+}
+
+// TestPebbleIssuance runs against a local Pebble started with
+// pebble-challtestsrv as its DNS server, e.g.
+//
+//	KOKOA_PEBBLE_DIRECTORY=https://localhost:14000/dir \
+//	KOKOA_PEBBLE_CA=pebble.minica.pem \
+//	KOKOA_PEBBLE_CHALLTESTSRV=http://localhost:8055 go test ./internal/acme
+func TestPebbleIssuance(t *testing.T) {
+	directory := os.Getenv("KOKOA_PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("KOKOA_PEBBLE_DIRECTORY not set")
+	}
+	provider, err := NewDNSProvider("challtestsrv", os.Getenv("KOKOA_PEBBLE_CHALLTESTSRV"))
+	if err != nil {
+		t.Fatalf("provider: %v", err)
+	}
+	_, store, box := newTestManager(t, nil)
+	m, err := NewManager(Config{
+		DirectoryURL: directory,
+		Email:        "admin@example.com",
+		Provider:     provider,
+		CAFile:       os.Getenv("KOKOA_PEBBLE_CA"),
+		Logger:       log.New(io.Discard, "", 0),
+	}, store, box)
+	if err != nil {
+		t.Fatalf("new manager: %v", err)
+	}
+	createRoute(t, store, "*.pebble.example.com", "10.0.0.2")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	if err := m.RenewDue(ctx); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+	cert, err := store.CertificateByHostname(ctx, "*.pebble.example.com")
+	if err != nil || !cert.Issued() {
+		t.Fatalf("certificate not issued: %+v, %v", cert, err)
+	}
+}
@@ -0,0 +1,100 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+)
+
+// DNSProvider publishes the TXT records used by DNS-01 challenges. fqdn is the
+// full record name including the trailing dot, e.g.
+// "_acme-challenge.example.com.".
+type DNSProvider interface {
+	Present(ctx context.Context, fqdn, value string) error
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// NewDNSProvider returns the provider registered under name. target is the
+// provider specific setting: the hook command for "exec" and the management
+// URL for "challtestsrv".
+func NewDNSProvider(name, target string) (DNSProvider, error) {
+	switch name {
+	case "exec":
+		if target == "" {
+			return nil, fmt.Errorf("dns provider exec requires a command")
+		}
+		return ExecProvider{Command: target}, nil
+	case "challtestsrv":
+		if target == "" {
+			target = "http://localhost:8055"
+		}
+		return ChallTestSrvProvider{BaseURL: strings.TrimRight(target, "/")}, nil
+	default:
+		return nil, fmt.Errorf("unknown dns provider %q", name)
+	}
+}
+
+// ExecProvider runs Command with the arguments "present" or "cleanup", the
+// record name and the record value, so any DNS API can be driven by a script.
+type ExecProvider struct {
+	Command string
+}
+
+func (p ExecProvider) Present(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "present", fqdn, value)
+}
+
+func (p ExecProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.run(ctx, "cleanup", fqdn, value)
+}
+
+func (p ExecProvider) run(ctx context.Context, action, fqdn, value string) error {
+	out, err := exec.CommandContext(ctx, p.Command, action, fqdn, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("dns hook %s %s: %w: %s", action, fqdn, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// ChallTestSrvProvider talks to the management API of pebble-challtestsrv,
+// the mock DNS server that ships with Pebble. It is meant for local testing.
+type ChallTestSrvProvider struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+func (p ChallTestSrvProvider) Present(ctx context.Context, fqdn, value string) error {
+	return p.post(ctx, "/set-txt", map[string]string{"host": fqdn, "value": value})
+}
+
+func (p ChallTestSrvProvider) CleanUp(ctx context.Context, fqdn, _ string) error {
+	return p.post(ctx, "/clear-txt", map[string]string{"host": fqdn})
+}
+
+func (p ChallTestSrvProvider) post(ctx context.Context, path string, body any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.BaseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("challtestsrv %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("challtestsrv %s: unexpected status %d", path, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+)
+
+func (s *Server) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		Name      string     `json:"name"`
+		Role      string     `json:"role"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := validateAPIKey(req.Name, req.Role, req.Scopes, req.ExpiresAt); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	plain, err := newSecret("kk_")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to generate key")
+		return
+	}
+	params := db.CreateAPIKeyParams{
+		Name:     req.Name,
+		KeyPlain: plain,
+		Role:     req.Role,
+		Scopes:   req.Scopes,
+	}
+	if req.ExpiresAt != nil {
+		params.ExpiresAt = *req.ExpiresAt
+	}
+	key, err := s.store.CreateAPIKey(r.Context(), params)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"id":         key.ID,
+		"name":       key.Name,
+		"role":       key.Role,
+		"scopes":     key.Scopes,
+		"expires_at": req.ExpiresAt,
+		"key":        plain,
+	})
+}
+
+func (s *Server) handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	list, err := s.store.ListAPIKeys(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list api keys")
+		return
+	}
+	writeResource(w, r, http.StatusOK, list)
+}
+
+func (s *Server) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if err := s.store.RevokeAPIKey(r.Context(), r.PathValue("id"), time.Now()); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "api key not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to revoke api key")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func validateAPIKey(name, role string, scopes []string, expiresAt *time.Time) error {
+	if strings.TrimSpace(name) == "" {
+		return errf("name is required")
+	}
+	if !validRole(role) {
+		return errf("role must be one of viewer, operator, admin")
+	}
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return errf("scope " + scope + " is not a hostname or *.zone pattern")
+		}
+	}
+	if len(scopes) > 0 && role == db.RoleAdmin {
+		return errf("admin keys cannot be scoped")
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return errf("expires_at must be in the future")
+	}
+	return nil
+}
+
+// newSecret returns a random URL-safe secret with the given prefix.
+func newSecret(prefix string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// audit records an action in the audit log. The actor is the API key of the
+// request or the one set with withAuditActor. Failures are logged: the action
+// itself has already happened.
+func (s *Server) audit(ctx context.Context, action, targetType, targetID string, detail any) {
+	entry := db.AuditEntry{
+		Actor:      auditActor(ctx),
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+	}
+	if detail != nil {
+		raw, err := json.Marshal(detail)
+		if err != nil {
+			s.logger.Printf("audit %s: %v", action, err)
+			return
+		}
+		entry.Detail = raw
+	}
+	if _, err := s.store.AppendAudit(ctx, entry); err != nil {
+		s.logger.Printf("audit %s: %v", action, err)
+	}
+}
+
+type auditActorContextKey struct{}
+
+// withAuditActor names the actor for requests not made with an API key.
+func withAuditActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, auditActorContextKey{}, actor)
+}
+
+func auditActor(ctx context.Context) string {
+	if key, ok := apiKeyFromContext(ctx); ok {
+		return "api_key:" + key.ID
+	}
+	if actor, ok := ctx.Value(auditActorContextKey{}).(string); ok {
+		return actor
+	}
+	return "system"
+}
+
+func (s *Server) handleListAuditLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	filter := db.AuditFilter{
+		TargetType: q.Get("target_type"),
+		TargetID:   q.Get("target_id"),
+		Action:     q.Get("action"),
+		Limit:      defaultAuditLimit,
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuditLimit {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		filter.Limit = n
+	}
+	list, err := s.store.ListAuditLog(r.Context(), filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list audit log")
+		return
+	}
+	writeResource(w, r, http.StatusOK, list)
+}
@@ -0,0 +1,161 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+)
+
+type permission string
+
+const (
+	permOriginsRead   permission = "origins:read"
+	permOriginsWrite  permission = "origins:write"
+	permRoutesRead    permission = "routes:read"
+	permRoutesWrite   permission = "routes:write"
+	permEdgesRead     permission = "edges:read"
+	permEdgesWrite    permission = "edges:write"
+	permAPIKeysManage permission = "api_keys:manage"
+	// permEventsRead opens the event stream; each event is further filtered
+	// by the read permission for its resource.
+	permEventsRead     permission = "events:read"
+	permWebhooksManage permission = "webhooks:manage"
+	permAuditRead      permission = "audit:read"
+	// permJoinTokensManage issues the tokens new edges register with.
+	permJoinTokensManage permission = "join_tokens:manage"
+	// permEdgesApprove lets pending edges start receiving configuration.
+	permEdgesApprove permission = "edges:approve"
+	// permTunnelRead shows tunnel address allocations across origins and edges.
+	permTunnelRead permission = "tunnel:read"
+	// permTunnelManage forces or cancels WireGuard key rotations.
+	permTunnelManage permission = "tunnel:manage"
+)
+
+var rolePermissions = map[string][]permission{
+	db.RoleViewer: {
+		permOriginsRead, permRoutesRead, permEdgesRead, permEventsRead, permTunnelRead,
+	},
+	db.RoleOperator: {
+		permOriginsRead, permRoutesRead, permEdgesRead, permEventsRead, permTunnelRead,
+		permOriginsWrite, permRoutesWrite, permEdgesWrite, permJoinTokensManage,
+	},
+	db.RoleAdmin: {
+		permOriginsRead, permRoutesRead, permEdgesRead, permEventsRead, permTunnelRead,
+		permOriginsWrite, permRoutesWrite, permEdgesWrite, permJoinTokensManage,
+		permAPIKeysManage, permWebhooksManage, permAuditRead, permEdgesApprove, permTunnelManage,
+	},
+}
+
+// scopedPermissions can be granted to keys restricted by hostname scopes; the
+// handler narrows the request to matching routes. Every other write permission
+// requires an unscoped key.
+var scopedPermissions = map[permission]bool{
+	permOriginsRead: true,
+	permRoutesRead:  true,
+	permRoutesWrite: true,
+	permEdgesRead:   true,
+	permEventsRead:  true,
+}
+
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func roleAllows(role string, perm permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+type apiKeyContextKey struct{}
+
+func withAPIKey(ctx context.Context, key db.APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey{}, key)
+}
+
+func apiKeyFromContext(ctx context.Context) (db.APIKey, bool) {
+	key, ok := ctx.Value(apiKeyContextKey{}).(db.APIKey)
+	return key, ok
+}
+
+// require authenticates the request with an API key and checks that the key's
+// role grants perm before calling next.
+func (s *Server) require(perm permission, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := apiKeyFromRequest(r)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "missing api key")
+			return
+		}
+		key, err := s.store.APIKeyByToken(r.Context(), token)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, "invalid api key")
+			return
+		}
+		now := time.Now()
+		if !key.Active(now) {
+			writeError(w, http.StatusUnauthorized, "api key is revoked or expired")
+			return
+		}
+		if !roleAllows(key.Role, perm) {
+			writeError(w, http.StatusForbidden, "api key role does not grant "+string(perm))
+			return
+		}
+		if len(key.Scopes) > 0 && !scopedPermissions[perm] {
+			writeError(w, http.StatusForbidden, "scoped api keys cannot use "+string(perm))
+			return
+		}
+		if !key.LastUsedAt.Valid || now.Sub(key.LastUsedAt.Time) > time.Minute {
+			_ = s.store.TouchAPIKey(r.Context(), key.ID, now)
+		}
+		next(w, r.WithContext(withAPIKey(r.Context(), key)))
+	})
+}
+
+// hostnameInScope reports whether the caller's API key may act on hostname.
+// Unscoped keys cover every hostname.
+func hostnameInScope(ctx context.Context, hostname string) bool {
+	key, ok := apiKeyFromContext(ctx)
+	if !ok || len(key.Scopes) == 0 {
+		return true
+	}
+	hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+	for _, scope := range key.Scopes {
+		if scopeMatches(scope, hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeMatches matches an exact hostname scope or a "*.zone" scope, which
+// covers any hostname below zone (but not zone itself).
+func scopeMatches(scope, hostname string) bool {
+	scope = strings.TrimSuffix(strings.ToLower(scope), ".")
+	if suffix, ok := strings.CutPrefix(scope, "*"); ok {
+		return strings.HasSuffix(hostname, suffix) && len(hostname) > len(suffix)
+	}
+	return scope == hostname
+}
+
+func validScope(scope string) bool {
+	return validHostname(strings.TrimPrefix(scope, "*."))
+}
+
+func apiKeyFromRequest(r *http.Request) (string, bool) {
+	if key := strings.TrimSpace(r.Header.Get("X-API-Key")); key != "" {
+		return key, true
+	}
+	token, ok := bearerToken(r.Header.Get("Authorization"))
+	if !ok || token == "" {
+		return "", false
+	}
+	return token, true
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+	"github.com/neo/kokoa-proxy/control-plane/internal/generator"
+	"github.com/neo/kokoa-proxy/control-plane/internal/signing"
+)
+
+type edgeCertificate struct {
+	Hostname     string    `json:"hostname"`
+	Dir          string    `json:"dir"`
+	FullchainPEM string    `json:"fullchain_pem"`
+	PrivkeyPEM   string    `json:"privkey_pem"`
+	NotAfter     time.Time `json:"not_after"`
+}
+
+// handleEdgeCertificates hands an edge the issued certificates and decrypted
+// keys for the hostnames it serves. Dir is the directory below the edge's
+// certificate directory that the generated server blocks reference.
+func (s *Server) handleEdgeCertificates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	node, ok := s.authenticateEdge(w, r)
+	if !ok || !requireApproved(w, node) {
+		return
+	}
+	if s.secrets == nil {
+		writeError(w, http.StatusServiceUnavailable, "certificate management is not configured")
+		return
+	}
+
+	snap, err := s.edgeSnapshot(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load routes")
+		return
+	}
+	certs, err := s.edgeCertificates(r.Context(), snap.configFor(node.ID).Config.Hostnames)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load certificates")
+		return
+	}
+	out := make([]edgeCertificate, 0, len(certs))
+	for _, c := range certs {
+		key, err := s.secrets.Open(c.KeyEncrypted)
+		if err != nil {
+			s.logger.Printf("decrypt certificate key for %s: %v", c.Hostname, err)
+			writeError(w, http.StatusInternalServerError, "failed to decrypt certificate key")
+			return
+		}
+		out = append(out, edgeCertificate{
+			Hostname:     c.Hostname,
+			Dir:          generator.CertDirName(c.Hostname),
+			FullchainPEM: c.CertPEM,
+			PrivkeyPEM:   string(key),
+			NotAfter:     c.NotAfter.Time,
+		})
+	}
+	hash := certificatesHash(certs)
+	issuedAt := time.Now().Unix()
+	body, err := json.Marshal(map[string]any{
+		"edge_id":           node.ID,
+		"issued_at":         issuedAt,
+		"certificates_hash": hash,
+		"certificates":      out,
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to encode certificates")
+		return
+	}
+	body = append(body, '\n')
+	// The keys are signed like the config: an edge only writes them when the
+	// signature holds and the hash matches the one its signed config carries.
+	if s.signer != nil {
+		msg := signing.CertificatesMessage(node.ID, hash, issuedAt, body)
+		w.Header().Set("X-Kokoa-Signature", base64.StdEncoding.EncodeToString(s.signer.Sign(msg)))
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
+
+// edgeCertificates returns the issued certificates among hostnames, in
+// hostname order.
+func (s *Server) edgeCertificates(ctx context.Context, hostnames []string) ([]db.Certificate, error) {
+	all, err := s.store.ListCertificates(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return issuedCertificates(all, hostnames), nil
+}
+
+// issuedCertificates filters all down to the issued certificates among
+// hostnames.
+func issuedCertificates(all []db.Certificate, hostnames []string) []db.Certificate {
+	wanted := make(map[string]bool, len(hostnames))
+	for _, h := range hostnames {
+		wanted[h] = true
+	}
+	var out []db.Certificate
+	for _, c := range all {
+		if wanted[c.Hostname] && c.Issued() {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// certificatesHash changes whenever a certificate is issued or renewed, so
+// edges can skip downloading keys they already have.
+func certificatesHash(certs []db.Certificate) string {
+	hash := sha256.New()
+	for _, c := range certs {
+		fmt.Fprintf(hash, "%s %d\n", c.Hostname, c.IssuedAt.Time.UnixNano())
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
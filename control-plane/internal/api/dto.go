@@ -0,0 +1,442 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+)
+
+// The /api/v2 namespace serves the same handlers as /api/v1 but renders store
+// values through the types below: snake_case keys, null for unset values and
+// no secrets or hashes. v1 keeps serialising the store types as they are so
+// existing clients keep working.
+
+const apiV2Prefix = "/api/v2/"
+
+// writeResource writes v in the representation of the API version the
+// request addressed.
+func writeResource(w http.ResponseWriter, r *http.Request, status int, v any) {
+	if strings.HasPrefix(r.URL.Path, apiV2Prefix) {
+		v = presentV2(v)
+	}
+	writeJSON(w, status, v)
+}
+
+// presentV2 converts store values, and slices of them, to their v2
+// representation. Other values are returned unchanged.
+func presentV2(v any) any {
+	switch v := v.(type) {
+	case db.Origin:
+		return newOriginV2(v)
+	case []db.Origin:
+		return mapSlice(v, newOriginV2)
+	case db.RouteWithOrigin:
+		return newRouteV2(v)
+	case []db.RouteWithOrigin:
+		return mapSlice(v, newRouteV2)
+	case db.EdgeNode:
+		return newEdgeNodeV2(v)
+	case []db.EdgeNode:
+		return mapSlice(v, newEdgeNodeV2)
+	case db.APIKey:
+		return newAPIKeyV2(v)
+	case []db.APIKey:
+		return mapSlice(v, newAPIKeyV2)
+	case db.Webhook:
+		return newWebhookV2(v)
+	case []db.Webhook:
+		return mapSlice(v, newWebhookV2)
+	case []db.WebhookDelivery:
+		return mapSlice(v, newWebhookDeliveryV2)
+	case []db.AuditEntry:
+		return mapSlice(v, newAuditEntryV2)
+	case db.JoinToken:
+		return newJoinTokenV2(v)
+	case []db.JoinToken:
+		return mapSlice(v, newJoinTokenV2)
+	}
+	return v
+}
+
+// mapSlice converts every element with fn. The result is never nil, so empty
+// lists render as [] rather than null.
+func mapSlice[T, U any](in []T, fn func(T) U) []U {
+	out := make([]U, 0, len(in))
+	for _, v := range in {
+		out = append(out, fn(v))
+	}
+	return out
+}
+
+type originV2 struct {
+	ID                     string     `json:"id"`
+	Name                   string     `json:"name"`
+	WireguardIP            string     `json:"wg_ip"`
+	WireguardPublicKey     *string    `json:"wireguard_public_key"`
+	HasWireguardPrivateKey bool       `json:"has_wireguard_private_key"`
+	WireguardEndpoint      *string    `json:"wireguard_endpoint"`
+	CreatedAt              time.Time  `json:"created_at"`
+	RegisteredFrom         *string    `json:"registered_from"`
+	LastSeen               *time.Time `json:"last_seen"`
+	JoinTokenID            *string    `json:"join_token_id"`
+	AppliedWireGuardHash   *string    `json:"applied_wireguard_hash"`
+}
+
+func newOriginV2(o db.Origin) originV2 {
+	return originV2{
+		ID:                     o.ID,
+		Name:                   o.Name,
+		WireguardIP:            o.WireguardIP,
+		WireguardPublicKey:     optionalString(o.WireguardPublicKey),
+		HasWireguardPrivateKey: o.HasWireguardPrivateKey,
+		WireguardEndpoint:      optionalString(o.WireguardEndpoint),
+		CreatedAt:              o.CreatedAt,
+		RegisteredFrom:         nullString(o.RegisteredFrom),
+		LastSeen:               nullTime(o.LastSeen),
+		JoinTokenID:            nullString(o.JoinTokenID),
+		AppliedWireGuardHash:   nullString(o.AppliedWGHash),
+	}
+}
+
+type routeV2 struct {
+	ID                 string           `json:"id"`
+	Hostname           string           `json:"hostname"`
+	Wildcard           bool             `json:"wildcard"`
+	PathPrefix         string           `json:"path_prefix"`
+	StripPrefix        bool             `json:"strip_prefix"`
+	OriginID           string           `json:"origin_id"`
+	TargetPort         int              `json:"target_port"`
+	LBMethod           string           `json:"lb_method"`
+	MaxFails           int              `json:"max_fails"`
+	FailTimeoutSeconds int              `json:"fail_timeout_seconds"`
+	Backends           []routeBackendV2 `json:"backends"`
+	// Placement is null for routes served from every edge.
+	Placement *placementV2 `json:"placement"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+type placementV2 struct {
+	Groups []string          `json:"groups"`
+	Labels map[string]string `json:"labels"`
+}
+
+type routeBackendV2 struct {
+	OriginID    string `json:"origin_id"`
+	OriginName  string `json:"origin_name"`
+	WireguardIP string `json:"wg_ip"`
+	TargetPort  int    `json:"target_port"`
+	Weight      int    `json:"weight"`
+	Backup      bool   `json:"backup"`
+}
+
+// routeMaxFails is the max_fails nginx applies to the route's backends.
+func routeMaxFails(r db.RouteWithOrigin) int {
+	if r.MaxFails == nil {
+		return 1
+	}
+	return *r.MaxFails
+}
+
+func newRouteV2(r db.RouteWithOrigin) routeV2 {
+	return routeV2{
+		ID:                 r.ID,
+		Hostname:           r.Hostname,
+		Wildcard:           r.Wildcard,
+		PathPrefix:         r.PathPrefix,
+		StripPrefix:        r.StripPrefix,
+		OriginID:           r.OriginID,
+		TargetPort:         r.TargetPort,
+		LBMethod:           r.LBMethod,
+		MaxFails:           routeMaxFails(r),
+		FailTimeoutSeconds: r.FailTimeoutSeconds,
+		Backends: mapSlice(r.Backends, func(b db.RouteBackend) routeBackendV2 {
+			return routeBackendV2{
+				OriginID:    b.OriginID,
+				OriginName:  b.OriginName,
+				WireguardIP: b.WireguardIP,
+				TargetPort:  b.TargetPort,
+				Weight:      b.Weight,
+				Backup:      b.Backup,
+			}
+		}),
+		Placement: newPlacementV2(r.Placement),
+		CreatedAt: r.CreatedAt,
+	}
+}
+
+func newPlacementV2(p db.Placement) *placementV2 {
+	if p.IsZero() {
+		return nil
+	}
+	out := &placementV2{Groups: p.Groups, Labels: p.Labels}
+	if out.Groups == nil {
+		out.Groups = []string{}
+	}
+	if out.Labels == nil {
+		out.Labels = map[string]string{}
+	}
+	return out
+}
+
+type edgeNodeV2 struct {
+	ID             string            `json:"id"`
+	Name           string            `json:"name"`
+	WGAddr         *string           `json:"wg_addr"`
+	WGEndpoint     *string           `json:"wg_endpoint"`
+	WGPeerPubKey   *string           `json:"wg_peer_pubkey"`
+	WGAllowedIPs   *string           `json:"wg_allowed_ips"`
+	Group          *string           `json:"group"`
+	Labels         map[string]string `json:"labels"`
+	JoinTokenID    *string           `json:"join_token_id"`
+	State          string            `json:"state"`
+	RegisteredFrom *string           `json:"registered_from"`
+	WGPublicKey    *string           `json:"wg_public_key"`
+	ApprovedAt     *time.Time        `json:"approved_at"`
+	ApprovedBy     *string           `json:"approved_by"`
+	StateChangedAt *time.Time        `json:"state_changed_at"`
+	StateChangedBy *string           `json:"state_changed_by"`
+	DrainUntil     *time.Time        `json:"drain_until"`
+	PublicAddr     *string           `json:"public_addr"`
+	CreatedAt      time.Time         `json:"created_at"`
+	LastSeen       *time.Time        `json:"last_seen"`
+	StaleAt        *time.Time        `json:"stale_at"`
+	Status         edgeStatusV2      `json:"status"`
+	Token          edgeTokenV2       `json:"token"`
+}
+
+// edgeTokenV2 describes the lifecycle of an edge's token, never the token.
+type edgeTokenV2 struct {
+	IssuedAt          *time.Time `json:"issued_at"`
+	ExpiresAt         *time.Time `json:"expires_at"`
+	RevokedAt         *time.Time `json:"revoked_at"`
+	PreviousExpiresAt *time.Time `json:"previous_expires_at"`
+}
+
+// edgeStatusV2 is the last heartbeat of an edge. ConfigsBehind is null until
+// the edge reports a config the control plane knows.
+type edgeStatusV2 struct {
+	AppliedConfigHash *string    `json:"applied_config_hash"`
+	ApplyStatus       *string    `json:"apply_status"`
+	ApplyError        *string    `json:"apply_error"`
+	AgentVersion      *string    `json:"agent_version"`
+	NginxVersion      *string    `json:"nginx_version"`
+	UptimeSeconds     *int64     `json:"uptime_seconds"`
+	WireGuardHash     *string    `json:"wireguard_hash"`
+	ReportedAt        *time.Time `json:"reported_at"`
+	ConfigsBehind     *int       `json:"configs_behind"`
+}
+
+func newEdgeNodeV2(n db.EdgeNode) edgeNodeV2 {
+	out := edgeNodeV2{
+		ID:             n.ID,
+		Name:           n.Name,
+		WGAddr:         nullString(n.WGAddr),
+		WGEndpoint:     nullString(n.WGEndpoint),
+		WGPeerPubKey:   nullString(n.WGPeerPubKey),
+		WGAllowedIPs:   nullString(n.WGAllowedIPs),
+		Group:          nullString(n.GroupName),
+		Labels:         n.Labels,
+		JoinTokenID:    nullString(n.JoinTokenID),
+		State:          n.State,
+		RegisteredFrom: nullString(n.RegisteredFrom),
+		WGPublicKey:    nullString(n.WGPublicKey),
+		ApprovedAt:     nullTime(n.ApprovedAt),
+		ApprovedBy:     nullString(n.ApprovedBy),
+		StateChangedAt: nullTime(n.StateChangedAt),
+		StateChangedBy: nullString(n.StateChangedBy),
+		DrainUntil:     nullTime(n.DrainUntil),
+		PublicAddr:     nullString(n.PublicAddr),
+		CreatedAt:      n.CreatedAt,
+		LastSeen:       nullTime(n.LastSeen),
+		StaleAt:        nullTime(n.StaleAt),
+		Status: edgeStatusV2{
+			AppliedConfigHash: nullString(n.AppliedConfigHash),
+			ApplyStatus:       nullString(n.ApplyStatus),
+			ApplyError:        nullString(n.ApplyError),
+			AgentVersion:      nullString(n.AgentVersion),
+			NginxVersion:      nullString(n.NginxVersion),
+			UptimeSeconds:     nullInt64(n.UptimeSeconds),
+			WireGuardHash:     nullString(n.AppliedWGHash),
+			ReportedAt:        nullTime(n.StatusReportedAt),
+		},
+		Token: edgeTokenV2{
+			IssuedAt:          nullTime(n.TokenIssuedAt),
+			ExpiresAt:         nullTime(n.TokenExpiresAt),
+			RevokedAt:         nullTime(n.TokenRevokedAt),
+			PreviousExpiresAt: nullTime(n.PreviousTokenExpiresAt),
+		},
+	}
+	if n.ConfigsBehind >= 0 {
+		behind := n.ConfigsBehind
+		out.Status.ConfigsBehind = &behind
+	}
+	return out
+}
+
+type apiKeyV2 struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Role       string     `json:"role"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+func newAPIKeyV2(k db.APIKey) apiKeyV2 {
+	return apiKeyV2{
+		ID:         k.ID,
+		Name:       k.Name,
+		Role:       k.Role,
+		Scopes:     mapSlice(k.Scopes, func(s string) string { return s }),
+		CreatedAt:  k.CreatedAt,
+		LastUsedAt: nullTime(k.LastUsedAt),
+		ExpiresAt:  nullTime(k.ExpiresAt),
+		RevokedAt:  nullTime(k.RevokedAt),
+	}
+}
+
+type webhookV2 struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newWebhookV2(h db.Webhook) webhookV2 {
+	return webhookV2{
+		ID:        h.ID,
+		Name:      h.Name,
+		URL:       h.URL,
+		Events:    mapSlice(h.Events, func(s string) string { return s }),
+		CreatedAt: h.CreatedAt,
+	}
+}
+
+type webhookDeliveryV2 struct {
+	ID             int64      `json:"id"`
+	WebhookID      string     `json:"webhook_id"`
+	EventID        int64      `json:"event_id"`
+	EventType      string     `json:"event_type"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at"`
+	LastStatusCode *int64     `json:"last_status_code"`
+	LastError      *string    `json:"last_error"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DeliveredAt    *time.Time `json:"delivered_at"`
+}
+
+func newWebhookDeliveryV2(d db.WebhookDelivery) webhookDeliveryV2 {
+	return webhookDeliveryV2{
+		ID:             d.ID,
+		WebhookID:      d.WebhookID,
+		EventID:        d.EventID,
+		EventType:      d.EventType,
+		Status:         d.Status,
+		Attempts:       d.Attempts,
+		NextAttemptAt:  nullTime(d.NextAttemptAt),
+		LastStatusCode: nullInt64(d.LastStatusCode),
+		LastError:      nullString(d.LastError),
+		CreatedAt:      d.CreatedAt,
+		DeliveredAt:    nullTime(d.DeliveredAt),
+	}
+}
+
+type joinTokenV2 struct {
+	ID              string            `json:"id"`
+	Kind            string            `json:"kind"`
+	Description     string            `json:"description"`
+	MaxUses         int               `json:"max_uses"`
+	Uses            int               `json:"uses"`
+	ExpiresAt       time.Time         `json:"expires_at"`
+	EdgeName        *string           `json:"edge_name"`
+	Group           *string           `json:"group"`
+	Labels          map[string]string `json:"labels"`
+	RequireApproval bool              `json:"require_approval"`
+	CreatedBy       string            `json:"created_by"`
+	CreatedAt       time.Time         `json:"created_at"`
+	RevokedAt       *time.Time        `json:"revoked_at"`
+	Consumers       []joinTokenUseV2  `json:"consumers"`
+}
+
+// joinTokenUseV2 names the consumer after the token's kind.
+type joinTokenUseV2 struct {
+	EdgeNodeID string    `json:"edge_node_id,omitempty"`
+	EdgeName   string    `json:"edge_name,omitempty"`
+	OriginID   string    `json:"origin_id,omitempty"`
+	OriginName string    `json:"origin_name,omitempty"`
+	UsedAt     time.Time `json:"used_at"`
+}
+
+func newJoinTokenV2(t db.JoinToken) joinTokenV2 {
+	return joinTokenV2{
+		ID:              t.ID,
+		Kind:            t.Kind,
+		Description:     t.Description,
+		MaxUses:         t.MaxUses,
+		Uses:            t.Uses,
+		ExpiresAt:       t.ExpiresAt,
+		EdgeName:        nullString(t.EdgeName),
+		Group:           nullString(t.GroupName),
+		Labels:          t.Labels,
+		RequireApproval: t.RequireApproval,
+		CreatedBy:       t.CreatedBy,
+		CreatedAt:       t.CreatedAt,
+		RevokedAt:       nullTime(t.RevokedAt),
+		Consumers: mapSlice(t.Consumers, func(u db.JoinTokenUse) joinTokenUseV2 {
+			if t.Kind == db.JoinTokenKindOrigin {
+				return joinTokenUseV2{OriginID: u.ConsumerID, OriginName: u.ConsumerName, UsedAt: u.UsedAt}
+			}
+			return joinTokenUseV2{EdgeNodeID: u.ConsumerID, EdgeName: u.ConsumerName, UsedAt: u.UsedAt}
+		}),
+	}
+}
+
+type auditEntryV2 struct {
+	ID         int64           `json:"id"`
+	Actor      string          `json:"actor"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type"`
+	TargetID   string          `json:"target_id"`
+	Detail     json.RawMessage `json:"detail"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+func newAuditEntryV2(e db.AuditEntry) auditEntryV2 {
+	return auditEntryV2(e)
+}
+
+func optionalString(v string) *string {
+	if v == "" {
+		return nil
+	}
+	return &v
+}
+
+func nullString(v sql.NullString) *string {
+	if !v.Valid {
+		return nil
+	}
+	return &v.String
+}
+
+func nullInt64(v sql.NullInt64) *int64 {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Int64
+}
+
+func nullTime(v sql.NullTime) *time.Time {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Time
+}
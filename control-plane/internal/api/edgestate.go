@@ -0,0 +1,201 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+	"github.com/neo/kokoa-proxy/control-plane/internal/events"
+)
+
+const (
+	maxEdgeDrainPeriod = 24 * time.Hour
+	// drainSweepInterval is how often drained edges are looked for.
+	drainSweepInterval = 15 * time.Second
+)
+
+// handleCordonEdgeNode takes an active edge out of DNS answers. It keeps
+// receiving configuration and serving whoever still resolves to it.
+func (s *Server) handleCordonEdgeNode(w http.ResponseWriter, r *http.Request) {
+	s.transitionEdge(w, r, "edge.cordoned", db.EdgeTransition{
+		From: []string{db.EdgeStateActive},
+		To:   db.EdgeStateCordoned,
+	})
+}
+
+// handleUncordonEdgeNode puts a cordoned or draining edge back into service.
+func (s *Server) handleUncordonEdgeNode(w http.ResponseWriter, r *http.Request) {
+	s.transitionEdge(w, r, "edge.uncordoned", db.EdgeTransition{
+		From: []string{db.EdgeStateCordoned, db.EdgeStateDraining},
+		To:   db.EdgeStateActive,
+	})
+}
+
+// handleDrainEdgeNode starts the drain period of an edge: it stays out of DNS
+// and keeps serving until the period ends, then it is retired.
+func (s *Server) handleDrainEdgeNode(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		DrainSeconds *int `json:"drain_seconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	period := s.edgeDrainPeriod
+	if req.DrainSeconds != nil {
+		period = time.Duration(*req.DrainSeconds) * time.Second
+		if period < 0 || period > maxEdgeDrainPeriod {
+			writeError(w, http.StatusBadRequest, "drain_seconds must be between 0 and 86400")
+			return
+		}
+	}
+	s.transitionEdge(w, r, "edge.draining", db.EdgeTransition{
+		From:       []string{db.EdgeStateActive, db.EdgeStateCordoned},
+		To:         db.EdgeStateDraining,
+		DrainUntil: time.Now().Add(period),
+	})
+}
+
+// handleRetireEdgeNode retires an edge whose drain period is over and revokes
+// its token. force retires an edge in service right away.
+func (s *Server) handleRetireEdgeNode(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Force bool `json:"force"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	node, err := s.store.EdgeNodeByID(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeStoreError(w, err, "edge node not found")
+		return
+	}
+	from := []string{db.EdgeStateDraining}
+	if req.Force {
+		from = []string{db.EdgeStateActive, db.EdgeStateCordoned, db.EdgeStateDraining}
+	} else if node.State == db.EdgeStateDraining && node.DrainUntil.Time.After(time.Now()) {
+		writeError(w, http.StatusConflict, "edge is draining until "+node.DrainUntil.Time.UTC().Format(time.RFC3339)+"; pass force to retire it now")
+		return
+	}
+	s.transitionEdge(w, r, "edge.retired", db.EdgeTransition{From: from, To: db.EdgeStateRetired})
+}
+
+func (s *Server) transitionEdge(w http.ResponseWriter, r *http.Request, action string, t db.EdgeTransition) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	node, err := s.applyEdgeTransition(r.Context(), r.PathValue("id"), action, t)
+	if err != nil {
+		writeStoreError(w, err, "edge node not found")
+		return
+	}
+	writeResource(w, r, http.StatusOK, node)
+}
+
+// applyEdgeTransition changes the state of an edge as the actor of ctx and
+// records the change in the event and audit logs.
+func (s *Server) applyEdgeTransition(ctx context.Context, id, action string, t db.EdgeTransition) (db.EdgeNode, error) {
+	before, err := s.store.EdgeNodeByID(ctx, id)
+	if err != nil {
+		return db.EdgeNode{}, err
+	}
+	t.Actor = auditActor(ctx)
+	t.At = time.Now()
+	node, err := s.store.TransitionEdgeNode(ctx, id, t)
+	if err != nil {
+		return db.EdgeNode{}, err
+	}
+	detail := map[string]any{
+		"name":        node.Name,
+		"from":        before.State,
+		"to":          node.State,
+		"actor":       t.Actor,
+		"drain_until": nullTime(node.DrainUntil),
+	}
+	s.publish(ctx, events.EdgeStateChanged, "", detail)
+	s.audit(ctx, action, "edge_node", node.ID, detail)
+	return node, nil
+}
+
+// WatchDrainingEdges retires draining edges once their drain period is over.
+// It runs until ctx is done.
+func (s *Server) WatchDrainingEdges(ctx context.Context) {
+	ticker := time.NewTicker(drainSweepInterval)
+	defer ticker.Stop()
+	for {
+		s.retireDrainedEdges(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) retireDrainedEdges(ctx context.Context, now time.Time) {
+	nodes, err := s.store.DrainedEdgeNodes(ctx, now)
+	if err != nil {
+		s.logger.Printf("drained edge check: %v", err)
+		return
+	}
+	for _, n := range nodes {
+		_, err := s.applyEdgeTransition(ctx, n.ID, "edge.retired", db.EdgeTransition{
+			From: []string{db.EdgeStateDraining},
+			To:   db.EdgeStateRetired,
+		})
+		if err != nil && !errors.Is(err, db.ErrEdgeStateConflict) {
+			s.logger.Printf("retire drained edge %s: %v", n.ID, err)
+		}
+	}
+}
+
+type edgeDNSRecord struct {
+	ID      string  `json:"id"`
+	Name    string  `json:"name"`
+	Group   *string `json:"group"`
+	Address string  `json:"address"`
+}
+
+// handleEdgeDNS lists the edges DNS answers should point at: active edges
+// that are not stale. DNS updaters poll it to publish the addresses.
+func (s *Server) handleEdgeDNS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	nodes, err := s.store.ListEdgeNodes(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list edge nodes")
+		return
+	}
+	records := []edgeDNSRecord{}
+	seen := map[string]bool{}
+	addresses := []string{}
+	for _, n := range nodes {
+		addr := n.PublicAddr.String
+		if addr == "" {
+			addr = n.RegisteredFrom.String
+		}
+		if n.State != db.EdgeStateActive || n.StaleAt.Valid || addr == "" {
+			continue
+		}
+		records = append(records, edgeDNSRecord{ID: n.ID, Name: n.Name, Group: nullString(n.GroupName), Address: addr})
+		if !seen[addr] {
+			seen[addr] = true
+			addresses = append(addresses, addr)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	sort.Strings(addresses)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"addresses": addresses,
+		"edges":     records,
+	})
+}
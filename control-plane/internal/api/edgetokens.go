@@ -0,0 +1,157 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+)
+
+const (
+	// defaultRotateGrace is how long a rotated-out token keeps working when
+	// the request does not say otherwise, leaving time to install the new one.
+	defaultRotateGrace = time.Hour
+	maxRotateGrace     = 7 * 24 * time.Hour
+	// renewGrace covers requests an agent still has in flight with its old
+	// token when it renews.
+	renewGrace = 5 * time.Minute
+)
+
+// Headers on authenticated edge responses announcing token expiry.
+const (
+	headerTokenExpiresAt = "X-Kokoa-Token-Expires-At"
+	headerTokenRenew     = "X-Kokoa-Token-Renew"
+)
+
+func (s *Server) handleRotateEdgeToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		GraceSeconds *int `json:"grace_seconds"`
+		TTLSeconds   *int `json:"ttl_seconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	grace := defaultRotateGrace
+	if req.GraceSeconds != nil {
+		grace = time.Duration(*req.GraceSeconds) * time.Second
+		if grace < 0 || grace > maxRotateGrace {
+			writeError(w, http.StatusBadRequest, "grace_seconds must be between 0 and 604800")
+			return
+		}
+	}
+	ttl := s.edgeTokenTTL
+	if req.TTLSeconds != nil {
+		if *req.TTLSeconds < 0 {
+			writeError(w, http.StatusBadRequest, "ttl_seconds must not be negative")
+			return
+		}
+		ttl = time.Duration(*req.TTLSeconds) * time.Second
+	}
+
+	now := time.Now().UTC()
+	token := uuid.NewString()
+	params := db.RotateEdgeTokenParams{TokenPlain: token, At: now}
+	if grace > 0 {
+		params.PreviousValidUntil = now.Add(grace)
+	}
+	if ttl > 0 {
+		params.ExpiresAt = now.Add(ttl)
+	}
+	node, err := s.store.RotateEdgeToken(r.Context(), r.PathValue("id"), params)
+	if err != nil {
+		writeStoreError(w, err, "edge node not found")
+		return
+	}
+	s.audit(r.Context(), "edge.token_rotated", "edge_node", node.ID, map[string]any{
+		"grace_seconds":             int(grace / time.Second),
+		"token_expires_at":          nullTime(node.TokenExpiresAt),
+		"previous_token_expires_at": nullTime(node.PreviousTokenExpiresAt),
+	})
+	writeJSON(w, http.StatusOK, map[string]any{
+		"edge_node_id":              node.ID,
+		"token":                     token,
+		"token_expires_at":          nullTime(node.TokenExpiresAt),
+		"previous_token_expires_at": nullTime(node.PreviousTokenExpiresAt),
+	})
+}
+
+func (s *Server) handleRevokeEdgeToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	id := r.PathValue("id")
+	if err := s.store.RevokeEdgeToken(r.Context(), id, time.Now()); err != nil {
+		writeStoreError(w, err, "edge node not found or already revoked")
+		return
+	}
+	s.audit(r.Context(), "edge.token_revoked", "edge_node", id, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRenewEdgeToken lets an agent replace its own token before it expires.
+// The new token keeps the lifetime of the current one.
+func (s *Server) handleRenewEdgeToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	node, ok := s.authenticateEdge(w, r)
+	if !ok {
+		return
+	}
+	// A rotated-out token must not be able to mint a fresh one.
+	if node.UsingPreviousToken {
+		writeError(w, http.StatusForbidden, "token was rotated; install the new token")
+		return
+	}
+	ttl := s.edgeTokenTTL
+	if node.TokenExpiresAt.Valid && node.TokenIssuedAt.Valid {
+		ttl = node.TokenExpiresAt.Time.Sub(node.TokenIssuedAt.Time)
+	}
+	now := time.Now().UTC()
+	token := uuid.NewString()
+	params := db.RotateEdgeTokenParams{TokenPlain: token, At: now, PreviousValidUntil: now.Add(renewGrace)}
+	if ttl > 0 {
+		params.ExpiresAt = now.Add(ttl)
+	}
+	node, err := s.store.RotateEdgeToken(r.Context(), node.ID, params)
+	if err != nil {
+		writeStoreError(w, err, "edge node not found")
+		return
+	}
+	s.audit(withAuditActor(r.Context(), "edge:"+node.ID), "edge.token_renewed", "edge_node", node.ID, map[string]any{
+		"token_expires_at": nullTime(node.TokenExpiresAt),
+	})
+	writeJSON(w, http.StatusOK, map[string]any{
+		"edge_node_id":     node.ID,
+		"token":            token,
+		"token_expires_at": nullTime(node.TokenExpiresAt),
+	})
+}
+
+// setTokenHeaders tells the agent when its token expires and, once two thirds
+// of its lifetime have passed, that it should renew it.
+func setTokenHeaders(w http.ResponseWriter, node db.EdgeNode, now time.Time) {
+	if !node.TokenExpiresAt.Valid || node.UsingPreviousToken {
+		return
+	}
+	expires := node.TokenExpiresAt.Time
+	w.Header().Set(headerTokenExpiresAt, expires.UTC().Format(time.RFC3339))
+	renewAt := expires.Add(-time.Hour)
+	if node.TokenIssuedAt.Valid {
+		renewAt = node.TokenIssuedAt.Time.Add(expires.Sub(node.TokenIssuedAt.Time) * 2 / 3)
+	}
+	if !now.Before(renewAt) {
+		w.Header().Set(headerTokenRenew, "true")
+	}
+}
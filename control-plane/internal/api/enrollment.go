@@ -0,0 +1,92 @@
+package api
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+	"github.com/neo/kokoa-proxy/control-plane/internal/events"
+)
+
+// handleApproveEdgeNode lets a pending edge start receiving configuration.
+// Rejected registrations are removed with DELETE instead.
+func (s *Server) handleApproveEdgeNode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	actor := auditActor(r.Context())
+	node, err := s.store.ApproveEdgeNode(r.Context(), r.PathValue("id"), actor, time.Now())
+	if err != nil {
+		writeStoreError(w, err, "edge node not found or not pending")
+		return
+	}
+	s.publish(r.Context(), events.EdgeApproved, "", node)
+	s.audit(r.Context(), "edge.approved", "edge_node", node.ID, map[string]any{
+		"name":            node.Name,
+		"registered_from": nullString(node.RegisteredFrom),
+		"wg_public_key":   nullString(node.WGPublicKey),
+	})
+	writeResource(w, r, http.StatusOK, node)
+}
+
+// requireApproved refuses pending edges anything that carries routes or keys.
+func requireApproved(w http.ResponseWriter, node db.EdgeNode) bool {
+	if node.State == db.EdgeStatePending {
+		writeError(w, http.StatusForbidden, "edge is pending approval")
+		return false
+	}
+	return true
+}
+
+// remoteIP is the address the request came from, without the port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// validWireguardKey reports whether v is a base64 encoded Curve25519 key.
+func validWireguardKey(v string) bool {
+	raw, err := base64.StdEncoding.DecodeString(v)
+	return err == nil && len(raw) == 32
+}
+
+// validWireguardEndpoint accepts host:port with a non-zero port, where host
+// is an IP address or a DNS name.
+func validWireguardEndpoint(v string) bool {
+	host, port, err := net.SplitHostPort(v)
+	if err != nil || host == "" {
+		return false
+	}
+	if _, err := netip.ParseAddr(host); err != nil && !validEndpointName(host) {
+		return false
+	}
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 65536
+}
+
+func validEndpointName(h string) bool {
+	if len(h) > 253 {
+		return false
+	}
+	for _, p := range strings.Split(strings.TrimSuffix(h, "."), ".") {
+		if p == "" || len(p) > 63 || p[0] == '-' || p[len(p)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(p); i++ {
+			c := p[i]
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+	"github.com/neo/kokoa-proxy/control-plane/internal/events"
+)
+
+// eventPermissions maps the resource part of an event type to the permission
+// needed to receive it.
+var eventPermissions = map[string]permission{
+	"origin": permOriginsRead,
+	"route":  permRoutesRead,
+	"edge":   permEdgesRead,
+	"config": permRoutesRead,
+}
+
+const (
+	// eventKeepalive keeps idle streams from being closed by proxies.
+	eventKeepalive = 30 * time.Second
+	// edgeSeenInterval limits edge.seen to one event per edge and interval;
+	// agents contact the control plane several times a minute.
+	edgeSeenInterval = time.Minute
+)
+
+// handleEvents streams events as Server-Sent Events. A client resuming with
+// Last-Event-ID (or ?last_event_id= for the first EventSource connection)
+// first receives the logged events after that id. When some of them have
+// already been dropped from the log, a "resync" event tells the client to
+// reload its state.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	key, _ := apiKeyFromContext(r.Context())
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	var lastID int64
+	if lastEventID != "" {
+		id, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || id < 0 {
+			writeError(w, http.StatusBadRequest, "invalid Last-Event-ID")
+			return
+		}
+		lastID = id
+	}
+
+	// Subscribe before reading the log so no event falls in between; events
+	// delivered twice are skipped by id.
+	sub := s.events.Subscribe()
+	defer sub.Close()
+	var backlog []db.Event
+	resync := false
+	if lastEventID != "" {
+		var oldest int64
+		var err error
+		backlog, oldest, err = s.store.EventsAfter(r.Context(), lastID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to load events")
+			return
+		}
+		resync = oldest > lastID+1
+	}
+
+	// The key was checked when the stream opened. Revoking or expiring it
+	// ends the stream at the next event or keepalive.
+	keyActive := func() bool {
+		current, err := s.store.APIKeyByID(r.Context(), key.ID)
+		return err == nil && current.Active(time.Now())
+	}
+
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if resync {
+		fmt.Fprint(w, "event: resync\ndata: {}\n\n")
+	}
+	for _, ev := range backlog {
+		if eventVisible(r.Context(), key, ev) {
+			writeEvent(w, ev)
+		}
+		lastID = ev.ID
+	}
+	_ = rc.Flush()
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case ev, ok := <-sub.Events():
+			if !ok {
+				// Dropped for falling behind; the client resumes from the log.
+				return
+			}
+			if ev.ID <= lastID || !eventVisible(r.Context(), key, ev) {
+				continue
+			}
+			if !keyActive() {
+				return
+			}
+			writeEvent(w, ev)
+			lastID = ev.ID
+		case <-keepalive.C:
+			if !keyActive() {
+				return
+			}
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, ev db.Event) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, ev.Data)
+}
+
+// eventVisible reports whether the key may receive ev: its role must grant
+// read access to the resource, and route events must be within its scopes.
+func eventVisible(ctx context.Context, key db.APIKey, ev db.Event) bool {
+	resource, _, _ := strings.Cut(ev.Type, ".")
+	perm, ok := eventPermissions[resource]
+	if !ok || !roleAllows(key.Role, perm) {
+		return false
+	}
+	return ev.Hostname == "" || hostnameInScope(ctx, ev.Hostname)
+}
+
+// publish records an event. Store values are rendered like /api/v2 renders
+// them, so payloads do not depend on the store types. The change it describes
+// has already been made, so a failure is only logged.
+func (s *Server) publish(ctx context.Context, typ, hostname string, data any) {
+	if _, err := s.events.Publish(ctx, typ, hostname, presentV2(data)); err != nil {
+		s.logger.Printf("publish %s event: %v", typ, err)
+	}
+}
+
+// publishConfigChange publishes a route or origin event and rebuilds the edge
+// config right away, so config.generated follows without waiting for an edge
+// to poll.
+func (s *Server) publishConfigChange(ctx context.Context, typ, hostname string, data any) {
+	s.publish(ctx, typ, hostname, data)
+	if _, err := s.edgeSnapshot(ctx); err != nil {
+		s.logger.Printf("rebuild edge config: %v", err)
+	}
+}
+
+// edgeSeen publishes edge.seen, at most once per edgeSeenInterval per edge.
+func (s *Server) edgeSeen(ctx context.Context, node db.EdgeNode, at time.Time) {
+	s.seenMu.Lock()
+	last, ok := s.seenAt[node.ID]
+	if ok && at.Sub(last) < edgeSeenInterval {
+		s.seenMu.Unlock()
+		return
+	}
+	s.seenAt[node.ID] = at
+	s.seenMu.Unlock()
+	s.publish(ctx, events.EdgeSeen, "", map[string]any{
+		"id":        node.ID,
+		"name":      node.Name,
+		"last_seen": at.UTC(),
+	})
+}
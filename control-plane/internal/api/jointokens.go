@@ -0,0 +1,229 @@
+package api
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+)
+
+const (
+	defaultJoinTokenTTL = 24 * time.Hour
+	maxJoinTokenTTL     = 30 * 24 * time.Hour
+	maxJoinTokenUses    = 1000
+	maxLabels           = 32
+)
+
+func (s *Server) handleCreateJoinToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		// Kind is "edge" (default) or "origin".
+		Kind        string            `json:"kind"`
+		Description string            `json:"description"`
+		MaxUses     *int              `json:"max_uses"`
+		TTLSeconds  *int              `json:"ttl_seconds"`
+		EdgeName    string            `json:"edge_name"`
+		Group       string            `json:"group"`
+		Labels      map[string]string `json:"labels"`
+		// RequireApproval registers the token's edges as pending.
+		RequireApproval bool `json:"require_approval"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if req.Kind == "" {
+		req.Kind = db.JoinTokenKindEdge
+	}
+	switch req.Kind {
+	case db.JoinTokenKindEdge:
+	case db.JoinTokenKindOrigin:
+		if req.EdgeName != "" || req.Group != "" || len(req.Labels) > 0 || req.RequireApproval {
+			writeError(w, http.StatusBadRequest, "edge_name, group, labels and require_approval only apply to edge tokens")
+			return
+		}
+	default:
+		writeError(w, http.StatusBadRequest, "kind must be edge or origin")
+		return
+	}
+	if name := strings.TrimSpace(req.EdgeName); name != "" && !validResourceName(name) {
+		writeError(w, http.StatusBadRequest, "edge_name must be 1-64 characters of A-Z, a-z, 0-9, '.', '_' or '-'")
+		return
+	}
+	params := db.CreateJoinTokenParams{
+		Kind:            req.Kind,
+		Description:     strings.TrimSpace(req.Description),
+		MaxUses:         1,
+		EdgeName:        strings.TrimSpace(req.EdgeName),
+		GroupName:       req.Group,
+		Labels:          req.Labels,
+		RequireApproval: req.RequireApproval,
+		CreatedBy:       auditActor(r.Context()),
+	}
+	if req.MaxUses != nil {
+		if *req.MaxUses < 1 || *req.MaxUses > maxJoinTokenUses {
+			writeError(w, http.StatusBadRequest, "max_uses must be between 1 and 1000")
+			return
+		}
+		params.MaxUses = *req.MaxUses
+	}
+	ttl := defaultJoinTokenTTL
+	if req.TTLSeconds != nil {
+		ttl = time.Duration(*req.TTLSeconds) * time.Second
+		if ttl <= 0 || ttl > maxJoinTokenTTL {
+			writeError(w, http.StatusBadRequest, "ttl_seconds must be between 1 and 2592000")
+			return
+		}
+	}
+	params.ExpiresAt = time.Now().Add(ttl)
+	if err := validateEdgeGrouping(params.GroupName, params.Labels); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	secret, err := newSecret("")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to generate token")
+		return
+	}
+	token, plain, err := s.store.CreateJoinToken(r.Context(), params, secret)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.audit(r.Context(), "join_token.created", "join_token", token.ID, map[string]any{
+		"kind":             token.Kind,
+		"max_uses":         token.MaxUses,
+		"expires_at":       token.ExpiresAt,
+		"edge_name":        nullString(token.EdgeName),
+		"group":            nullString(token.GroupName),
+		"require_approval": token.RequireApproval,
+	})
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"id":               token.ID,
+		"kind":             token.Kind,
+		"token":            plain,
+		"max_uses":         token.MaxUses,
+		"expires_at":       token.ExpiresAt,
+		"edge_name":        nullString(token.EdgeName),
+		"group":            nullString(token.GroupName),
+		"labels":           token.Labels,
+		"require_approval": token.RequireApproval,
+	})
+}
+
+func (s *Server) handleListJoinTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	list, err := s.store.ListJoinTokens(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list join tokens")
+		return
+	}
+	writeResource(w, r, http.StatusOK, list)
+}
+
+func (s *Server) handleGetJoinToken(w http.ResponseWriter, r *http.Request) {
+	token, err := s.store.JoinTokenByID(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeStoreError(w, err, "join token not found")
+		return
+	}
+	writeResource(w, r, http.StatusOK, token)
+}
+
+func (s *Server) handleRevokeJoinToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	id := r.PathValue("id")
+	if err := s.store.RevokeJoinToken(r.Context(), id, time.Now()); err != nil {
+		writeStoreError(w, err, "join token not found or already revoked")
+		return
+	}
+	s.audit(r.Context(), "join_token.revoked", "join_token", id, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// registrationToken returns the token an edge registers with, from the
+// Authorization header or the legacy X-Bootstrap-Token header.
+func registrationToken(r *http.Request) string {
+	if token, ok := bearerToken(r.Header.Get("Authorization")); ok {
+		return token
+	}
+	return strings.TrimSpace(r.Header.Get("X-Bootstrap-Token"))
+}
+
+// errInvalidJoinToken is reported for every rejected registration token so
+// callers cannot tell unknown tokens from spent ones.
+var errInvalidJoinToken = errors.New("invalid, expired or used up join token")
+
+// checkRegistrationToken validates a join token of the given kind, or for
+// edges the static bootstrap token when one is configured. It returns the join
+// token for the former and nil for the latter.
+func (s *Server) checkRegistrationToken(r *http.Request, kind string, now time.Time) (*db.JoinToken, error) {
+	presented := registrationToken(r)
+	if presented == "" {
+		return nil, errInvalidJoinToken
+	}
+	if strings.HasPrefix(presented, db.JoinTokenPrefix) {
+		token, err := s.store.JoinTokenByToken(r.Context(), presented)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, errInvalidJoinToken
+			}
+			return nil, err
+		}
+		if token.Kind != kind || !token.Usable(now) {
+			return nil, errInvalidJoinToken
+		}
+		return &token, nil
+	}
+	if kind == db.JoinTokenKindEdge && s.bootstrapToken != "" && subtle.ConstantTimeCompare([]byte(presented), []byte(s.bootstrapToken)) == 1 {
+		return nil, nil
+	}
+	return nil, errInvalidJoinToken
+}
+
+// validateEdgeGrouping checks a group name and labels. Both use the
+// characters of DNS labels plus "." and "_", so they can be used in selectors.
+func validateEdgeGrouping(group string, labels map[string]string) error {
+	if group != "" && !validLabelText(group) {
+		return errf("group must be 1-63 characters of a-z, 0-9, '-', '_' or '.'")
+	}
+	if len(labels) > maxLabels {
+		return errf("at most 32 labels are allowed")
+	}
+	for k, v := range labels {
+		if !validLabelText(k) {
+			return errf("label key " + k + " must be 1-63 characters of a-z, 0-9, '-', '_' or '.'")
+		}
+		if v != "" && !validLabelText(v) {
+			return errf("label " + k + " has an invalid value")
+		}
+	}
+	return nil
+}
+
+func validLabelText(v string) bool {
+	if v == "" || len(v) > 63 {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"context"
+	"sync"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/events"
+	"github.com/neo/kokoa-proxy/control-plane/internal/generator"
+)
+
+// changeNotifier broadcasts store changes: every channel handed out by
+// changes is closed on the next notify.
+type changeNotifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func newChangeNotifier() *changeNotifier {
+	return &changeNotifier{ch: make(chan struct{})}
+}
+
+func (n *changeNotifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	close(n.ch)
+	n.ch = make(chan struct{})
+}
+
+// changes returns a channel that is closed on the next change. Callers must
+// obtain it before reading state so that a change in between is not missed.
+func (n *changeNotifier) changes() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.ch
+}
+
+// edgeSnapshot is everything an edge polls for, cached until the next store
+// change.
+type edgeSnapshot struct {
+	// Config holds every route, whether placed or not.
+	Config generator.Config
+	// Generation is the config_generations id of the snapshot.
+	Generation int64
+	// Edges maps edge ids to the config of the routes placed on them.
+	Edges map[string]*edgeConfig
+	// Unplaced is the config of the routes without a placement.
+	Unplaced *edgeConfig
+	// EdgePeers is the WireGuard peer set every edge gets: all origins.
+	EdgePeers []generator.WireGuardPeer
+	// EdgeAddrs maps edge ids to their wg_addr, the address of the
+	// interface each edge renders the peers into.
+	EdgeAddrs map[string]string
+	// EdgeKeys maps the same edges to their public keys.
+	EdgeKeys map[string]string
+}
+
+type snapshotCache struct {
+	mu       sync.Mutex
+	snapshot *edgeSnapshot
+}
+
+func (c *snapshotCache) invalidate() {
+	c.mu.Lock()
+	c.snapshot = nil
+	c.mu.Unlock()
+}
+
+// edgeSnapshot returns the cached snapshot or rebuilds it from the store. A
+// rebuild records the config hash as a generation so edge drift can be
+// measured against it. Rebuilds hold the cache lock, so an invalidation that
+// races with a rebuild waits for it and then discards the result.
+func (s *Server) edgeSnapshot(ctx context.Context) (edgeSnapshot, error) {
+	s.snapshots.mu.Lock()
+	defer s.snapshots.mu.Unlock()
+	if s.snapshots.snapshot != nil {
+		return *s.snapshots.snapshot, nil
+	}
+
+	snap, err := s.buildEdgeSnapshot(ctx)
+	if err != nil {
+		return edgeSnapshot{}, err
+	}
+	hash, edgeHashes := snap.generationHashes()
+	generation, created, err := s.store.RecordConfigGeneration(ctx, hash, edgeHashes)
+	if err != nil {
+		return edgeSnapshot{}, err
+	}
+	snap.Generation = generation
+	if created {
+		s.publish(ctx, events.ConfigGenerated, "", map[string]any{
+			"config_hash": hash,
+			"generation":  generation,
+		})
+	}
+	s.snapshots.snapshot = &snap
+	return snap, nil
+}
+
+// buildEdgeSnapshot builds a snapshot from the store without recording its
+// generation.
+func (s *Server) buildEdgeSnapshot(ctx context.Context) (edgeSnapshot, error) {
+	routes, err := s.store.ListRoutes(ctx)
+	if err != nil {
+		return edgeSnapshot{}, err
+	}
+	st, err := s.loadWireGuardState(ctx)
+	if err != nil {
+		return edgeSnapshot{}, err
+	}
+	snap := edgeSnapshot{Config: generator.BuildConfig(routes)}
+	if err := s.placeRoutes(ctx, &snap, routes, st.Edges); err != nil {
+		return edgeSnapshot{}, err
+	}
+	snapshotWireGuard(&snap, st)
+	return snap, nil
+}
+
+// pendingGenerations returns 1 when the config changed since the latest
+// recorded generation and 0 otherwise. Unlike edgeSnapshot it neither
+// records a generation nor fills the cache.
+func (s *Server) pendingGenerations(ctx context.Context) (int, error) {
+	s.snapshots.mu.Lock()
+	cached := s.snapshots.snapshot != nil
+	s.snapshots.mu.Unlock()
+	if cached {
+		return 0, nil
+	}
+	snap, err := s.buildEdgeSnapshot(ctx)
+	if err != nil {
+		return 0, err
+	}
+	latest, err := s.store.LatestConfigHash(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if hash, _ := snap.generationHashes(); hash != latest {
+		return 1, nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+	"github.com/neo/kokoa-proxy/control-plane/internal/events"
+)
+
+// handleRegisterOrigin enrolls an origin with an origin join token. The
+// origin submits its WireGuard public key and receives a tunnel address and a
+// token for the origin agent.
+func (s *Server) handleRegisterOrigin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	join, err := s.checkRegistrationToken(r, db.JoinTokenKindOrigin, time.Now())
+	if err != nil {
+		if errors.Is(err, errInvalidJoinToken) {
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to check join token")
+		return
+	}
+	var req struct {
+		Name               string `json:"name"`
+		WireguardPublicKey string `json:"wireguard_public_key"`
+		// WireguardEndpoint is the host:port edges dial; optional.
+		WireguardEndpoint string `json:"wireguard_endpoint"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if !validResourceName(req.Name) {
+		writeError(w, http.StatusBadRequest, "name must be 1-64 characters of A-Z, a-z, 0-9, '.', '_' or '-'")
+		return
+	}
+	if !validWireguardKey(req.WireguardPublicKey) {
+		writeError(w, http.StatusBadRequest, "wireguard_public_key must be a base64 WireGuard key")
+		return
+	}
+	if req.WireguardEndpoint != "" && !validWireguardEndpoint(req.WireguardEndpoint) {
+		writeError(w, http.StatusBadRequest, "wireguard_endpoint must be host:port")
+		return
+	}
+	token := uuid.NewString()
+	origin, err := s.store.RegisterOrigin(r.Context(), db.RegisterOriginParams{
+		Name:               req.Name,
+		WireguardPublicKey: req.WireguardPublicKey,
+		WireguardEndpoint:  req.WireguardEndpoint,
+		TokenPlain:         token,
+		JoinTokenID:        join.ID,
+		RegisteredFrom:     remoteIP(r),
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrJoinTokenUsedUp):
+			writeError(w, http.StatusUnauthorized, errInvalidJoinToken.Error())
+		case errors.Is(err, db.ErrTunnelPoolExhausted):
+			writeError(w, http.StatusServiceUnavailable, err.Error())
+		default:
+			writeStoreError(w, err, "join token not found")
+		}
+		return
+	}
+	s.publishConfigChange(r.Context(), events.OriginCreated, "", origin)
+	s.audit(withAuditActor(r.Context(), "join_token:"+join.ID), "origin.registered", "origin", origin.ID, map[string]any{
+		"name":            origin.Name,
+		"wg_ip":           origin.WireguardIP,
+		"registered_from": nullString(origin.RegisteredFrom),
+	})
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"origin_id":   origin.ID,
+		"name":        origin.Name,
+		"wg_ip":       origin.WireguardIP,
+		"tunnel_cidr": s.tunnelNetwork(origin.WireguardIP),
+		"token":       token,
+	})
+}
+
+// handleOriginHeartbeat records that the origin agent is alive and, when the
+// body names one, the WireGuard config it applied.
+func (s *Server) handleOriginHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	origin, ok := s.authenticateOrigin(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		WireGuardHash string `json:"wireguard_hash"`
+	}
+	// Agents before key rotation send no body.
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if req.WireGuardHash != "" {
+		if err := s.store.RecordOriginWGHash(r.Context(), origin.ID, req.WireGuardHash); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to record heartbeat")
+			return
+		}
+		if err := s.advanceWGKeyRotations(r.Context()); err != nil {
+			s.logger.Printf("advance wireguard key rotations: %v", err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) authenticateOrigin(w http.ResponseWriter, r *http.Request) (db.Origin, bool) {
+	token, ok := bearerToken(r.Header.Get("Authorization"))
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "missing bearer token")
+		return db.Origin{}, false
+	}
+	origin, err := s.store.OriginByToken(r.Context(), token)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "invalid token")
+		return db.Origin{}, false
+	}
+	_ = s.store.TouchOrigin(r.Context(), origin.ID, time.Now())
+	return origin, true
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+	"github.com/neo/kokoa-proxy/control-plane/internal/generator"
+)
+
+// edgeConfig is the nginx config of one set of routes, shared by every edge
+// the same routes are placed on.
+type edgeConfig struct {
+	Config generator.Config
+	// CertificatesHash is empty while certificate management is disabled.
+	CertificatesHash string
+}
+
+// placeRoutes builds the config of every edge from the routes placed on it.
+// Edges that select the same routes share one config. Unplaced holds the
+// routes without a placement, served to edges registered after the snapshot
+// until the next rebuild.
+func (s *Server) placeRoutes(ctx context.Context, snap *edgeSnapshot, routes []db.RouteWithOrigin, edges []db.EdgeNode) error {
+	var certs []db.Certificate
+	if s.secrets != nil {
+		var err error
+		if certs, err = s.store.ListCertificates(ctx); err != nil {
+			return err
+		}
+	}
+	byRoutes := map[string]*edgeConfig{}
+	build := func(selected []db.RouteWithOrigin) *edgeConfig {
+		ids := make([]string, len(selected))
+		for i, r := range selected {
+			ids[i] = r.ID
+		}
+		key := strings.Join(ids, ",")
+		if c, ok := byRoutes[key]; ok {
+			return c
+		}
+		c := &edgeConfig{Config: generator.BuildConfig(selected)}
+		if s.secrets != nil {
+			c.CertificatesHash = certificatesHash(issuedCertificates(certs, c.Config.Hostnames))
+		}
+		byRoutes[key] = c
+		return c
+	}
+
+	snap.Unplaced = build(placedRoutes(routes, func(p db.Placement) bool { return p.IsZero() }))
+	snap.Edges = make(map[string]*edgeConfig, len(edges))
+	for _, e := range edges {
+		snap.Edges[e.ID] = build(placedRoutes(routes, func(p db.Placement) bool { return p.MatchesEdge(e) }))
+	}
+	return nil
+}
+
+func placedRoutes(routes []db.RouteWithOrigin, match func(db.Placement) bool) []db.RouteWithOrigin {
+	out := []db.RouteWithOrigin{}
+	for _, r := range routes {
+		if match(r.Placement) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// configFor returns the config of the routes placed on an edge.
+func (snap edgeSnapshot) configFor(id string) *edgeConfig {
+	if c, ok := snap.Edges[id]; ok {
+		return c
+	}
+	return snap.Unplaced
+}
+
+// generationHashes returns the hash identifying the snapshot's generation
+// and the config hashes edges are served in it. Without placed routes every
+// edge gets Config, whose hash then identifies the generation as before.
+func (snap edgeSnapshot) generationHashes() (string, []string) {
+	seen := map[string]bool{snap.Unplaced.Config.ConfigHash: true}
+	hashes := []string{snap.Unplaced.Config.ConfigHash}
+	for _, c := range snap.Edges {
+		if h := c.Config.ConfigHash; !seen[h] {
+			seen[h] = true
+			hashes = append(hashes, h)
+		}
+	}
+	if len(hashes) == 1 && hashes[0] == snap.Config.ConfigHash {
+		return snap.Config.ConfigHash, nil
+	}
+	sort.Strings(hashes)
+	sum := sha256.Sum256([]byte(snap.Config.ConfigHash + "\n" + strings.Join(hashes, "\n")))
+	return fmt.Sprintf("%x", sum[:]), hashes
+}
+
+// etag identifies the config of an edge together with its certificates and
+// WireGuard peers. Without either it is the config hash itself.
+func (snap edgeSnapshot) etag(id string) string {
+	config := snap.configFor(id)
+	wg := ""
+	if len(snap.EdgePeers) > 0 || snap.EdgeAddrs[id] != "" {
+		wg = snap.edgeWireGuard(id).PeersHash
+	}
+	if config.CertificatesHash == "" && wg == "" {
+		return config.Config.ConfigHash
+	}
+	parts := config.Config.ConfigHash + "\n" + config.CertificatesHash
+	if wg != "" {
+		parts += "\n" + wg
+	}
+	sum := sha256.Sum256([]byte(parts))
+	return fmt.Sprintf("%x", sum[:])
+}
+
+// validatePlacement checks a route's placement with the rules edge groups
+// and labels are set with.
+func validatePlacement(p db.Placement) error {
+	for _, g := range p.Groups {
+		if !validLabelText(g) {
+			return errf("placement group " + g + " must be 1-63 characters of a-z, 0-9, '-', '_' or '.'")
+		}
+	}
+	if len(p.Groups) > maxLabels {
+		return errf("at most 32 placement groups are allowed")
+	}
+	return validateEdgeGrouping("", p.Labels)
+}
@@ -1,53 +1,173 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"mime"
 	"net/http"
 	"net/netip"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/neo/kokoa-proxy/control-plane/internal/db"
-	"github.com/neo/kokoa-proxy/control-plane/internal/generator"
+	"github.com/neo/kokoa-proxy/control-plane/internal/events"
+	"github.com/neo/kokoa-proxy/control-plane/internal/secrets"
+	"github.com/neo/kokoa-proxy/control-plane/internal/signing"
 	"github.com/neo/kokoa-proxy/control-plane/internal/web"
 )
 
 type ServerConfig struct {
-	Store          *db.Store
+	Store *db.Store
+	// BootstrapToken is the deprecated static registration secret accepted
+	// besides join tokens. Empty disables it.
 	BootstrapToken string
 	Logger         *log.Logger
+	// Secrets decrypts certificate keys for edges. Without it the
+	// certificates endpoint is disabled.
+	Secrets *secrets.Box
+	// Signer signs edge configs. Without it configs are sent unsigned.
+	Signer *signing.Signer
+	// Events is shared with background publishers such as the webhook
+	// worker. A private bus is created when it is nil.
+	Events *events.Bus
+	// EdgeTokenTTL is the lifetime of newly issued edge tokens; zero means
+	// they never expire.
+	EdgeTokenTTL time.Duration
+	// RequireEdgeApproval registers every new edge as pending; join tokens
+	// can also require approval for their own edges.
+	RequireEdgeApproval bool
+	// EdgeDrainPeriod is how long a draining edge keeps serving before it is
+	// retired, unless the drain request sets its own.
+	EdgeDrainPeriod time.Duration
 }
 
 type Server struct {
 	store          *db.Store
 	bootstrapToken string
 	logger         *log.Logger
+	secrets        *secrets.Box
 	rateLimiter    *rateLimiter
+	changes        *changeNotifier
+	snapshots      snapshotCache
+	events         *events.Bus
+	signer         *signing.Signer
+	edgeTokenTTL   time.Duration
+	// requireEdgeApproval makes new edges wait in the pending state.
+	requireEdgeApproval bool
+	edgeDrainPeriod     time.Duration
+
+	seenMu sync.Mutex
+	seenAt map[string]time.Time
 }
 
 func NewServer(cfg ServerConfig) *Server {
-	return &Server{
-		store:          cfg.Store,
-		bootstrapToken: cfg.BootstrapToken,
-		logger:         cfg.Logger,
-		rateLimiter:    newRateLimiter(60, time.Minute),
+	if cfg.Logger == nil {
+		cfg.Logger = log.New(io.Discard, "", 0)
+	}
+	if cfg.Events == nil {
+		cfg.Events = events.NewBus(cfg.Store)
+	}
+	s := &Server{
+		store:               cfg.Store,
+		bootstrapToken:      cfg.BootstrapToken,
+		logger:              cfg.Logger,
+		secrets:             cfg.Secrets,
+		rateLimiter:         newRateLimiter(60, time.Minute),
+		changes:             newChangeNotifier(),
+		events:              cfg.Events,
+		signer:              cfg.Signer,
+		edgeTokenTTL:        cfg.EdgeTokenTTL,
+		requireEdgeApproval: cfg.RequireEdgeApproval,
+		edgeDrainPeriod:     cfg.EdgeDrainPeriod,
+		seenAt:              make(map[string]time.Time),
 	}
+	cfg.Store.OnChange(func() {
+		s.snapshots.invalidate()
+		s.changes.notify()
+	})
+	return s
 }
 
 func (s *Server) Routes() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthz", s.handleHealth)
-	mux.HandleFunc("/api/v1/origins", s.handleCreateOrigin)
-	mux.HandleFunc("/api/v1/routes", s.handleCreateRoute)
-	mux.HandleFunc("/api/v1/origins/list", s.handleListOrigins)
-	mux.HandleFunc("/api/v1/routes/list", s.handleListRoutes)
-	mux.HandleFunc("/api/v1/edge-nodes/list", s.handleListEdgeNodes)
+	// Management endpoints are served under both versions; they differ only in
+	// how writeResource renders the response.
+	for _, prefix := range []string{"/api/v1", "/api/v2"} {
+		mux.Handle(prefix+"/origins", s.require(permOriginsWrite, s.handleCreateOrigin))
+		mux.Handle(prefix+"/routes", s.require(permRoutesWrite, s.handleCreateRoute))
+		mux.Handle(prefix+"/origins/list", s.require(permOriginsRead, s.handleListOrigins))
+		mux.Handle(prefix+"/routes/list", s.require(permRoutesRead, s.handleListRoutes))
+		mux.Handle(prefix+"/edge-nodes/list", s.require(permEdgesRead, s.handleListEdgeNodes))
+		mux.Handle(prefix+"/origins/{id}", methodHandlers{
+			http.MethodGet:    s.require(permOriginsRead, s.handleGetOrigin),
+			http.MethodPatch:  s.require(permOriginsWrite, s.handleUpdateOrigin),
+			http.MethodDelete: s.require(permOriginsWrite, s.handleDeleteOrigin),
+		})
+		mux.Handle(prefix+"/routes/{id}", methodHandlers{
+			http.MethodGet:    s.require(permRoutesRead, s.handleGetRoute),
+			http.MethodPatch:  s.require(permRoutesWrite, s.handleUpdateRoute),
+			http.MethodDelete: s.require(permRoutesWrite, s.handleDeleteRoute),
+		})
+		mux.Handle(prefix+"/edge-nodes/{id}", methodHandlers{
+			http.MethodGet:    s.require(permEdgesRead, s.handleGetEdgeNode),
+			http.MethodPatch:  s.require(permEdgesWrite, s.handleUpdateEdgeNode),
+			http.MethodDelete: s.require(permEdgesWrite, s.handleDeleteEdgeNode),
+		})
+		mux.Handle(prefix+"/edge-nodes/{id}/rotate-token", s.require(permEdgesWrite, s.handleRotateEdgeToken))
+		mux.Handle(prefix+"/edge-nodes/{id}/revoke", s.require(permEdgesWrite, s.handleRevokeEdgeToken))
+		mux.Handle(prefix+"/edge-nodes/{id}/approve", s.require(permEdgesApprove, s.handleApproveEdgeNode))
+		mux.Handle(prefix+"/edge-nodes/{id}/cordon", s.require(permEdgesWrite, s.handleCordonEdgeNode))
+		mux.Handle(prefix+"/edge-nodes/{id}/uncordon", s.require(permEdgesWrite, s.handleUncordonEdgeNode))
+		mux.Handle(prefix+"/edge-nodes/{id}/drain", s.require(permEdgesWrite, s.handleDrainEdgeNode))
+		mux.Handle(prefix+"/edge-nodes/{id}/retire", s.require(permEdgesWrite, s.handleRetireEdgeNode))
+		mux.Handle(prefix+"/edge-nodes/dns", s.require(permEdgesRead, s.handleEdgeDNS))
+		mux.Handle(prefix+"/join-tokens", s.require(permJoinTokensManage, s.handleCreateJoinToken))
+		mux.Handle(prefix+"/join-tokens/list", s.require(permJoinTokensManage, s.handleListJoinTokens))
+		mux.Handle(prefix+"/join-tokens/{id}", methodHandlers{
+			http.MethodGet: s.require(permJoinTokensManage, s.handleGetJoinToken),
+		})
+		mux.Handle(prefix+"/join-tokens/{id}/revoke", s.require(permJoinTokensManage, s.handleRevokeJoinToken))
+		mux.Handle(prefix+"/api-keys", s.require(permAPIKeysManage, s.handleCreateAPIKey))
+		mux.Handle(prefix+"/api-keys/list", s.require(permAPIKeysManage, s.handleListAPIKeys))
+		mux.Handle(prefix+"/api-keys/{id}/revoke", s.require(permAPIKeysManage, s.handleRevokeAPIKey))
+		mux.Handle(prefix+"/webhooks", s.require(permWebhooksManage, s.handleCreateWebhook))
+		mux.Handle(prefix+"/webhooks/list", s.require(permWebhooksManage, s.handleListWebhooks))
+		mux.Handle(prefix+"/webhooks/{id}", methodHandlers{
+			http.MethodGet:    s.require(permWebhooksManage, s.handleGetWebhook),
+			http.MethodDelete: s.require(permWebhooksManage, s.handleDeleteWebhook),
+		})
+		mux.Handle(prefix+"/webhooks/{id}/deliveries", s.require(permWebhooksManage, s.handleListWebhookDeliveries))
+		mux.Handle(prefix+"/audit-log", s.require(permAuditRead, s.handleListAuditLog))
+		mux.Handle(prefix+"/tunnel/pools", s.require(permTunnelRead, s.handleTunnelPools))
+		mux.Handle(prefix+"/tunnel/addresses", s.require(permTunnelRead, s.handleListTunnelAddresses))
+		mux.Handle(prefix+"/tunnel/key-rotations/list", s.require(permTunnelRead, s.handleListWGKeyRotations))
+		mux.Handle(prefix+"/tunnel/key-rotations/{id}", methodHandlers{
+			http.MethodGet: s.require(permTunnelRead, s.handleGetWGKeyRotation),
+		})
+		mux.Handle(prefix+"/tunnel/key-rotations/{id}/complete", s.require(permTunnelManage, s.handleCompleteWGKeyRotation))
+		mux.Handle(prefix+"/tunnel/key-rotations/{id}/cancel", s.require(permTunnelManage, s.handleCancelWGKeyRotation))
+	}
+	mux.Handle("/api/v1/events", s.require(permEventsRead, s.handleEvents))
 	mux.HandleFunc("/api/v1/edge-nodes/register", s.handleRegisterEdgeNode)
 	mux.HandleFunc("/api/v1/edge-nodes/me/config", s.handleEdgeConfig)
-	mux.Handle("/", web.Handler())
+	mux.HandleFunc("/api/v1/edge-nodes/me/certificates", s.handleEdgeCertificates)
+	mux.HandleFunc("/api/v1/edge-nodes/me/status", s.handleEdgeStatus)
+	mux.HandleFunc("/api/v1/edge-nodes/me/token", s.handleRenewEdgeToken)
+	mux.HandleFunc("/api/v1/edge-nodes/me/wireguard-key", s.handleEdgeWireGuardKey)
+	mux.HandleFunc("/api/v1/origins/register", s.handleRegisterOrigin)
+	mux.HandleFunc("/api/v1/origins/me/heartbeat", s.handleOriginHeartbeat)
+	mux.HandleFunc("/api/v1/origins/me/wireguard", s.handleOriginWireGuard)
+	mux.HandleFunc("/api/v1/origins/me/wireguard-key", s.handleOriginWireGuardKey)
+	mux.HandleFunc("/api/v1/signing-key", s.handleSigningKey)
+	mux.Handle("/", web.Handler(s.webConfig()))
 	return s.logRequests(s.applyRateLimit(mux))
 }
 
@@ -67,35 +187,110 @@ func (s *Server) handleCreateOrigin(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	// wireguard_private_key_encrypted is the field name of earlier
+	// releases; despite the name it always carried the key as given.
 	var req struct {
 		Name                         string `json:"name"`
 		WireguardIP                  string `json:"wg_ip"`
 		WireguardPublicKey           string `json:"wireguard_public_key"`
+		WireguardPrivateKey          string `json:"wireguard_private_key"`
 		WireguardPrivateKeyEncrypted string `json:"wireguard_private_key_encrypted"`
+		WireguardEndpoint            string `json:"wireguard_endpoint"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		writeError(w, http.StatusBadRequest, "invalid json")
 		return
 	}
-	if err := validateOrigin(req.Name, req.WireguardIP); err != nil {
+	if err := validateOrigin(req.Name, req.WireguardIP, req.WireguardEndpoint); err != nil {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if req.WireguardIP == tunnelAddrAuto {
+		req.WireguardIP = ""
+	}
+	if req.WireguardPrivateKey == "" {
+		req.WireguardPrivateKey = req.WireguardPrivateKeyEncrypted
+	}
 	origin, err := s.store.CreateOrigin(r.Context(), db.CreateOriginParams{
-		Name:                         req.Name,
-		WireguardIP:                  req.WireguardIP,
-		WireguardPublicKey:           req.WireguardPublicKey,
-		WireguardPrivateKeyEncrypted: req.WireguardPrivateKeyEncrypted,
+		Name:                req.Name,
+		WireguardIP:         req.WireguardIP,
+		WireguardPublicKey:  req.WireguardPublicKey,
+		WireguardPrivateKey: req.WireguardPrivateKey,
+		WireguardEndpoint:   req.WireguardEndpoint,
 	})
 	if err != nil {
-		status := http.StatusBadRequest
-		if isConstraintError(err) {
-			status = http.StatusConflict
-		}
-		writeError(w, status, err.Error())
+		writeStoreError(w, err, "origin not found")
+		return
+	}
+	s.publishConfigChange(r.Context(), events.OriginCreated, "", origin)
+	writeResource(w, r, http.StatusCreated, origin)
+}
+
+func (s *Server) handleGetOrigin(w http.ResponseWriter, r *http.Request) {
+	origin, err := s.store.OriginByID(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeStoreError(w, err, "origin not found")
+		return
+	}
+	writeResource(w, r, http.StatusOK, origin)
+}
+
+func (s *Server) handleUpdateOrigin(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name                         *string `json:"name"`
+		WireguardIP                  *string `json:"wg_ip"`
+		WireguardPublicKey           *string `json:"wireguard_public_key"`
+		WireguardPrivateKey          *string `json:"wireguard_private_key"`
+		WireguardPrivateKeyEncrypted *string `json:"wireguard_private_key_encrypted"`
+		WireguardEndpoint            *string `json:"wireguard_endpoint"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	current, err := s.store.OriginByID(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeStoreError(w, err, "origin not found")
+		return
+	}
+	params := db.UpdateOriginParams{
+		Name:                current.Name,
+		WireguardIP:         current.WireguardIP,
+		WireguardPublicKey:  current.WireguardPublicKey,
+		WireguardPrivateKey: req.WireguardPrivateKey,
+		WireguardEndpoint:   current.WireguardEndpoint,
+	}
+	if params.WireguardPrivateKey == nil {
+		params.WireguardPrivateKey = req.WireguardPrivateKeyEncrypted
+	}
+	patchString(&params.Name, req.Name)
+	patchString(&params.WireguardIP, req.WireguardIP)
+	patchString(&params.WireguardPublicKey, req.WireguardPublicKey)
+	patchString(&params.WireguardEndpoint, req.WireguardEndpoint)
+	if err := validateOrigin(params.Name, params.WireguardIP, params.WireguardEndpoint); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if params.WireguardIP == tunnelAddrAuto {
+		params.WireguardIP = ""
+	}
+	origin, err := s.store.UpdateOrigin(r.Context(), current.ID, params)
+	if err != nil {
+		writeStoreError(w, err, "origin not found")
 		return
 	}
-	writeJSON(w, http.StatusCreated, origin)
+	s.publishConfigChange(r.Context(), events.OriginUpdated, "", origin)
+	writeResource(w, r, http.StatusOK, origin)
+}
+
+func (s *Server) handleDeleteOrigin(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := s.store.DeleteOrigin(r.Context(), id); err != nil {
+		writeStoreError(w, err, "origin not found")
+		return
+	}
+	s.publishConfigChange(r.Context(), events.OriginDeleted, "", map[string]string{"id": id})
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (s *Server) handleCreateRoute(w http.ResponseWriter, r *http.Request) {
@@ -104,22 +299,56 @@ func (s *Server) handleCreateRoute(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var req struct {
-		Hostname   string `json:"hostname"`
-		OriginID   string `json:"origin_id"`
-		TargetPort int    `json:"target_port"`
+		Hostname           string                `json:"hostname"`
+		PathPrefix         string                `json:"path_prefix"`
+		StripPrefix        bool                  `json:"strip_prefix"`
+		OriginID           string                `json:"origin_id"`
+		TargetPort         int                   `json:"target_port"`
+		Backends           []routeBackendRequest `json:"backends"`
+		LBMethod           string                `json:"lb_method"`
+		MaxFails           *int                  `json:"max_fails"`
+		FailTimeoutSeconds int                   `json:"fail_timeout_seconds"`
+		// Placement selects the edges serving the route; omitted means all.
+		Placement db.Placement `json:"placement"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		writeError(w, http.StatusBadRequest, "invalid json")
 		return
 	}
-	if err := validateRoute(req.Hostname, req.TargetPort, req.OriginID); err != nil {
+	pathPrefix, err := normalizePathPrefix(req.PathPrefix)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	backends := []db.RouteBackend{{OriginID: req.OriginID, TargetPort: req.TargetPort}}
+	if len(req.Backends) > 0 {
+		backends = toRouteBackends(req.Backends)
+	}
+	if err := validateRoute(req.Hostname, backends); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateBalancing(req.LBMethod, req.MaxFails, req.FailTimeoutSeconds, backends); err != nil {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if err := validatePlacement(req.Placement); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !hostnameInScope(r.Context(), req.Hostname) {
+		writeError(w, http.StatusForbidden, "hostname is outside the api key scope")
+		return
+	}
 	route, err := s.store.CreateRoute(r.Context(), db.CreateRouteParams{
-		Hostname:   req.Hostname,
-		OriginID:   req.OriginID,
-		TargetPort: req.TargetPort,
+		Hostname:           req.Hostname,
+		PathPrefix:         pathPrefix,
+		StripPrefix:        req.StripPrefix,
+		LBMethod:           req.LBMethod,
+		MaxFails:           req.MaxFails,
+		FailTimeoutSeconds: req.FailTimeoutSeconds,
+		Backends:           backends,
+		Placement:          req.Placement,
 	})
 	if err != nil {
 		status := http.StatusBadRequest
@@ -129,7 +358,139 @@ func (s *Server) handleCreateRoute(w http.ResponseWriter, r *http.Request) {
 		writeError(w, status, err.Error())
 		return
 	}
-	writeJSON(w, http.StatusCreated, route)
+	s.writeRoute(w, r, http.StatusCreated, events.RouteCreated, route.ID)
+}
+
+func (s *Server) handleGetRoute(w http.ResponseWriter, r *http.Request) {
+	route, err := s.store.RouteByID(r.Context(), r.PathValue("id"))
+	if err == nil && !hostnameInScope(r.Context(), route.Hostname) {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		writeStoreError(w, err, "route not found")
+		return
+	}
+	writeResource(w, r, http.StatusOK, route)
+}
+
+// writeRoute responds with the stored route, which unlike the result of a
+// write carries the names and addresses of its origins.
+// writeRoute publishes the event of a stored route change and responds with
+// the route and its backends.
+func (s *Server) writeRoute(w http.ResponseWriter, r *http.Request, status int, event, id string) {
+	route, err := s.store.RouteByID(r.Context(), id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load route")
+		return
+	}
+	s.publishConfigChange(r.Context(), event, route.Hostname, route)
+	writeResource(w, r, status, route)
+}
+
+func (s *Server) handleUpdateRoute(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Hostname           *string               `json:"hostname"`
+		PathPrefix         *string               `json:"path_prefix"`
+		StripPrefix        *bool                 `json:"strip_prefix"`
+		OriginID           *string               `json:"origin_id"`
+		TargetPort         *int                  `json:"target_port"`
+		Backends           []routeBackendRequest `json:"backends"`
+		LBMethod           *string               `json:"lb_method"`
+		MaxFails           *int                  `json:"max_fails"`
+		FailTimeoutSeconds *int                  `json:"fail_timeout_seconds"`
+		// Placement replaces the placement; {} places the route on all edges.
+		Placement *db.Placement `json:"placement"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	current, err := s.store.RouteByID(r.Context(), r.PathValue("id"))
+	if err == nil && !hostnameInScope(r.Context(), current.Hostname) {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		writeStoreError(w, err, "route not found")
+		return
+	}
+	params := db.UpdateRouteParams{
+		Hostname:           current.Hostname,
+		PathPrefix:         current.PathPrefix,
+		StripPrefix:        current.StripPrefix,
+		LBMethod:           current.LBMethod,
+		MaxFails:           current.MaxFails,
+		FailTimeoutSeconds: current.FailTimeoutSeconds,
+		Backends:           append([]db.RouteBackend(nil), current.Backends...),
+		Placement:          current.Placement,
+	}
+	patchString(&params.Hostname, req.Hostname)
+	patchString(&params.PathPrefix, req.PathPrefix)
+	patchString(&params.LBMethod, req.LBMethod)
+	if req.StripPrefix != nil {
+		params.StripPrefix = *req.StripPrefix
+	}
+	if req.MaxFails != nil {
+		params.MaxFails = req.MaxFails
+	}
+	if req.FailTimeoutSeconds != nil {
+		params.FailTimeoutSeconds = *req.FailTimeoutSeconds
+	}
+	if req.Placement != nil {
+		params.Placement = *req.Placement
+	}
+	if req.Backends != nil {
+		params.Backends = toRouteBackends(req.Backends)
+	} else if len(params.Backends) > 0 {
+		// origin_id/target_port address the primary backend, as in the
+		// single-origin API.
+		primary := &params.Backends[primaryBackendIndex(params.Backends)]
+		patchString(&primary.OriginID, req.OriginID)
+		if req.TargetPort != nil {
+			primary.TargetPort = *req.TargetPort
+		}
+	}
+	if params.PathPrefix, err = normalizePathPrefix(params.PathPrefix); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateRoute(params.Hostname, params.Backends); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateBalancing(params.LBMethod, params.MaxFails, params.FailTimeoutSeconds, params.Backends); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validatePlacement(params.Placement); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !hostnameInScope(r.Context(), params.Hostname) {
+		writeError(w, http.StatusForbidden, "hostname is outside the api key scope")
+		return
+	}
+	route, err := s.store.UpdateRoute(r.Context(), current.ID, params)
+	if err != nil {
+		writeStoreError(w, err, "route not found")
+		return
+	}
+	s.writeRoute(w, r, http.StatusOK, events.RouteUpdated, route.ID)
+}
+
+func (s *Server) handleDeleteRoute(w http.ResponseWriter, r *http.Request) {
+	current, err := s.store.RouteByID(r.Context(), r.PathValue("id"))
+	if err == nil && !hostnameInScope(r.Context(), current.Hostname) {
+		err = sql.ErrNoRows
+	}
+	if err == nil {
+		err = s.store.DeleteRoute(r.Context(), current.ID)
+	}
+	if err != nil {
+		writeStoreError(w, err, "route not found")
+		return
+	}
+	s.publishConfigChange(r.Context(), events.RouteDeleted, current.Hostname, current)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (s *Server) handleRegisterEdgeNode(w http.ResponseWriter, r *http.Request) {
@@ -137,12 +498,14 @@ func (s *Server) handleRegisterEdgeNode(w http.ResponseWriter, r *http.Request)
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	if s.bootstrapToken == "" {
-		writeError(w, http.StatusServiceUnavailable, "bootstrap token is not configured")
-		return
-	}
-	if !s.validateBootstrapToken(r) {
-		writeError(w, http.StatusUnauthorized, "invalid bootstrap token")
+	now := time.Now()
+	join, err := s.checkRegistrationToken(r, db.JoinTokenKindEdge, now)
+	if err != nil {
+		if errors.Is(err, errInvalidJoinToken) {
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "failed to check join token")
 		return
 	}
 	var req struct {
@@ -151,35 +514,82 @@ func (s *Server) handleRegisterEdgeNode(w http.ResponseWriter, r *http.Request)
 		WGEndpoint   string `json:"wg_endpoint"`
 		WGPeerPubKey string `json:"wg_peer_pubkey"`
 		WGAllowedIPs string `json:"wg_allowed_ips"`
+		// WGPublicKey is the edge's own WireGuard key, shown for approval.
+		WGPublicKey string `json:"wg_public_key"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		writeError(w, http.StatusBadRequest, "invalid json")
 		return
 	}
-	if err := validateEdgeRegister(req.Name, req.WGAddr, req.WGEndpoint, req.WGPeerPubKey, req.WGAllowedIPs); err != nil {
-		writeError(w, http.StatusBadRequest, err.Error())
+	if req.WGPublicKey != "" && !validWireguardKey(req.WGPublicKey) {
+		writeError(w, http.StatusBadRequest, "wg_public_key must be a base64 WireGuard key")
 		return
 	}
 	issuedToken := uuid.NewString()
-	node, err := s.store.RegisterEdgeNode(r.Context(), db.RegisterEdgeNodeParams{
+	params := db.RegisterEdgeNodeParams{
 		TokenPlain:   issuedToken,
 		Name:         req.Name,
 		WGAddr:       req.WGAddr,
 		WGEndpoint:   req.WGEndpoint,
 		WGPeerPubKey: req.WGPeerPubKey,
 		WGAllowedIPs: req.WGAllowedIPs,
-	})
+		WGPublicKey:  req.WGPublicKey,
+		// The rate limiter keys on RemoteAddr as well; proxies in front of
+		// the control plane show up as the source.
+		RegisteredFrom: remoteIP(r),
+	}
+	if s.requireEdgeApproval || (join != nil && join.RequireApproval) {
+		params.State = db.EdgeStatePending
+	}
+	actor := "bootstrap_token"
+	if join != nil {
+		// Whatever the join token pre-assigns wins over the agent's request.
+		if join.EdgeName.Valid {
+			params.Name = join.EdgeName.String
+		}
+		params.GroupName = join.GroupName.String
+		params.Labels = join.Labels
+		params.JoinTokenID = join.ID
+		actor = "join_token:" + join.ID
+	}
+	if err := validateEdgeRegister(params.Name, params.WGAddr, params.WGEndpoint, params.WGPeerPubKey, params.WGAllowedIPs); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	params.AllocateWGAddr = params.WGAddr == tunnelAddrAuto
+	if s.edgeTokenTTL > 0 {
+		params.TokenExpiresAt = now.Add(s.edgeTokenTTL)
+	}
+	node, err := s.store.RegisterEdgeNode(r.Context(), params)
 	if err != nil {
 		status := http.StatusBadRequest
-		if isConstraintError(err) {
+		switch {
+		case errors.Is(err, db.ErrJoinTokenUsedUp):
+			status = http.StatusUnauthorized
+			err = errInvalidJoinToken
+		case errors.Is(err, db.ErrTunnelPoolExhausted):
+			status = http.StatusServiceUnavailable
+		case isConstraintError(err):
 			status = http.StatusConflict
 		}
 		writeError(w, status, err.Error())
 		return
 	}
+	s.publish(r.Context(), events.EdgeRegistered, "", node)
+	s.audit(withAuditActor(r.Context(), actor), "edge.registered", "edge_node", node.ID, map[string]any{
+		"name":             node.Name,
+		"join_token_id":    nullString(node.JoinTokenID),
+		"state":            node.State,
+		"registered_from":  nullString(node.RegisteredFrom),
+		"token_expires_at": nullTime(node.TokenExpiresAt),
+	})
 	writeJSON(w, http.StatusCreated, map[string]any{
-		"edge_node_id": node.ID,
-		"token":        issuedToken,
+		"edge_node_id":     node.ID,
+		"name":             node.Name,
+		"state":            node.State,
+		"wg_addr":          nullString(node.WGAddr),
+		"token":            issuedToken,
+		"token_expires_at": nullTime(node.TokenExpiresAt),
 	})
 }
 
@@ -188,30 +598,203 @@ func (s *Server) handleEdgeConfig(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
+	node, ok := s.authenticateEdge(w, r)
+	if !ok || !requireApproved(w, node) {
+		return
+	}
+
+	wait, err := parseWait(r.URL.Query().Get("wait"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	since := r.URL.Query().Get("since")
+	if since == "" {
+		since = etagValue(r.Header.Get("If-None-Match"))
+	}
+	if wait > 0 {
+		// Long polls outlive the server's write timeout.
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + 10*time.Second))
+	}
+
+	var timeout <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		// Subscribe before reading the snapshot so that a change between the
+		// two wakes the loop instead of being lost.
+		changed := s.changes.changes()
+		snap, err := s.edgeSnapshot(r.Context())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to load config")
+			return
+		}
+		etag := snap.etag(node.ID)
+		w.Header().Set("ETag", `"`+etag+`"`)
+		if since != etag {
+			s.writeEdgeConfig(w, node, snap)
+			return
+		}
+		if wait == 0 {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		select {
+		case <-changed:
+			// The change may have been the revocation of this very token.
+			token, _ := bearerToken(r.Header.Get("Authorization"))
+			if _, err := s.store.EdgeNodeByToken(r.Context(), token, time.Now()); err != nil {
+				w.Header().Del("ETag")
+				writeError(w, http.StatusUnauthorized, "invalid token")
+				return
+			}
+		case <-timeout:
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// maxConfigWait caps long polls so that idle connections are recycled.
+const maxConfigWait = 120 * time.Second
+
+// parseWait parses the wait query parameter, either a duration ("60s") or a
+// number of seconds.
+func parseWait(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		secs, convErr := strconv.Atoi(v)
+		if convErr != nil {
+			return 0, fmt.Errorf("invalid wait %q", v)
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid wait %q", v)
+	}
+	return min(d, maxConfigWait), nil
+}
+
+// etagValue strips the quotes and weak prefix from an If-None-Match value.
+func etagValue(v string) string {
+	v = strings.TrimSpace(v)
+	v = strings.TrimPrefix(v, "W/")
+	return strings.Trim(v, `"`)
+}
+
+// authenticateEdge resolves the edge node from its bearer token and records
+// that it was seen. On failure the response has already been written.
+func (s *Server) authenticateEdge(w http.ResponseWriter, r *http.Request) (db.EdgeNode, bool) {
 	token, ok := bearerToken(r.Header.Get("Authorization"))
 	if !ok {
 		writeError(w, http.StatusUnauthorized, "missing bearer token")
-		return
+		return db.EdgeNode{}, false
 	}
-	node, err := s.store.EdgeNodeByToken(r.Context(), token)
+	now := time.Now()
+	node, err := s.store.EdgeNodeByToken(r.Context(), token, now)
 	if err != nil {
 		writeError(w, http.StatusUnauthorized, "invalid token")
+		return db.EdgeNode{}, false
+	}
+	// Retirement is final, whatever token the edge presents.
+	if node.State == db.EdgeStateRetired {
+		writeError(w, http.StatusForbidden, "edge is retired")
+		return db.EdgeNode{}, false
+	}
+	setTokenHeaders(w, node, now)
+	_ = s.store.TouchEdgeNode(r.Context(), node.ID, now)
+	s.edgeSeen(r.Context(), node, now)
+	return node, true
+}
+
+func (s *Server) handleGetEdgeNode(w http.ResponseWriter, r *http.Request) {
+	node, err := s.store.EdgeNodeByID(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeStoreError(w, err, "edge node not found")
 		return
 	}
-	_ = s.store.TouchEdgeNode(r.Context(), node.ID, time.Now())
+	writeResource(w, r, http.StatusOK, node)
+}
 
-	routes, err := s.store.ListRoutes(r.Context())
+func (s *Server) handleUpdateEdgeNode(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name         *string `json:"name"`
+		WGAddr       *string `json:"wg_addr"`
+		WGEndpoint   *string `json:"wg_endpoint"`
+		WGPeerPubKey *string `json:"wg_peer_pubkey"`
+		WGAllowedIPs *string `json:"wg_allowed_ips"`
+		Group        *string `json:"group"`
+		// Labels replaces all labels; {} removes them.
+		Labels     *map[string]string `json:"labels"`
+		PublicAddr *string            `json:"public_addr"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	current, err := s.store.EdgeNodeByID(r.Context(), r.PathValue("id"))
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to load routes")
+		writeStoreError(w, err, "edge node not found")
 		return
 	}
-	config := generator.BuildConfig(routes)
-	writeJSON(w, http.StatusOK, map[string]any{
-		"config_hash": config.ConfigHash,
-		"hostnames":   config.Hostnames,
-		"nginx_map":   config.Map,
-		"routes":      config.Routes,
-	})
+	params := db.UpdateEdgeNodeParams{
+		Name:         current.Name,
+		WGAddr:       current.WGAddr.String,
+		WGEndpoint:   current.WGEndpoint.String,
+		WGPeerPubKey: current.WGPeerPubKey.String,
+		WGAllowedIPs: current.WGAllowedIPs.String,
+		GroupName:    current.GroupName.String,
+		Labels:       current.Labels,
+		PublicAddr:   current.PublicAddr.String,
+	}
+	patchString(&params.Name, req.Name)
+	patchString(&params.WGAddr, req.WGAddr)
+	patchString(&params.WGEndpoint, req.WGEndpoint)
+	patchString(&params.WGPeerPubKey, req.WGPeerPubKey)
+	patchString(&params.WGAllowedIPs, req.WGAllowedIPs)
+	patchString(&params.GroupName, req.Group)
+	patchString(&params.PublicAddr, req.PublicAddr)
+	if req.Labels != nil {
+		params.Labels = *req.Labels
+	}
+	if err := validateEdgeRegister(params.Name, params.WGAddr, params.WGEndpoint, params.WGPeerPubKey, params.WGAllowedIPs); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateEdgeGrouping(params.GroupName, params.Labels); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, err := netip.ParseAddr(params.PublicAddr); params.PublicAddr != "" && err != nil {
+		writeError(w, http.StatusBadRequest, "public_addr must be a valid IP address")
+		return
+	}
+	params.AllocateWGAddr = params.WGAddr == tunnelAddrAuto
+	node, err := s.store.UpdateEdgeNode(r.Context(), current.ID, params)
+	if err != nil {
+		writeStoreError(w, err, "edge node not found")
+		return
+	}
+	s.publish(r.Context(), events.EdgeUpdated, "", node)
+	writeResource(w, r, http.StatusOK, node)
+}
+
+func (s *Server) handleDeleteEdgeNode(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := s.store.DeleteEdgeNode(r.Context(), id); err != nil {
+		writeStoreError(w, err, "edge node not found")
+		return
+	}
+	s.publish(r.Context(), events.EdgeDeleted, "", map[string]string{"id": id})
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (s *Server) handleListOrigins(w http.ResponseWriter, r *http.Request) {
@@ -224,7 +807,7 @@ func (s *Server) handleListOrigins(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, "failed to list origins")
 		return
 	}
-	writeJSON(w, http.StatusOK, list)
+	writeResource(w, r, http.StatusOK, list)
 }
 
 func (s *Server) handleListRoutes(w http.ResponseWriter, r *http.Request) {
@@ -237,7 +820,13 @@ func (s *Server) handleListRoutes(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, "failed to list routes")
 		return
 	}
-	writeJSON(w, http.StatusOK, list)
+	visible := make([]db.RouteWithOrigin, 0, len(list))
+	for _, route := range list {
+		if hostnameInScope(r.Context(), route.Hostname) {
+			visible = append(visible, route)
+		}
+	}
+	writeResource(w, r, http.StatusOK, visible)
 }
 
 func (s *Server) handleListEdgeNodes(w http.ResponseWriter, r *http.Request) {
@@ -245,23 +834,97 @@ func (s *Server) handleListEdgeNodes(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
+	// Drift counts the config no edge has fetched yet, which the next
+	// snapshot rebuild records as a generation.
+	pending, err := s.pendingGenerations(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load routes")
+		return
+	}
 	list, err := s.store.ListEdgeNodes(r.Context())
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "failed to list edge nodes")
 		return
 	}
-	writeJSON(w, http.StatusOK, list)
+	for i := range list {
+		if list[i].ConfigsBehind >= 0 {
+			list[i].ConfigsBehind += pending
+		}
+	}
+	if state := r.URL.Query().Get("state"); state != "" {
+		filtered := list[:0]
+		for _, n := range list {
+			if n.State == state {
+				filtered = append(filtered, n)
+			}
+		}
+		list = filtered
+	}
+	writeResource(w, r, http.StatusOK, list)
 }
 
-func (s *Server) validateBootstrapToken(r *http.Request) bool {
-	header := r.Header.Get("Authorization")
-	if strings.HasPrefix(header, "Bearer ") && strings.TrimPrefix(header, "Bearer ") == s.bootstrapToken {
-		return true
+func (s *Server) handleEdgeStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
 	}
-	if r.Header.Get("X-Bootstrap-Token") == s.bootstrapToken {
-		return true
+	node, ok := s.authenticateEdge(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		ConfigHash    string `json:"config_hash"`
+		ApplyStatus   string `json:"apply_status"`
+		ApplyError    string `json:"apply_error"`
+		AgentVersion  string `json:"agent_version"`
+		NginxVersion  string `json:"nginx_version"`
+		UptimeSeconds *int64 `json:"uptime_seconds"`
+		// WireGuardHash is the peers_hash of the applied WireGuard config.
+		WireGuardHash string `json:"wireguard_hash"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	switch req.ApplyStatus {
+	case "", db.ApplyStatusApplied, db.ApplyStatusFailed:
+	default:
+		writeError(w, http.StatusBadRequest, "apply_status must be applied or failed")
+		return
+	}
+	if len(req.ApplyError) > 4096 {
+		req.ApplyError = req.ApplyError[:4096]
+	}
+	updated, err := s.store.RecordEdgeStatus(r.Context(), node.ID, db.EdgeStatusParams{
+		AppliedConfigHash: req.ConfigHash,
+		ApplyStatus:       req.ApplyStatus,
+		ApplyError:        req.ApplyError,
+		AgentVersion:      req.AgentVersion,
+		NginxVersion:      req.NginxVersion,
+		UptimeSeconds:     req.UptimeSeconds,
+		AppliedWGHash:     req.WireGuardHash,
+	}, time.Now())
+	if err != nil {
+		writeStoreError(w, err, "edge node not found")
+		return
 	}
-	return false
+	if req.WireGuardHash != "" {
+		if err := s.advanceWGKeyRotations(r.Context()); err != nil {
+			s.logger.Printf("advance wireguard key rotations: %v", err)
+		}
+	}
+	// Heartbeats repeat the last result; only a new failure is an event.
+	if req.ApplyStatus == db.ApplyStatusFailed && (node.ApplyStatus.String != db.ApplyStatusFailed || node.ApplyError.String != req.ApplyError) {
+		s.publish(r.Context(), events.EdgeApplyFailed, "", map[string]any{
+			"id":          node.ID,
+			"name":        node.Name,
+			"config_hash": req.ConfigHash,
+			"apply_error": req.ApplyError,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"configs_behind": updated.ConfigsBehind,
+	})
 }
 
 func (s *Server) logRequests(next http.Handler) http.Handler {
@@ -292,39 +955,149 @@ func writeError(w http.ResponseWriter, status int, msg string) {
 	writeJSON(w, status, map[string]string{"error": msg})
 }
 
-func validateOrigin(name, wgIP string) error {
+// writeStoreError maps store errors to responses: missing rows become 404,
+// constraint violations 409 and anything else 400.
+func writeStoreError(w http.ResponseWriter, err error, notFound string) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		writeError(w, http.StatusNotFound, notFound)
+	case errors.Is(err, db.ErrTunnelPoolExhausted):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	case isConstraintError(err), errors.Is(err, db.ErrEdgeStateConflict):
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		writeError(w, http.StatusBadRequest, err.Error())
+	}
+}
+
+// patchString overwrites dst when a PATCH body supplied the field.
+func patchString(dst *string, v *string) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+func validateOrigin(name, wgIP, wgEndpoint string) error {
 	if strings.TrimSpace(name) == "" {
 		return errf("name is required")
 	}
-	if wgIP == "" {
-		return errf("wg_ip is required")
+	if wgEndpoint != "" && !validWireguardEndpoint(wgEndpoint) {
+		return errf("wireguard_endpoint must be host:port")
+	}
+	if wgIP == "" || wgIP == tunnelAddrAuto {
+		return nil
 	}
 	if _, err := netip.ParseAddr(wgIP); err != nil {
-		return errf("wg_ip must be a valid IP address")
+		return errf("wg_ip must be a valid IP address or \"auto\"")
 	}
 	return nil
 }
 
-func validateRoute(hostname string, port int, originID string) error {
-	if strings.TrimSpace(hostname) == "" || originID == "" {
+type routeBackendRequest struct {
+	OriginID   string `json:"origin_id"`
+	TargetPort int    `json:"target_port"`
+	Weight     int    `json:"weight"`
+	Backup     bool   `json:"backup"`
+}
+
+func toRouteBackends(in []routeBackendRequest) []db.RouteBackend {
+	out := make([]db.RouteBackend, 0, len(in))
+	for _, b := range in {
+		out = append(out, db.RouteBackend{OriginID: b.OriginID, TargetPort: b.TargetPort, Weight: b.Weight, Backup: b.Backup})
+	}
+	return out
+}
+
+// primaryBackendIndex mirrors the store's notion of the primary backend: the
+// first non-backup entry, else the first entry.
+func primaryBackendIndex(backends []db.RouteBackend) int {
+	for i, b := range backends {
+		if !b.Backup {
+			return i
+		}
+	}
+	return 0
+}
+
+func validateRoute(hostname string, backends []db.RouteBackend) error {
+	if strings.TrimSpace(hostname) == "" || len(backends) == 0 {
 		return errf("hostname and origin_id are required")
 	}
-	if !validHostname(hostname) {
-		return errf("hostname is invalid")
+	if !validHostname(strings.TrimPrefix(hostname, "*.")) {
+		return errf("hostname is invalid (wildcards must be a leading *. label)")
 	}
-	if port < 1 || port > 65535 {
-		return errf("target_port must be between 1 and 65535")
+	for _, b := range backends {
+		if b.OriginID == "" {
+			return errf("hostname and origin_id are required")
+		}
+		if b.TargetPort < 1 || b.TargetPort > 65535 {
+			return errf("target_port must be between 1 and 65535")
+		}
 	}
 	return nil
 }
 
+func validateBalancing(method string, maxFails *int, failTimeout int, backends []db.RouteBackend) error {
+	switch method {
+	case "", db.LBRoundRobin, db.LBLeastConn, db.LBIPHash:
+	default:
+		return errf("lb_method must be one of round_robin, least_conn, ip_hash")
+	}
+	if (maxFails != nil && *maxFails < 0) || failTimeout < 0 {
+		return errf("max_fails and fail_timeout_seconds must not be negative")
+	}
+	active := 0
+	for _, b := range backends {
+		if b.Weight < 0 {
+			return errf("weight must not be negative")
+		}
+		if b.Backup {
+			if method == db.LBIPHash {
+				return errf("backup backends cannot be used with ip_hash")
+			}
+			continue
+		}
+		active++
+	}
+	if active == 0 {
+		return errf("at least one backend must not be a backup")
+	}
+	return nil
+}
+
+// normalizePathPrefix returns the canonical form of a route path prefix: it
+// starts and ends with "/" so that "/api" matches "/api/..." but not "/apix".
+func normalizePathPrefix(p string) (string, error) {
+	if p == "" || p == "/" {
+		return "/", nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return "", errf("path_prefix must start with /")
+	}
+	if !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	for _, seg := range strings.Split(strings.Trim(p, "/"), "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return "", errf("path_prefix must not contain empty, . or .. segments")
+		}
+		for i := 0; i < len(seg); i++ {
+			c := seg[i]
+			if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || strings.IndexByte("-._~%", c) >= 0) {
+				return "", errf("path_prefix contains an unsupported character")
+			}
+		}
+	}
+	return p, nil
+}
+
 func validateEdgeRegister(name, wgAddr, wgEndpoint, wgPeer, wgAllowed string) error {
-	if strings.TrimSpace(name) == "" {
-		return errf("name is required")
+	if !validResourceName(name) {
+		return errf("name must be 1-64 characters of A-Z, a-z, 0-9, '.', '_' or '-'")
 	}
-	if wgAddr != "" {
+	if wgAddr != "" && wgAddr != tunnelAddrAuto {
 		if _, err := netip.ParsePrefix(wgAddr); err != nil {
-			return errf("wg_addr must be CIDR (e.g. 10.0.0.3/32)")
+			return errf("wg_addr must be CIDR (e.g. 10.0.0.3/32) or \"auto\"")
 		}
 	}
 	if wgEndpoint != "" && !strings.Contains(wgEndpoint, ":") {
@@ -341,6 +1114,21 @@ func validateEdgeRegister(name, wgAddr, wgEndpoint, wgPeer, wgAllowed string) er
 	return nil
 }
 
+// validResourceName checks names that machines pick for themselves when they
+// register, which the admin UI later shows.
+func validResourceName(v string) bool {
+	if v == "" || len(v) > 64 {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
 func validHostname(h string) bool {
 	if strings.HasSuffix(h, ".") {
 		h = strings.TrimSuffix(h, ".")
@@ -380,6 +1168,9 @@ func isConstraintError(err error) bool {
 	if err == nil {
 		return false
 	}
+	if errors.Is(err, db.ErrTunnelAddressInUse) {
+		return true
+	}
 	return strings.Contains(strings.ToLower(err.Error()), "constraint failed")
 }
 
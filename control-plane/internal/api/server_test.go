@@ -1,18 +1,31 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+	"github.com/neo/kokoa-proxy/control-plane/internal/generator"
+	"github.com/neo/kokoa-proxy/control-plane/internal/secrets"
+	"github.com/neo/kokoa-proxy/control-plane/internal/signing"
 )
 
+const testAdminKey = "test-admin-key"
+
 func newTestServer(t *testing.T) *Server {
 	t.Helper()
 	path := filepath.Join(t.TempDir(), "test.db")
@@ -24,7 +37,15 @@ func newTestServer(t *testing.T) *Server {
 	if err := store.Migrate(context.Background()); err != nil {
 		t.Fatalf("migrate: %v", err)
 	}
-	return NewServer(ServerConfig{Store: store})
+	if err := store.EnsureAPIKey(context.Background(), db.CreateAPIKeyParams{Name: "admin", KeyPlain: testAdminKey}); err != nil {
+		t.Fatalf("seed api key: %v", err)
+	}
+	box, err := secrets.NewBox(make([]byte, 32))
+	if err != nil {
+		t.Fatalf("new box: %v", err)
+	}
+	store.SetSecrets(box)
+	return NewServer(ServerConfig{Store: store, Secrets: box})
 }
 
 func TestCreateOriginValidation(t *testing.T) {
@@ -32,6 +53,7 @@ func TestCreateOriginValidation(t *testing.T) {
 	body := `{"name":"o1","wg_ip":"not-an-ip"}`
 	req := httptest.NewRequest(http.MethodPost, "/api/v1/origins", strings.NewReader(body))
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", testAdminKey)
 	rec := httptest.NewRecorder()
 
 	srv.Routes().ServeHTTP(rec, req)
@@ -40,6 +62,56 @@ func TestCreateOriginValidation(t *testing.T) {
 	}
 }
 
+func TestOriginPrivateKeyIsSealedAndHidden(t *testing.T) {
+	srv := newTestServer(t)
+	const privateKey = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+
+	rec := doRequest(t, srv, http.MethodPost, "/api/v1/origins", testAdminKey, map[string]any{
+		"name": "o1", "wg_ip": "10.0.0.2", "wireguard_private_key": privateKey,
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create origin: %d %s", rec.Code, rec.Body.String())
+	}
+	var created db.Origin
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decode origin: %v", err)
+	}
+	if !created.HasWireguardPrivateKey {
+		t.Fatal("expected HasWireguardPrivateKey after create")
+	}
+
+	stored, err := srv.store.OriginByID(context.Background(), created.ID)
+	if err != nil {
+		t.Fatalf("load origin: %v", err)
+	}
+	if !strings.HasPrefix(stored.WireguardPrivateKeyEncrypted, "v2:") || strings.Contains(stored.WireguardPrivateKeyEncrypted, privateKey) {
+		t.Fatalf("private key not sealed at rest: %q", stored.WireguardPrivateKeyEncrypted)
+	}
+	if plain, err := srv.store.OriginPrivateKey(context.Background(), created.ID); err != nil || plain != privateKey {
+		t.Fatalf("open private key: %q, %v", plain, err)
+	}
+
+	for _, path := range []string{"/api/v1/origins/list", "/api/v1/origins/" + created.ID} {
+		rec := doRequest(t, srv, http.MethodGet, path, testAdminKey, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d", path, rec.Code)
+		}
+		if strings.Contains(rec.Body.String(), privateKey) || strings.Contains(rec.Body.String(), stored.WireguardPrivateKeyEncrypted) {
+			t.Fatalf("GET %s leaks the private key: %s", path, rec.Body.String())
+		}
+	}
+
+	// A PATCH without the key keeps it; an empty key removes it.
+	rec = doRequest(t, srv, http.MethodPatch, "/api/v1/origins/"+created.ID, testAdminKey, map[string]any{"name": "o1-renamed"})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"HasWireguardPrivateKey":true`) {
+		t.Fatalf("rename origin: %d %s", rec.Code, rec.Body.String())
+	}
+	rec = doRequest(t, srv, http.MethodPatch, "/api/v1/origins/"+created.ID, testAdminKey, map[string]any{"wireguard_private_key": ""})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"HasWireguardPrivateKey":false`) {
+		t.Fatalf("clear private key: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
 func TestCreateRouteValidationAndSuccess(t *testing.T) {
 	srv := newTestServer(t)
 
@@ -55,6 +127,7 @@ func TestCreateRouteValidationAndSuccess(t *testing.T) {
 	badBody := `{"hostname":"app.example.com","origin_id":"` + origin.ID + `","target_port":70000}`
 	req := httptest.NewRequest(http.MethodPost, "/api/v1/routes", strings.NewReader(badBody))
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", testAdminKey)
 	rec := httptest.NewRecorder()
 	srv.Routes().ServeHTTP(rec, req)
 	if rec.Code != http.StatusBadRequest {
@@ -70,9 +143,1975 @@ func TestCreateRouteValidationAndSuccess(t *testing.T) {
 	buf, _ := json.Marshal(good)
 	req2 := httptest.NewRequest(http.MethodPost, "/api/v1/routes", bytes.NewReader(buf))
 	req2.Header.Set("Content-Type", "application/json")
+	req2.Header.Set("X-API-Key", testAdminKey)
 	rec2 := httptest.NewRecorder()
 	srv.Routes().ServeHTTP(rec2, req2)
 	if rec2.Code != http.StatusCreated {
 		t.Fatalf("expected 201, got %d", rec2.Code)
 	}
 }
+
+func TestManagementEndpointsRequireAPIKey(t *testing.T) {
+	srv := newTestServer(t)
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		key    string
+		want   int
+	}{
+		{"create origin without key", http.MethodPost, "/api/v1/origins", "", http.StatusUnauthorized},
+		{"create route with wrong key", http.MethodPost, "/api/v1/routes", "nope", http.StatusUnauthorized},
+		{"list edges without key", http.MethodGet, "/api/v1/edge-nodes/list", "", http.StatusUnauthorized},
+		{"list routes with key", http.MethodGet, "/api/v1/routes/list", testAdminKey, http.StatusOK},
+		{"health stays public", http.MethodGet, "/healthz", "", http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(`{"name":"o1","wg_ip":"10.0.0.2"}`))
+			req.Header.Set("Content-Type", "application/json")
+			if tc.key != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.key)
+			}
+			rec := httptest.NewRecorder()
+			srv.Routes().ServeHTTP(rec, req)
+			if rec.Code != tc.want {
+				t.Fatalf("expected %d, got %d (%s)", tc.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func doRequest(t *testing.T, srv *Server, method, path, key string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader *bytes.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("marshal body: %v", err)
+		}
+		reader = bytes.NewReader(buf)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	rec := httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rec, req)
+	return rec
+}
+
+func adminKeyID(t *testing.T, srv *Server) string {
+	t.Helper()
+	key, err := srv.store.APIKeyByToken(context.Background(), testAdminKey)
+	if err != nil {
+		t.Fatalf("load admin key: %v", err)
+	}
+	return key.ID
+}
+
+func createAPIKey(t *testing.T, srv *Server, body map[string]any) (id, key string) {
+	t.Helper()
+	rec := doRequest(t, srv, http.MethodPost, "/api/v1/api-keys", testAdminKey, body)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create api key: expected 201, got %d (%s)", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		ID  string `json:"id"`
+		Key string `json:"key"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode api key: %v", err)
+	}
+	return resp.ID, resp.Key
+}
+
+func TestAPIKeyRolesAndScopes(t *testing.T) {
+	srv := newTestServer(t)
+	origin, err := srv.store.CreateOrigin(context.Background(), db.CreateOriginParams{Name: "o1", WireguardIP: "10.0.0.2"})
+	if err != nil {
+		t.Fatalf("create origin: %v", err)
+	}
+
+	_, viewer := createAPIKey(t, srv, map[string]any{"name": "ci", "role": "viewer"})
+	if rec := doRequest(t, srv, http.MethodGet, "/api/v1/routes/list", viewer, nil); rec.Code != http.StatusOK {
+		t.Fatalf("viewer list: expected 200, got %d", rec.Code)
+	}
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/origins", viewer, map[string]any{"name": "o2", "wg_ip": "10.0.0.3"}); rec.Code != http.StatusForbidden {
+		t.Fatalf("viewer create origin: expected 403, got %d", rec.Code)
+	}
+
+	_, staging := createAPIKey(t, srv, map[string]any{"name": "staging", "role": "operator", "scopes": []string{"*.staging.example.com"}})
+	route := func(host string) map[string]any {
+		return map[string]any{"hostname": host, "origin_id": origin.ID, "target_port": 8080}
+	}
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/routes", staging, route("app.staging.example.com")); rec.Code != http.StatusCreated {
+		t.Fatalf("scoped create in scope: expected 201, got %d (%s)", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/routes", staging, route("app.example.com")); rec.Code != http.StatusForbidden {
+		t.Fatalf("scoped create out of scope: expected 403, got %d", rec.Code)
+	}
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/origins", staging, map[string]any{"name": "o3", "wg_ip": "10.0.0.4"}); rec.Code != http.StatusForbidden {
+		t.Fatalf("scoped create origin: expected 403, got %d", rec.Code)
+	}
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/routes", testAdminKey, route("www.example.com")); rec.Code != http.StatusCreated {
+		t.Fatalf("admin create: expected 201, got %d", rec.Code)
+	}
+	rec := doRequest(t, srv, http.MethodGet, "/api/v1/routes/list", staging, nil)
+	var routes []db.RouteWithOrigin
+	if err := json.Unmarshal(rec.Body.Bytes(), &routes); err != nil {
+		t.Fatalf("decode routes: %v", err)
+	}
+	if len(routes) != 1 || routes[0].Hostname != "app.staging.example.com" {
+		t.Fatalf("scoped list leaked routes: %+v", routes)
+	}
+}
+
+func TestRevokedAPIKeyIsRejected(t *testing.T) {
+	srv := newTestServer(t)
+	id, key := createAPIKey(t, srv, map[string]any{"name": "temp", "role": "viewer"})
+	if rec := doRequest(t, srv, http.MethodGet, "/api/v1/origins/list", key, nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 before revoke, got %d", rec.Code)
+	}
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/api-keys/"+id+"/revoke", testAdminKey, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("revoke: expected 204, got %d", rec.Code)
+	}
+	if rec := doRequest(t, srv, http.MethodGet, "/api/v1/origins/list", key, nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 after revoke, got %d", rec.Code)
+	}
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/api-keys/"+id+"/revoke", testAdminKey, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("second revoke: expected 404, got %d", rec.Code)
+	}
+}
+
+func TestRouteUpdateAndDelete(t *testing.T) {
+	srv := newTestServer(t)
+	ctx := context.Background()
+	o1, err := srv.store.CreateOrigin(ctx, db.CreateOriginParams{Name: "o1", WireguardIP: "10.0.0.2"})
+	if err != nil {
+		t.Fatalf("create origin: %v", err)
+	}
+	o2, err := srv.store.CreateOrigin(ctx, db.CreateOriginParams{Name: "o2", WireguardIP: "10.0.0.3"})
+	if err != nil {
+		t.Fatalf("create origin: %v", err)
+	}
+	r1, err := srv.store.CreateRoute(ctx, db.CreateRouteParams{Hostname: "a.example.com", OriginID: o1.ID, TargetPort: 8080})
+	if err != nil {
+		t.Fatalf("create route: %v", err)
+	}
+	if _, err := srv.store.CreateRoute(ctx, db.CreateRouteParams{Hostname: "b.example.com", OriginID: o1.ID, TargetPort: 8080}); err != nil {
+		t.Fatalf("create route: %v", err)
+	}
+
+	rec := doRequest(t, srv, http.MethodPatch, "/api/v1/routes/"+r1.ID, testAdminKey, map[string]any{"target_port": 9090, "origin_id": o2.ID})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("patch route: expected 200, got %d (%s)", rec.Code, rec.Body.String())
+	}
+	got, err := srv.store.RouteByID(ctx, r1.ID)
+	if err != nil {
+		t.Fatalf("route by id: %v", err)
+	}
+	if got.TargetPort != 9090 || got.OriginID != o2.ID || got.Hostname != "a.example.com" {
+		t.Fatalf("unexpected route after patch: %+v", got)
+	}
+
+	if rec := doRequest(t, srv, http.MethodPatch, "/api/v1/routes/"+r1.ID, testAdminKey, map[string]any{"hostname": "b.example.com"}); rec.Code != http.StatusConflict {
+		t.Fatalf("duplicate hostname: expected 409, got %d", rec.Code)
+	}
+	if rec := doRequest(t, srv, http.MethodGet, "/api/v1/routes/missing", testAdminKey, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("get missing route: expected 404, got %d", rec.Code)
+	}
+	if rec := doRequest(t, srv, http.MethodPut, "/api/v1/routes/"+r1.ID, testAdminKey, nil); rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("put route: expected 405, got %d", rec.Code)
+	}
+	if rec := doRequest(t, srv, http.MethodDelete, "/api/v1/routes/"+r1.ID, testAdminKey, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete route: expected 204, got %d", rec.Code)
+	}
+	if rec := doRequest(t, srv, http.MethodDelete, "/api/v1/routes/"+r1.ID, testAdminKey, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("delete route twice: expected 404, got %d", rec.Code)
+	}
+
+	if rec := doRequest(t, srv, http.MethodDelete, "/api/v1/origins/"+o1.ID, testAdminKey, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete origin: expected 204, got %d", rec.Code)
+	}
+	routes, err := srv.store.ListRoutes(ctx)
+	if err != nil {
+		t.Fatalf("list routes: %v", err)
+	}
+	if len(routes) != 0 {
+		t.Fatalf("expected routes of deleted origin to cascade, got %+v", routes)
+	}
+}
+
+func TestDeleteEdgeNodeInvalidatesToken(t *testing.T) {
+	srv := newTestServer(t)
+	node, err := srv.store.RegisterEdgeNode(context.Background(), db.RegisterEdgeNodeParams{TokenPlain: "edge-token", Name: "edge-1"})
+	if err != nil {
+		t.Fatalf("register edge: %v", err)
+	}
+	rec := doRequest(t, srv, http.MethodPatch, "/api/v1/edge-nodes/"+node.ID, testAdminKey, map[string]any{"name": "edge-renamed"})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "edge-renamed") {
+		t.Fatalf("rename edge: got %d (%s)", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(t, srv, http.MethodDelete, "/api/v1/edge-nodes/"+node.ID, testAdminKey, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete edge: expected 204, got %d", rec.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/edge-nodes/me/config", nil)
+	req.Header.Set("Authorization", "Bearer edge-token")
+	rec = httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("config after delete: expected 401, got %d", rec.Code)
+	}
+}
+
+func TestV2Representations(t *testing.T) {
+	srv := newTestServer(t)
+	ctx := context.Background()
+	if _, err := srv.store.RegisterEdgeNode(ctx, db.RegisterEdgeNodeParams{TokenPlain: "edge-token", Name: "edge-1"}); err != nil {
+		t.Fatalf("register edge: %v", err)
+	}
+
+	rec := doRequest(t, srv, http.MethodPost, "/api/v2/origins", testAdminKey, map[string]any{"name": "o1", "wg_ip": "10.0.0.2"})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create origin: %d %s", rec.Code, rec.Body.String())
+	}
+	var origin map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &origin); err != nil {
+		t.Fatalf("decode origin: %v", err)
+	}
+	if origin["id"] == nil || origin["wg_ip"] != "10.0.0.2" || origin["wireguard_public_key"] != nil || origin["has_wireguard_private_key"] != false {
+		t.Fatalf("unexpected v2 origin %v", origin)
+	}
+	if _, ok := origin["ID"]; ok {
+		t.Fatalf("v2 origin has Go-cased keys: %v", origin)
+	}
+
+	rec = doRequest(t, srv, http.MethodPost, "/api/v2/routes", testAdminKey, map[string]any{
+		"hostname": "app.example.com", "origin_id": origin["id"], "target_port": 8080,
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create route: %d %s", rec.Code, rec.Body.String())
+	}
+	var route struct {
+		ID       string `json:"id"`
+		Backends []struct {
+			OriginName  string `json:"origin_name"`
+			WireguardIP string `json:"wg_ip"`
+		} `json:"backends"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &route); err != nil {
+		t.Fatalf("decode route: %v", err)
+	}
+	if route.ID == "" || len(route.Backends) != 1 || route.Backends[0].OriginName != "o1" || route.Backends[0].WireguardIP != "10.0.0.2" {
+		t.Fatalf("unexpected v2 route %s", rec.Body.String())
+	}
+
+	rec = doRequest(t, srv, http.MethodGet, "/api/v2/edge-nodes/list", testAdminKey, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("list edges: %d", rec.Code)
+	}
+	var edges []map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &edges); err != nil {
+		t.Fatalf("decode edges: %v", err)
+	}
+	if len(edges) != 1 || edges[0]["name"] != "edge-1" || edges[0]["last_seen"] != nil || edges[0]["wg_addr"] != nil {
+		t.Fatalf("unexpected v2 edges %s", rec.Body.String())
+	}
+	status, _ := edges[0]["status"].(map[string]any)
+	if status == nil || status["configs_behind"] != nil || status["apply_status"] != nil {
+		t.Fatalf("unexpected v2 edge status %s", rec.Body.String())
+	}
+	for _, leak := range []string{"TokenHash", "token_hash", `"Valid"`} {
+		if strings.Contains(rec.Body.String(), leak) {
+			t.Fatalf("v2 edge list leaks %s: %s", leak, rec.Body.String())
+		}
+	}
+
+	// Empty lists are [] rather than null.
+	if rec := doRequest(t, srv, http.MethodGet, "/api/v2/webhooks/list", testAdminKey, nil); strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Fatalf("empty v2 list: %q", rec.Body.String())
+	}
+
+	// v1 keeps its shape, minus the token hash.
+	rec = doRequest(t, srv, http.MethodGet, "/api/v1/edge-nodes/list", testAdminKey, nil)
+	if !strings.Contains(rec.Body.String(), `"ID"`) || strings.Contains(rec.Body.String(), "TokenHash") {
+		t.Fatalf("unexpected v1 edge list %s", rec.Body.String())
+	}
+}
+
+func TestPathPrefixRoutesShareHostname(t *testing.T) {
+	srv := newTestServer(t)
+	origin, err := srv.store.CreateOrigin(context.Background(), db.CreateOriginParams{Name: "o1", WireguardIP: "10.0.0.2"})
+	if err != nil {
+		t.Fatalf("create origin: %v", err)
+	}
+	route := func(prefix string) map[string]any {
+		return map[string]any{"hostname": "example.com", "path_prefix": prefix, "origin_id": origin.ID, "target_port": 8080}
+	}
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/routes", testAdminKey, route("")); rec.Code != http.StatusCreated {
+		t.Fatalf("root route: expected 201, got %d (%s)", rec.Code, rec.Body.String())
+	}
+	rec := doRequest(t, srv, http.MethodPost, "/api/v1/routes", testAdminKey, route("/api"))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("api route: expected 201, got %d (%s)", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), `"PathPrefix":"/api/"`) {
+		t.Fatalf("expected normalized prefix, got %s", rec.Body.String())
+	}
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/routes", testAdminKey, route("/api/")); rec.Code != http.StatusConflict {
+		t.Fatalf("duplicate prefix: expected 409, got %d", rec.Code)
+	}
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/routes", testAdminKey, route("/../etc")); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid prefix: expected 400, got %d", rec.Code)
+	}
+}
+
+func TestWildcardRouteValidation(t *testing.T) {
+	srv := newTestServer(t)
+	origin, err := srv.store.CreateOrigin(context.Background(), db.CreateOriginParams{Name: "o1", WireguardIP: "10.0.0.2"})
+	if err != nil {
+		t.Fatalf("create origin: %v", err)
+	}
+	cases := map[string]int{
+		"*.dev.example.com":   http.StatusCreated,
+		"dev.example.com":     http.StatusCreated,
+		"*.*.example.com":     http.StatusBadRequest,
+		"api.*.example.com":   http.StatusBadRequest,
+		"*.com":               http.StatusBadRequest,
+		"*":                   http.StatusBadRequest,
+		"*.dev.example.com.x": http.StatusCreated,
+	}
+	for host, want := range cases {
+		rec := doRequest(t, srv, http.MethodPost, "/api/v1/routes", testAdminKey, map[string]any{"hostname": host, "origin_id": origin.ID, "target_port": 8080})
+		if rec.Code != want {
+			t.Fatalf("%s: expected %d, got %d (%s)", host, want, rec.Code, rec.Body.String())
+		}
+	}
+	routes, err := srv.store.ListRoutes(context.Background())
+	if err != nil {
+		t.Fatalf("list routes: %v", err)
+	}
+	for _, r := range routes {
+		if r.Wildcard != strings.HasPrefix(r.Hostname, "*.") {
+			t.Fatalf("wildcard not stored for %s", r.Hostname)
+		}
+	}
+}
+
+func TestRouteBackends(t *testing.T) {
+	srv := newTestServer(t)
+	ctx := context.Background()
+	primary, err := srv.store.CreateOrigin(ctx, db.CreateOriginParams{Name: "o1", WireguardIP: "10.0.0.2"})
+	if err != nil {
+		t.Fatalf("create origin: %v", err)
+	}
+	standby, err := srv.store.CreateOrigin(ctx, db.CreateOriginParams{Name: "o2", WireguardIP: "10.0.0.3"})
+	if err != nil {
+		t.Fatalf("create origin: %v", err)
+	}
+
+	rec := doRequest(t, srv, http.MethodPost, "/api/v1/routes", testAdminKey, map[string]any{
+		"hostname":  "app.example.com",
+		"lb_method": "ip_hash",
+		"backends": []map[string]any{
+			{"origin_id": primary.ID, "target_port": 8080},
+			{"origin_id": standby.ID, "target_port": 8080, "backup": true},
+		},
+	})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("ip_hash with backup: expected 400, got %d", rec.Code)
+	}
+
+	rec = doRequest(t, srv, http.MethodPost, "/api/v1/routes", testAdminKey, map[string]any{
+		"hostname": "app.example.com",
+		"backends": []map[string]any{
+			{"origin_id": primary.ID, "target_port": 8080, "weight": 3},
+			{"origin_id": standby.ID, "target_port": 8080, "backup": true},
+		},
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create route: expected 201, got %d (%s)", rec.Code, rec.Body.String())
+	}
+	var route db.Route
+	if err := json.Unmarshal(rec.Body.Bytes(), &route); err != nil {
+		t.Fatalf("decode route: %v", err)
+	}
+	if route.OriginID != primary.ID || len(route.Backends) != 2 {
+		t.Fatalf("unexpected route: %+v", route)
+	}
+	if route.MaxFails == nil || *route.MaxFails != 1 {
+		t.Fatalf("max_fails should default to 1: %v", route.MaxFails)
+	}
+	rec = doRequest(t, srv, http.MethodPatch, "/api/v1/routes/"+route.ID, testAdminKey, map[string]any{"max_fails": 0})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("set max_fails=0: expected 200, got %d (%s)", rec.Code, rec.Body.String())
+	}
+	if got, err := srv.store.RouteByID(ctx, route.ID); err != nil || got.MaxFails == nil || *got.MaxFails != 0 {
+		t.Fatalf("max_fails=0 not stored: %+v (%v)", got, err)
+	}
+
+	// Deleting the primary origin keeps the route alive on its backup, which
+	// becomes a regular backend: nginx refuses an upstream of backups only.
+	if err := srv.store.DeleteOrigin(ctx, primary.ID); err != nil {
+		t.Fatalf("delete origin: %v", err)
+	}
+	got, err := srv.store.RouteByID(ctx, route.ID)
+	if err != nil {
+		t.Fatalf("route lookup: %v", err)
+	}
+	if len(got.Backends) != 1 || got.OriginID != standby.ID || got.Backends[0].Backup {
+		t.Fatalf("unexpected backends after delete: %+v", got.Backends)
+	}
+	routes, err := srv.store.ListRoutes(ctx)
+	if err != nil {
+		t.Fatalf("list routes: %v", err)
+	}
+	if upstreams := generator.BuildConfig(routes).Upstreams; strings.Contains(upstreams, "backup") {
+		t.Fatalf("upstream still lists only backups:\n%s", upstreams)
+	}
+}
+
+func TestEdgeCertificates(t *testing.T) {
+	srv := newTestServer(t)
+	_, key, _ := ed25519.GenerateKey(nil)
+	srv.signer = signing.NewSigner(key)
+	ctx := context.Background()
+	origin, err := srv.store.CreateOrigin(ctx, db.CreateOriginParams{Name: "o1", WireguardIP: "10.0.0.2"})
+	if err != nil {
+		t.Fatalf("create origin: %v", err)
+	}
+	routeIDs := make(map[string]string)
+	for _, host := range []string{"app.example.com", "*.dev.example.com"} {
+		route, err := srv.store.CreateRoute(ctx, db.CreateRouteParams{Hostname: host, OriginID: origin.ID, TargetPort: 8080})
+		if err != nil {
+			t.Fatalf("create route: %v", err)
+		}
+		routeIDs[host] = route.ID
+	}
+	node, err := srv.store.RegisterEdgeNode(ctx, db.RegisterEdgeNodeParams{TokenPlain: "edge-token", Name: "edge1"})
+	if err != nil {
+		t.Fatalf("register edge: %v", err)
+	}
+	sealed, err := srv.secrets.Seal([]byte("KEY"))
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	for _, host := range []string{"*.dev.example.com", "old.example.com"} {
+		if err := srv.store.SaveCertificate(ctx, db.SaveCertificateParams{Hostname: host, CertPEM: "CERT", KeyEncrypted: sealed, NotAfter: time.Now().Add(time.Hour), IssuedAt: time.Now()}); err != nil {
+			t.Fatalf("save certificate: %v", err)
+		}
+	}
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		srv.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := get("/api/v1/edge-nodes/me/certificates", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rec.Code)
+	}
+	rec := get("/api/v1/edge-nodes/me/certificates", "edge-token")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (%s)", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		EdgeID           string            `json:"edge_id"`
+		IssuedAt         int64             `json:"issued_at"`
+		CertificatesHash string            `json:"certificates_hash"`
+		Certificates     []edgeCertificate `json:"certificates"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.EdgeID != node.ID || resp.IssuedAt == 0 {
+		t.Fatalf("unexpected signed fields: %+v", resp)
+	}
+	sig, err := base64.StdEncoding.DecodeString(rec.Header().Get("X-Kokoa-Signature"))
+	if err != nil {
+		t.Fatalf("decode signature: %v", err)
+	}
+	pub := key.Public().(ed25519.PublicKey)
+	if !ed25519.Verify(pub, signing.CertificatesMessage(node.ID, resp.CertificatesHash, resp.IssuedAt, rec.Body.Bytes()), sig) {
+		t.Fatal("signature does not verify over the certificates response")
+	}
+	swapped := bytes.Replace(rec.Body.Bytes(), []byte(`"privkey_pem":"KEY"`), []byte(`"privkey_pem":"EVIL"`), 1)
+	if ed25519.Verify(pub, signing.CertificatesMessage(node.ID, resp.CertificatesHash, resp.IssuedAt, swapped), sig) {
+		t.Fatal("signature verified for a swapped key")
+	}
+	// Only hostnames with a route are handed out; app.example.com has no cert yet.
+	if len(resp.Certificates) != 1 || resp.Certificates[0].Dir != "_wildcard.dev.example.com" || resp.Certificates[0].PrivkeyPEM != "KEY" {
+		t.Fatalf("unexpected certificates: %+v", resp.Certificates)
+	}
+
+	var config map[string]any
+	if err := json.Unmarshal(get("/api/v1/edge-nodes/me/config", "edge-token").Body.Bytes(), &config); err != nil {
+		t.Fatalf("decode config: %v", err)
+	}
+	if config["certificates_hash"] != resp.CertificatesHash {
+		t.Fatalf("config and certificates endpoints disagree on hash: %v vs %s", config["certificates_hash"], resp.CertificatesHash)
+	}
+
+	// Removing the last route of a hostname drops its certificate and key.
+	if rec := doRequest(t, srv, http.MethodDelete, "/api/v1/routes/"+routeIDs["*.dev.example.com"], testAdminKey, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete route: expected 204, got %d (%s)", rec.Code, rec.Body.String())
+	}
+	if _, err := srv.store.CertificateByHostname(ctx, "*.dev.example.com"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("certificate of a removed hostname kept: %v", err)
+	}
+	rec = get("/api/v1/edge-nodes/me/certificates", "edge-token")
+	resp.Certificates = nil
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if rec.Code != http.StatusOK || len(resp.Certificates) != 0 {
+		t.Fatalf("removed hostname still served: %d %+v", rec.Code, resp.Certificates)
+	}
+	if err := srv.store.SaveCertificate(ctx, db.SaveCertificateParams{Hostname: "app.example.com", CertPEM: "CERT", KeyEncrypted: sealed, NotAfter: time.Now().Add(time.Hour), IssuedAt: time.Now()}); err != nil {
+		t.Fatalf("save certificate: %v", err)
+	}
+	if rec := doRequest(t, srv, http.MethodPatch, "/api/v1/routes/"+routeIDs["app.example.com"], testAdminKey, map[string]any{"hostname": "api.example.com"}); rec.Code != http.StatusOK {
+		t.Fatalf("rename route: expected 200, got %d (%s)", rec.Code, rec.Body.String())
+	}
+	if _, err := srv.store.CertificateByHostname(ctx, "app.example.com"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("certificate of a renamed hostname kept: %v", err)
+	}
+}
+
+func TestEdgeStatusReportsDrift(t *testing.T) {
+	srv := newTestServer(t)
+	ctx := context.Background()
+	origin, err := srv.store.CreateOrigin(ctx, db.CreateOriginParams{Name: "o1", WireguardIP: "10.0.0.2"})
+	if err != nil {
+		t.Fatalf("create origin: %v", err)
+	}
+	if _, err := srv.store.RegisterEdgeNode(ctx, db.RegisterEdgeNodeParams{TokenPlain: "edge-token", Name: "edge1"}); err != nil {
+		t.Fatalf("register edge: %v", err)
+	}
+	edgeRequest := func(method, path string, body any) *httptest.ResponseRecorder {
+		buf, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewReader(buf))
+		req.Header.Set("Authorization", "Bearer edge-token")
+		rec := httptest.NewRecorder()
+		srv.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+	onlyEdge := func() db.EdgeNode {
+		t.Helper()
+		var nodes []db.EdgeNode
+		rec := doRequest(t, srv, http.MethodGet, "/api/v1/edge-nodes/list", testAdminKey, nil)
+		if err := json.Unmarshal(rec.Body.Bytes(), &nodes); err != nil || len(nodes) != 1 {
+			t.Fatalf("list edges: %v (%s)", err, rec.Body.String())
+		}
+		return nodes[0]
+	}
+	// Routes created through the API record a generation right away.
+	addRoute := func(host string) {
+		t.Helper()
+		rec := doRequest(t, srv, http.MethodPost, "/api/v1/routes", testAdminKey, map[string]any{"hostname": host, "origin_id": origin.ID, "target_port": 8080})
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("create route: %d %s", rec.Code, rec.Body.String())
+		}
+	}
+
+	if node := onlyEdge(); node.ConfigsBehind != -1 {
+		t.Fatalf("edge that never reported should have unknown drift, got %d", node.ConfigsBehind)
+	}
+
+	addRoute("a.example.com")
+	var config struct {
+		ConfigHash string `json:"config_hash"`
+	}
+	if err := json.Unmarshal(edgeRequest(http.MethodGet, "/api/v1/edge-nodes/me/config", nil).Body.Bytes(), &config); err != nil {
+		t.Fatalf("decode config: %v", err)
+	}
+	rec := edgeRequest(http.MethodPost, "/api/v1/edge-nodes/me/status", map[string]any{
+		"config_hash": config.ConfigHash, "apply_status": "applied", "agent_version": "0.3.0", "nginx_version": "1.24.0", "uptime_seconds": 42,
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status: expected 200, got %d (%s)", rec.Code, rec.Body.String())
+	}
+	if node := onlyEdge(); node.ConfigsBehind != 0 || node.AgentVersion.String != "0.3.0" || node.UptimeSeconds.Int64 != 42 {
+		t.Fatalf("unexpected node after applying: %+v", node)
+	}
+
+	addRoute("b.example.com")
+	addRoute("c.example.com")
+	if node := onlyEdge(); node.ConfigsBehind != 2 {
+		t.Fatalf("expected edge to be 2 configs behind, got %d", node.ConfigsBehind)
+	}
+	// A change no snapshot has recorded yet counts without the list
+	// recording it.
+	if _, err := srv.store.CreateRoute(ctx, db.CreateRouteParams{Hostname: "d.example.com", OriginID: origin.ID, TargetPort: 8080}); err != nil {
+		t.Fatalf("create route: %v", err)
+	}
+	latest, err := srv.store.LatestConfigHash(ctx)
+	if err != nil {
+		t.Fatalf("latest config hash: %v", err)
+	}
+	if node := onlyEdge(); node.ConfigsBehind != 3 {
+		t.Fatalf("expected edge to be 3 configs behind, got %d", node.ConfigsBehind)
+	}
+	if after, _ := srv.store.LatestConfigHash(ctx); after != latest {
+		t.Fatal("listing edges recorded a config generation")
+	}
+
+	rec = edgeRequest(http.MethodPost, "/api/v1/edge-nodes/me/status", map[string]any{
+		"config_hash": config.ConfigHash, "apply_status": "failed", "apply_error": "nginx: [emerg] unknown directive",
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status: expected 200, got %d", rec.Code)
+	}
+	if node := onlyEdge(); node.ApplyStatus.String != db.ApplyStatusFailed || node.ApplyError.String == "" || node.ConfigsBehind != 3 {
+		t.Fatalf("failure not recorded: %+v", node)
+	}
+	// Heartbeats without a field keep the last reported value.
+	if rec := edgeRequest(http.MethodPost, "/api/v1/edge-nodes/me/status", map[string]any{}); rec.Code != http.StatusOK {
+		t.Fatalf("empty status: expected 200, got %d", rec.Code)
+	}
+	if node := onlyEdge(); node.ApplyError.String == "" || node.AppliedConfigHash.String != config.ConfigHash || node.AgentVersion.String != "0.3.0" || node.UptimeSeconds.Int64 != 42 {
+		t.Fatalf("empty heartbeat cleared the status: %+v", node)
+	}
+	// A successful apply clears the previous error.
+	if rec := edgeRequest(http.MethodPost, "/api/v1/edge-nodes/me/status", map[string]any{"config_hash": config.ConfigHash, "apply_status": "applied"}); rec.Code != http.StatusOK {
+		t.Fatalf("status: expected 200, got %d", rec.Code)
+	}
+	if node := onlyEdge(); node.ApplyStatus.String != db.ApplyStatusApplied || node.ApplyError.Valid {
+		t.Fatalf("apply error not cleared: %+v", node)
+	}
+	if rec := edgeRequest(http.MethodPost, "/api/v1/edge-nodes/me/status", map[string]any{"apply_status": "bogus"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown apply_status, got %d", rec.Code)
+	}
+}
+
+func TestRoutePlacement(t *testing.T) {
+	srv := newTestServer(t)
+	ctx := context.Background()
+	origin, err := srv.store.CreateOrigin(ctx, db.CreateOriginParams{Name: "o1", WireguardIP: "10.0.0.2"})
+	if err != nil {
+		t.Fatalf("create origin: %v", err)
+	}
+	tokyo, err := srv.store.RegisterEdgeNode(ctx, db.RegisterEdgeNodeParams{TokenPlain: "tokyo-token", Name: "tokyo",
+		GroupName: "jp", Labels: map[string]string{"tier": "premium"}})
+	if err != nil {
+		t.Fatalf("register edge: %v", err)
+	}
+	osaka, err := srv.store.RegisterEdgeNode(ctx, db.RegisterEdgeNodeParams{TokenPlain: "osaka-token", Name: "osaka", GroupName: "jp"})
+	if err != nil {
+		t.Fatalf("register edge: %v", err)
+	}
+	type edgeConfig struct {
+		ConfigHash string   `json:"config_hash"`
+		Hostnames  []string `json:"hostnames"`
+	}
+	fetch := func(token string) edgeConfig {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/edge-nodes/me/config", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		srv.Routes().ServeHTTP(rec, req)
+		var config edgeConfig
+		if err := json.Unmarshal(rec.Body.Bytes(), &config); err != nil {
+			t.Fatalf("decode config: %v (%s)", err, rec.Body.String())
+		}
+		return config
+	}
+	createRoute := func(host string, placement any) string {
+		t.Helper()
+		rec := doRequest(t, srv, http.MethodPost, "/api/v2/routes", testAdminKey, map[string]any{
+			"hostname": host, "origin_id": origin.ID, "target_port": 8080, "placement": placement,
+		})
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("create route %s: expected 201, got %d (%s)", host, rec.Code, rec.Body.String())
+		}
+		var route struct {
+			ID string `json:"id"`
+		}
+		_ = json.Unmarshal(rec.Body.Bytes(), &route)
+		return route.ID
+	}
+
+	createRoute("all.example.com", nil)
+	premium := createRoute("premium.example.com", map[string]any{"labels": map[string]string{"tier": "premium"}})
+	createRoute("jp.example.com", map[string]any{"groups": []string{"jp"}})
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v2/routes", testAdminKey, map[string]any{
+		"hostname": "bad.example.com", "origin_id": origin.ID, "target_port": 8080, "placement": map[string]any{"groups": []string{"JP!"}},
+	}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid placement group, got %d", rec.Code)
+	}
+
+	if got := fetch("tokyo-token").Hostnames; strings.Join(got, ",") != "all.example.com,jp.example.com,premium.example.com" {
+		t.Fatalf("tokyo hostnames: %v", got)
+	}
+	osakaConfig := fetch("osaka-token")
+	if got := osakaConfig.Hostnames; strings.Join(got, ",") != "all.example.com,jp.example.com" {
+		t.Fatalf("osaka hostnames: %v", got)
+	}
+
+	rec := doRequest(t, srv, http.MethodGet, "/api/v2/routes/"+premium, testAdminKey, nil)
+	var route struct {
+		Placement *struct {
+			Groups []string          `json:"groups"`
+			Labels map[string]string `json:"labels"`
+		} `json:"placement"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &route); err != nil || route.Placement == nil || route.Placement.Labels["tier"] != "premium" {
+		t.Fatalf("unexpected placement: %s", rec.Body.String())
+	}
+
+	// Both edges applied their own config and are in sync.
+	for token, config := range map[string]edgeConfig{"tokyo-token": fetch("tokyo-token"), "osaka-token": osakaConfig} {
+		buf, _ := json.Marshal(map[string]any{"config_hash": config.ConfigHash, "apply_status": "applied"})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/edge-nodes/me/status", bytes.NewReader(buf))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		srv.Routes().ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status: expected 200, got %d (%s)", rec.Code, rec.Body.String())
+		}
+	}
+	behind := func(id string) int {
+		t.Helper()
+		if _, err := srv.edgeSnapshot(ctx); err != nil {
+			t.Fatalf("snapshot: %v", err)
+		}
+		node, err := srv.store.EdgeNodeByID(ctx, id)
+		if err != nil {
+			t.Fatalf("load edge: %v", err)
+		}
+		return node.ConfigsBehind
+	}
+	if behind(tokyo.ID) != 0 || behind(osaka.ID) != 0 {
+		t.Fatalf("edges should be in sync with their placed configs")
+	}
+
+	// Placing the premium route on every edge only changes osaka's config.
+	if rec := doRequest(t, srv, http.MethodPatch, "/api/v2/routes/"+premium, testAdminKey, map[string]any{"placement": map[string]any{}}); rec.Code != http.StatusOK {
+		t.Fatalf("clear placement: expected 200, got %d (%s)", rec.Code, rec.Body.String())
+	}
+	if behind(tokyo.ID) != 0 || behind(osaka.ID) != 1 {
+		t.Fatalf("expected only osaka to be behind, got tokyo=%d osaka=%d", behind(tokyo.ID), behind(osaka.ID))
+	}
+	if got := fetch("osaka-token").Hostnames; len(got) != 3 {
+		t.Fatalf("osaka hostnames after clearing placement: %v", got)
+	}
+}
+
+func TestEdgeTokenRotationAndRevocation(t *testing.T) {
+	srv := newTestServer(t)
+	ctx := context.Background()
+	node, err := srv.store.RegisterEdgeNode(ctx, db.RegisterEdgeNodeParams{TokenPlain: "edge-token", Name: "edge1"})
+	if err != nil {
+		t.Fatalf("register edge: %v", err)
+	}
+	edgeRequest := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		srv.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+	rotate := func(body map[string]any) string {
+		t.Helper()
+		rec := doRequest(t, srv, http.MethodPost, "/api/v1/edge-nodes/"+node.ID+"/rotate-token", testAdminKey, body)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("rotate: %d %s", rec.Code, rec.Body.String())
+		}
+		var resp struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Token == "" {
+			t.Fatalf("decode rotate response: %v (%s)", err, rec.Body.String())
+		}
+		return resp.Token
+	}
+
+	// Rotation keeps the old token working during the grace window, but it
+	// can no longer renew itself.
+	second := rotate(map[string]any{"grace_seconds": 600, "ttl_seconds": 3600})
+	for _, token := range []string{"edge-token", second} {
+		if rec := edgeRequest(http.MethodGet, "/api/v1/edge-nodes/me/config", token); rec.Code != http.StatusOK {
+			t.Fatalf("config with %s during grace: %d", token, rec.Code)
+		}
+	}
+	if rec := edgeRequest(http.MethodPost, "/api/v1/edge-nodes/me/token", "edge-token"); rec.Code != http.StatusForbidden {
+		t.Fatalf("renew with previous token: expected 403, got %d", rec.Code)
+	}
+	rec := edgeRequest(http.MethodGet, "/api/v1/edge-nodes/me/config", second)
+	if rec.Header().Get("X-Kokoa-Token-Expires-At") == "" || rec.Header().Get("X-Kokoa-Token-Renew") != "" {
+		t.Fatalf("unexpected token headers %v", rec.Header())
+	}
+
+	// Self-renewal keeps the lifetime and briefly honours the renewed token.
+	rec = edgeRequest(http.MethodPost, "/api/v1/edge-nodes/me/token", second)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("renew: %d %s", rec.Code, rec.Body.String())
+	}
+	var renewed struct {
+		Token          string    `json:"token"`
+		TokenExpiresAt time.Time `json:"token_expires_at"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &renewed); err != nil {
+		t.Fatalf("decode renew response: %v", err)
+	}
+	if d := time.Until(renewed.TokenExpiresAt); d < 59*time.Minute || d > time.Hour {
+		t.Fatalf("renewed token should live an hour, expires in %s", d)
+	}
+	if rec := edgeRequest(http.MethodGet, "/api/v1/edge-nodes/me/config", second); rec.Code != http.StatusOK {
+		t.Fatalf("renewed token within grace: %d", rec.Code)
+	}
+	if rec := edgeRequest(http.MethodGet, "/api/v1/edge-nodes/me/config", "edge-token"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("token from two rotations ago: expected 401, got %d", rec.Code)
+	}
+	if _, err := srv.store.EdgeNodeByToken(ctx, renewed.Token, time.Now().Add(2*time.Hour)); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expired token should not authenticate, got %v", err)
+	}
+
+	// Rotating without grace cuts the old token off at once.
+	third := rotate(map[string]any{"grace_seconds": 0})
+	if rec := edgeRequest(http.MethodGet, "/api/v1/edge-nodes/me/config", renewed.Token); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("token rotated without grace: expected 401, got %d", rec.Code)
+	}
+
+	// Revocation also ends a long poll that is already waiting.
+	etag := edgeRequest(http.MethodGet, "/api/v1/edge-nodes/me/config", third).Header().Get("ETag")
+	done := make(chan int, 1)
+	go func() {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/edge-nodes/me/config?wait=30s", nil)
+		req.Header.Set("Authorization", "Bearer "+third)
+		req.Header.Set("If-None-Match", etag)
+		rec := httptest.NewRecorder()
+		srv.Routes().ServeHTTP(rec, req)
+		done <- rec.Code
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/edge-nodes/"+node.ID+"/revoke", testAdminKey, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("revoke: %d %s", rec.Code, rec.Body.String())
+	}
+	select {
+	case code := <-done:
+		if code != http.StatusUnauthorized {
+			t.Fatalf("long poll after revoke: expected 401, got %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("long poll did not end on revocation")
+	}
+	if rec := edgeRequest(http.MethodGet, "/api/v1/edge-nodes/me/config", third); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("revoked token: expected 401, got %d", rec.Code)
+	}
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/edge-nodes/"+node.ID+"/revoke", testAdminKey, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("second revoke: expected 404, got %d", rec.Code)
+	}
+
+	rec = doRequest(t, srv, http.MethodGet, "/api/v2/audit-log?target_id="+node.ID, testAdminKey, nil)
+	var entries []struct {
+		Actor  string `json:"actor"`
+		Action string `json:"action"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("decode audit log: %v (%s)", err, rec.Body.String())
+	}
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+	}
+	want := []string{"edge.token_revoked", "edge.token_rotated", "edge.token_renewed", "edge.token_rotated"}
+	if strings.Join(actions, ",") != strings.Join(want, ",") {
+		t.Fatalf("audit actions = %v, want %v", actions, want)
+	}
+	if entries[0].Actor != "api_key:"+adminKeyID(t, srv) || entries[2].Actor != "edge:"+node.ID {
+		t.Fatalf("unexpected audit actors %+v", entries)
+	}
+}
+
+func TestTokenRenewHeader(t *testing.T) {
+	issued := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	node := db.EdgeNode{
+		TokenIssuedAt:  sql.NullTime{Time: issued, Valid: true},
+		TokenExpiresAt: sql.NullTime{Time: issued.Add(3 * time.Hour), Valid: true},
+	}
+	for _, tc := range []struct {
+		at    time.Duration
+		renew bool
+	}{{time.Hour, false}, {2*time.Hour - time.Second, false}, {2 * time.Hour, true}} {
+		rec := httptest.NewRecorder()
+		setTokenHeaders(rec, node, issued.Add(tc.at))
+		if got := rec.Header().Get("X-Kokoa-Token-Renew") == "true"; got != tc.renew {
+			t.Fatalf("renew header after %s = %v, want %v", tc.at, got, tc.renew)
+		}
+	}
+}
+
+func TestJoinTokens(t *testing.T) {
+	srv := newTestServer(t)
+	createToken := func(body map[string]any) (id, token string) {
+		t.Helper()
+		rec := doRequest(t, srv, http.MethodPost, "/api/v1/join-tokens", testAdminKey, body)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("create join token: %d %s", rec.Code, rec.Body.String())
+		}
+		var resp struct {
+			ID    string `json:"id"`
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode join token: %v", err)
+		}
+		return resp.ID, resp.Token
+	}
+	register := func(token, name string) *httptest.ResponseRecorder {
+		buf, _ := json.Marshal(map[string]string{"name": name})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/edge-nodes/register", bytes.NewReader(buf))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		srv.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/join-tokens", testAdminKey, map[string]any{"labels": map[string]string{"Bad Key": "x"}}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid label: expected 400, got %d", rec.Code)
+	}
+
+	id, token := createToken(map[string]any{"max_uses": 2, "group": "tokyo", "labels": map[string]string{"region": "ap-northeast-1"}})
+	for _, name := range []string{"edge-a", "edge-b"} {
+		if rec := register(token, name); rec.Code != http.StatusCreated {
+			t.Fatalf("register %s: %d %s", name, rec.Code, rec.Body.String())
+		}
+	}
+	if rec := register(token, "edge-c"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("exhausted token: expected 401, got %d", rec.Code)
+	}
+	if rec := register(db.JoinTokenPrefix+id+".wrong-secret", "edge-d"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong secret: expected 401, got %d", rec.Code)
+	}
+	if rec := register("no-bootstrap-token-configured", "edge-e"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("static token without CP_BOOTSTRAP_TOKEN: expected 401, got %d", rec.Code)
+	}
+
+	rec := doRequest(t, srv, http.MethodGet, "/api/v2/join-tokens/"+id, testAdminKey, nil)
+	var listed struct {
+		Uses      int `json:"uses"`
+		Consumers []struct {
+			EdgeNodeID string `json:"edge_node_id"`
+			EdgeName   string `json:"edge_name"`
+		} `json:"consumers"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &listed); err != nil {
+		t.Fatalf("decode join token: %v (%s)", err, rec.Body.String())
+	}
+	if listed.Uses != 2 || len(listed.Consumers) != 2 || listed.Consumers[0].EdgeName != "edge-a" {
+		t.Fatalf("unexpected consumers: %s", rec.Body.String())
+	}
+	rec = doRequest(t, srv, http.MethodGet, "/api/v2/edge-nodes/"+listed.Consumers[0].EdgeNodeID, testAdminKey, nil)
+	var edge struct {
+		Group       string            `json:"group"`
+		Labels      map[string]string `json:"labels"`
+		JoinTokenID string            `json:"join_token_id"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &edge); err != nil {
+		t.Fatalf("decode edge: %v", err)
+	}
+	if edge.Group != "tokyo" || edge.Labels["region"] != "ap-northeast-1" || edge.JoinTokenID != id {
+		t.Fatalf("edge did not inherit the join token's grouping: %s", rec.Body.String())
+	}
+
+	// A pre-assigned name wins over the agent's; revoked tokens are refused.
+	_, pinned := createToken(map[string]any{"edge_name": "pinned"})
+	rec = register(pinned, "hostname")
+	if rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), `"name":"pinned"`) {
+		t.Fatalf("pinned name: %d %s", rec.Code, rec.Body.String())
+	}
+	revokedID, revoked := createToken(map[string]any{})
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/join-tokens/"+revokedID+"/revoke", testAdminKey, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("revoke join token: %d", rec.Code)
+	}
+	if rec := register(revoked, "edge-f"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("revoked token: expected 401, got %d", rec.Code)
+	}
+}
+
+func TestEdgeEnrollmentApproval(t *testing.T) {
+	srv := newTestServer(t)
+	rec := doRequest(t, srv, http.MethodPost, "/api/v1/join-tokens", testAdminKey, map[string]any{"require_approval": true, "max_uses": 2})
+	var join struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &join); err != nil || join.Token == "" {
+		t.Fatalf("create join token: %d %s", rec.Code, rec.Body.String())
+	}
+	register := func(body map[string]string) *httptest.ResponseRecorder {
+		buf, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/edge-nodes/register", bytes.NewReader(buf))
+		req.Header.Set("Authorization", "Bearer "+join.Token)
+		rec := httptest.NewRecorder()
+		srv.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+	edgeGet := func(path, token string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		srv.Routes().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if rec := register(map[string]string{"name": "edge-bad", "wg_public_key": "not-a-key"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid wg_public_key: expected 400, got %d", rec.Code)
+	}
+	if rec := register(map[string]string{"name": "<img src=x onerror=alert(1)>"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("markup in name: expected 400, got %d", rec.Code)
+	}
+	pubkey := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	rec = register(map[string]string{"name": "edge-new", "wg_public_key": pubkey})
+	var registered struct {
+		ID    string `json:"edge_node_id"`
+		Token string `json:"token"`
+		State string `json:"state"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &registered); err != nil || registered.State != db.EdgeStatePending {
+		t.Fatalf("register: %d %s", rec.Code, rec.Body.String())
+	}
+	for _, path := range []string{"/api/v1/edge-nodes/me/config", "/api/v1/edge-nodes/me/certificates"} {
+		if code := edgeGet(path, registered.Token); code != http.StatusForbidden {
+			t.Fatalf("%s while pending: expected 403, got %d", path, code)
+		}
+	}
+	buf, _ := json.Marshal(map[string]string{"public_key": base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/edge-nodes/me/wireguard-key", bytes.NewReader(buf))
+	req.Header.Set("Authorization", "Bearer "+registered.Token)
+	rec = httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("wireguard key rotation while pending: expected 403, got %d", rec.Code)
+	}
+
+	rec = doRequest(t, srv, http.MethodGet, "/api/v2/edge-nodes/list?state=pending", testAdminKey, nil)
+	var pending []struct {
+		ID             string `json:"id"`
+		Name           string `json:"name"`
+		RegisteredFrom string `json:"registered_from"`
+		WGPublicKey    string `json:"wg_public_key"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &pending); err != nil {
+		t.Fatalf("decode pending edges: %v", err)
+	}
+	if len(pending) != 1 || pending[0].ID != registered.ID || pending[0].RegisteredFrom != "192.0.2.1" || pending[0].WGPublicKey != pubkey {
+		t.Fatalf("unexpected pending edges: %s", rec.Body.String())
+	}
+
+	_, operatorKey := createAPIKey(t, srv, map[string]any{"name": "ops", "role": "operator"})
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/edge-nodes/"+registered.ID+"/approve", operatorKey, nil); rec.Code != http.StatusForbidden {
+		t.Fatalf("operator approve: expected 403, got %d", rec.Code)
+	}
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/edge-nodes/"+registered.ID+"/approve", testAdminKey, nil); rec.Code != http.StatusOK {
+		t.Fatalf("approve: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/edge-nodes/"+registered.ID+"/approve", testAdminKey, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("approve twice: expected 404, got %d", rec.Code)
+	}
+	if code := edgeGet("/api/v1/edge-nodes/me/config", registered.Token); code != http.StatusOK {
+		t.Fatalf("config after approval: expected 200, got %d", code)
+	}
+
+	// Without a join token asking for it, approval follows the server setting.
+	srv.requireEdgeApproval = true
+	srv.bootstrapToken = "legacy"
+	buf, _ = json.Marshal(map[string]string{"name": "edge-legacy"})
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/edge-nodes/register", bytes.NewReader(buf))
+	req.Header.Set("X-Bootstrap-Token", "legacy")
+	rec = httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), `"state":"pending"`) {
+		t.Fatalf("legacy registration with approval required: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestEdgeLifecycle(t *testing.T) {
+	srv := newTestServer(t)
+	ctx := context.Background()
+	node, err := srv.store.RegisterEdgeNode(ctx, db.RegisterEdgeNodeParams{TokenPlain: "edge-token", Name: "edge1", WGAddr: "10.9.0.5/32", RegisteredFrom: "198.51.100.7"})
+	if err != nil {
+		t.Fatalf("register edge: %v", err)
+	}
+	edgeConfigCode := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/edge-nodes/me/config", nil)
+		req.Header.Set("Authorization", "Bearer edge-token")
+		rec := httptest.NewRecorder()
+		srv.Routes().ServeHTTP(rec, req)
+		return rec.Code
+	}
+	dnsAddresses := func() []string {
+		t.Helper()
+		rec := doRequest(t, srv, http.MethodGet, "/api/v2/edge-nodes/dns", testAdminKey, nil)
+		var resp struct {
+			Addresses []string `json:"addresses"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("dns: %d %s", rec.Code, rec.Body.String())
+		}
+		return resp.Addresses
+	}
+	transition := func(op string, body any, want int) edgeNodeV2 {
+		t.Helper()
+		rec := doRequest(t, srv, http.MethodPost, "/api/v2/edge-nodes/"+node.ID+"/"+op, testAdminKey, body)
+		if rec.Code != want {
+			t.Fatalf("%s: expected %d, got %d (%s)", op, want, rec.Code, rec.Body.String())
+		}
+		var out edgeNodeV2
+		_ = json.Unmarshal(rec.Body.Bytes(), &out)
+		return out
+	}
+
+	if got := dnsAddresses(); strings.Join(got, ",") != "198.51.100.7" {
+		t.Fatalf("active edge should be answered with its registration address, got %v", got)
+	}
+	if rec := doRequest(t, srv, http.MethodPatch, "/api/v1/edge-nodes/"+node.ID, testAdminKey, map[string]any{"public_addr": "203.0.113.10"}); rec.Code != http.StatusOK {
+		t.Fatalf("set public_addr: %d %s", rec.Code, rec.Body.String())
+	}
+	if got := dnsAddresses(); strings.Join(got, ",") != "203.0.113.10" {
+		t.Fatalf("dns should use public_addr, got %v", got)
+	}
+
+	cordoned := transition("cordon", nil, http.StatusOK)
+	if cordoned.State != db.EdgeStateCordoned || cordoned.StateChangedBy == nil || *cordoned.StateChangedBy != "api_key:"+adminKeyID(t, srv) {
+		t.Fatalf("unexpected cordoned edge: %+v", cordoned)
+	}
+	if got := dnsAddresses(); len(got) != 0 {
+		t.Fatalf("cordoned edge still in dns: %v", got)
+	}
+	if code := edgeConfigCode(); code != http.StatusOK {
+		t.Fatalf("cordoned edge should keep receiving config, got %d", code)
+	}
+	transition("cordon", nil, http.StatusConflict)
+
+	draining := transition("drain", map[string]any{"drain_seconds": 3600}, http.StatusOK)
+	if draining.State != db.EdgeStateDraining || draining.DrainUntil == nil || time.Until(*draining.DrainUntil) < 59*time.Minute {
+		t.Fatalf("unexpected draining edge: %+v", draining)
+	}
+	transition("retire", nil, http.StatusConflict)
+	srv.retireDrainedEdges(ctx, time.Now())
+	if code := edgeConfigCode(); code != http.StatusOK {
+		t.Fatalf("draining edge should keep receiving config, got %d", code)
+	}
+	if back := transition("uncordon", nil, http.StatusOK); back.State != db.EdgeStateActive || back.DrainUntil != nil {
+		t.Fatalf("unexpected uncordoned edge: %+v", back)
+	}
+
+	transition("drain", map[string]any{"drain_seconds": 0}, http.StatusOK)
+	srv.retireDrainedEdges(ctx, time.Now().Add(time.Second))
+	retired, err := srv.store.EdgeNodeByID(ctx, node.ID)
+	if err != nil || retired.State != db.EdgeStateRetired || !retired.TokenRevokedAt.Valid || retired.StateChangedBy.String != "system" {
+		t.Fatalf("drained edge not retired: %+v (%v)", retired, err)
+	}
+	if code := edgeConfigCode(); code != http.StatusUnauthorized {
+		t.Fatalf("retired edge token: expected 401, got %d", code)
+	}
+	transition("uncordon", nil, http.StatusConflict)
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/edge-nodes/"+node.ID+"/rotate-token", testAdminKey, nil); rec.Code != http.StatusConflict {
+		t.Fatalf("rotate-token of a retired edge: expected 409, got %d (%s)", rec.Code, rec.Body.String())
+	}
+	if retired, err := srv.store.EdgeNodeByID(ctx, node.ID); err != nil || !retired.TokenRevokedAt.Valid {
+		t.Fatalf("retired edge token should stay revoked: %+v (%v)", retired, err)
+	}
+	if retired.WGAddr.Valid {
+		t.Fatalf("retired edge kept its tunnel address: %q", retired.WGAddr.String)
+	}
+	addrs, err := srv.store.ListTunnelAddresses(ctx)
+	if err != nil {
+		t.Fatalf("list tunnel addresses: %v", err)
+	}
+	for _, a := range addrs {
+		if a.OwnerID == node.ID {
+			t.Fatalf("retired edge still owns %s", a.Addr)
+		}
+	}
+	stale, err := srv.store.MarkStaleEdgeNodes(ctx, time.Now().Add(time.Hour), time.Now())
+	if err != nil {
+		t.Fatalf("mark stale: %v", err)
+	}
+	for _, e := range stale {
+		if e.ID == node.ID {
+			t.Fatalf("retired edge marked stale")
+		}
+	}
+
+	entries, err := srv.store.ListAuditLog(ctx, db.AuditFilter{TargetID: node.ID, Limit: 10})
+	if err != nil {
+		t.Fatalf("audit log: %v", err)
+	}
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+	}
+	if got := strings.Join(actions, ","); got != "edge.retired,edge.draining,edge.uncordoned,edge.draining,edge.cordoned" {
+		t.Fatalf("audit actions = %s", got)
+	}
+}
+
+func TestOriginEnrollment(t *testing.T) {
+	srv := newTestServer(t)
+	newJoinToken := func(body map[string]any) string {
+		rec := doRequest(t, srv, http.MethodPost, "/api/v1/join-tokens", testAdminKey, body)
+		var join struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &join); err != nil || join.Token == "" {
+			t.Fatalf("create join token: %d %s", rec.Code, rec.Body.String())
+		}
+		return join.Token
+	}
+	post := func(path, token string, body any) *httptest.ResponseRecorder {
+		buf, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(buf))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		srv.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/join-tokens", testAdminKey, map[string]any{"kind": "origin", "group": "tokyo"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("origin token with group: expected 400, got %d", rec.Code)
+	}
+	pubkey := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	body := map[string]string{"name": "origin-new", "wireguard_public_key": pubkey}
+	edgeToken := newJoinToken(map[string]any{})
+	if rec := post("/api/v1/origins/register", edgeToken, body); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("register origin with edge token: expected 401, got %d", rec.Code)
+	}
+	originToken := newJoinToken(map[string]any{"kind": "origin"})
+	if rec := post("/api/v1/edge-nodes/register", originToken, map[string]string{"name": "edge-x"}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("register edge with origin token: expected 401, got %d", rec.Code)
+	}
+	if rec := post("/api/v1/origins/register", originToken, map[string]string{"name": "origin-new", "wireguard_public_key": "bad"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid key: expected 400, got %d", rec.Code)
+	}
+	for _, bad := range []map[string]string{
+		{"name": "<b>origin</b>", "wireguard_public_key": pubkey},
+		{"name": "origin-new", "wireguard_public_key": pubkey, "wireguard_endpoint": "<b>x</b>:51820"},
+	} {
+		if rec := post("/api/v1/origins/register", originToken, bad); rec.Code != http.StatusBadRequest {
+			t.Fatalf("register origin %v: expected 400, got %d", bad, rec.Code)
+		}
+	}
+
+	rec := post("/api/v1/origins/register", originToken, body)
+	var registered struct {
+		OriginID   string `json:"origin_id"`
+		WGIP       string `json:"wg_ip"`
+		TunnelCIDR string `json:"tunnel_cidr"`
+		Token      string `json:"token"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &registered); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("register origin: %d %s", rec.Code, rec.Body.String())
+	}
+	if registered.WGIP != "10.20.0.1" || registered.TunnelCIDR != "10.20.0.0/24" || registered.Token == "" {
+		t.Fatalf("unexpected registration: %s", rec.Body.String())
+	}
+	if rec := post("/api/v1/origins/register", originToken, map[string]string{"name": "origin-2", "wireguard_public_key": pubkey}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("reuse single-use token: expected 401, got %d", rec.Code)
+	}
+
+	if rec := post("/api/v1/origins/me/heartbeat", "wrong", nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("heartbeat with bad token: expected 401, got %d", rec.Code)
+	}
+	if rec := post("/api/v1/origins/me/heartbeat", registered.Token, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("heartbeat: expected 204, got %d", rec.Code)
+	}
+	rec = doRequest(t, srv, http.MethodGet, "/api/v2/origins/"+registered.OriginID, testAdminKey, nil)
+	var origin struct {
+		WGIP           string  `json:"wg_ip"`
+		RegisteredFrom string  `json:"registered_from"`
+		LastSeen       *string `json:"last_seen"`
+		JoinTokenID    string  `json:"join_token_id"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &origin); err != nil {
+		t.Fatalf("decode origin: %v", err)
+	}
+	if origin.WGIP != "10.20.0.1" || origin.RegisteredFrom != "192.0.2.1" || origin.LastSeen == nil || origin.JoinTokenID == "" {
+		t.Fatalf("unexpected origin: %s", rec.Body.String())
+	}
+
+	// The next origin skips addresses already used by origins and edges.
+	if _, err := srv.store.CreateOrigin(context.Background(), db.CreateOriginParams{Name: "manual", WireguardIP: "10.20.0.2"}); err != nil {
+		t.Fatalf("create origin: %v", err)
+	}
+	rec = post("/api/v1/origins/register", newJoinToken(map[string]any{"kind": "origin"}), map[string]string{"name": "origin-3", "wireguard_public_key": pubkey})
+	if !strings.Contains(rec.Body.String(), `"wg_ip":"10.20.0.3"`) {
+		t.Fatalf("second registration: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestTunnelAddressManagement(t *testing.T) {
+	srv := newTestServer(t)
+	createOrigin := func(body map[string]any) *httptest.ResponseRecorder {
+		return doRequest(t, srv, http.MethodPost, "/api/v2/origins", testAdminKey, body)
+	}
+	wgIP := func(rec *httptest.ResponseRecorder) string {
+		var o struct {
+			ID   string `json:"id"`
+			WGIP string `json:"wg_ip"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &o); err != nil || rec.Code != http.StatusCreated {
+			t.Fatalf("create origin: %d %s", rec.Code, rec.Body.String())
+		}
+		return o.ID + " " + o.WGIP
+	}
+
+	first := wgIP(createOrigin(map[string]any{"name": "o1"}))
+	if !strings.HasSuffix(first, " 10.20.0.1") {
+		t.Fatalf("first allocation: %s", first)
+	}
+	if got := wgIP(createOrigin(map[string]any{"name": "o2", "wg_ip": "10.20.0.2"})); !strings.HasSuffix(got, " 10.20.0.2") {
+		t.Fatalf("explicit address: %s", got)
+	}
+
+	rec := doRequest(t, srv, http.MethodPost, "/api/v1/join-tokens", testAdminKey, map[string]any{})
+	var join struct {
+		Token string `json:"token"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &join)
+	buf, _ := json.Marshal(map[string]string{"name": "edge-1", "wg_addr": "auto"})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/edge-nodes/register", bytes.NewReader(buf))
+	req.Header.Set("Authorization", "Bearer "+join.Token)
+	rec = httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rec, req)
+	var edge struct {
+		ID     string `json:"edge_node_id"`
+		WGAddr string `json:"wg_addr"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &edge); err != nil || edge.WGAddr != "10.20.0.3/32" {
+		t.Fatalf("register edge with wg_addr auto: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// Addresses collide across origins and edges.
+	if rec := createOrigin(map[string]any{"name": "o3", "wg_ip": "10.20.0.3"}); rec.Code != http.StatusConflict {
+		t.Fatalf("origin on an edge's address: expected 409, got %d", rec.Code)
+	}
+	if rec := doRequest(t, srv, http.MethodPatch, "/api/v1/edge-nodes/"+edge.ID, testAdminKey, map[string]any{"wg_addr": "10.20.0.1/32"}); rec.Code != http.StatusConflict {
+		t.Fatalf("edge on an origin's address: expected 409, got %d", rec.Code)
+	}
+
+	rec = doRequest(t, srv, http.MethodGet, "/api/v2/tunnel/pools", testAdminKey, nil)
+	var usage struct {
+		Pools []struct {
+			CIDR      string `json:"cidr"`
+			Size      uint64 `json:"size"`
+			Allocated int    `json:"allocated"`
+			Free      uint64 `json:"free"`
+		} `json:"pools"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &usage); err != nil || len(usage.Pools) != 1 {
+		t.Fatalf("pools: %d %s", rec.Code, rec.Body.String())
+	}
+	if p := usage.Pools[0]; p.CIDR != "10.20.0.0/24" || p.Size != 254 || p.Allocated != 3 || p.Free != 251 {
+		t.Fatalf("unexpected usage: %s", rec.Body.String())
+	}
+
+	// Deleting an origin releases its address for the next allocation.
+	if rec := doRequest(t, srv, http.MethodDelete, "/api/v1/origins/"+strings.Fields(first)[0], testAdminKey, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete origin: %d", rec.Code)
+	}
+	if got := wgIP(createOrigin(map[string]any{"name": "o4", "wg_ip": "auto"})); !strings.HasSuffix(got, " 10.20.0.1") {
+		t.Fatalf("reallocation: %s", got)
+	}
+
+	// Once the IPv4 pool is full, addresses come from the IPv6 pool.
+	srv.store.SetTunnelPools([]netip.Prefix{netip.MustParsePrefix("10.20.0.0/30"), netip.MustParsePrefix("fd00:20::/64")})
+	if got := wgIP(createOrigin(map[string]any{"name": "o5"})); !strings.HasSuffix(got, " fd00:20::1") {
+		t.Fatalf("IPv6 allocation: %s", got)
+	}
+}
+
+func TestWireGuardPeerDistribution(t *testing.T) {
+	srv := newTestServer(t)
+	key := func(b byte) string {
+		raw := make([]byte, 32)
+		raw[0] = b
+		return base64.StdEncoding.EncodeToString(raw)
+	}
+	joinToken := func(body map[string]any) string {
+		rec := doRequest(t, srv, http.MethodPost, "/api/v1/join-tokens", testAdminKey, body)
+		var join struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &join); err != nil || join.Token == "" {
+			t.Fatalf("create join token: %d %s", rec.Code, rec.Body.String())
+		}
+		return join.Token
+	}
+	request := func(method, path, token string, body any) *httptest.ResponseRecorder {
+		var buf []byte
+		if body != nil {
+			buf, _ = json.Marshal(body)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(buf))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		srv.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/origins", testAdminKey, map[string]any{"name": "bad", "wireguard_endpoint": "no-port"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid endpoint: expected 400, got %d", rec.Code)
+	}
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/origins", testAdminKey, map[string]any{
+		"name": "manual", "wireguard_public_key": key(1), "wireguard_endpoint": "manual.example.com:51820",
+	}); rec.Code != http.StatusCreated {
+		t.Fatalf("create origin: %d %s", rec.Code, rec.Body.String())
+	}
+	rec := request(http.MethodPost, "/api/v1/origins/register", joinToken(map[string]any{"kind": "origin"}), map[string]string{
+		"name": "enrolled", "wireguard_public_key": key(2), "wireguard_endpoint": "enrolled.example.com:51821",
+	})
+	var origin struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &origin); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("register origin: %d %s", rec.Code, rec.Body.String())
+	}
+	rec = request(http.MethodPost, "/api/v1/edge-nodes/register", joinToken(map[string]any{}), map[string]string{
+		"name": "edge-1", "wg_addr": "auto", "wg_public_key": key(3),
+	})
+	var edge struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &edge); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("register edge: %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = request(http.MethodGet, "/api/v1/edge-nodes/me/config", edge.Token, nil)
+	var config struct {
+		WireGuard generator.WireGuardConfig `json:"wireguard"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &config); err != nil {
+		t.Fatalf("decode edge config: %v", err)
+	}
+	wg := config.WireGuard
+	if wg.Address != "10.20.0.3/32" || len(wg.Peers) != 2 || wg.Peers[0].Name != "enrolled" || wg.Peers[0].Endpoint != "enrolled.example.com:51821" ||
+		!strings.Contains(wg.WGQuick, "AllowedIPs = 10.20.0.1/32") {
+		t.Fatalf("unexpected edge wireguard config: %+v", wg)
+	}
+	etag := rec.Header().Get("ETag")
+
+	rec = request(http.MethodGet, "/api/v1/origins/me/wireguard?format=wg-quick", origin.Token, nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Address = 10.20.0.2/24\nListenPort = 51821\n") ||
+		!strings.Contains(rec.Body.String(), "PublicKey = "+key(3)+"\nAllowedIPs = 10.20.0.3/32\n") {
+		t.Fatalf("origin wg-quick config: %d %s", rec.Code, rec.Body.String())
+	}
+	originETag := rec.Header().Get("ETag")
+	if rec := request(http.MethodGet, "/api/v1/origins/me/wireguard", "wrong", nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("origin wireguard with bad token: expected 401, got %d", rec.Code)
+	}
+
+	// A new origin reaches every edge, and a new edge every origin.
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/origins", testAdminKey, map[string]any{"name": "third", "wireguard_public_key": key(4)}); rec.Code != http.StatusCreated {
+		t.Fatalf("create origin: %d", rec.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/edge-nodes/me/config", nil)
+	req.Header.Set("Authorization", "Bearer "+edge.Token)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), key(4)) {
+		t.Fatalf("edge config after adding an origin: %d", rec.Code)
+	}
+	request(http.MethodPost, "/api/v1/edge-nodes/register", joinToken(map[string]any{}), map[string]string{
+		"name": "edge-2", "wg_addr": "auto", "wg_public_key": key(5),
+	})
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/origins/me/wireguard", nil)
+	req.Header.Set("Authorization", "Bearer "+origin.Token)
+	req.Header.Set("If-None-Match", originETag)
+	rec = httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rec, req)
+	var originConfig generator.WireGuardConfig
+	if err := json.Unmarshal(rec.Body.Bytes(), &originConfig); err != nil || len(originConfig.Peers) != 2 {
+		t.Fatalf("origin config after adding an edge: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestWireGuardKeyRotation(t *testing.T) {
+	srv := newTestServer(t)
+	key := func(b byte) string {
+		raw := make([]byte, 32)
+		raw[0] = b
+		return base64.StdEncoding.EncodeToString(raw)
+	}
+	request := func(method, path, token string, body any) *httptest.ResponseRecorder {
+		var buf []byte
+		if body != nil {
+			buf, _ = json.Marshal(body)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(buf))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		srv.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+	register := func(path string, tokenBody, body map[string]any) string {
+		rec := doRequest(t, srv, http.MethodPost, "/api/v1/join-tokens", testAdminKey, tokenBody)
+		var join struct {
+			Token string `json:"token"`
+		}
+		_ = json.Unmarshal(rec.Body.Bytes(), &join)
+		rec = request(http.MethodPost, path, join.Token, body)
+		var out struct {
+			Token string `json:"token"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil || rec.Code != http.StatusCreated {
+			t.Fatalf("register %s: %d %s", path, rec.Code, rec.Body.String())
+		}
+		return out.Token
+	}
+	originToken := register("/api/v1/origins/register", map[string]any{"kind": "origin"}, map[string]any{
+		"name": "origin-1", "wireguard_public_key": key(1), "wireguard_endpoint": "origin.example.com:51820",
+	})
+	edgeToken := register("/api/v1/edge-nodes/register", map[string]any{}, map[string]any{
+		"name": "edge-1", "wg_addr": "auto", "wg_public_key": key(2),
+	})
+	edgeWireGuard := func() generator.WireGuardConfig {
+		var config struct {
+			WireGuard generator.WireGuardConfig `json:"wireguard"`
+		}
+		rec := request(http.MethodGet, "/api/v1/edge-nodes/me/config", edgeToken, nil)
+		if err := json.Unmarshal(rec.Body.Bytes(), &config); err != nil {
+			t.Fatalf("decode edge config: %v", err)
+		}
+		return config.WireGuard
+	}
+	originWireGuard := func() generator.WireGuardConfig {
+		var config generator.WireGuardConfig
+		rec := request(http.MethodGet, "/api/v1/origins/me/wireguard", originToken, nil)
+		if err := json.Unmarshal(rec.Body.Bytes(), &config); err != nil {
+			t.Fatalf("decode origin config: %v", err)
+		}
+		return config
+	}
+	reportEdge := func(hash string) {
+		if rec := request(http.MethodPost, "/api/v1/edge-nodes/me/status", edgeToken, map[string]any{"wireguard_hash": hash}); rec.Code != http.StatusOK {
+			t.Fatalf("edge status: %d %s", rec.Code, rec.Body.String())
+		}
+	}
+	type rotation struct {
+		ID      string `json:"id"`
+		State   string `json:"state"`
+		Pending int    `json:"pending"`
+		Peers   []struct {
+			ID      string `json:"id"`
+			Applied bool   `json:"applied"`
+		} `json:"peers"`
+	}
+	decode := func(rec *httptest.ResponseRecorder) rotation {
+		var out rotation
+		if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+			t.Fatalf("decode rotation: %d %s", rec.Code, rec.Body.String())
+		}
+		return out
+	}
+
+	// The edge syncs WireGuard, so the origin's rotation waits for it.
+	before := edgeWireGuard()
+	reportEdge(before.PeersHash)
+	rec := request(http.MethodPost, "/api/v1/origins/me/wireguard-key", originToken, map[string]string{"public_key": key(9)})
+	started := decode(rec)
+	if rec.Code != http.StatusCreated || started.State != db.WGKeyRotationOverlap || started.Pending != 1 || len(started.Peers) != 1 {
+		t.Fatalf("start rotation: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := request(http.MethodPost, "/api/v1/origins/me/wireguard-key", originToken, map[string]string{"public_key": key(9)}); rec.Code != http.StatusOK {
+		t.Fatalf("retried rotation: expected 200, got %d", rec.Code)
+	}
+	if rec := request(http.MethodPost, "/api/v1/origins/me/wireguard-key", originToken, map[string]string{"public_key": key(8)}); rec.Code != http.StatusConflict {
+		t.Fatalf("second rotation: expected 409, got %d", rec.Code)
+	}
+	if rec := request(http.MethodPost, "/api/v1/origins/me/wireguard-key", originToken, map[string]string{"public_key": "short"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid key: expected 400, got %d", rec.Code)
+	}
+
+	overlap := edgeWireGuard()
+	if len(overlap.Peers) != 2 || overlap.Peers[0].PublicKey != key(1) || overlap.Peers[1].PublicKey != key(9) || len(overlap.Peers[1].AllowedIPs) != 0 {
+		t.Fatalf("edge peers during overlap: %+v", overlap.Peers)
+	}
+	reportEdge(before.PeersHash)
+	if got := decode(doRequest(t, srv, http.MethodGet, "/api/v2/tunnel/key-rotations/"+started.ID, testAdminKey, nil)); got.State != db.WGKeyRotationOverlap || got.Pending != 1 {
+		t.Fatalf("rotation before the edge applied: %+v", got)
+	}
+	reportEdge(overlap.PeersHash)
+	done := decode(doRequest(t, srv, http.MethodGet, "/api/v2/tunnel/key-rotations/"+started.ID, testAdminKey, nil))
+	if done.State != db.WGKeyRotationCompleted || len(done.Peers) != 1 || !done.Peers[0].Applied {
+		t.Fatalf("rotation after the edge applied: %+v", done)
+	}
+	after := edgeWireGuard()
+	if len(after.Peers) != 1 || after.Peers[0].PublicKey != key(9) || len(after.Peers[0].AllowedIPs) != 1 {
+		t.Fatalf("edge peers after rotation: %+v", after.Peers)
+	}
+	if config := originWireGuard(); config.PublicKey != key(9) || !strings.Contains(config.WGQuick, "# PublicKey = "+key(9)+"\n") {
+		t.Fatalf("origin config after rotation: %+v", config)
+	}
+	entries, err := srv.store.ListAuditLog(context.Background(), db.AuditFilter{Action: "wireguard_key.rotated", Limit: 10})
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("audit entries: %v %d", err, len(entries))
+	}
+
+	// An edge rotation waits for the origin once it reports, and can be
+	// cancelled.
+	if rec := request(http.MethodPost, "/api/v1/origins/me/heartbeat", originToken, map[string]string{"wireguard_hash": originWireGuard().PeersHash}); rec.Code != http.StatusNoContent {
+		t.Fatalf("origin heartbeat: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := request(http.MethodPost, "/api/v1/origins/me/heartbeat", originToken, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("origin heartbeat without body: %d", rec.Code)
+	}
+	edgeRotation := decode(request(http.MethodPost, "/api/v1/edge-nodes/me/wireguard-key", edgeToken, map[string]string{"public_key": key(7)}))
+	if edgeRotation.State != db.WGKeyRotationOverlap || edgeRotation.Pending != 1 {
+		t.Fatalf("edge rotation: %+v", edgeRotation)
+	}
+	if peers := originWireGuard().Peers; len(peers) != 2 || peers[1].PublicKey != key(7) {
+		t.Fatalf("origin peers during edge rotation: %+v", peers)
+	}
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v2/tunnel/key-rotations/"+edgeRotation.ID+"/cancel", testAdminKey, nil); rec.Code != http.StatusOK {
+		t.Fatalf("cancel rotation: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v2/tunnel/key-rotations/"+edgeRotation.ID+"/complete", testAdminKey, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("complete cancelled rotation: expected 404, got %d", rec.Code)
+	}
+	if peers := originWireGuard().Peers; len(peers) != 1 || peers[0].PublicKey != key(2) {
+		t.Fatalf("origin peers after cancelling: %+v", peers)
+	}
+	var list []rotation
+	rec = doRequest(t, srv, http.MethodGet, "/api/v2/tunnel/key-rotations/list?state=cancelled", testAdminKey, nil)
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil || len(list) != 1 || list[0].ID != edgeRotation.ID {
+		t.Fatalf("list cancelled rotations: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestEdgeConfigConditionalAndLongPoll(t *testing.T) {
+	srv := newTestServer(t)
+	ctx := context.Background()
+	origin, err := srv.store.CreateOrigin(ctx, db.CreateOriginParams{Name: "o1", WireguardIP: "10.0.0.2"})
+	if err != nil {
+		t.Fatalf("create origin: %v", err)
+	}
+	if _, err := srv.store.RegisterEdgeNode(ctx, db.RegisterEdgeNodeParams{TokenPlain: "edge-token", Name: "edge1"}); err != nil {
+		t.Fatalf("register edge: %v", err)
+	}
+	getConfig := func(query, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/edge-nodes/me/config"+query, nil)
+		req.Header.Set("Authorization", "Bearer edge-token")
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		srv.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := getConfig("", "")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" {
+		t.Fatalf("expected 200 with ETag, got %d %q", rec.Code, etag)
+	}
+	if rec := getConfig("", etag); rec.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for matching ETag, got %d", rec.Code)
+	}
+	if rec := getConfig("?wait=abc", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid wait, got %d", rec.Code)
+	}
+
+	start := time.Now()
+	if rec := getConfig("?wait=1&since="+strings.Trim(etag, `"`), ""); rec.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 after wait, got %d", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("long poll returned early after %s", elapsed)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := srv.store.CreateRoute(ctx, db.CreateRouteParams{Hostname: "a.example.com", OriginID: origin.ID, TargetPort: 8080}); err != nil {
+			t.Errorf("create route: %v", err)
+		}
+	}()
+	start = time.Now()
+	rec = getConfig("?wait=30s", etag)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Fatalf("expected new config, got %d %q", rec.Code, rec.Header().Get("ETag"))
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("long poll was not woken by the change, took %s", elapsed)
+	}
+	var config struct {
+		Hostnames []string `json:"hostnames"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &config); err != nil || len(config.Hostnames) != 1 {
+		t.Fatalf("unexpected config: %s", rec.Body.String())
+	}
+}
+
+type sseEvent struct {
+	ID   string
+	Type string
+	Data string
+}
+
+// readEvents connects to the event stream and reads events until one of type
+// until arrives.
+func readEvents(t *testing.T, url, key, lastEventID, until string, during func()) []sseEvent {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url+"/api/v1/events", nil)
+	req.Header.Set("X-API-Key", key)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected event stream, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if during != nil {
+		go during()
+	}
+	var out []sseEvent
+	var ev sseEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			ev.ID = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			ev.Type = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			ev.Data = strings.TrimPrefix(line, "data: ")
+		case line == "" && ev.Type != "":
+			out = append(out, ev)
+			if ev.Type == until {
+				return out
+			}
+			ev = sseEvent{}
+		}
+	}
+	t.Fatalf("stream ended before %s: %+v (%v)", until, out, scanner.Err())
+	return nil
+}
+
+func eventTypes(events []sseEvent) []string {
+	var out []string
+	for _, ev := range events {
+		out = append(out, ev.Type)
+	}
+	return out
+}
+
+func TestEventStream(t *testing.T) {
+	srv := newTestServer(t)
+	ts := httptest.NewServer(srv.Routes())
+	defer ts.Close()
+
+	rec := doRequest(t, srv, http.MethodPost, "/api/v1/origins", testAdminKey, map[string]any{"name": "o1", "wg_ip": "10.0.0.2"})
+	var origin db.Origin
+	if err := json.Unmarshal(rec.Body.Bytes(), &origin); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("create origin: %d %s", rec.Code, rec.Body.String())
+	}
+	createRoute := func(host string) {
+		rec := doRequest(t, srv, http.MethodPost, "/api/v1/routes", testAdminKey, map[string]any{"hostname": host, "origin_id": origin.ID, "target_port": 8080})
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("create route: %d %s", rec.Code, rec.Body.String())
+		}
+	}
+	createRoute("app.example.com")
+	createRoute("team.other.com")
+
+	// Resuming from the start replays the log.
+	got := eventTypes(readEvents(t, ts.URL, testAdminKey, "0", "route.created", nil))
+	if strings.Join(got, ",") != "origin.created,config.generated,route.created" {
+		t.Fatalf("unexpected replay: %v", got)
+	}
+
+	// Scoped keys only see routes within their scopes.
+	_, scoped := createAPIKey(t, srv, map[string]any{"name": "team", "role": db.RoleViewer, "scopes": []string{"*.other.com"}})
+	replay := readEvents(t, ts.URL, scoped, "0", "route.created", nil)
+	for _, ev := range replay {
+		if strings.Contains(ev.Data, "app.example.com") {
+			t.Fatalf("scoped key saw an out-of-scope route: %+v", ev)
+		}
+	}
+	last := replay[len(replay)-1]
+	if !strings.Contains(last.Data, "team.other.com") {
+		t.Fatalf("scoped key did not see its route: %+v", replay)
+	}
+	// Payloads are the v2 resources, not the store structs.
+	if !strings.Contains(last.Data, `"hostname":"team.other.com"`) || !strings.Contains(last.Data, `"origin_name":"o1"`) || strings.Contains(last.Data, `"Valid"`) {
+		t.Fatalf("route event is not a v2 route: %s", last.Data)
+	}
+
+	// Live events follow the replay.
+	live := readEvents(t, ts.URL, testAdminKey, last.ID, "route.deleted", func() {
+		var route db.Route
+		rec := doRequest(t, srv, http.MethodGet, "/api/v1/routes/list", testAdminKey, nil)
+		var routes []db.Route
+		_ = json.Unmarshal(rec.Body.Bytes(), &routes)
+		for _, r := range routes {
+			if r.Hostname == "app.example.com" {
+				route = r
+			}
+		}
+		doRequest(t, srv, http.MethodDelete, "/api/v1/routes/"+route.ID, testAdminKey, nil)
+	})
+	if strings.Join(eventTypes(live), ",") != "config.generated,route.deleted" {
+		t.Fatalf("unexpected live events: %v", eventTypes(live))
+	}
+}
+
+func TestEventStreamEndsWhenKeyIsRevoked(t *testing.T) {
+	srv := newTestServer(t)
+	ts := httptest.NewServer(srv.Routes())
+	defer ts.Close()
+	id, key := createAPIKey(t, srv, map[string]any{"name": "watcher", "role": db.RoleViewer})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/api/v1/events", nil)
+	req.Header.Set("X-API-Key", key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("connect: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/api-keys/"+id+"/revoke", testAdminKey, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("revoke: %d", rec.Code)
+	}
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/origins", testAdminKey, map[string]any{"name": "o1", "wg_ip": "10.0.0.2"}); rec.Code != http.StatusCreated {
+		t.Fatalf("create origin: %d", rec.Code)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("stream did not end after the key was revoked: %v", err)
+	}
+	if strings.Contains(string(body), "origin.created") {
+		t.Fatalf("revoked key received an event: %s", body)
+	}
+}
+
+func TestWebhookEndpoints(t *testing.T) {
+	srv := newTestServer(t)
+	_, operator := createAPIKey(t, srv, map[string]any{"name": "ops", "role": db.RoleOperator})
+	if rec := doRequest(t, srv, http.MethodPost, "/api/v1/webhooks", operator, map[string]any{"name": "slack", "url": "https://hooks.example.com/x"}); rec.Code != http.StatusForbidden {
+		t.Fatalf("operator should not manage webhooks, got %d", rec.Code)
+	}
+	for _, body := range []map[string]any{
+		{"name": "slack", "url": "ftp://hooks.example.com/x"},
+		{"name": "", "url": "https://hooks.example.com/x"},
+		{"name": "slack", "url": "https://hooks.example.com/x", "events": []string{"edge.["}},
+	} {
+		if rec := doRequest(t, srv, http.MethodPost, "/api/v1/webhooks", testAdminKey, body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %v, got %d", body, rec.Code)
+		}
+	}
+
+	rec := doRequest(t, srv, http.MethodPost, "/api/v1/webhooks", testAdminKey, map[string]any{
+		"name": "slack", "url": "https://hooks.example.com/x", "events": []string{"edge.*", "route.created"},
+	})
+	var created struct {
+		ID     string `json:"id"`
+		Secret string `json:"secret"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil || rec.Code != http.StatusCreated || !strings.HasPrefix(created.Secret, "whsec_") {
+		t.Fatalf("create webhook: %d %s", rec.Code, rec.Body.String())
+	}
+	rec = doRequest(t, srv, http.MethodGet, "/api/v1/webhooks/list", testAdminKey, nil)
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), created.Secret) {
+		t.Fatalf("list should not expose the secret: %s", rec.Body.String())
+	}
+
+	// Only a new apply failure is published, not every heartbeat repeating it.
+	if _, err := srv.store.RegisterEdgeNode(context.Background(), db.RegisterEdgeNodeParams{TokenPlain: "edge-token", Name: "edge1"}); err != nil {
+		t.Fatalf("register edge: %v", err)
+	}
+	sub := srv.events.Subscribe()
+	defer sub.Close()
+	for i := 0; i < 2; i++ {
+		buf, _ := json.Marshal(map[string]any{"config_hash": "abc", "apply_status": "failed", "apply_error": "nginx: [emerg]"})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/edge-nodes/me/status", bytes.NewReader(buf))
+		req.Header.Set("Authorization", "Bearer edge-token")
+		srv.Routes().ServeHTTP(httptest.NewRecorder(), req)
+	}
+	var failures int
+	for len(sub.Events()) > 0 {
+		if ev := <-sub.Events(); ev.Type == "edge.apply_failed" {
+			failures++
+		}
+	}
+	if failures != 1 {
+		t.Fatalf("expected one edge.apply_failed event, got %d", failures)
+	}
+
+	if rec := doRequest(t, srv, http.MethodGet, "/api/v1/webhooks/"+created.ID+"/deliveries", testAdminKey, nil); rec.Code != http.StatusOK {
+		t.Fatalf("deliveries: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(t, srv, http.MethodDelete, "/api/v1/webhooks/"+created.ID, testAdminKey, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete webhook: %d", rec.Code)
+	}
+	if rec := doRequest(t, srv, http.MethodGet, "/api/v1/webhooks/"+created.ID+"/deliveries", testAdminKey, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 after delete, got %d", rec.Code)
+	}
+}
+
+func TestEdgeConfigIsSigned(t *testing.T) {
+	srv := newTestServer(t)
+	_, key, _ := ed25519.GenerateKey(nil)
+	srv.signer = signing.NewSigner(key)
+	node, err := srv.store.RegisterEdgeNode(context.Background(), db.RegisterEdgeNodeParams{TokenPlain: "edge-token", Name: "edge1"})
+	if err != nil {
+		t.Fatalf("register edge: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/edge-nodes/me/config", nil)
+	req.Header.Set("Authorization", "Bearer edge-token")
+	rec := httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rec, req)
+	var config struct {
+		EdgeID     string `json:"edge_id"`
+		ConfigHash string `json:"config_hash"`
+		Generation int64  `json:"generation"`
+		IssuedAt   int64  `json:"issued_at"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &config); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("config: %d %s", rec.Code, rec.Body.String())
+	}
+	if config.EdgeID != node.ID || config.Generation != 1 || config.IssuedAt == 0 {
+		t.Fatalf("unexpected signed fields: %+v", config)
+	}
+	sig, err := base64.StdEncoding.DecodeString(rec.Header().Get("X-Kokoa-Signature"))
+	if err != nil {
+		t.Fatalf("decode signature: %v", err)
+	}
+	pub := key.Public().(ed25519.PublicKey)
+	msg := signing.ConfigMessage(node.ID, config.ConfigHash, config.Generation, config.IssuedAt, rec.Body.Bytes())
+	if !ed25519.Verify(pub, msg, sig) {
+		t.Fatal("signature does not verify over the response body")
+	}
+	tampered := signing.ConfigMessage(node.ID, config.ConfigHash, config.Generation, config.IssuedAt, append(rec.Body.Bytes(), ' '))
+	if ed25519.Verify(pub, tampered, sig) {
+		t.Fatal("signature verified for a modified body")
+	}
+
+	rec = httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/signing-key", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != srv.signer.PublicKeyPEM() {
+		t.Fatalf("signing key: %d %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	srv.Routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/edge/install.sh", nil))
+	if !strings.Contains(rec.Body.String(), srv.signer.PublicKeyPEM()) {
+		t.Fatal("install script does not pin the signing key")
+	}
+}
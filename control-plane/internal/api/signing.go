@@ -0,0 +1,71 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+	"github.com/neo/kokoa-proxy/control-plane/internal/signing"
+	"github.com/neo/kokoa-proxy/control-plane/internal/web"
+)
+
+// writeEdgeConfig sends an edge the config of the routes placed on it. With a signer configured the
+// response carries X-Kokoa-Signature, an Ed25519 signature over
+// signing.ConfigMessage for the exact body, so agents can reject tampered,
+// replayed or out-of-order configs.
+func (s *Server) writeEdgeConfig(w http.ResponseWriter, node db.EdgeNode, snap edgeSnapshot) {
+	placed := snap.configFor(node.ID)
+	config := placed.Config
+	issuedAt := time.Now().Unix()
+	body, err := json.Marshal(map[string]any{
+		"edge_id":           node.ID,
+		"generation":        snap.Generation,
+		"issued_at":         issuedAt,
+		"config_hash":       config.ConfigHash,
+		"certificates_hash": placed.CertificatesHash,
+		"hostnames":         config.Hostnames,
+		"nginx_map":         config.Map,
+		"nginx_conf":        config.Conf,
+		"upstreams":         config.Upstreams,
+		"locations":         config.Locations,
+		"routes":            config.Routes,
+		"wireguard":         snap.edgeWireGuard(node.ID),
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to encode config")
+		return
+	}
+	body = append(body, '\n')
+	if s.signer != nil {
+		msg := signing.ConfigMessage(node.ID, config.ConfigHash, snap.Generation, issuedAt, body)
+		w.Header().Set("X-Kokoa-Signature", base64.StdEncoding.EncodeToString(s.signer.Sign(msg)))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
+
+// handleSigningKey serves the public key that verifies edge configs. It is
+// public: the key is pinned on edges at install time.
+func (s *Server) handleSigningKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.signer == nil {
+		writeError(w, http.StatusNotFound, "config signing is not configured")
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("X-Kokoa-Key-Fingerprint", s.signer.Fingerprint())
+	_, _ = w.Write([]byte(s.signer.PublicKeyPEM()))
+}
+
+func (s *Server) webConfig() web.Config {
+	if s.signer == nil {
+		return web.Config{}
+	}
+	return web.Config{SigningPublicKey: s.signer.PublicKeyPEM()}
+}
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+	"github.com/neo/kokoa-proxy/control-plane/internal/ipam"
+)
+
+// tunnelAddrAuto in place of wg_ip or wg_addr asks for an address from the
+// tunnel pools.
+const tunnelAddrAuto = "auto"
+
+type tunnelPoolUsage struct {
+	CIDR      string `json:"cidr"`
+	Family    string `json:"family"`
+	Size      uint64 `json:"size"`
+	Allocated int    `json:"allocated"`
+	Free      uint64 `json:"free"`
+	// Utilization is the allocated share of the pool in percent.
+	Utilization float64 `json:"utilization"`
+}
+
+type tunnelAddressV2 struct {
+	Addr        string    `json:"addr"`
+	OwnerType   string    `json:"owner_type"`
+	OwnerID     string    `json:"owner_id"`
+	OwnerName   string    `json:"owner_name"`
+	Pool        *string   `json:"pool"`
+	AllocatedAt time.Time `json:"allocated_at"`
+}
+
+type tunnelConflictV2 struct {
+	Addr   string            `json:"addr"`
+	Owners []tunnelAddressV2 `json:"owners"`
+}
+
+// handleTunnelPools reports how full each tunnel pool is, together with
+// addresses configured on more than one origin or edge.
+func (s *Server) handleTunnelPools(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	addrs, err := s.store.ListTunnelAddresses(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list tunnel addresses")
+		return
+	}
+	conflicts, err := s.store.TunnelAddressConflicts(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to check tunnel addresses")
+		return
+	}
+	pools := []tunnelPoolUsage{}
+	outside := 0
+	for _, a := range addrs {
+		if s.tunnelPoolOf(a.Addr) == nil {
+			outside++
+		}
+	}
+	for _, pool := range s.store.TunnelPools() {
+		usage := tunnelPoolUsage{CIDR: pool.String(), Family: "ipv6", Size: ipam.Size(pool)}
+		if pool.Addr().Is4() {
+			usage.Family = "ipv4"
+		}
+		for _, a := range addrs {
+			if ipam.Contains(pool, a.Addr) {
+				usage.Allocated++
+			}
+		}
+		usage.Free = usage.Size - uint64(usage.Allocated)
+		usage.Utilization = float64(usage.Allocated) / float64(usage.Size) * 100
+		pools = append(pools, usage)
+	}
+	out := []tunnelConflictV2{}
+	for _, c := range conflicts {
+		out = append(out, tunnelConflictV2{Addr: c.Addr.String(), Owners: mapSlice(c.Owners, s.tunnelAddressV2)})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"pools": pools,
+		// Addresses held outside every pool were picked by hand.
+		"outside_pools": outside,
+		"conflicts":     out,
+	})
+}
+
+func (s *Server) handleListTunnelAddresses(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	addrs, err := s.store.ListTunnelAddresses(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list tunnel addresses")
+		return
+	}
+	writeJSON(w, http.StatusOK, mapSlice(addrs, s.tunnelAddressV2))
+}
+
+func (s *Server) tunnelAddressV2(a db.TunnelAddress) tunnelAddressV2 {
+	out := tunnelAddressV2{
+		Addr:        a.Addr.String(),
+		OwnerType:   a.OwnerType,
+		OwnerID:     a.OwnerID,
+		OwnerName:   a.OwnerName,
+		AllocatedAt: a.AllocatedAt,
+	}
+	if pool := s.tunnelPoolOf(a.Addr); pool != nil {
+		v := pool.String()
+		out.Pool = &v
+	}
+	return out
+}
+
+// tunnelPoolOf returns the configured pool addr belongs to, or nil.
+func (s *Server) tunnelPoolOf(addr netip.Addr) *netip.Prefix {
+	for _, pool := range s.store.TunnelPools() {
+		if ipam.Contains(pool, addr) {
+			return &pool
+		}
+	}
+	return nil
+}
+
+// tunnelNetwork returns the pool an allocated address came from, the network
+// the origin's WireGuard interface is configured with.
+func (s *Server) tunnelNetwork(addr string) string {
+	a, err := netip.ParseAddr(addr)
+	if err != nil {
+		return ""
+	}
+	if pool := s.tunnelPoolOf(a); pool != nil {
+		return pool.String()
+	}
+	return ipam.HostPrefix(a).String()
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+	"github.com/neo/kokoa-proxy/control-plane/internal/webhooks"
+)
+
+// deliveryLogLimit is how many recent deliveries the delivery log returns.
+const deliveryLogLimit = 100
+
+func (s *Server) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		Name   string   `json:"name"`
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+		Secret string   `json:"secret"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if err := validateWebhook(req.Name, req.URL, req.Events); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	secret := req.Secret
+	if secret == "" {
+		var err error
+		if secret, err = newSecret("whsec_"); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to generate secret")
+			return
+		}
+	}
+	hook, err := s.store.CreateWebhook(r.Context(), db.CreateWebhookParams{
+		Name:   req.Name,
+		URL:    req.URL,
+		Events: req.Events,
+		Secret: secret,
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"id":     hook.ID,
+		"name":   hook.Name,
+		"url":    hook.URL,
+		"events": hook.Events,
+		"secret": secret,
+	})
+}
+
+func (s *Server) handleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	list, err := s.store.ListWebhooks(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list webhooks")
+		return
+	}
+	writeResource(w, r, http.StatusOK, list)
+}
+
+func (s *Server) handleGetWebhook(w http.ResponseWriter, r *http.Request) {
+	hook, err := s.store.WebhookByID(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeStoreError(w, err, "webhook not found")
+		return
+	}
+	writeResource(w, r, http.StatusOK, hook)
+}
+
+func (s *Server) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if err := s.store.DeleteWebhook(r.Context(), r.PathValue("id")); err != nil {
+		writeStoreError(w, err, "webhook not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListWebhookDeliveries is the delivery log: the most recent deliveries
+// of a webhook with their attempt count and last result.
+func (s *Server) handleListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	hook, err := s.store.WebhookByID(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeStoreError(w, err, "webhook not found")
+		return
+	}
+	list, err := s.store.ListWebhookDeliveries(r.Context(), hook.ID, deliveryLogLimit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list deliveries")
+		return
+	}
+	writeResource(w, r, http.StatusOK, list)
+}
+
+func validateWebhook(name, rawURL string, events []string) error {
+	if strings.TrimSpace(name) == "" {
+		return errf("name is required")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errf("url must be an http or https URL")
+	}
+	for _, e := range events {
+		if !webhooks.ValidPattern(e) {
+			return errf("event pattern " + e + " is invalid")
+		}
+	}
+	return nil
+}
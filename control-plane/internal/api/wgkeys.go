@@ -0,0 +1,355 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+	"github.com/neo/kokoa-proxy/control-plane/internal/generator"
+)
+
+type wgKeyRotationV2 struct {
+	ID           string     `json:"id"`
+	OwnerType    string     `json:"owner_type"`
+	OwnerID      string     `json:"owner_id"`
+	OwnerName    string     `json:"owner_name"`
+	OldPublicKey string     `json:"old_public_key"`
+	NewPublicKey string     `json:"new_public_key"`
+	State        string     `json:"state"`
+	RequestedBy  *string    `json:"requested_by"`
+	StartedAt    time.Time  `json:"started_at"`
+	FinishedAt   *time.Time `json:"finished_at"`
+	// Peers are the nodes that must apply the new key; once the rotation
+	// finished only those that did are listed.
+	Peers   []wgKeyRotationPeerV2 `json:"peers"`
+	Pending int                   `json:"pending"`
+}
+
+type wgKeyRotationPeerV2 struct {
+	Type      string     `json:"type"`
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"applied_at"`
+}
+
+// wgRotationTarget is a node whose WireGuard config lists the rotating node.
+// Applied is set when the node runs its current config.
+type wgRotationTarget struct {
+	Type, ID, Name string
+	Applied        bool
+}
+
+// wgRotationTargets returns the nodes that must apply r's new key: the peers
+// of its owner that sync WireGuard through their agent. A node that reports
+// the peers hash of its current config runs one listing the new key.
+func (s *Server) wgRotationTargets(r db.WGKeyRotation, st wireGuardState, snap edgeSnapshot) []wgRotationTarget {
+	var out []wgRotationTarget
+	switch r.OwnerType {
+	case db.TunnelOwnerOrigin:
+		for _, e := range st.Edges {
+			if !e.Serving() || !e.AppliedWGHash.Valid {
+				continue
+			}
+			config := snap.edgeWireGuard(e.ID)
+			if hasPeer(config.Peers, r.OwnerID) {
+				out = append(out, wgRotationTarget{Type: db.TunnelOwnerEdge, ID: e.ID, Name: e.Name, Applied: config.PeersHash == e.AppliedWGHash.String})
+			}
+		}
+	case db.TunnelOwnerEdge:
+		for _, o := range st.Origins {
+			if !o.AppliedWGHash.Valid {
+				continue
+			}
+			config := s.originWireGuard(o, st)
+			if hasPeer(config.Peers, r.OwnerID) {
+				out = append(out, wgRotationTarget{Type: db.TunnelOwnerOrigin, ID: o.ID, Name: o.Name, Applied: config.PeersHash == o.AppliedWGHash.String})
+			}
+		}
+	}
+	return out
+}
+
+// wgAuditTarget is the audit target type of a key owner.
+func wgAuditTarget(ownerType string) string {
+	if ownerType == db.TunnelOwnerEdge {
+		return "edge_node"
+	}
+	return "origin"
+}
+
+func hasPeer(peers []generator.WireGuardPeer, id string) bool {
+	for _, p := range peers {
+		if p.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// advanceWGKeyRotations records the peers that applied the new key of each
+// overlapping rotation and completes the rotations every peer has applied.
+// It runs whenever a node reports the WireGuard config it applied.
+func (s *Server) advanceWGKeyRotations(ctx context.Context) error {
+	rotations, err := s.store.ListWGKeyRotations(ctx, db.WGKeyRotationOverlap, "")
+	if err != nil || len(rotations) == 0 {
+		return err
+	}
+	snap, err := s.edgeSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	st, err := s.loadWireGuardState(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, r := range rotations {
+		applied := map[string]bool{}
+		for _, p := range r.Applied {
+			applied[p.PeerID] = true
+		}
+		done := true
+		for _, t := range s.wgRotationTargets(r, st, snap) {
+			switch {
+			case applied[t.ID]:
+			case t.Applied:
+				if err := s.store.RecordWGKeyRotationPeer(ctx, r.ID, t.Type, t.ID, now); err != nil {
+					return err
+				}
+			default:
+				done = false
+			}
+		}
+		if !done {
+			continue
+		}
+		if _, err := s.store.FinishWGKeyRotation(ctx, r.ID, db.WGKeyRotationCompleted, now); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			return err
+		}
+		s.audit(withAuditActor(ctx, "system"), "wireguard_key.rotated", wgAuditTarget(r.OwnerType), r.OwnerID, map[string]any{
+			"rotation_id":    r.ID,
+			"new_public_key": r.NewPublicKey,
+		})
+	}
+	return nil
+}
+
+// handleEdgeWireGuardKey starts rotating the calling edge's WireGuard key.
+func (s *Server) handleEdgeWireGuardKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	node, ok := s.authenticateEdge(w, r)
+	if !ok || !requireApproved(w, node) {
+		return
+	}
+	s.startWGKeyRotation(w, r, "edge:"+node.ID, db.TunnelOwnerEdge, node.ID)
+}
+
+// handleOriginWireGuardKey starts rotating the calling origin's WireGuard key.
+func (s *Server) handleOriginWireGuardKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	origin, ok := s.authenticateOrigin(w, r)
+	if !ok {
+		return
+	}
+	s.startWGKeyRotation(w, r, "origin:"+origin.ID, db.TunnelOwnerOrigin, origin.ID)
+}
+
+func (s *Server) startWGKeyRotation(w http.ResponseWriter, r *http.Request, actor, ownerType, ownerID string) {
+	ctx := withAuditActor(r.Context(), actor)
+	var req struct {
+		PublicKey string `json:"public_key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if !validWireguardKey(req.PublicKey) {
+		writeError(w, http.StatusBadRequest, "public_key must be a base64 WireGuard key")
+		return
+	}
+	rotation, created, err := s.store.StartWGKeyRotation(ctx, ownerType, ownerID, req.PublicKey, auditActor(ctx), time.Now())
+	switch {
+	case errors.Is(err, db.ErrWGKeyUnchanged):
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	case errors.Is(err, db.ErrWGKeyRotationInProgress), errors.Is(err, db.ErrNoWGPublicKey):
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		writeStoreError(w, err, ownerType+" not found")
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		s.audit(ctx, "wireguard_key.rotation_started", wgAuditTarget(ownerType), ownerID, map[string]any{
+			"rotation_id":    rotation.ID,
+			"old_public_key": rotation.OldPublicKey,
+			"new_public_key": rotation.NewPublicKey,
+		})
+		// Without peers to wait for the rotation completes right away.
+		if err := s.advanceWGKeyRotations(ctx); err != nil {
+			s.logger.Printf("advance wireguard key rotations: %v", err)
+		}
+	}
+	out, err := s.wgKeyRotationsV2(ctx, []string{rotation.ID})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load rotation")
+		return
+	}
+	writeJSON(w, status, out[0])
+}
+
+func (s *Server) handleListWGKeyRotations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	state := q.Get("state")
+	switch state {
+	case "", db.WGKeyRotationOverlap, db.WGKeyRotationCompleted, db.WGKeyRotationCancelled:
+	default:
+		writeError(w, http.StatusBadRequest, "state must be overlap, completed or cancelled")
+		return
+	}
+	list, err := s.store.ListWGKeyRotations(r.Context(), state, q.Get("owner_id"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list key rotations")
+		return
+	}
+	ids := make([]string, 0, len(list))
+	for _, rotation := range list {
+		ids = append(ids, rotation.ID)
+	}
+	out, err := s.wgKeyRotationsV2(r.Context(), ids)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to list key rotations")
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) handleGetWGKeyRotation(w http.ResponseWriter, r *http.Request) {
+	if _, err := s.store.WGKeyRotationByID(r.Context(), r.PathValue("id")); err != nil {
+		writeStoreError(w, err, "key rotation not found")
+		return
+	}
+	out, err := s.wgKeyRotationsV2(r.Context(), []string{r.PathValue("id")})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load key rotation")
+		return
+	}
+	writeJSON(w, http.StatusOK, out[0])
+}
+
+// handleCompleteWGKeyRotation retires the old key without waiting for the
+// remaining peers, e.g. when one of them is gone for good.
+func (s *Server) handleCompleteWGKeyRotation(w http.ResponseWriter, r *http.Request) {
+	s.finishWGKeyRotation(w, r, db.WGKeyRotationCompleted, "wireguard_key.rotation_forced")
+}
+
+// handleCancelWGKeyRotation drops the new key and keeps the old one.
+func (s *Server) handleCancelWGKeyRotation(w http.ResponseWriter, r *http.Request) {
+	s.finishWGKeyRotation(w, r, db.WGKeyRotationCancelled, "wireguard_key.rotation_cancelled")
+}
+
+func (s *Server) finishWGKeyRotation(w http.ResponseWriter, r *http.Request, state, action string) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	rotation, err := s.store.FinishWGKeyRotation(r.Context(), r.PathValue("id"), state, time.Now())
+	if err != nil {
+		writeStoreError(w, err, "key rotation not found or already finished")
+		return
+	}
+	s.audit(r.Context(), action, wgAuditTarget(rotation.OwnerType), rotation.OwnerID, map[string]any{
+		"rotation_id":    rotation.ID,
+		"new_public_key": rotation.NewPublicKey,
+	})
+	out, err := s.wgKeyRotationsV2(r.Context(), []string{rotation.ID})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load key rotation")
+		return
+	}
+	writeJSON(w, http.StatusOK, out[0])
+}
+
+// wgKeyRotationsV2 loads rotations with the progress of each peer.
+func (s *Server) wgKeyRotationsV2(ctx context.Context, ids []string) ([]wgKeyRotationV2, error) {
+	out := []wgKeyRotationV2{}
+	if len(ids) == 0 {
+		return out, nil
+	}
+	snap, err := s.edgeSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	st, err := s.loadWireGuardState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]string{}
+	for _, o := range st.Origins {
+		names[o.ID] = o.Name
+	}
+	for _, e := range st.Edges {
+		names[e.ID] = e.Name
+	}
+	for _, id := range ids {
+		r, err := s.store.WGKeyRotationByID(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		v := wgKeyRotationV2{
+			ID:           r.ID,
+			OwnerType:    r.OwnerType,
+			OwnerID:      r.OwnerID,
+			OwnerName:    r.OwnerName,
+			OldPublicKey: r.OldPublicKey,
+			NewPublicKey: r.NewPublicKey,
+			State:        r.State,
+			RequestedBy:  nullString(r.RequestedBy),
+			StartedAt:    r.StartedAt,
+			FinishedAt:   nullTime(r.FinishedAt),
+			Peers:        []wgKeyRotationPeerV2{},
+		}
+		applied := map[string]time.Time{}
+		for _, p := range r.Applied {
+			applied[p.PeerID] = p.AppliedAt
+		}
+		if r.State == db.WGKeyRotationOverlap {
+			for _, t := range s.wgRotationTargets(r, st, snap) {
+				peer := wgKeyRotationPeerV2{Type: t.Type, ID: t.ID, Name: t.Name}
+				if at, ok := applied[t.ID]; ok {
+					peer.Applied, peer.AppliedAt = true, &at
+				} else {
+					v.Pending++
+				}
+				v.Peers = append(v.Peers, peer)
+			}
+		} else {
+			for _, p := range r.Applied {
+				at := p.AppliedAt
+				v.Peers = append(v.Peers, wgKeyRotationPeerV2{Type: p.PeerType, ID: p.PeerID, Name: names[p.PeerID], Applied: true, AppliedAt: &at})
+			}
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
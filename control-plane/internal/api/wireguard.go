@@ -0,0 +1,104 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+	"github.com/neo/kokoa-proxy/control-plane/internal/generator"
+)
+
+// wireGuardState is what the WireGuard configs of all nodes are rendered
+// from.
+type wireGuardState struct {
+	Origins []db.Origin
+	Edges   []db.EdgeNode
+	// NextKeys maps the nodes rotating their key to the new key.
+	NextKeys map[string]string
+}
+
+func (s *Server) loadWireGuardState(ctx context.Context) (wireGuardState, error) {
+	origins, err := s.store.ListOrigins(ctx)
+	if err != nil {
+		return wireGuardState{}, err
+	}
+	edges, err := s.store.ListEdgeNodes(ctx)
+	if err != nil {
+		return wireGuardState{}, err
+	}
+	rotations, err := s.store.ListWGKeyRotations(ctx, db.WGKeyRotationOverlap, "")
+	if err != nil {
+		return wireGuardState{}, err
+	}
+	st := wireGuardState{Origins: origins, Edges: edges, NextKeys: map[string]string{}}
+	for _, r := range rotations {
+		st.NextKeys[r.OwnerID] = r.NewPublicKey
+	}
+	return st, nil
+}
+
+// snapshotWireGuard adds the edges' WireGuard peers, addresses and keys to
+// snap.
+func snapshotWireGuard(snap *edgeSnapshot, st wireGuardState) {
+	snap.EdgePeers = generator.EdgePeers(st.Origins, st.NextKeys)
+	snap.EdgeAddrs = map[string]string{}
+	snap.EdgeKeys = map[string]string{}
+	for _, e := range st.Edges {
+		if e.WGAddr.Valid {
+			snap.EdgeAddrs[e.ID] = e.WGAddr.String
+			snap.EdgeKeys[e.ID] = e.WGPublicKey.String
+		}
+	}
+}
+
+// edgeWireGuard renders the WireGuard interface of an edge.
+func (snap edgeSnapshot) edgeWireGuard(id string) generator.WireGuardConfig {
+	return generator.BuildWireGuard(snap.EdgeAddrs[id], 0, snap.EdgeKeys[id], snap.EdgePeers)
+}
+
+// originWireGuard renders the WireGuard interface of an origin.
+func (s *Server) originWireGuard(origin db.Origin, st wireGuardState) generator.WireGuardConfig {
+	address := origin.WireguardIP
+	if network := s.tunnelNetwork(origin.WireguardIP); network != "" {
+		// The whole tunnel network is reachable through the interface.
+		address = origin.WireguardIP + network[strings.IndexByte(network, '/'):]
+	}
+	return generator.BuildWireGuard(address, generator.OriginListenPort(origin.WireguardEndpoint), origin.WireguardPublicKey,
+		generator.OriginPeers(st.Edges, st.NextKeys))
+}
+
+// handleOriginWireGuard serves the origin's WireGuard interface with every
+// active edge as a peer, as JSON or, with ?format=wg-quick, as a wg-quick
+// config. The ETag is the peers hash, so agents can poll cheaply.
+func (s *Server) handleOriginWireGuard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	origin, ok := s.authenticateOrigin(w, r)
+	if !ok {
+		return
+	}
+	st, err := s.loadWireGuardState(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to load wireguard peers")
+		return
+	}
+	config := s.originWireGuard(origin, st)
+	etag := `"` + config.PeersHash + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, config)
+	case "wg-quick":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte(config.WGQuick))
+	default:
+		writeError(w, http.StatusBadRequest, "format must be json or wg-quick")
+	}
+}
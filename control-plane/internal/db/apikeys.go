@@ -0,0 +1,205 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+type APIKey struct {
+	ID         string
+	Name       string
+	KeyHash    string `json:"-"`
+	Role       string
+	Scopes     []string
+	CreatedAt  time.Time
+	LastUsedAt sql.NullTime
+	ExpiresAt  sql.NullTime
+	RevokedAt  sql.NullTime
+}
+
+// Active reports whether the key may still be used to authenticate at the given time.
+func (k APIKey) Active(now time.Time) bool {
+	if k.RevokedAt.Valid {
+		return false
+	}
+	if k.ExpiresAt.Valid && !now.Before(k.ExpiresAt.Time) {
+		return false
+	}
+	return true
+}
+
+type CreateAPIKeyParams struct {
+	Name      string
+	KeyPlain  string
+	Role      string
+	Scopes    []string
+	ExpiresAt time.Time
+}
+
+func (s *Store) CreateAPIKey(ctx context.Context, params CreateAPIKeyParams) (APIKey, error) {
+	now := time.Now().UTC()
+	id := uuid.NewString()
+	keyHash := hashToken(params.KeyPlain)
+	role := params.Role
+	if role == "" {
+		role = RoleAdmin
+	}
+	expiresAt := toNullTime(params.ExpiresAt)
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO api_keys (id, name, key_hash, role, scopes, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, id, params.Name, keyHash, role, joinScopes(params.Scopes), now, expiresAt)
+	if err != nil {
+		return APIKey{}, fmt.Errorf("insert api key: %w", err)
+	}
+	return APIKey{
+		ID:        id,
+		Name:      params.Name,
+		KeyHash:   keyHash,
+		Role:      role,
+		Scopes:    params.Scopes,
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// EnsureAPIKey stores the given key unless a key with the same hash already exists.
+// It is used to seed the admin key configured through the environment.
+func (s *Store) EnsureAPIKey(ctx context.Context, params CreateAPIKeyParams) error {
+	role := params.Role
+	if role == "" {
+		role = RoleAdmin
+	}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO api_keys (id, name, key_hash, role, scopes, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(key_hash) DO NOTHING
+	`, uuid.NewString(), params.Name, hashToken(params.KeyPlain), role, joinScopes(params.Scopes), time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("ensure api key: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) APIKeyByToken(ctx context.Context, token string) (APIKey, error) {
+	row := s.db.QueryRowContext(ctx, `
+		SELECT id, name, key_hash, role, scopes, created_at, last_used_at, expires_at, revoked_at
+		FROM api_keys
+		WHERE key_hash = ?
+	`, hashToken(token))
+	key, err := scanAPIKey(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return APIKey{}, err
+		}
+		return APIKey{}, fmt.Errorf("select api key: %w", err)
+	}
+	return key, nil
+}
+
+func (s *Store) APIKeyByID(ctx context.Context, id string) (APIKey, error) {
+	row := s.db.QueryRowContext(ctx, `
+		SELECT id, name, key_hash, role, scopes, created_at, last_used_at, expires_at, revoked_at
+		FROM api_keys
+		WHERE id = ?
+	`, id)
+	key, err := scanAPIKey(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return APIKey{}, err
+		}
+		return APIKey{}, fmt.Errorf("select api key: %w", err)
+	}
+	return key, nil
+}
+
+func (s *Store) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, name, key_hash, role, scopes, created_at, last_used_at, expires_at, revoked_at
+		FROM api_keys
+		ORDER BY created_at DESC
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("list api keys: %w", err)
+	}
+	defer rows.Close()
+
+	var out []APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan api key: %w", err)
+		}
+		out = append(out, key)
+	}
+	return out, rows.Err()
+}
+
+// RevokeAPIKey marks the key as revoked. It returns sql.ErrNoRows when no
+// unrevoked key with the given id exists.
+func (s *Store) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL
+	`, at.UTC(), id)
+	if err != nil {
+		return fmt.Errorf("revoke api key: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *Store) TouchAPIKey(ctx context.Context, id string, at time.Time) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE api_keys SET last_used_at = ? WHERE id = ?
+	`, at.UTC(), id)
+	if err != nil {
+		return fmt.Errorf("update api key last_used_at: %w", err)
+	}
+	return nil
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var key APIKey
+	var scopes string
+	if err := row.Scan(&key.ID, &key.Name, &key.KeyHash, &key.Role, &scopes, &key.CreatedAt, &key.LastUsedAt, &key.ExpiresAt, &key.RevokedAt); err != nil {
+		return APIKey{}, err
+	}
+	key.Scopes = splitScopes(scopes)
+	return key, nil
+}
+
+func joinScopes(scopes []string) string {
+	return strings.Join(scopes, ",")
+}
+
+func splitScopes(v string) []string {
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
+
+func toNullTime(v time.Time) sql.NullTime {
+	if v.IsZero() {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: v.UTC(), Valid: true}
+}
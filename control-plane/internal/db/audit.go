@@ -0,0 +1,89 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// AuditEntry records a security-relevant action: who (Actor, such as
+// "api_key:<id>" or "edge:<id>") did what (Action) to which object. Detail
+// holds action-specific fields and never contains secrets.
+type AuditEntry struct {
+	ID         int64
+	Actor      string
+	Action     string
+	TargetType string
+	TargetID   string
+	Detail     json.RawMessage
+	CreatedAt  time.Time
+}
+
+// AppendAudit adds an entry to the audit log. A nil Detail is stored as {}
+// and a zero CreatedAt as the current time.
+func (s *Store) AppendAudit(ctx context.Context, entry AuditEntry) (AuditEntry, error) {
+	if len(entry.Detail) == 0 {
+		entry.Detail = json.RawMessage(`{}`)
+	}
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
+	}
+	entry.CreatedAt = entry.CreatedAt.UTC()
+	res, err := s.db.ExecContext(ctx, `
+		INSERT INTO audit_log (actor, action, target_type, target_id, detail, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, entry.Actor, entry.Action, entry.TargetType, entry.TargetID, string(entry.Detail), entry.CreatedAt)
+	if err != nil {
+		return AuditEntry{}, fmt.Errorf("insert audit entry: %w", err)
+	}
+	if entry.ID, err = res.LastInsertId(); err != nil {
+		return AuditEntry{}, fmt.Errorf("insert audit entry: %w", err)
+	}
+	return entry, nil
+}
+
+// AuditFilter narrows ListAuditLog. Empty fields match everything.
+type AuditFilter struct {
+	TargetType string
+	TargetID   string
+	Action     string
+	Limit      int
+}
+
+// ListAuditLog returns the newest matching entries first.
+func (s *Store) ListAuditLog(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	query := `SELECT id, actor, action, target_type, target_id, detail, created_at FROM audit_log WHERE 1 = 1`
+	var args []any
+	if filter.TargetType != "" {
+		query += ` AND target_type = ?`
+		args = append(args, filter.TargetType)
+	}
+	if filter.TargetID != "" {
+		query += ` AND target_id = ?`
+		args = append(args, filter.TargetID)
+	}
+	if filter.Action != "" {
+		query += ` AND action = ?`
+		args = append(args, filter.Action)
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, filter.Limit)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list audit log: %w", err)
+	}
+	defer rows.Close()
+
+	var out []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		var detail string
+		if err := rows.Scan(&e.ID, &e.Actor, &e.Action, &e.TargetType, &e.TargetID, &detail, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan audit entry: %w", err)
+		}
+		e.Detail = json.RawMessage(detail)
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
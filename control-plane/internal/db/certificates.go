@@ -0,0 +1,162 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Certificate is the issuance state of one hostname. CertPEM is empty until
+// the first successful issuance; KeyEncrypted is sealed by the caller and never
+// serialised.
+type Certificate struct {
+	Hostname     string
+	CertPEM      string
+	KeyEncrypted string `json:"-"`
+	NotAfter     sql.NullTime
+	IssuedAt     sql.NullTime
+	LastError    sql.NullString
+	Failures     int
+	RetryAt      sql.NullTime
+	UpdatedAt    time.Time
+}
+
+// Issued reports whether a certificate has been stored for the hostname.
+func (c Certificate) Issued() bool {
+	return c.CertPEM != ""
+}
+
+type SaveCertificateParams struct {
+	Hostname     string
+	CertPEM      string
+	KeyEncrypted string
+	NotAfter     time.Time
+	IssuedAt     time.Time
+}
+
+// SaveCertificate stores a freshly issued certificate and clears any failure state.
+func (s *Store) SaveCertificate(ctx context.Context, params SaveCertificateParams) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO certificates (hostname, cert_pem, key_encrypted, not_after, issued_at, last_error, failures, retry_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, NULL, 0, NULL, ?)
+		ON CONFLICT(hostname) DO UPDATE SET
+			cert_pem = excluded.cert_pem,
+			key_encrypted = excluded.key_encrypted,
+			not_after = excluded.not_after,
+			issued_at = excluded.issued_at,
+			last_error = NULL,
+			failures = 0,
+			retry_at = NULL,
+			updated_at = excluded.updated_at
+	`, params.Hostname, params.CertPEM, params.KeyEncrypted, params.NotAfter.UTC(), params.IssuedAt.UTC(), time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("save certificate: %w", err)
+	}
+	s.changed()
+	return nil
+}
+
+// RecordCertificateFailure notes a failed issuance attempt. Any previously
+// issued certificate is kept so edges continue serving it until it expires.
+func (s *Store) RecordCertificateFailure(ctx context.Context, hostname, message string, retryAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO certificates (hostname, last_error, failures, retry_at, updated_at)
+		VALUES (?, ?, 1, ?, ?)
+		ON CONFLICT(hostname) DO UPDATE SET
+			last_error = excluded.last_error,
+			failures = certificates.failures + 1,
+			retry_at = excluded.retry_at,
+			updated_at = excluded.updated_at
+	`, hostname, message, retryAt.UTC(), time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("record certificate failure: %w", err)
+	}
+	return nil
+}
+
+// deleteOrphanedCertificates removes the certificates and keys of hostnames
+// that no route references any more, so they are neither renewed nor handed
+// to edges.
+func deleteOrphanedCertificates(ctx context.Context, tx *sql.Tx) error {
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM certificates WHERE hostname NOT IN (SELECT hostname FROM routes)
+	`); err != nil {
+		return fmt.Errorf("delete orphaned certificates: %w", err)
+	}
+	return nil
+}
+
+const certificateColumns = `hostname, cert_pem, key_encrypted, not_after, issued_at, last_error, failures, retry_at, updated_at`
+
+func scanCertificate(row rowScanner) (Certificate, error) {
+	var c Certificate
+	err := row.Scan(&c.Hostname, &c.CertPEM, &c.KeyEncrypted, &c.NotAfter, &c.IssuedAt, &c.LastError, &c.Failures, &c.RetryAt, &c.UpdatedAt)
+	return c, err
+}
+
+func (s *Store) CertificateByHostname(ctx context.Context, hostname string) (Certificate, error) {
+	c, err := scanCertificate(s.db.QueryRowContext(ctx, `SELECT `+certificateColumns+` FROM certificates WHERE hostname = ?`, hostname))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Certificate{}, err
+		}
+		return Certificate{}, fmt.Errorf("select certificate: %w", err)
+	}
+	return c, nil
+}
+
+func (s *Store) ListCertificates(ctx context.Context) ([]Certificate, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+certificateColumns+` FROM certificates ORDER BY hostname`)
+	if err != nil {
+		return nil, fmt.Errorf("list certificates: %w", err)
+	}
+	defer rows.Close()
+
+	var out []Certificate
+	for rows.Next() {
+		c, err := scanCertificate(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan certificate: %w", err)
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// ACMEAccount is the account key registered with an ACME directory.
+type ACMEAccount struct {
+	DirectoryURL string
+	Email        string
+	KeyEncrypted string `json:"-"`
+	CreatedAt    time.Time
+}
+
+func (s *Store) ACMEAccountByDirectory(ctx context.Context, directoryURL string) (ACMEAccount, error) {
+	var a ACMEAccount
+	err := s.db.QueryRowContext(ctx, `
+		SELECT directory_url, email, key_encrypted, created_at
+		FROM acme_accounts
+		WHERE directory_url = ?
+	`, directoryURL).Scan(&a.DirectoryURL, &a.Email, &a.KeyEncrypted, &a.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ACMEAccount{}, err
+		}
+		return ACMEAccount{}, fmt.Errorf("select acme account: %w", err)
+	}
+	return a, nil
+}
+
+func (s *Store) SaveACMEAccount(ctx context.Context, account ACMEAccount) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO acme_accounts (directory_url, email, key_encrypted, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(directory_url) DO UPDATE SET email = excluded.email, key_encrypted = excluded.key_encrypted
+	`, account.DirectoryURL, account.Email, account.KeyEncrypted, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("save acme account: %w", err)
+	}
+	return nil
+}
@@ -6,14 +6,23 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"net/netip"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/neo/kokoa-proxy/control-plane/internal/ipam"
+	"github.com/neo/kokoa-proxy/control-plane/internal/secrets"
 	_ "modernc.org/sqlite" // SQLite driver
 )
 
 type Store struct {
-	db *sql.DB
+	db          *sql.DB
+	secrets     *secrets.Box
+	tunnelPools []netip.Prefix
+
+	mu        sync.Mutex
+	listeners []func()
 }
 
 func Open(path string) (*Store, error) {
@@ -28,6 +37,25 @@ func Open(path string) (*Store, error) {
 	return &Store{db: dbh}, nil
 }
 
+// OnChange registers fn to run after every committed mutation of origins,
+// routes, edge nodes or certificates. Bookkeeping writes such as
+// last-seen timestamps, heartbeats and config generations do not fire it.
+// fn runs synchronously on the mutating goroutine and must not block.
+func (s *Store) OnChange(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+func (s *Store) changed() {
+	s.mu.Lock()
+	listeners := append([]func(){}, s.listeners...)
+	s.mu.Unlock()
+	for _, fn := range listeners {
+		fn()
+	}
+}
+
 func (s *Store) Close() error {
 	if s == nil || s.db == nil {
 		return nil
@@ -35,146 +63,434 @@ func (s *Store) Close() error {
 	return s.db.Close()
 }
 
-func (s *Store) Migrate(ctx context.Context) error {
-	if _, err := s.db.ExecContext(ctx, schemaSQL); err != nil {
-		return fmt.Errorf("apply schema: %w", err)
-	}
-	return nil
-}
-
+// Origin is a backend reachable over WireGuard. The private key is sealed at
+// rest and never serialised; HasWireguardPrivateKey tells clients whether one
+// is stored.
 type Origin struct {
 	ID                           string
 	Name                         string
 	WireguardIP                  string
 	WireguardPublicKey           string
-	WireguardPrivateKeyEncrypted string
-	CreatedAt                    time.Time
+	WireguardPrivateKeyEncrypted string `json:"-"`
+	HasWireguardPrivateKey       bool
+	// WireguardEndpoint is the host:port edges dial to reach the origin.
+	WireguardEndpoint string
+	CreatedAt         time.Time
+	// Origins that enrolled themselves hold a token for the origin agent.
+	TokenHash      sql.NullString `json:"-"`
+	RegisteredFrom sql.NullString
+	LastSeen       sql.NullTime
+	JoinTokenID    sql.NullString
+	// AppliedWGHash is the peers_hash of the WireGuard config the origin
+	// agent last applied.
+	AppliedWGHash sql.NullString
 }
 
+// CreateOriginParams carries the WireGuard private key in plaintext; the store
+// seals it before writing and refuses it when no secrets key is configured.
 type CreateOriginParams struct {
-	Name                         string
-	WireguardIP                  string
-	WireguardPublicKey           string
-	WireguardPrivateKeyEncrypted string
+	Name string
+	// WireguardIP is allocated from the tunnel pools when empty.
+	WireguardIP         string
+	WireguardPublicKey  string
+	WireguardPrivateKey string
+	WireguardEndpoint   string
 }
 
 func (s *Store) CreateOrigin(ctx context.Context, params CreateOriginParams) (Origin, error) {
+	sealed, err := s.sealSecret(params.WireguardPrivateKey, true)
+	if err != nil {
+		return Origin{}, err
+	}
 	now := time.Now().UTC()
 	id := uuid.NewString()
-	_, err := s.db.ExecContext(ctx, `
-		INSERT INTO origins (id, name, wireguard_ip, wireguard_public_key, wireguard_private_key_encrypted, created_at)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`, id, params.Name, params.WireguardIP, params.WireguardPublicKey, params.WireguardPrivateKeyEncrypted, now)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Origin{}, fmt.Errorf("begin: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	addr, err := s.assignOriginTunnelAddr(ctx, tx, id, params.WireguardIP, now)
+	if err != nil {
+		return Origin{}, err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO origins (id, name, wireguard_ip, wireguard_public_key, wireguard_private_key_encrypted, wireguard_endpoint, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, id, params.Name, addr.String(), params.WireguardPublicKey, sealed, nullIfEmpty(params.WireguardEndpoint), now)
 	if err != nil {
 		return Origin{}, fmt.Errorf("insert origin: %w", err)
 	}
+	if err := tx.Commit(); err != nil {
+		return Origin{}, err
+	}
+	s.changed()
 	return Origin{
 		ID:                           id,
 		Name:                         params.Name,
-		WireguardIP:                  params.WireguardIP,
+		WireguardIP:                  addr.String(),
 		WireguardPublicKey:           params.WireguardPublicKey,
-		WireguardPrivateKeyEncrypted: params.WireguardPrivateKeyEncrypted,
+		WireguardPrivateKeyEncrypted: sealed,
+		HasWireguardPrivateKey:       sealed != "",
+		WireguardEndpoint:            params.WireguardEndpoint,
 		CreatedAt:                    now,
 	}, nil
 }
 
-type Route struct {
-	ID         string
-	Hostname   string
-	OriginID   string
-	TargetPort int
-	CreatedAt  time.Time
+const originColumns = `id, name, wireguard_ip, wireguard_public_key, wireguard_private_key_encrypted, created_at,
+	token_hash, registered_from, last_seen, join_token_id, wireguard_endpoint, applied_wg_hash`
+
+func scanOrigin(row rowScanner) (Origin, error) {
+	var o Origin
+	var publicKey, privateKey, endpoint sql.NullString
+	if err := row.Scan(&o.ID, &o.Name, &o.WireguardIP, &publicKey, &privateKey, &o.CreatedAt,
+		&o.TokenHash, &o.RegisteredFrom, &o.LastSeen, &o.JoinTokenID, &endpoint, &o.AppliedWGHash); err != nil {
+		return Origin{}, err
+	}
+	o.WireguardEndpoint = endpoint.String
+	o.WireguardPublicKey = publicKey.String
+	o.WireguardPrivateKeyEncrypted = privateKey.String
+	o.HasWireguardPrivateKey = privateKey.String != ""
+	return o, nil
 }
 
-type CreateRouteParams struct {
-	Hostname   string
-	OriginID   string
-	TargetPort int
+func (s *Store) OriginByID(ctx context.Context, id string) (Origin, error) {
+	o, err := scanOrigin(s.db.QueryRowContext(ctx, `SELECT `+originColumns+` FROM origins WHERE id = ?`, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Origin{}, err
+		}
+		return Origin{}, fmt.Errorf("select origin: %w", err)
+	}
+	return o, nil
 }
 
-func (s *Store) CreateRoute(ctx context.Context, params CreateRouteParams) (Route, error) {
-	now := time.Now().UTC()
-	id := uuid.NewString()
-	_, err := s.db.ExecContext(ctx, `
-		INSERT INTO routes (id, hostname, origin_id, target_port, created_at)
-		VALUES (?, ?, ?, ?, ?)
-	`, id, params.Hostname, params.OriginID, params.TargetPort, now)
+// OriginPrivateKey returns the plaintext WireGuard private key of an origin,
+// or an empty string when none is stored.
+func (s *Store) OriginPrivateKey(ctx context.Context, id string) (string, error) {
+	o, err := s.OriginByID(ctx, id)
 	if err != nil {
-		return Route{}, fmt.Errorf("insert route: %w", err)
-	}
-	return Route{
-		ID:         id,
-		Hostname:   params.Hostname,
-		OriginID:   params.OriginID,
-		TargetPort: params.TargetPort,
-		CreatedAt:  now,
-	}, nil
+		return "", err
+	}
+	return s.openSecret(o.WireguardPrivateKeyEncrypted)
+}
+
+// UpdateOriginParams replaces every mutable column of an origin. A nil
+// WireguardPrivateKey keeps the stored key; an empty one removes it. An empty
+// WireguardIP allocates a new address.
+type UpdateOriginParams struct {
+	Name                string
+	WireguardIP         string
+	WireguardPublicKey  string
+	WireguardPrivateKey *string
+	WireguardEndpoint   string
 }
 
+func (s *Store) UpdateOrigin(ctx context.Context, id string, params UpdateOriginParams) (Origin, error) {
+	var sealed string
+	if params.WireguardPrivateKey != nil {
+		var err error
+		if sealed, err = s.sealSecret(*params.WireguardPrivateKey, true); err != nil {
+			return Origin{}, err
+		}
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Origin{}, fmt.Errorf("begin: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT 1 FROM origins WHERE id = ?`, id).Scan(&exists); err != nil {
+		return Origin{}, err
+	}
+	addr, err := s.assignOriginTunnelAddr(ctx, tx, id, params.WireguardIP, time.Now())
+	if err != nil {
+		return Origin{}, err
+	}
+	query := `UPDATE origins SET name = ?, wireguard_ip = ?, wireguard_public_key = ?, wireguard_endpoint = ? WHERE id = ?`
+	args := []any{params.Name, addr.String(), params.WireguardPublicKey, nullIfEmpty(params.WireguardEndpoint), id}
+	if params.WireguardPrivateKey != nil {
+		query = `UPDATE origins SET name = ?, wireguard_ip = ?, wireguard_public_key = ?, wireguard_endpoint = ?, wireguard_private_key_encrypted = ? WHERE id = ?`
+		args = []any{params.Name, addr.String(), params.WireguardPublicKey, nullIfEmpty(params.WireguardEndpoint), sealed, id}
+	}
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return Origin{}, fmt.Errorf("update origin: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return Origin{}, err
+	}
+	s.changed()
+	return s.OriginByID(ctx, id)
+}
+
+// assignOriginTunnelAddr records the origin's tunnel address, allocating one
+// when wgIP is empty.
+func (s *Store) assignOriginTunnelAddr(ctx context.Context, tx *sql.Tx, id, wgIP string, at time.Time) (netip.Addr, error) {
+	if err := assignTunnelAddr(ctx, tx, TunnelOwnerOrigin, id, netip.Addr{}, at); err != nil {
+		return netip.Addr{}, err
+	}
+	var addr netip.Addr
+	var err error
+	if wgIP == "" {
+		addr, err = s.allocateTunnelAddr(ctx, tx)
+	} else if addr, err = ipam.ParseAddr(wgIP); err != nil {
+		err = fmt.Errorf("invalid wg_ip %q", wgIP)
+	}
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr, assignTunnelAddr(ctx, tx, TunnelOwnerOrigin, id, addr, at)
+}
+
+// DeleteOrigin removes an origin together with its route backends. Routes left
+// without any backend are removed as well, and routes left with only backup
+// backends promote them, since nginx rejects an upstream of backups only.
+func (s *Store) DeleteOrigin(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM origins WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("delete origin: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if err := assignTunnelAddr(ctx, tx, TunnelOwnerOrigin, id, netip.Addr{}, time.Now()); err != nil {
+		return err
+	}
+	if err := deleteWGKeyRotations(ctx, tx, TunnelOwnerOrigin, id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM routes WHERE id NOT IN (SELECT route_id FROM route_backends)
+	`); err != nil {
+		return fmt.Errorf("delete orphaned routes: %w", err)
+	}
+	if err := deleteOrphanedCertificates(ctx, tx); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE route_backends SET backup = 0
+		WHERE route_id IN (SELECT route_id FROM route_backends GROUP BY route_id HAVING MIN(backup) = 1)
+	`); err != nil {
+		return fmt.Errorf("promote backup backends: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.changed()
+	return nil
+}
+
+// Edge node states. Pending edges hold a token but receive no configuration
+// until they are approved. Cordoned and draining edges keep serving but are
+// left out of DNS answers; retired edges have their token revoked.
+const (
+	EdgeStatePending  = "pending"
+	EdgeStateActive   = "active"
+	EdgeStateCordoned = "cordoned"
+	EdgeStateDraining = "draining"
+	EdgeStateRetired  = "retired"
+)
+
 type EdgeNode struct {
 	ID           string
 	Name         string
-	TokenHash    string
+	TokenHash    string `json:"-"`
 	CreatedAt    time.Time
 	LastSeen     sql.NullTime
 	WGAddr       sql.NullString
 	WGEndpoint   sql.NullString
 	WGPeerPubKey sql.NullString
 	WGAllowedIPs sql.NullString
+	GroupName    sql.NullString
+	Labels       map[string]string
+	// JoinTokenID is the join token the edge registered with, if any.
+	JoinTokenID sql.NullString
+	State       string
+	// RegisteredFrom and WGPublicKey describe the registration for review.
+	RegisteredFrom sql.NullString
+	WGPublicKey    sql.NullString
+	ApprovedAt     sql.NullTime
+	ApprovedBy     sql.NullString
+	// PublicAddr is the address DNS answers point at; RegisteredFrom is
+	// used while it is unset.
+	PublicAddr sql.NullString
+	// DrainUntil ends the drain period of a draining edge.
+	DrainUntil     sql.NullTime
+	StateChangedAt sql.NullTime
+	StateChangedBy sql.NullString
+
+	AppliedConfigHash sql.NullString
+	ApplyStatus       sql.NullString
+	ApplyError        sql.NullString
+	AgentVersion      sql.NullString
+	NginxVersion      sql.NullString
+	UptimeSeconds     sql.NullInt64
+	StatusReportedAt  sql.NullTime
+	// AppliedWGHash is the peers_hash of the WireGuard config the agent
+	// last applied; null for edges that do not sync WireGuard.
+	AppliedWGHash sql.NullString
+	// StaleAt is set while the edge has not been heard from for longer
+	// than the stale threshold.
+	StaleAt sql.NullTime
+
+	// Token lifecycle. A null TokenExpiresAt never expires; a revoked token
+	// and its predecessor are refused until the token is rotated.
+	TokenIssuedAt          sql.NullTime
+	TokenExpiresAt         sql.NullTime
+	TokenRevokedAt         sql.NullTime
+	PreviousTokenExpiresAt sql.NullTime
+	// UsingPreviousToken is set by EdgeNodeByToken when the request
+	// authenticated with the token replaced by the last rotation.
+	UsingPreviousToken bool `json:"-"`
+
+	// ConfigsBehind is the number of config generations produced after the
+	// one the edge last applied, or -1 when that is unknown.
+	ConfigsBehind int
 }
 
 type RegisterEdgeNodeParams struct {
-	TokenPlain   string
-	Name         string
-	WGAddr       string
-	WGEndpoint   string
-	WGPeerPubKey string
-	WGAllowedIPs string
+	TokenPlain string
+	Name       string
+	WGAddr     string
+	// AllocateWGAddr ignores WGAddr and allocates a host address from the
+	// tunnel pools instead.
+	AllocateWGAddr bool
+	WGEndpoint     string
+	WGPeerPubKey   string
+	WGAllowedIPs   string
+	// TokenExpiresAt is zero for tokens that never expire.
+	TokenExpiresAt time.Time
+	GroupName      string
+	Labels         map[string]string
+	// JoinTokenID, when set, is consumed in the same transaction; the
+	// registration fails with ErrJoinTokenUsedUp if it is no longer usable.
+	JoinTokenID string
+	// State defaults to EdgeStateActive.
+	State          string
+	RegisteredFrom string
+	WGPublicKey    string
 }
 
 func (s *Store) RegisterEdgeNode(ctx context.Context, params RegisterEdgeNodeParams) (EdgeNode, error) {
 	now := time.Now().UTC()
 	id := uuid.NewString()
-	tokenHash := sha256.Sum256([]byte(params.TokenPlain))
-	_, err := s.db.ExecContext(ctx, `
-		INSERT INTO edge_nodes (id, name, token_hash, wg_addr, wg_endpoint, wg_peer_pubkey, wg_allowed_ips, created_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
-	`, id, params.Name, fmt.Sprintf("%x", tokenHash[:]), nullIfEmpty(params.WGAddr), nullIfEmpty(params.WGEndpoint), nullIfEmpty(params.WGPeerPubKey), nullIfEmpty(params.WGAllowedIPs), now)
+	tokenHash := hashToken(params.TokenPlain)
+	labels, err := encodeLabels(params.Labels)
+	if err != nil {
+		return EdgeNode{}, err
+	}
+	state := params.State
+	if state == "" {
+		state = EdgeStateActive
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return EdgeNode{}, fmt.Errorf("begin: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if params.JoinTokenID != "" {
+		if err := consumeJoinToken(ctx, tx, params.JoinTokenID, id, params.Name, now); err != nil {
+			return EdgeNode{}, err
+		}
+	}
+	if params.WGAddr, err = s.assignEdgeTunnelAddr(ctx, tx, id, params.WGAddr, params.AllocateWGAddr, now); err != nil {
+		return EdgeNode{}, err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO edge_nodes (id, name, token_hash, wg_addr, wg_endpoint, wg_peer_pubkey, wg_allowed_ips, created_at, token_issued_at, token_expires_at,
+			group_name, labels, join_token_id, state, registered_from, wg_public_key)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, id, params.Name, tokenHash, nullIfEmpty(params.WGAddr), nullIfEmpty(params.WGEndpoint), nullIfEmpty(params.WGPeerPubKey), nullIfEmpty(params.WGAllowedIPs), now,
+		now, toNullTime(params.TokenExpiresAt), nullIfEmpty(params.GroupName), labels, nullIfEmpty(params.JoinTokenID),
+		state, nullIfEmpty(params.RegisteredFrom), nullIfEmpty(params.WGPublicKey))
 	if err != nil {
 		return EdgeNode{}, fmt.Errorf("insert edge node: %w", err)
 	}
+	if err := tx.Commit(); err != nil {
+		return EdgeNode{}, err
+	}
+	s.changed()
 	return EdgeNode{
-		ID:           id,
-		Name:         params.Name,
-		TokenHash:    fmt.Sprintf("%x", tokenHash[:]),
-		CreatedAt:    now,
-		WGAddr:       toNullString(params.WGAddr),
-		WGEndpoint:   toNullString(params.WGEndpoint),
-		WGPeerPubKey: toNullString(params.WGPeerPubKey),
-		WGAllowedIPs: toNullString(params.WGAllowedIPs),
+		ID:             id,
+		Name:           params.Name,
+		TokenHash:      tokenHash,
+		CreatedAt:      now,
+		WGAddr:         toNullString(params.WGAddr),
+		WGEndpoint:     toNullString(params.WGEndpoint),
+		WGPeerPubKey:   toNullString(params.WGPeerPubKey),
+		WGAllowedIPs:   toNullString(params.WGAllowedIPs),
+		GroupName:      toNullString(params.GroupName),
+		Labels:         decodeLabels(labels),
+		JoinTokenID:    toNullString(params.JoinTokenID),
+		State:          state,
+		RegisteredFrom: toNullString(params.RegisteredFrom),
+		WGPublicKey:    toNullString(params.WGPublicKey),
+		TokenIssuedAt:  sql.NullTime{Time: now, Valid: true},
+		TokenExpiresAt: toNullTime(params.TokenExpiresAt),
+		ConfigsBehind:  -1,
 	}, nil
 }
 
-func (s *Store) EdgeNodeByToken(ctx context.Context, token string) (EdgeNode, error) {
-	tokenHash := sha256.Sum256([]byte(token))
-	var node EdgeNode
-	err := s.db.QueryRowContext(ctx, `
-		SELECT id, name, token_hash, wg_addr, wg_endpoint, wg_peer_pubkey, wg_allowed_ips, created_at, last_seen
+// edgeNodeColumns must be selected FROM edge_nodes without an alias since the
+// drift subquery refers to the outer row.
+const edgeNodeColumns = `id, name, token_hash, wg_addr, wg_endpoint, wg_peer_pubkey, wg_allowed_ips, created_at, last_seen,
+	applied_config_hash, apply_status, apply_error, agent_version, nginx_version, uptime_seconds, status_reported_at, stale_at,
+	token_issued_at, token_expires_at, token_revoked_at, previous_token_expires_at, group_name, labels, join_token_id,
+	state, registered_from, wg_public_key, approved_at, approved_by, applied_wg_hash,
+	public_addr, drain_until, state_changed_at, state_changed_by,
+	CASE WHEN EXISTS (SELECT 1 FROM config_generation_hashes WHERE config_hash = edge_nodes.applied_config_hash)
+		THEN (SELECT COUNT(*) FROM config_generations g WHERE g.id > (
+			SELECT MAX(generation_id) FROM config_generation_hashes WHERE config_hash = edge_nodes.applied_config_hash))
+		ELSE -1 END`
+
+func scanEdgeNode(row rowScanner, extra ...any) (EdgeNode, error) {
+	var n EdgeNode
+	var labels string
+	dest := []any{&n.ID, &n.Name, &n.TokenHash, &n.WGAddr, &n.WGEndpoint, &n.WGPeerPubKey, &n.WGAllowedIPs, &n.CreatedAt, &n.LastSeen,
+		&n.AppliedConfigHash, &n.ApplyStatus, &n.ApplyError, &n.AgentVersion, &n.NginxVersion, &n.UptimeSeconds, &n.StatusReportedAt,
+		&n.StaleAt, &n.TokenIssuedAt, &n.TokenExpiresAt, &n.TokenRevokedAt, &n.PreviousTokenExpiresAt, &n.GroupName, &labels, &n.JoinTokenID,
+		&n.State, &n.RegisteredFrom, &n.WGPublicKey, &n.ApprovedAt, &n.ApprovedBy, &n.AppliedWGHash,
+		&n.PublicAddr, &n.DrainUntil, &n.StateChangedAt, &n.StateChangedBy, &n.ConfigsBehind}
+	err := row.Scan(append(dest, extra...)...)
+	n.Labels = decodeLabels(labels)
+	return n, err
+}
+
+// EdgeNodeByToken resolves the edge node a token authenticates at the given
+// time: its current token unless expired, or its previous token within the
+// rotation grace window. Revoked tokens match nothing.
+func (s *Store) EdgeNodeByToken(ctx context.Context, token string, at time.Time) (EdgeNode, error) {
+	hash := hashToken(token)
+	at = at.UTC()
+	var current bool
+	node, err := scanEdgeNode(s.db.QueryRowContext(ctx, `
+		SELECT `+edgeNodeColumns+`, token_hash = ?
 		FROM edge_nodes
-		WHERE token_hash = ?
-	`, fmt.Sprintf("%x", tokenHash[:])).Scan(&node.ID, &node.Name, &node.TokenHash, &node.WGAddr, &node.WGEndpoint, &node.WGPeerPubKey, &node.WGAllowedIPs, &node.CreatedAt, &node.LastSeen)
+		WHERE token_revoked_at IS NULL AND (
+			(token_hash = ? AND (token_expires_at IS NULL OR token_expires_at > ?))
+			OR (previous_token_hash = ? AND previous_token_expires_at > ?))
+	`, hash, hash, at, hash, at), &current)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return EdgeNode{}, err
 		}
 		return EdgeNode{}, fmt.Errorf("select edge node: %w", err)
 	}
+	node.UsingPreviousToken = !current
 	return node, nil
 }
 
 func (s *Store) TouchEdgeNode(ctx context.Context, id string, at time.Time) error {
 	_, err := s.db.ExecContext(ctx, `
-		UPDATE edge_nodes SET last_seen = ? WHERE id = ?
+		UPDATE edge_nodes SET last_seen = ?, stale_at = NULL WHERE id = ?
 	`, at.UTC(), id)
 	if err != nil {
 		return fmt.Errorf("update last_seen: %w", err)
@@ -182,39 +498,137 @@ func (s *Store) TouchEdgeNode(ctx context.Context, id string, at time.Time) erro
 	return nil
 }
 
-type RouteWithOrigin struct {
-	Hostname    string
-	TargetPort  int
-	OriginID    string
-	OriginName  string
-	WireguardIP string
+func (s *Store) EdgeNodeByID(ctx context.Context, id string) (EdgeNode, error) {
+	node, err := scanEdgeNode(s.db.QueryRowContext(ctx, `SELECT `+edgeNodeColumns+` FROM edge_nodes WHERE id = ?`, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return EdgeNode{}, err
+		}
+		return EdgeNode{}, fmt.Errorf("select edge node: %w", err)
+	}
+	return node, nil
 }
 
-func (s *Store) ListRoutes(ctx context.Context) ([]RouteWithOrigin, error) {
-	rows, err := s.db.QueryContext(ctx, `
-		SELECT r.hostname, r.target_port, r.origin_id, o.name, o.wireguard_ip
-		FROM routes r
-		INNER JOIN origins o ON r.origin_id = o.id
-	`)
+// UpdateEdgeNodeParams replaces the descriptive and WireGuard columns of an edge node.
+type UpdateEdgeNodeParams struct {
+	Name   string
+	WGAddr string
+	// AllocateWGAddr ignores WGAddr and allocates a host address from the
+	// tunnel pools instead.
+	AllocateWGAddr bool
+	WGEndpoint     string
+	WGPeerPubKey   string
+	WGAllowedIPs   string
+	GroupName      string
+	Labels         map[string]string
+	PublicAddr     string
+}
+
+func (s *Store) UpdateEdgeNode(ctx context.Context, id string, params UpdateEdgeNodeParams) (EdgeNode, error) {
+	labels, err := encodeLabels(params.Labels)
 	if err != nil {
-		return nil, fmt.Errorf("list routes: %w", err)
+		return EdgeNode{}, err
 	}
-	defer rows.Close()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return EdgeNode{}, fmt.Errorf("begin: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
 
-	var out []RouteWithOrigin
-	for rows.Next() {
-		var r RouteWithOrigin
-		if err := rows.Scan(&r.Hostname, &r.TargetPort, &r.OriginID, &r.OriginName, &r.WireguardIP); err != nil {
-			return nil, fmt.Errorf("scan route: %w", err)
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT 1 FROM edge_nodes WHERE id = ?`, id).Scan(&exists); err != nil {
+		return EdgeNode{}, err
+	}
+	wgAddr, err := s.assignEdgeTunnelAddr(ctx, tx, id, params.WGAddr, params.AllocateWGAddr, time.Now())
+	if err != nil {
+		return EdgeNode{}, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE edge_nodes
+		SET name = ?, wg_addr = ?, wg_endpoint = ?, wg_peer_pubkey = ?, wg_allowed_ips = ?, group_name = ?, labels = ?, public_addr = ?
+		WHERE id = ?
+	`, params.Name, nullIfEmpty(wgAddr), nullIfEmpty(params.WGEndpoint), nullIfEmpty(params.WGPeerPubKey), nullIfEmpty(params.WGAllowedIPs),
+		nullIfEmpty(params.GroupName), labels, nullIfEmpty(params.PublicAddr), id); err != nil {
+		return EdgeNode{}, fmt.Errorf("update edge node: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return EdgeNode{}, err
+	}
+	s.changed()
+	return s.EdgeNodeByID(ctx, id)
+}
+
+// ApproveEdgeNode moves a pending edge node to the active state. It returns
+// sql.ErrNoRows when no pending edge node has the given id.
+func (s *Store) ApproveEdgeNode(ctx context.Context, id, approvedBy string, at time.Time) (EdgeNode, error) {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE edge_nodes SET state = ?, approved_at = ?, approved_by = ? WHERE id = ? AND state = ?
+	`, EdgeStateActive, at.UTC(), approvedBy, id, EdgeStatePending)
+	if err != nil {
+		return EdgeNode{}, fmt.Errorf("approve edge node: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return EdgeNode{}, sql.ErrNoRows
+	}
+	s.changed()
+	return s.EdgeNodeByID(ctx, id)
+}
+
+// DeleteEdgeNode removes an edge node, which also invalidates its token and
+// releases its tunnel address.
+func (s *Store) DeleteEdgeNode(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM edge_nodes WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("delete edge node: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if err := assignTunnelAddr(ctx, tx, TunnelOwnerEdge, id, netip.Addr{}, time.Now()); err != nil {
+		return err
+	}
+	if err := deleteWGKeyRotations(ctx, tx, TunnelOwnerEdge, id); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.changed()
+	return nil
+}
+
+// assignEdgeTunnelAddr records the address of an edge's wg_addr and returns
+// the wg_addr to store: the one given, or a host prefix of a newly allocated
+// address when allocate is set.
+func (s *Store) assignEdgeTunnelAddr(ctx context.Context, tx *sql.Tx, id, wgAddr string, allocate bool, at time.Time) (string, error) {
+	if err := assignTunnelAddr(ctx, tx, TunnelOwnerEdge, id, netip.Addr{}, at); err != nil {
+		return "", err
+	}
+	var addr netip.Addr
+	var err error
+	switch {
+	case allocate:
+		if addr, err = s.allocateTunnelAddr(ctx, tx); err != nil {
+			return "", err
+		}
+		wgAddr = ipam.HostPrefix(addr).String()
+	case wgAddr != "":
+		if addr, err = ipam.ParseAddr(wgAddr); err != nil {
+			return "", fmt.Errorf("invalid wg_addr %q", wgAddr)
 		}
-		out = append(out, r)
 	}
-	return out, rows.Err()
+	return wgAddr, assignTunnelAddr(ctx, tx, TunnelOwnerEdge, id, addr, at)
 }
 
 func (s *Store) ListEdgeNodes(ctx context.Context) ([]EdgeNode, error) {
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, name, token_hash, wg_addr, wg_endpoint, wg_peer_pubkey, wg_allowed_ips, created_at, last_seen
+		SELECT `+edgeNodeColumns+`
 		FROM edge_nodes
 		ORDER BY created_at DESC
 	`)
@@ -225,8 +639,8 @@ func (s *Store) ListEdgeNodes(ctx context.Context) ([]EdgeNode, error) {
 
 	var out []EdgeNode
 	for rows.Next() {
-		var n EdgeNode
-		if err := rows.Scan(&n.ID, &n.Name, &n.TokenHash, &n.WGAddr, &n.WGEndpoint, &n.WGPeerPubKey, &n.WGAllowedIPs, &n.CreatedAt, &n.LastSeen); err != nil {
+		n, err := scanEdgeNode(rows)
+		if err != nil {
 			return nil, fmt.Errorf("scan edge node: %w", err)
 		}
 		out = append(out, n)
@@ -234,6 +648,25 @@ func (s *Store) ListEdgeNodes(ctx context.Context) ([]EdgeNode, error) {
 	return out, rows.Err()
 }
 
+// deleteByID deletes a row by primary key and returns sql.ErrNoRows when nothing matched.
+func (s *Store) deleteByID(ctx context.Context, table, id string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM `+table+` WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("delete from %s: %w", table, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	s.changed()
+	return nil
+}
+
+// hashToken returns the hex-encoded SHA-256 digest stored in place of bearer secrets.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return fmt.Sprintf("%x", sum[:])
+}
+
 func nullIfEmpty(v string) any {
 	if v == "" {
 		return nil
@@ -250,7 +683,7 @@ func toNullString(v string) sql.NullString {
 
 func (s *Store) ListOrigins(ctx context.Context) ([]Origin, error) {
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, name, wireguard_ip, wireguard_public_key, wireguard_private_key_encrypted, created_at
+		SELECT `+originColumns+`
 		FROM origins
 		ORDER BY created_at DESC
 	`)
@@ -261,8 +694,8 @@ func (s *Store) ListOrigins(ctx context.Context) ([]Origin, error) {
 
 	var out []Origin
 	for rows.Next() {
-		var o Origin
-		if err := rows.Scan(&o.ID, &o.Name, &o.WireguardIP, &o.WireguardPublicKey, &o.WireguardPrivateKeyEncrypted, &o.CreatedAt); err != nil {
+		o, err := scanOrigin(rows)
+		if err != nil {
 			return nil, fmt.Errorf("scan origin: %w", err)
 		}
 		out = append(out, o)
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// ErrEdgeStateConflict is returned when an edge node is not in a state the
+// requested transition starts from.
+var ErrEdgeStateConflict = errors.New("edge node is not in a state this transition applies to")
+
+// EdgeTransition moves an edge node from one of From to To.
+type EdgeTransition struct {
+	From  []string
+	To    string
+	Actor string
+	At    time.Time
+	// DrainUntil ends the drain period when To is EdgeStateDraining.
+	DrainUntil time.Time
+}
+
+// Serving reports whether the edge carries traffic: active edges and those
+// being taken out of service still do.
+func (n EdgeNode) Serving() bool {
+	switch n.State {
+	case EdgeStateActive, EdgeStateCordoned, EdgeStateDraining:
+		return true
+	}
+	return false
+}
+
+// TransitionEdgeNode changes the state of an edge node and records who did
+// it. Retiring an edge also revokes its token and releases its tunnel
+// address.
+func (s *Store) TransitionEdgeNode(ctx context.Context, id string, t EdgeTransition) (EdgeNode, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return EdgeNode{}, fmt.Errorf("begin: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var state string
+	if err := tx.QueryRowContext(ctx, `SELECT state FROM edge_nodes WHERE id = ?`, id).Scan(&state); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return EdgeNode{}, err
+		}
+		return EdgeNode{}, fmt.Errorf("select edge node state: %w", err)
+	}
+	if !slices.Contains(t.From, state) {
+		return EdgeNode{}, fmt.Errorf("%w: edge node is %s", ErrEdgeStateConflict, state)
+	}
+	var drainUntil any
+	if t.To == EdgeStateDraining {
+		drainUntil = t.DrainUntil.UTC()
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE edge_nodes SET state = ?, drain_until = ?, state_changed_at = ?, state_changed_by = ? WHERE id = ?
+	`, t.To, drainUntil, t.At.UTC(), nullIfEmpty(t.Actor), id); err != nil {
+		return EdgeNode{}, fmt.Errorf("update edge node state: %w", err)
+	}
+	if t.To == EdgeStateRetired {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE edge_nodes
+			SET token_revoked_at = COALESCE(token_revoked_at, ?), previous_token_hash = NULL, previous_token_expires_at = NULL, wg_addr = NULL
+			WHERE id = ?
+		`, t.At.UTC(), id); err != nil {
+			return EdgeNode{}, fmt.Errorf("revoke edge token: %w", err)
+		}
+		if err := assignTunnelAddr(ctx, tx, TunnelOwnerEdge, id, netip.Addr{}, t.At); err != nil {
+			return EdgeNode{}, err
+		}
+		if err := deleteWGKeyRotations(ctx, tx, TunnelOwnerEdge, id); err != nil {
+			return EdgeNode{}, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return EdgeNode{}, err
+	}
+	s.changed()
+	return s.EdgeNodeByID(ctx, id)
+}
+
+// DrainedEdgeNodes returns the draining edge nodes whose drain period ended
+// by now.
+func (s *Store) DrainedEdgeNodes(ctx context.Context, now time.Time) ([]EdgeNode, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+edgeNodeColumns+`
+		FROM edge_nodes
+		WHERE state = ? AND drain_until <= ?
+		ORDER BY drain_until
+	`, EdgeStateDraining, now.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("list drained edge nodes: %w", err)
+	}
+	defer rows.Close()
+
+	var out []EdgeNode
+	for rows.Next() {
+		n, err := scanEdgeNode(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan edge node: %w", err)
+		}
+		out = append(out, n)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,149 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Apply results reported by edge agents.
+const (
+	ApplyStatusApplied = "applied"
+	ApplyStatusFailed  = "failed"
+)
+
+// EdgeStatusParams is a heartbeat from an edge agent. AppliedConfigHash is the
+// config the edge is serving, which stays the previous one when applying a
+// newer config failed. Empty fields keep the value of the last heartbeat that
+// had them; an ApplyStatus always comes with its ApplyError, so a successful
+// apply clears the error of a failed one.
+type EdgeStatusParams struct {
+	AppliedConfigHash string
+	ApplyStatus       string
+	ApplyError        string
+	AgentVersion      string
+	NginxVersion      string
+	// UptimeSeconds is nil when the agent did not report it.
+	UptimeSeconds *int64
+	// AppliedWGHash is empty when the agent does not manage WireGuard.
+	AppliedWGHash string
+}
+
+func (s *Store) RecordEdgeStatus(ctx context.Context, id string, params EdgeStatusParams, at time.Time) (EdgeNode, error) {
+	status := nullIfEmpty(params.ApplyStatus)
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE edge_nodes
+		SET applied_config_hash = COALESCE(?, applied_config_hash),
+			apply_status = COALESCE(?, apply_status),
+			apply_error = CASE WHEN ? IS NULL THEN apply_error ELSE ? END,
+			agent_version = COALESCE(?, agent_version),
+			nginx_version = COALESCE(?, nginx_version),
+			uptime_seconds = COALESCE(?, uptime_seconds),
+			applied_wg_hash = COALESCE(?, applied_wg_hash),
+			status_reported_at = ?, last_seen = ?, stale_at = NULL
+		WHERE id = ?
+	`, nullIfEmpty(params.AppliedConfigHash), status, status, nullIfEmpty(params.ApplyError),
+		nullIfEmpty(params.AgentVersion), nullIfEmpty(params.NginxVersion), params.UptimeSeconds, nullIfEmpty(params.AppliedWGHash),
+		at.UTC(), at.UTC(), id)
+	if err != nil {
+		return EdgeNode{}, fmt.Errorf("update edge status: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return EdgeNode{}, sql.ErrNoRows
+	}
+	return s.EdgeNodeByID(ctx, id)
+}
+
+// LatestConfigHash returns the hash of the latest config generation, or ""
+// before the first one is recorded.
+func (s *Store) LatestConfigHash(ctx context.Context) (string, error) {
+	var hash string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COALESCE((SELECT config_hash FROM config_generations ORDER BY id DESC LIMIT 1), '')
+	`).Scan(&hash)
+	if err != nil {
+		return "", fmt.Errorf("select latest config generation: %w", err)
+	}
+	return hash, nil
+}
+
+// MarkStaleEdgeNodes flags the serving edges not seen since cutoff and
+// returns those that were not flagged already. Contacting the control plane
+// clears the flag. Pending and retired edges are not expected to call in.
+func (s *Store) MarkStaleEdgeNodes(ctx context.Context, cutoff, at time.Time) ([]EdgeNode, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		UPDATE edge_nodes SET stale_at = ?
+		WHERE stale_at IS NULL AND COALESCE(last_seen, created_at) < ? AND state IN (?, ?, ?)
+		RETURNING id
+	`, at.UTC(), cutoff.UTC(), EdgeStateActive, EdgeStateCordoned, EdgeStateDraining)
+	if err != nil {
+		return nil, fmt.Errorf("mark stale edge nodes: %w", err)
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan edge node id: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("mark stale edge nodes: %w", err)
+	}
+
+	out := make([]EdgeNode, 0, len(ids))
+	for _, id := range ids {
+		node, err := s.EdgeNodeByID(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, node)
+	}
+	return out, nil
+}
+
+// RecordConfigGeneration appends hash to the config history unless it is
+// already the latest generation. Reverting to an earlier config therefore
+// starts a new generation, so edges still on the reverted-from config count
+// as behind. edgeHashes are the config hashes edges are served in the
+// generation when routes are placed on some edges only; they are recorded
+// with the latest generation alongside hash. It returns the id of the latest
+// generation and whether it was appended by this call.
+func (s *Store) RecordConfigGeneration(ctx context.Context, hash string, edgeHashes []string) (int64, bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, fmt.Errorf("begin: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO config_generations (config_hash, created_at)
+		SELECT ?, ?
+		WHERE COALESCE((SELECT config_hash FROM config_generations ORDER BY id DESC LIMIT 1), '') != ?
+	`, hash, time.Now().UTC(), hash)
+	if err != nil {
+		return 0, false, fmt.Errorf("record config generation: %w", err)
+	}
+	created := false
+	if n, _ := res.RowsAffected(); n > 0 {
+		created = true
+	}
+	var id int64
+	if err := tx.QueryRowContext(ctx, `SELECT MAX(id) FROM config_generations`).Scan(&id); err != nil {
+		return 0, false, fmt.Errorf("select config generation: %w", err)
+	}
+	for _, h := range append([]string{hash}, edgeHashes...) {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT OR IGNORE INTO config_generation_hashes (generation_id, config_hash) VALUES (?, ?)
+		`, id, h); err != nil {
+			return 0, false, fmt.Errorf("record config generation hash: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, false, err
+	}
+	return id, created, nil
+}
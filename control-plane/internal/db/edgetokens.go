@@ -0,0 +1,69 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// RotateEdgeTokenParams replaces the token of an edge node.
+type RotateEdgeTokenParams struct {
+	TokenPlain string
+	// ExpiresAt is zero for a token that never expires.
+	ExpiresAt time.Time
+	// PreviousValidUntil keeps the replaced token working until then so the
+	// edge can switch over. Zero invalidates it at once; a revoked token
+	// never gets a grace window.
+	PreviousValidUntil time.Time
+	At                 time.Time
+}
+
+// RotateEdgeToken issues a new token for the edge node and lifts any
+// revocation. It returns sql.ErrNoRows when the edge node does not exist and
+// ErrEdgeStateConflict when it is retired: retirement is final.
+func (s *Store) RotateEdgeToken(ctx context.Context, id string, params RotateEdgeTokenParams) (EdgeNode, error) {
+	grace := !params.PreviousValidUntil.IsZero()
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE edge_nodes SET
+			previous_token_hash = CASE WHEN ? AND token_revoked_at IS NULL THEN token_hash END,
+			previous_token_expires_at = CASE WHEN ? AND token_revoked_at IS NULL THEN ? END,
+			token_hash = ?,
+			token_issued_at = ?,
+			token_expires_at = ?,
+			token_revoked_at = NULL
+		WHERE id = ? AND state != ?
+	`, grace, grace, toNullTime(params.PreviousValidUntil), hashToken(params.TokenPlain), params.At.UTC(), toNullTime(params.ExpiresAt), id,
+		EdgeStateRetired)
+	if err != nil {
+		return EdgeNode{}, fmt.Errorf("rotate edge token: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var state string
+		if err := s.db.QueryRowContext(ctx, `SELECT state FROM edge_nodes WHERE id = ?`, id).Scan(&state); err != nil {
+			return EdgeNode{}, err
+		}
+		return EdgeNode{}, fmt.Errorf("%w: edge node is %s", ErrEdgeStateConflict, state)
+	}
+	s.changed()
+	return s.EdgeNodeByID(ctx, id)
+}
+
+// RevokeEdgeToken blocks the current and previous token of an edge node
+// until it is rotated. It returns sql.ErrNoRows when no edge node with an
+// unrevoked token has the given id.
+func (s *Store) RevokeEdgeToken(ctx context.Context, id string, at time.Time) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE edge_nodes
+		SET token_revoked_at = ?, previous_token_hash = NULL, previous_token_expires_at = NULL
+		WHERE id = ? AND token_revoked_at IS NULL
+	`, at.UTC(), id)
+	if err != nil {
+		return fmt.Errorf("revoke edge token: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	s.changed()
+	return nil
+}
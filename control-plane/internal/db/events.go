@@ -0,0 +1,76 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// EventLogSize is the number of events kept for resuming event streams.
+const EventLogSize = 1000
+
+// Event is an entry of the event log. Hostname is set for events about a
+// route so that streams can be filtered by API key scope.
+type Event struct {
+	ID        int64
+	Type      string
+	Hostname  string
+	Data      json.RawMessage
+	CreatedAt time.Time
+}
+
+// AppendEvent adds an event to the log and drops the entries that fall out of
+// the last EventLogSize.
+func (s *Store) AppendEvent(ctx context.Context, typ, hostname string, data json.RawMessage) (Event, error) {
+	now := time.Now().UTC()
+	res, err := s.db.ExecContext(ctx, `
+		INSERT INTO events (type, hostname, data, created_at) VALUES (?, ?, ?, ?)
+	`, typ, nullIfEmpty(hostname), string(data), now)
+	if err != nil {
+		return Event{}, fmt.Errorf("insert event: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Event{}, fmt.Errorf("insert event: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM events WHERE id <= ?`, id-EventLogSize); err != nil {
+		return Event{}, fmt.Errorf("prune events: %w", err)
+	}
+	return Event{ID: id, Type: typ, Hostname: hostname, Data: data, CreatedAt: now}, nil
+}
+
+// EventsAfter returns the logged events with an id greater than afterID, oldest
+// first, together with the id of the oldest event still in the log (0 when the
+// log is empty).
+func (s *Store) EventsAfter(ctx context.Context, afterID int64) ([]Event, int64, error) {
+	var oldest sql.NullInt64
+	if err := s.db.QueryRowContext(ctx, `SELECT MIN(id) FROM events`).Scan(&oldest); err != nil {
+		return nil, 0, fmt.Errorf("select oldest event: %w", err)
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, type, hostname, data, created_at
+		FROM events
+		WHERE id > ?
+		ORDER BY id
+	`, afterID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("list events: %w", err)
+	}
+	defer rows.Close()
+
+	var out []Event
+	for rows.Next() {
+		var ev Event
+		var hostname sql.NullString
+		var data string
+		if err := rows.Scan(&ev.ID, &ev.Type, &hostname, &data, &ev.CreatedAt); err != nil {
+			return nil, 0, fmt.Errorf("scan event: %w", err)
+		}
+		ev.Hostname = hostname.String
+		ev.Data = json.RawMessage(data)
+		out = append(out, ev)
+	}
+	return out, oldest.Int64, rows.Err()
+}
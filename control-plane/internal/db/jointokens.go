@@ -0,0 +1,264 @@
+package db
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// JoinTokenPrefix starts every join token. The token is
+// "kjt_<id>.<secret>": the id selects the row and the hash of the whole token
+// is compared in constant time, so lookups never depend on the secret.
+const JoinTokenPrefix = "kjt_"
+
+// Join token kinds: a token admits either edges or origins.
+const (
+	JoinTokenKindEdge   = "edge"
+	JoinTokenKindOrigin = "origin"
+)
+
+// ErrJoinTokenUsedUp is returned by RegisterEdgeNode and RegisterOrigin when
+// the join token was revoked, expired or exhausted after it was validated.
+var ErrJoinTokenUsedUp = errors.New("join token is no longer valid")
+
+// JoinToken admits new edges or origins, depending on Kind. Edges registered
+// with it take its EdgeName, GroupName and Labels when those are set.
+type JoinToken struct {
+	ID          string
+	Kind        string
+	Description string
+	TokenHash   string `json:"-"`
+	MaxUses     int
+	Uses        int
+	ExpiresAt   time.Time
+	EdgeName    sql.NullString
+	GroupName   sql.NullString
+	Labels      map[string]string
+	// RequireApproval registers edges as pending even when approval is not
+	// required globally.
+	RequireApproval bool
+	CreatedBy       string
+	CreatedAt       time.Time
+	RevokedAt       sql.NullTime
+	// Consumers lists the edges or origins registered with the token,
+	// oldest first.
+	Consumers []JoinTokenUse
+}
+
+// JoinTokenUse records an edge or origin registered with a join token. The
+// name is kept so the record survives the consumer being deleted.
+type JoinTokenUse struct {
+	ConsumerID   string
+	ConsumerName string
+	UsedAt       time.Time
+}
+
+// Usable reports whether the token may still register an edge at the given time.
+func (t JoinToken) Usable(now time.Time) bool {
+	return !t.RevokedAt.Valid && now.Before(t.ExpiresAt) && t.Uses < t.MaxUses
+}
+
+type CreateJoinTokenParams struct {
+	// Kind defaults to JoinTokenKindEdge.
+	Kind            string
+	Description     string
+	MaxUses         int
+	ExpiresAt       time.Time
+	EdgeName        string
+	GroupName       string
+	Labels          map[string]string
+	RequireApproval bool
+	CreatedBy       string
+}
+
+// CreateJoinToken stores a new join token and returns it with its plaintext,
+// which is not kept.
+func (s *Store) CreateJoinToken(ctx context.Context, params CreateJoinTokenParams, secret string) (JoinToken, string, error) {
+	now := time.Now().UTC()
+	id := uuid.NewString()
+	plain := JoinTokenPrefix + id + "." + secret
+	kind := params.Kind
+	if kind == "" {
+		kind = JoinTokenKindEdge
+	}
+	labels, err := encodeLabels(params.Labels)
+	if err != nil {
+		return JoinToken{}, "", err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO join_tokens (id, kind, description, token_hash, max_uses, expires_at, edge_name, group_name, labels, require_approval, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, id, kind, params.Description, hashToken(plain), params.MaxUses, params.ExpiresAt.UTC(), nullIfEmpty(params.EdgeName),
+		nullIfEmpty(params.GroupName), labels, params.RequireApproval, params.CreatedBy, now)
+	if err != nil {
+		return JoinToken{}, "", fmt.Errorf("insert join token: %w", err)
+	}
+	token, err := s.JoinTokenByID(ctx, id)
+	return token, plain, err
+}
+
+const joinTokenColumns = `id, kind, description, token_hash, max_uses, uses, expires_at, edge_name, group_name, labels, require_approval, created_by, created_at, revoked_at`
+
+func scanJoinToken(row rowScanner) (JoinToken, error) {
+	var t JoinToken
+	var labels string
+	if err := row.Scan(&t.ID, &t.Kind, &t.Description, &t.TokenHash, &t.MaxUses, &t.Uses, &t.ExpiresAt, &t.EdgeName, &t.GroupName,
+		&labels, &t.RequireApproval, &t.CreatedBy, &t.CreatedAt, &t.RevokedAt); err != nil {
+		return JoinToken{}, err
+	}
+	t.Labels = decodeLabels(labels)
+	return t, nil
+}
+
+func (s *Store) JoinTokenByID(ctx context.Context, id string) (JoinToken, error) {
+	t, err := scanJoinToken(s.db.QueryRowContext(ctx, `SELECT `+joinTokenColumns+` FROM join_tokens WHERE id = ?`, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return JoinToken{}, err
+		}
+		return JoinToken{}, fmt.Errorf("select join token: %w", err)
+	}
+	uses, err := s.joinTokenUses(ctx, id)
+	if err != nil {
+		return JoinToken{}, err
+	}
+	t.Consumers = uses
+	return t, nil
+}
+
+// JoinTokenByToken returns the join token a plaintext token belongs to, or
+// sql.ErrNoRows when it matches none. The caller checks Usable.
+func (s *Store) JoinTokenByToken(ctx context.Context, plain string) (JoinToken, error) {
+	id, _, ok := strings.Cut(strings.TrimPrefix(plain, JoinTokenPrefix), ".")
+	if !ok || !strings.HasPrefix(plain, JoinTokenPrefix) {
+		return JoinToken{}, sql.ErrNoRows
+	}
+	t, err := s.JoinTokenByID(ctx, id)
+	if err != nil {
+		return JoinToken{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(plain)), []byte(t.TokenHash)) != 1 {
+		return JoinToken{}, sql.ErrNoRows
+	}
+	return t, nil
+}
+
+// ListJoinTokens returns all join tokens, newest first, with their consumers.
+func (s *Store) ListJoinTokens(ctx context.Context) ([]JoinToken, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+joinTokenColumns+` FROM join_tokens ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("list join tokens: %w", err)
+	}
+	var out []JoinToken
+	index := map[string]int{}
+	for rows.Next() {
+		t, err := scanJoinToken(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan join token: %w", err)
+		}
+		index[t.ID] = len(out)
+		out = append(out, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	uses, err := s.db.QueryContext(ctx, `SELECT join_token_id, consumer_id, consumer_name, used_at FROM join_token_uses ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("list join token uses: %w", err)
+	}
+	defer uses.Close()
+	for uses.Next() {
+		var tokenID string
+		var u JoinTokenUse
+		if err := uses.Scan(&tokenID, &u.ConsumerID, &u.ConsumerName, &u.UsedAt); err != nil {
+			return nil, fmt.Errorf("scan join token use: %w", err)
+		}
+		if i, ok := index[tokenID]; ok {
+			out[i].Consumers = append(out[i].Consumers, u)
+		}
+	}
+	return out, uses.Err()
+}
+
+func (s *Store) joinTokenUses(ctx context.Context, id string) ([]JoinTokenUse, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT consumer_id, consumer_name, used_at FROM join_token_uses WHERE join_token_id = ? ORDER BY id
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("list join token uses: %w", err)
+	}
+	defer rows.Close()
+	var out []JoinTokenUse
+	for rows.Next() {
+		var u JoinTokenUse
+		if err := rows.Scan(&u.ConsumerID, &u.ConsumerName, &u.UsedAt); err != nil {
+			return nil, fmt.Errorf("scan join token use: %w", err)
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
+
+// RevokeJoinToken stops a join token from registering further edges. Edges
+// already registered with it are not affected.
+func (s *Store) RevokeJoinToken(ctx context.Context, id string, at time.Time) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE join_tokens SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL
+	`, at.UTC(), id)
+	if err != nil {
+		return fmt.Errorf("revoke join token: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// consumeJoinToken counts one use of a join token inside tx, failing with
+// ErrJoinTokenUsedUp when it is no longer usable at the given time.
+func consumeJoinToken(ctx context.Context, tx *sql.Tx, id, consumerID, consumerName string, at time.Time) error {
+	res, err := tx.ExecContext(ctx, `
+		UPDATE join_tokens SET uses = uses + 1
+		WHERE id = ? AND revoked_at IS NULL AND expires_at > ? AND uses < max_uses
+	`, id, at)
+	if err != nil {
+		return fmt.Errorf("consume join token: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrJoinTokenUsedUp
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO join_token_uses (join_token_id, consumer_id, consumer_name, used_at) VALUES (?, ?, ?, ?)
+	`, id, consumerID, consumerName, at); err != nil {
+		return fmt.Errorf("record join token use: %w", err)
+	}
+	return nil
+}
+
+func encodeLabels(labels map[string]string) (string, error) {
+	if len(labels) == 0 {
+		return "{}", nil
+	}
+	raw, err := json.Marshal(labels)
+	if err != nil {
+		return "", fmt.Errorf("encode labels: %w", err)
+	}
+	return string(raw), nil
+}
+
+// decodeLabels never returns nil so labels render as {} rather than null.
+func decodeLabels(v string) map[string]string {
+	labels := map[string]string{}
+	_ = json.Unmarshal([]byte(v), &labels)
+	return labels
+}
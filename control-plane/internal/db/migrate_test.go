@@ -0,0 +1,172 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// v0Schema is the schema created by binaries that predate versioned
+// migrations: a single CREATE IF NOT EXISTS blob without schema_migrations.
+const v0Schema = `
+PRAGMA journal_mode=WAL;
+PRAGMA foreign_keys=ON;
+
+CREATE TABLE IF NOT EXISTS origins (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	wireguard_ip TEXT NOT NULL UNIQUE,
+	wireguard_public_key TEXT,
+	wireguard_private_key_encrypted TEXT,
+	created_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS routes (
+	id TEXT PRIMARY KEY,
+	hostname TEXT NOT NULL UNIQUE,
+	origin_id TEXT NOT NULL REFERENCES origins(id) ON DELETE CASCADE,
+	target_port INTEGER NOT NULL,
+	created_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS edge_nodes (
+	id TEXT PRIMARY KEY,
+	token_hash TEXT NOT NULL UNIQUE,
+	name TEXT,
+	wg_addr TEXT,
+	wg_endpoint TEXT,
+	wg_peer_pubkey TEXT,
+	wg_allowed_ips TEXT,
+	created_at DATETIME NOT NULL,
+	last_seen DATETIME
+);
+`
+
+func openTestStore(t *testing.T) (*Store, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.db")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	return store, path
+}
+
+func newV0Store(t *testing.T) *Store {
+	t.Helper()
+	store, _ := openTestStore(t)
+	ctx := context.Background()
+	if _, err := store.db.ExecContext(ctx, v0Schema); err != nil {
+		t.Fatalf("create v0 schema: %v", err)
+	}
+	now := time.Now().UTC()
+	if _, err := store.db.ExecContext(ctx, `INSERT INTO origins (id, name, wireguard_ip, wireguard_public_key, wireguard_private_key_encrypted, created_at) VALUES ('o1', 'origin-1', '10.0.0.2', '', '', ?)`, now); err != nil {
+		t.Fatalf("seed origin: %v", err)
+	}
+	if _, err := store.db.ExecContext(ctx, `INSERT INTO routes (id, hostname, origin_id, target_port, created_at) VALUES ('r1', 'app.example.com', 'o1', 8080, ?)`, now); err != nil {
+		t.Fatalf("seed route: %v", err)
+	}
+	if _, err := store.db.ExecContext(ctx, `INSERT INTO edge_nodes (id, token_hash, name, created_at) VALUES ('e1', ?, 'edge-1', ?)`, hashToken("edge-token"), now); err != nil {
+		t.Fatalf("seed edge: %v", err)
+	}
+	return store
+}
+
+func TestMigrateUpgradesV0Database(t *testing.T) {
+	store := newV0Store(t)
+	ctx := context.Background()
+
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	version, err := store.SchemaVersion(ctx)
+	if err != nil {
+		t.Fatalf("schema version: %v", err)
+	}
+	if version != LatestSchemaVersion() {
+		t.Fatalf("expected version %d, got %d", LatestSchemaVersion(), version)
+	}
+
+	routes, err := store.ListRoutes(ctx)
+	if err != nil {
+		t.Fatalf("list routes: %v", err)
+	}
+	if len(routes) != 1 || routes[0].Hostname != "app.example.com" || routes[0].WireguardIP != "10.0.0.2" {
+		t.Fatalf("route not preserved: %+v", routes)
+	}
+	node, err := store.EdgeNodeByToken(ctx, "edge-token", time.Now())
+	if err != nil || node.ID != "e1" {
+		t.Fatalf("edge not preserved: %+v, %v", node, err)
+	}
+	addrs, err := store.ListTunnelAddresses(ctx)
+	if err != nil || len(addrs) != 1 || addrs[0].Addr.String() != "10.0.0.2" || addrs[0].OwnerID != "o1" {
+		t.Fatalf("origin address not recorded: %+v, %v", addrs, err)
+	}
+	if _, err := store.CreateAPIKey(ctx, CreateAPIKeyParams{Name: "admin", KeyPlain: "k"}); err != nil {
+		t.Fatalf("tables from later migrations unusable: %v", err)
+	}
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	store, _ := openTestStore(t)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := store.Migrate(ctx); err != nil {
+			t.Fatalf("migrate run %d: %v", i, err)
+		}
+	}
+	var applied int
+	if err := store.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM schema_migrations`).Scan(&applied); err != nil {
+		t.Fatalf("count migrations: %v", err)
+	}
+	if applied != len(migrations) {
+		t.Fatalf("expected %d recorded migrations, got %d", len(migrations), applied)
+	}
+}
+
+func TestMigrateRefusesNewerDatabase(t *testing.T) {
+	store, _ := openTestStore(t)
+	ctx := context.Background()
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if _, err := store.db.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, 'from the future', ?)`, LatestSchemaVersion()+1, time.Now().UTC()); err != nil {
+		t.Fatalf("insert future version: %v", err)
+	}
+	if err := store.Migrate(ctx); !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("expected ErrSchemaTooNew, got %v", err)
+	}
+}
+
+func TestFailedMigrationRollsBack(t *testing.T) {
+	store, _ := openTestStore(t)
+	ctx := context.Background()
+
+	orig := migrations
+	t.Cleanup(func() { migrations = orig })
+	migrations = append(append([]migration{}, orig...), migration{
+		version: LatestSchemaVersion() + 1,
+		name:    "broken",
+		sql:     `CREATE TABLE half_applied (id TEXT); SELECT * FROM no_such_table;`,
+	})
+
+	if err := store.Migrate(ctx); err == nil {
+		t.Fatal("expected broken migration to fail")
+	}
+	version, err := store.SchemaVersion(ctx)
+	if err != nil {
+		t.Fatalf("schema version: %v", err)
+	}
+	if version != orig[len(orig)-1].version {
+		t.Fatalf("expected version %d after failure, got %d", orig[len(orig)-1].version, version)
+	}
+	var name string
+	err = store.db.QueryRowContext(ctx, `SELECT name FROM sqlite_master WHERE name = 'half_applied'`).Scan(&name)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected half-applied table to be rolled back, got %q (%v)", name, err)
+	}
+}
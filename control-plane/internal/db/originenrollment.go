@@ -0,0 +1,77 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RegisterOriginParams describes an origin enrolling itself with a join token.
+type RegisterOriginParams struct {
+	Name               string
+	WireguardPublicKey string
+	WireguardEndpoint  string
+	TokenPlain         string
+	JoinTokenID        string
+	RegisteredFrom     string
+}
+
+// RegisterOrigin creates an origin that enrolled itself, with a tunnel address
+// allocated from the tunnel pools. The join token is consumed in the same
+// transaction.
+func (s *Store) RegisterOrigin(ctx context.Context, params RegisterOriginParams) (Origin, error) {
+	now := time.Now().UTC()
+	id := uuid.NewString()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Origin{}, fmt.Errorf("begin: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := consumeJoinToken(ctx, tx, params.JoinTokenID, id, params.Name, now); err != nil {
+		return Origin{}, err
+	}
+	addr, err := s.assignOriginTunnelAddr(ctx, tx, id, "", now)
+	if err != nil {
+		return Origin{}, err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO origins (id, name, wireguard_ip, wireguard_public_key, wireguard_endpoint, created_at, token_hash, token_issued_at,
+			registered_from, join_token_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, id, params.Name, addr.String(), nullIfEmpty(params.WireguardPublicKey), nullIfEmpty(params.WireguardEndpoint), now,
+		hashToken(params.TokenPlain), now, nullIfEmpty(params.RegisteredFrom), params.JoinTokenID)
+	if err != nil {
+		return Origin{}, fmt.Errorf("insert origin: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return Origin{}, err
+	}
+	s.changed()
+	return s.OriginByID(ctx, id)
+}
+
+// OriginByToken resolves the origin an origin agent token belongs to.
+func (s *Store) OriginByToken(ctx context.Context, token string) (Origin, error) {
+	o, err := scanOrigin(s.db.QueryRowContext(ctx, `SELECT `+originColumns+` FROM origins WHERE token_hash = ?`, hashToken(token)))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Origin{}, err
+		}
+		return Origin{}, fmt.Errorf("select origin: %w", err)
+	}
+	return o, nil
+}
+
+// TouchOrigin records a heartbeat from the origin agent.
+func (s *Store) TouchOrigin(ctx context.Context, id string, at time.Time) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE origins SET last_seen = ? WHERE id = ?`, at.UTC(), id)
+	if err != nil {
+		return fmt.Errorf("update origin last_seen: %w", err)
+	}
+	return nil
+}
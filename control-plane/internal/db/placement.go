@@ -0,0 +1,68 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Placement selects the edges a route is served from. The zero Placement
+// places a route on every edge.
+type Placement struct {
+	// Groups lists edge groups; an edge must be in one of them.
+	Groups []string `json:"groups,omitempty"`
+	// Labels must all be set on the edge. An empty value matches any value.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+func (p Placement) IsZero() bool {
+	return len(p.Groups) == 0 && len(p.Labels) == 0
+}
+
+// Matches reports whether an edge in group with labels is selected.
+func (p Placement) Matches(group string, labels map[string]string) bool {
+	if len(p.Groups) > 0 {
+		found := false
+		for _, g := range p.Groups {
+			if g == group {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for k, want := range p.Labels {
+		got, ok := labels[k]
+		if !ok || (want != "" && got != want) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchesEdge reports whether the edge is selected.
+func (p Placement) MatchesEdge(node EdgeNode) bool {
+	return p.Matches(node.GroupName.String, node.Labels)
+}
+
+// encodePlacement stores the zero Placement as NULL.
+func encodePlacement(p Placement) (any, error) {
+	if p.IsZero() {
+		return nil, nil
+	}
+	groups := append([]string(nil), p.Groups...)
+	sort.Strings(groups)
+	raw, err := json.Marshal(Placement{Groups: groups, Labels: p.Labels})
+	if err != nil {
+		return nil, fmt.Errorf("encode placement: %w", err)
+	}
+	return string(raw), nil
+}
+
+func decodePlacement(v string) Placement {
+	var p Placement
+	_ = json.Unmarshal([]byte(v), &p)
+	return p
+}
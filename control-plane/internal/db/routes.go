@@ -0,0 +1,364 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Load balancing methods for a route's upstream group.
+const (
+	LBRoundRobin = "round_robin"
+	LBLeastConn  = "least_conn"
+	LBIPHash     = "ip_hash"
+)
+
+const (
+	defaultMaxFails           = 1
+	defaultFailTimeoutSeconds = 10
+)
+
+// RouteBackend is one upstream server of a route. OriginName and WireguardIP
+// are filled in when reading and ignored when writing.
+type RouteBackend struct {
+	OriginID    string
+	OriginName  string
+	WireguardIP string
+	TargetPort  int
+	Weight      int
+	Backup      bool
+}
+
+// Route is a route as written. OriginID and TargetPort mirror the primary
+// backend so that clients of the single-origin API keep working.
+type Route struct {
+	ID                 string
+	Hostname           string
+	Wildcard           bool
+	PathPrefix         string
+	StripPrefix        bool
+	OriginID           string
+	TargetPort         int
+	LBMethod           string
+	MaxFails           *int
+	FailTimeoutSeconds int
+	Backends           []RouteBackend
+	Placement          Placement
+	CreatedAt          time.Time
+}
+
+// CreateRouteParams describes a route. An empty PathPrefix means "/", an empty
+// LBMethod round robin, and zero FailTimeoutSeconds/Weight select the nginx
+// defaults. A nil MaxFails selects the default of 1 while zero never marks a
+// backend down. When Backends is empty, OriginID and TargetPort describe the
+// route's only backend. A zero Placement serves the route from every edge.
+type CreateRouteParams struct {
+	Hostname           string
+	PathPrefix         string
+	StripPrefix        bool
+	OriginID           string
+	TargetPort         int
+	LBMethod           string
+	MaxFails           *int
+	FailTimeoutSeconds int
+	Backends           []RouteBackend
+	Placement          Placement
+}
+
+// UpdateRouteParams replaces every mutable column and the backend list of a route.
+type UpdateRouteParams = CreateRouteParams
+
+func (p CreateRouteParams) normalized() CreateRouteParams {
+	p.PathPrefix = defaultPathPrefix(p.PathPrefix)
+	if p.LBMethod == "" {
+		p.LBMethod = LBRoundRobin
+	}
+	if p.MaxFails == nil {
+		maxFails := defaultMaxFails
+		p.MaxFails = &maxFails
+	}
+	if p.FailTimeoutSeconds == 0 {
+		p.FailTimeoutSeconds = defaultFailTimeoutSeconds
+	}
+	if len(p.Backends) == 0 {
+		p.Backends = []RouteBackend{{OriginID: p.OriginID, TargetPort: p.TargetPort}}
+	} else {
+		p.Backends = append([]RouteBackend(nil), p.Backends...)
+	}
+	for i := range p.Backends {
+		if p.Backends[i].Weight == 0 {
+			p.Backends[i].Weight = 1
+		}
+	}
+	primary := primaryBackend(p.Backends)
+	p.OriginID, p.TargetPort = primary.OriginID, primary.TargetPort
+	return p
+}
+
+func (p CreateRouteParams) toRoute(id string, createdAt time.Time) Route {
+	return Route{
+		ID:                 id,
+		Hostname:           p.Hostname,
+		Wildcard:           IsWildcardHostname(p.Hostname),
+		PathPrefix:         p.PathPrefix,
+		StripPrefix:        p.StripPrefix,
+		OriginID:           p.OriginID,
+		TargetPort:         p.TargetPort,
+		LBMethod:           p.LBMethod,
+		MaxFails:           p.MaxFails,
+		FailTimeoutSeconds: p.FailTimeoutSeconds,
+		Backends:           p.Backends,
+		Placement:          p.Placement,
+		CreatedAt:          createdAt,
+	}
+}
+
+func (s *Store) CreateRoute(ctx context.Context, params CreateRouteParams) (Route, error) {
+	now := time.Now().UTC()
+	id := uuid.NewString()
+	params = params.normalized()
+	placement, err := encodePlacement(params.Placement)
+	if err != nil {
+		return Route{}, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Route{}, fmt.Errorf("begin: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO routes (id, hostname, wildcard, path_prefix, strip_prefix, lb_method, max_fails, fail_timeout_seconds, placement, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, id, params.Hostname, IsWildcardHostname(params.Hostname), params.PathPrefix, params.StripPrefix, params.LBMethod, params.MaxFails, params.FailTimeoutSeconds,
+		placement, now)
+	if err != nil {
+		return Route{}, fmt.Errorf("insert route: %w", err)
+	}
+	if err := insertRouteBackends(ctx, tx, id, params.Backends); err != nil {
+		return Route{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Route{}, fmt.Errorf("commit route: %w", err)
+	}
+	s.changed()
+	return params.toRoute(id, now), nil
+}
+
+func (s *Store) UpdateRoute(ctx context.Context, id string, params UpdateRouteParams) (Route, error) {
+	params = params.normalized()
+	placement, err := encodePlacement(params.Placement)
+	if err != nil {
+		return Route{}, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Route{}, fmt.Errorf("begin: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE routes
+		SET hostname = ?, wildcard = ?, path_prefix = ?, strip_prefix = ?, lb_method = ?, max_fails = ?, fail_timeout_seconds = ?, placement = ?
+		WHERE id = ?
+	`, params.Hostname, IsWildcardHostname(params.Hostname), params.PathPrefix, params.StripPrefix, params.LBMethod, params.MaxFails, params.FailTimeoutSeconds,
+		placement, id)
+	if err != nil {
+		return Route{}, fmt.Errorf("update route: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return Route{}, sql.ErrNoRows
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM route_backends WHERE route_id = ?`, id); err != nil {
+		return Route{}, fmt.Errorf("clear route backends: %w", err)
+	}
+	if err := insertRouteBackends(ctx, tx, id, params.Backends); err != nil {
+		return Route{}, err
+	}
+	if err := deleteOrphanedCertificates(ctx, tx); err != nil {
+		return Route{}, err
+	}
+	var createdAt time.Time
+	if err := tx.QueryRowContext(ctx, `SELECT created_at FROM routes WHERE id = ?`, id).Scan(&createdAt); err != nil {
+		return Route{}, fmt.Errorf("select route: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return Route{}, fmt.Errorf("commit route: %w", err)
+	}
+	s.changed()
+	return params.toRoute(id, createdAt), nil
+}
+
+func insertRouteBackends(ctx context.Context, tx *sql.Tx, routeID string, backends []RouteBackend) error {
+	for i, b := range backends {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO route_backends (route_id, position, origin_id, target_port, weight, backup)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, routeID, i, b.OriginID, b.TargetPort, b.Weight, b.Backup)
+		if err != nil {
+			return fmt.Errorf("insert route backend: %w", err)
+		}
+	}
+	return nil
+}
+
+// DeleteRoute deletes a route together with the certificates of its hostname
+// when no other route uses it.
+func (s *Store) DeleteRoute(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM routes WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("delete from routes: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if err := deleteOrphanedCertificates(ctx, tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit route: %w", err)
+	}
+	s.changed()
+	return nil
+}
+
+// IsWildcardHostname reports whether hostname is a "*.zone" pattern.
+func IsWildcardHostname(hostname string) bool {
+	return strings.HasPrefix(hostname, "*.")
+}
+
+func defaultPathPrefix(p string) string {
+	if p == "" {
+		return "/"
+	}
+	return p
+}
+
+// primaryBackend is the first non-backup backend, or the first backend when
+// all of them are backups.
+func primaryBackend(backends []RouteBackend) RouteBackend {
+	for _, b := range backends {
+		if !b.Backup {
+			return b
+		}
+	}
+	if len(backends) == 0 {
+		return RouteBackend{}
+	}
+	return backends[0]
+}
+
+// RouteWithOrigin is a route joined with its backends' origins. The Origin*,
+// WireguardIP and TargetPort fields describe the primary backend.
+type RouteWithOrigin struct {
+	ID                 string
+	Hostname           string
+	Wildcard           bool
+	PathPrefix         string
+	StripPrefix        bool
+	TargetPort         int
+	OriginID           string
+	OriginName         string
+	WireguardIP        string
+	LBMethod           string
+	MaxFails           *int
+	FailTimeoutSeconds int
+	Backends           []RouteBackend
+	Placement          Placement
+	CreatedAt          time.Time
+}
+
+func (s *Store) RouteByID(ctx context.Context, id string) (RouteWithOrigin, error) {
+	routes, err := s.loadRoutes(ctx, `WHERE r.id = ?`, id)
+	if err != nil {
+		return RouteWithOrigin{}, err
+	}
+	if len(routes) == 0 {
+		return RouteWithOrigin{}, sql.ErrNoRows
+	}
+	return routes[0], nil
+}
+
+func (s *Store) ListRoutes(ctx context.Context) ([]RouteWithOrigin, error) {
+	return s.loadRoutes(ctx, "")
+}
+
+// loadRoutes reads the routes matching where together with their backends.
+// Routes without any backend are skipped since they cannot serve traffic.
+func (s *Store) loadRoutes(ctx context.Context, where string, args ...any) ([]RouteWithOrigin, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT r.id, r.hostname, r.wildcard, r.path_prefix, r.strip_prefix, r.lb_method, r.max_fails, r.fail_timeout_seconds, r.placement, r.created_at
+		FROM routes r
+		`+where+`
+		ORDER BY r.hostname, r.path_prefix
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list routes: %w", err)
+	}
+	var routes []RouteWithOrigin
+	index := make(map[string]int)
+	for rows.Next() {
+		var r RouteWithOrigin
+		var placement sql.NullString
+		if err := rows.Scan(&r.ID, &r.Hostname, &r.Wildcard, &r.PathPrefix, &r.StripPrefix, &r.LBMethod, &r.MaxFails, &r.FailTimeoutSeconds, &placement, &r.CreatedAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan route: %w", err)
+		}
+		r.Placement = decodePlacement(placement.String)
+		index[r.ID] = len(routes)
+		routes = append(routes, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list routes: %w", err)
+	}
+
+	rows, err = s.db.QueryContext(ctx, `
+		SELECT b.route_id, b.origin_id, o.name, o.wireguard_ip, b.target_port, b.weight, b.backup
+		FROM route_backends b
+		INNER JOIN origins o ON b.origin_id = o.id
+		INNER JOIN routes r ON b.route_id = r.id
+		`+where+`
+		ORDER BY b.route_id, b.position
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list route backends: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var routeID string
+		var b RouteBackend
+		if err := rows.Scan(&routeID, &b.OriginID, &b.OriginName, &b.WireguardIP, &b.TargetPort, &b.Weight, &b.Backup); err != nil {
+			return nil, fmt.Errorf("scan route backend: %w", err)
+		}
+		if i, ok := index[routeID]; ok {
+			routes[i].Backends = append(routes[i].Backends, b)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list route backends: %w", err)
+	}
+
+	out := routes[:0]
+	for _, r := range routes {
+		if len(r.Backends) == 0 {
+			continue
+		}
+		primary := primaryBackend(r.Backends)
+		r.OriginID, r.OriginName, r.WireguardIP, r.TargetPort = primary.OriginID, primary.OriginName, primary.WireguardIP, primary.TargetPort
+		out = append(out, r)
+	}
+	return out, nil
+}
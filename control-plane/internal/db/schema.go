@@ -1,9 +1,20 @@
 package db
 
-const schemaSQL = `
-PRAGMA journal_mode=WAL;
-PRAGMA foreign_keys=ON;
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
 
+// migrations are applied in order by Migrate and must never be edited once
+// released; schema changes always go into a new entry with the next version.
+// Version 1 uses IF NOT EXISTS so databases created before versioning existed
+// (version 0) are adopted without losing data.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "initial schema",
+		sql: `
 CREATE TABLE IF NOT EXISTS origins (
 	id TEXT PRIMARY KEY,
 	name TEXT NOT NULL UNIQUE,
@@ -32,4 +43,347 @@ CREATE TABLE IF NOT EXISTS edge_nodes (
 	created_at DATETIME NOT NULL,
 	last_seen DATETIME
 );
-`
+`,
+	},
+	{
+		version: 2,
+		name:    "api keys",
+		sql: `
+CREATE TABLE IF NOT EXISTS api_keys (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	key_hash TEXT NOT NULL UNIQUE,
+	role TEXT NOT NULL DEFAULT 'admin',
+	scopes TEXT NOT NULL DEFAULT '',
+	created_at DATETIME NOT NULL,
+	last_used_at DATETIME,
+	expires_at DATETIME,
+	revoked_at DATETIME
+);
+`,
+	},
+	{
+		version: 3,
+		name:    "route path prefixes",
+		sql: `
+CREATE TABLE routes_new (
+	id TEXT PRIMARY KEY,
+	hostname TEXT NOT NULL,
+	path_prefix TEXT NOT NULL DEFAULT '/',
+	strip_prefix INTEGER NOT NULL DEFAULT 0,
+	origin_id TEXT NOT NULL REFERENCES origins(id) ON DELETE CASCADE,
+	target_port INTEGER NOT NULL,
+	created_at DATETIME NOT NULL,
+	UNIQUE (hostname, path_prefix)
+);
+INSERT INTO routes_new (id, hostname, path_prefix, strip_prefix, origin_id, target_port, created_at)
+	SELECT id, hostname, '/', 0, origin_id, target_port, created_at FROM routes;
+DROP TABLE routes;
+ALTER TABLE routes_new RENAME TO routes;
+`,
+	},
+	{
+		version: 4,
+		name:    "wildcard routes",
+		sql: `
+ALTER TABLE routes ADD COLUMN wildcard INTEGER NOT NULL DEFAULT 0;
+UPDATE routes SET wildcard = 1 WHERE hostname LIKE '*.%';
+`,
+	},
+	{
+		version: 5,
+		name:    "route backends and load balancing",
+		sql: `
+CREATE TABLE routes_new (
+	id TEXT PRIMARY KEY,
+	hostname TEXT NOT NULL,
+	wildcard INTEGER NOT NULL DEFAULT 0,
+	path_prefix TEXT NOT NULL DEFAULT '/',
+	strip_prefix INTEGER NOT NULL DEFAULT 0,
+	lb_method TEXT NOT NULL DEFAULT 'round_robin',
+	max_fails INTEGER NOT NULL DEFAULT 1,
+	fail_timeout_seconds INTEGER NOT NULL DEFAULT 10,
+	created_at DATETIME NOT NULL,
+	UNIQUE (hostname, path_prefix)
+);
+INSERT INTO routes_new (id, hostname, wildcard, path_prefix, strip_prefix, created_at)
+	SELECT id, hostname, wildcard, path_prefix, strip_prefix, created_at FROM routes;
+
+CREATE TABLE route_backends (
+	route_id TEXT NOT NULL REFERENCES routes(id) ON DELETE CASCADE,
+	position INTEGER NOT NULL,
+	origin_id TEXT NOT NULL REFERENCES origins(id) ON DELETE CASCADE,
+	target_port INTEGER NOT NULL,
+	weight INTEGER NOT NULL DEFAULT 1,
+	backup INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (route_id, position),
+	UNIQUE (route_id, origin_id, target_port)
+);
+INSERT INTO route_backends (route_id, position, origin_id, target_port)
+	SELECT id, 0, origin_id, target_port FROM routes;
+
+DROP TABLE routes;
+ALTER TABLE routes_new RENAME TO routes;
+CREATE INDEX route_backends_origin_id ON route_backends (origin_id);
+`,
+	},
+	{
+		version: 6,
+		name:    "acme certificates",
+		sql: `
+CREATE TABLE certificates (
+	hostname TEXT PRIMARY KEY,
+	cert_pem TEXT NOT NULL DEFAULT '',
+	key_encrypted TEXT NOT NULL DEFAULT '',
+	not_after DATETIME,
+	issued_at DATETIME,
+	last_error TEXT,
+	failures INTEGER NOT NULL DEFAULT 0,
+	retry_at DATETIME,
+	updated_at DATETIME NOT NULL
+);
+
+CREATE TABLE acme_accounts (
+	directory_url TEXT PRIMARY KEY,
+	email TEXT NOT NULL,
+	key_encrypted TEXT NOT NULL,
+	created_at DATETIME NOT NULL
+);
+`,
+	},
+	{
+		version: 7,
+		name:    "edge status reporting",
+		sql: `
+ALTER TABLE edge_nodes ADD COLUMN applied_config_hash TEXT;
+ALTER TABLE edge_nodes ADD COLUMN apply_status TEXT;
+ALTER TABLE edge_nodes ADD COLUMN apply_error TEXT;
+ALTER TABLE edge_nodes ADD COLUMN agent_version TEXT;
+ALTER TABLE edge_nodes ADD COLUMN nginx_version TEXT;
+ALTER TABLE edge_nodes ADD COLUMN uptime_seconds INTEGER;
+ALTER TABLE edge_nodes ADD COLUMN status_reported_at DATETIME;
+
+CREATE TABLE config_generations (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	config_hash TEXT NOT NULL,
+	created_at DATETIME NOT NULL
+);
+CREATE INDEX config_generations_hash ON config_generations (config_hash);
+`,
+	},
+	{
+		version: 8,
+		name:    "event log",
+		sql: `
+CREATE TABLE events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	type TEXT NOT NULL,
+	hostname TEXT,
+	data TEXT NOT NULL,
+	created_at DATETIME NOT NULL
+);
+`,
+	},
+	{
+		version: 9,
+		name:    "webhooks",
+		sql: `
+CREATE TABLE webhooks (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	url TEXT NOT NULL,
+	events TEXT NOT NULL DEFAULT '',
+	secret TEXT NOT NULL,
+	created_at DATETIME NOT NULL
+);
+
+CREATE TABLE webhook_deliveries (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	webhook_id TEXT NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+	event_id INTEGER NOT NULL,
+	event_type TEXT NOT NULL,
+	payload TEXT NOT NULL,
+	status TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at DATETIME,
+	last_status_code INTEGER,
+	last_error TEXT,
+	created_at DATETIME NOT NULL,
+	delivered_at DATETIME
+);
+CREATE INDEX webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at);
+CREATE INDEX webhook_deliveries_webhook ON webhook_deliveries (webhook_id, id);
+
+ALTER TABLE edge_nodes ADD COLUMN stale_at DATETIME;
+`,
+	},
+	{
+		version: 10,
+		name:    "edge token lifecycle and audit log",
+		sql: `
+ALTER TABLE edge_nodes ADD COLUMN token_issued_at DATETIME;
+ALTER TABLE edge_nodes ADD COLUMN token_expires_at DATETIME;
+ALTER TABLE edge_nodes ADD COLUMN token_revoked_at DATETIME;
+ALTER TABLE edge_nodes ADD COLUMN previous_token_hash TEXT;
+ALTER TABLE edge_nodes ADD COLUMN previous_token_expires_at DATETIME;
+CREATE INDEX edge_nodes_previous_token ON edge_nodes (previous_token_hash);
+
+CREATE TABLE audit_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	actor TEXT NOT NULL,
+	action TEXT NOT NULL,
+	target_type TEXT NOT NULL,
+	target_id TEXT NOT NULL,
+	detail TEXT NOT NULL DEFAULT '{}',
+	created_at DATETIME NOT NULL
+);
+CREATE INDEX audit_log_target ON audit_log (target_type, target_id, id);
+`,
+	},
+	{
+		version: 11,
+		name:    "join tokens",
+		sql: `
+CREATE TABLE join_tokens (
+	id TEXT PRIMARY KEY,
+	description TEXT NOT NULL DEFAULT '',
+	token_hash TEXT NOT NULL,
+	max_uses INTEGER NOT NULL,
+	uses INTEGER NOT NULL DEFAULT 0,
+	expires_at DATETIME NOT NULL,
+	edge_name TEXT,
+	group_name TEXT,
+	labels TEXT NOT NULL DEFAULT '{}',
+	created_by TEXT NOT NULL DEFAULT '',
+	created_at DATETIME NOT NULL,
+	revoked_at DATETIME
+);
+
+CREATE TABLE join_token_uses (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	join_token_id TEXT NOT NULL REFERENCES join_tokens(id) ON DELETE CASCADE,
+	edge_node_id TEXT NOT NULL,
+	edge_name TEXT NOT NULL,
+	used_at DATETIME NOT NULL
+);
+CREATE INDEX join_token_uses_token ON join_token_uses (join_token_id, id);
+
+ALTER TABLE edge_nodes ADD COLUMN group_name TEXT;
+ALTER TABLE edge_nodes ADD COLUMN labels TEXT NOT NULL DEFAULT '{}';
+ALTER TABLE edge_nodes ADD COLUMN join_token_id TEXT;
+`,
+	},
+	{
+		version: 12,
+		name:    "edge enrollment approval",
+		sql: `
+ALTER TABLE edge_nodes ADD COLUMN state TEXT NOT NULL DEFAULT 'active';
+ALTER TABLE edge_nodes ADD COLUMN registered_from TEXT;
+ALTER TABLE edge_nodes ADD COLUMN wg_public_key TEXT;
+ALTER TABLE edge_nodes ADD COLUMN approved_at DATETIME;
+ALTER TABLE edge_nodes ADD COLUMN approved_by TEXT;
+ALTER TABLE join_tokens ADD COLUMN require_approval INTEGER NOT NULL DEFAULT 0;
+`,
+	},
+	{
+		version: 13,
+		name:    "origin enrollment",
+		sql: `
+ALTER TABLE join_tokens ADD COLUMN kind TEXT NOT NULL DEFAULT 'edge';
+ALTER TABLE join_token_uses RENAME COLUMN edge_node_id TO consumer_id;
+ALTER TABLE join_token_uses RENAME COLUMN edge_name TO consumer_name;
+
+ALTER TABLE origins ADD COLUMN token_hash TEXT;
+ALTER TABLE origins ADD COLUMN token_issued_at DATETIME;
+ALTER TABLE origins ADD COLUMN registered_from TEXT;
+ALTER TABLE origins ADD COLUMN last_seen DATETIME;
+ALTER TABLE origins ADD COLUMN join_token_id TEXT;
+CREATE UNIQUE INDEX origins_token_hash ON origins (token_hash);
+`,
+	},
+	{
+		// Existing addresses are recorded first come, first served; later
+		// duplicates are reported by TunnelAddressConflicts.
+		version: 14,
+		name:    "tunnel addresses",
+		sql: `
+CREATE TABLE tunnel_addresses (
+	addr TEXT PRIMARY KEY,
+	owner_type TEXT NOT NULL,
+	owner_id TEXT NOT NULL,
+	allocated_at DATETIME NOT NULL
+);
+CREATE INDEX tunnel_addresses_owner ON tunnel_addresses (owner_type, owner_id);
+
+INSERT OR IGNORE INTO tunnel_addresses (addr, owner_type, owner_id, allocated_at)
+	SELECT wireguard_ip, 'origin', id, created_at FROM origins ORDER BY created_at;
+INSERT OR IGNORE INTO tunnel_addresses (addr, owner_type, owner_id, allocated_at)
+	SELECT CASE WHEN instr(wg_addr, '/') > 0 THEN substr(wg_addr, 1, instr(wg_addr, '/') - 1) ELSE wg_addr END, 'edge', id, created_at
+	FROM edge_nodes WHERE wg_addr IS NOT NULL AND wg_addr != '' ORDER BY created_at;
+`,
+	},
+	{
+		version: 15,
+		name:    "origin wireguard endpoint",
+		sql: `
+ALTER TABLE origins ADD COLUMN wireguard_endpoint TEXT;
+`,
+	},
+	{
+		// At most one rotation per node overlaps its old and new key.
+		version: 16,
+		name:    "wireguard key rotations",
+		sql: `
+ALTER TABLE origins ADD COLUMN applied_wg_hash TEXT;
+ALTER TABLE edge_nodes ADD COLUMN applied_wg_hash TEXT;
+
+CREATE TABLE wg_key_rotations (
+	id TEXT PRIMARY KEY,
+	owner_type TEXT NOT NULL,
+	owner_id TEXT NOT NULL,
+	old_public_key TEXT NOT NULL,
+	new_public_key TEXT NOT NULL,
+	state TEXT NOT NULL,
+	requested_by TEXT,
+	started_at DATETIME NOT NULL,
+	finished_at DATETIME
+);
+CREATE UNIQUE INDEX wg_key_rotations_overlap ON wg_key_rotations (owner_type, owner_id) WHERE state = 'overlap';
+
+CREATE TABLE wg_key_rotation_peers (
+	rotation_id TEXT NOT NULL REFERENCES wg_key_rotations (id) ON DELETE CASCADE,
+	peer_type TEXT NOT NULL,
+	peer_id TEXT NOT NULL,
+	applied_at DATETIME NOT NULL,
+	PRIMARY KEY (rotation_id, peer_type, peer_id)
+);
+`,
+	},
+	{
+		// Edges get the config of the routes placed on them; every config
+		// hash built for a generation is recorded so drift stays measurable.
+		version: 17,
+		name:    "route placement",
+		sql: `
+ALTER TABLE routes ADD COLUMN placement TEXT;
+
+CREATE TABLE config_generation_hashes (
+	generation_id INTEGER NOT NULL REFERENCES config_generations (id) ON DELETE CASCADE,
+	config_hash TEXT NOT NULL,
+	PRIMARY KEY (config_hash, generation_id)
+);
+INSERT INTO config_generation_hashes (generation_id, config_hash) SELECT id, config_hash FROM config_generations;
+`,
+	},
+	{
+		// Edges can be taken out of DNS and drained before they are retired.
+		version: 18,
+		name:    "edge lifecycle",
+		sql: `
+ALTER TABLE edge_nodes ADD COLUMN public_addr TEXT;
+ALTER TABLE edge_nodes ADD COLUMN drain_until DATETIME;
+ALTER TABLE edge_nodes ADD COLUMN state_changed_at DATETIME;
+ALTER TABLE edge_nodes ADD COLUMN state_changed_by TEXT;
+`,
+	},
+}
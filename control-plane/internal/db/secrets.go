@@ -0,0 +1,148 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/secrets"
+)
+
+// ErrSecretsUnavailable is returned when a sensitive value has to be sealed or
+// opened but no key-encryption key is configured.
+var ErrSecretsUnavailable = errors.New("no secrets key is configured (set CP_SECRETS_KEY or CP_SECRETS_KEY_FILE)")
+
+// sealedColumn is a column whose values are sealed with the store's secrets
+// box. Certificate and ACME account keys are sealed by their callers; the
+// rest are sealed by the store on write.
+type sealedColumn struct {
+	table, key, column string
+}
+
+var sealedColumns = []sealedColumn{
+	{"origins", "id", "wireguard_private_key_encrypted"},
+	{"webhooks", "id", "secret"},
+	{"certificates", "hostname", "key_encrypted"},
+	{"acme_accounts", "directory_url", "key_encrypted"},
+}
+
+// SetSecrets configures the box used to seal sensitive columns. It must be
+// called before the store is shared between goroutines. Without a box origin
+// private keys are refused and webhook secrets are stored as given.
+func (s *Store) SetSecrets(box *secrets.Box) {
+	s.secrets = box
+}
+
+// sealSecret seals a plaintext value for storage. Empty values stay empty.
+// When required is false and no box is configured the value is stored as
+// given, to be sealed later by ReencryptSecrets.
+func (s *Store) sealSecret(plaintext string, required bool) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	if s.secrets == nil {
+		if required {
+			return "", ErrSecretsUnavailable
+		}
+		return plaintext, nil
+	}
+	sealed, err := s.secrets.Seal([]byte(plaintext))
+	if err != nil {
+		return "", fmt.Errorf("seal secret: %w", err)
+	}
+	return sealed, nil
+}
+
+// openSecret reverses sealSecret. Values stored before encryption at rest was
+// enabled are returned as they are.
+func (s *Store) openSecret(stored string) (string, error) {
+	if !secrets.IsSealed(stored) {
+		return stored, nil
+	}
+	if s.secrets == nil {
+		return "", ErrSecretsUnavailable
+	}
+	plaintext, err := s.secrets.Open(stored)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// ReencryptStats counts the values touched by ReencryptSecrets.
+type ReencryptStats struct {
+	// Sealed values were stored in plaintext.
+	Sealed int
+	// Rotated values were sealed under a previous key or the legacy format.
+	Rotated int
+}
+
+// ReencryptSecrets brings every sealed column up to date with the primary
+// key: plaintext values are sealed and values wrapped with a previous key are
+// rewrapped. It runs in a single transaction, so a failure leaves every value
+// as it was. Once it succeeds, previous keys can be dropped.
+func (s *Store) ReencryptSecrets(ctx context.Context) (ReencryptStats, error) {
+	var stats ReencryptStats
+	if s.secrets == nil {
+		return stats, ErrSecretsUnavailable
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return stats, fmt.Errorf("begin reencrypt: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, col := range sealedColumns {
+		updates, err := s.reencryptColumn(ctx, tx, col, &stats)
+		if err != nil {
+			return ReencryptStats{}, err
+		}
+		for key, value := range updates {
+			if _, err := tx.ExecContext(ctx,
+				`UPDATE `+col.table+` SET `+col.column+` = ? WHERE `+col.key+` = ?`, value, key); err != nil {
+				return ReencryptStats{}, fmt.Errorf("update %s.%s: %w", col.table, col.column, err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return ReencryptStats{}, fmt.Errorf("commit reencrypt: %w", err)
+	}
+	return stats, nil
+}
+
+// reencryptColumn returns the new value of every row of col that needs one,
+// keyed by primary key.
+func (s *Store) reencryptColumn(ctx context.Context, tx *sql.Tx, col sealedColumn, stats *ReencryptStats) (map[string]string, error) {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT `+col.key+`, `+col.column+` FROM `+col.table+` WHERE `+col.column+` IS NOT NULL AND `+col.column+` != ''`)
+	if err != nil {
+		return nil, fmt.Errorf("select %s.%s: %w", col.table, col.column, err)
+	}
+	defer rows.Close()
+
+	updates := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, fmt.Errorf("scan %s.%s: %w", col.table, col.column, err)
+		}
+		switch {
+		case !secrets.IsSealed(value):
+			sealed, err := s.secrets.Seal([]byte(value))
+			if err != nil {
+				return nil, fmt.Errorf("seal %s %s: %w", col.table, key, err)
+			}
+			updates[key] = sealed
+			stats.Sealed++
+		case s.secrets.NeedsRotation(value):
+			rotated, err := s.secrets.Rotate(value)
+			if err != nil {
+				return nil, fmt.Errorf("rotate %s %s: %w", col.table, key, err)
+			}
+			updates[key] = rotated
+			stats.Rotated++
+		}
+	}
+	return updates, rows.Err()
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/secrets"
+)
+
+func TestOriginPrivateKeyRequiresSecrets(t *testing.T) {
+	store, _ := openTestStore(t)
+	ctx := context.Background()
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	_, err := store.CreateOrigin(ctx, CreateOriginParams{Name: "o1", WireguardIP: "10.0.0.2", WireguardPrivateKey: "key"})
+	if !errors.Is(err, ErrSecretsUnavailable) {
+		t.Fatalf("expected ErrSecretsUnavailable, got %v", err)
+	}
+	if _, err := store.CreateOrigin(ctx, CreateOriginParams{Name: "o1", WireguardIP: "10.0.0.2"}); err != nil {
+		t.Fatalf("origin without private key: %v", err)
+	}
+}
+
+func TestReencryptSecrets(t *testing.T) {
+	store, _ := openTestStore(t)
+	ctx := context.Background()
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+
+	// A webhook secret written before any key was configured stays plaintext.
+	hook, err := store.CreateWebhook(ctx, CreateWebhookParams{Name: "h", URL: "http://example.com", Secret: "whsec_plain"})
+	if err != nil {
+		t.Fatalf("create webhook: %v", err)
+	}
+	if hook.Secret != "whsec_plain" {
+		t.Fatalf("expected plaintext secret without a key, got %q", hook.Secret)
+	}
+
+	oldBox, _ := secrets.NewBox(oldKey)
+	store.SetSecrets(oldBox)
+	origin, err := store.CreateOrigin(ctx, CreateOriginParams{Name: "o1", WireguardIP: "10.0.0.2", WireguardPrivateKey: "wg-key"})
+	if err != nil {
+		t.Fatalf("create origin: %v", err)
+	}
+
+	rotated, _ := secrets.NewBox(newKey, oldKey)
+	store.SetSecrets(rotated)
+	stats, err := store.ReencryptSecrets(ctx)
+	if err != nil {
+		t.Fatalf("reencrypt: %v", err)
+	}
+	if stats.Sealed != 1 || stats.Rotated != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if stats, err := store.ReencryptSecrets(ctx); err != nil || stats != (ReencryptStats{}) {
+		t.Fatalf("second reencrypt should be a no-op: %+v, %v", stats, err)
+	}
+
+	// The previous key is no longer needed.
+	newOnly, _ := secrets.NewBox(newKey)
+	store.SetSecrets(newOnly)
+	if plain, err := store.OriginPrivateKey(ctx, origin.ID); err != nil || plain != "wg-key" {
+		t.Fatalf("origin private key after rotation: %q, %v", plain, err)
+	}
+	stored, err := store.WebhookByID(ctx, hook.ID)
+	if err != nil {
+		t.Fatalf("load webhook: %v", err)
+	}
+	if !strings.HasPrefix(stored.Secret, "v2:"+newOnly.PrimaryKeyID()+":") {
+		t.Fatalf("webhook secret not sealed: %q", stored.Secret)
+	}
+	if plain, err := store.openSecret(stored.Secret); err != nil || plain != "whsec_plain" {
+		t.Fatalf("open webhook secret: %q, %v", plain, err)
+	}
+}
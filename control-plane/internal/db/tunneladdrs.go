@@ -0,0 +1,185 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/ipam"
+)
+
+// Owners of tunnel addresses.
+const (
+	TunnelOwnerOrigin = "origin"
+	TunnelOwnerEdge   = "edge"
+)
+
+var (
+	// ErrTunnelPoolExhausted is returned when no tunnel address is left to
+	// allocate.
+	ErrTunnelPoolExhausted = errors.New("tunnel address pool is exhausted")
+	// ErrTunnelAddressInUse is returned when an origin or edge is given an
+	// address another origin or edge already holds.
+	ErrTunnelAddressInUse = errors.New("tunnel address is already in use")
+)
+
+// TunnelAddress is an address of the tunnel network held by an origin or an
+// edge. Addresses outside the configured pools are recorded as well, so
+// collisions are caught for hand-picked addresses too.
+type TunnelAddress struct {
+	Addr        netip.Addr
+	OwnerType   string
+	OwnerID     string
+	OwnerName   string
+	AllocatedAt time.Time
+}
+
+// SetTunnelPools configures the networks addresses are allocated from, tried
+// in order. It must be called before the store is shared between goroutines;
+// without it ipam.DefaultPool is used.
+func (s *Store) SetTunnelPools(pools []netip.Prefix) {
+	s.tunnelPools = pools
+}
+
+// TunnelPools returns the networks addresses are allocated from.
+func (s *Store) TunnelPools() []netip.Prefix {
+	if len(s.tunnelPools) == 0 {
+		return []netip.Prefix{ipam.DefaultPool}
+	}
+	return s.tunnelPools
+}
+
+// allocateTunnelAddr picks the lowest free address of the first pool that
+// still has one. The caller records it with assignTunnelAddr in the same tx.
+func (s *Store) allocateTunnelAddr(ctx context.Context, tx *sql.Tx) (netip.Addr, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT addr FROM tunnel_addresses`)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("list tunnel addresses: %w", err)
+	}
+	defer rows.Close()
+	used := map[netip.Addr]bool{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return netip.Addr{}, fmt.Errorf("scan tunnel address: %w", err)
+		}
+		if addr, err := ipam.ParseAddr(v); err == nil {
+			used[addr] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return netip.Addr{}, err
+	}
+	for _, pool := range s.TunnelPools() {
+		if addr, ok := ipam.Next(pool, func(a netip.Addr) bool { return used[a] }); ok {
+			return addr, nil
+		}
+	}
+	return netip.Addr{}, ErrTunnelPoolExhausted
+}
+
+// assignTunnelAddr makes addr the only tunnel address held by the owner,
+// releasing any other. An invalid addr only releases.
+func assignTunnelAddr(ctx context.Context, tx *sql.Tx, ownerType, ownerID string, addr netip.Addr, at time.Time) error {
+	if addr.IsValid() {
+		var heldType, heldID string
+		err := tx.QueryRowContext(ctx, `SELECT owner_type, owner_id FROM tunnel_addresses WHERE addr = ?`, addr.String()).Scan(&heldType, &heldID)
+		switch {
+		case err == nil && (heldType != ownerType || heldID != ownerID):
+			return fmt.Errorf("%w: %s is held by %s %s", ErrTunnelAddressInUse, addr, heldType, heldID)
+		case err == nil:
+			return nil
+		case !errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("select tunnel address: %w", err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM tunnel_addresses WHERE owner_type = ? AND owner_id = ?`, ownerType, ownerID); err != nil {
+		return fmt.Errorf("release tunnel address: %w", err)
+	}
+	if !addr.IsValid() {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO tunnel_addresses (addr, owner_type, owner_id, allocated_at) VALUES (?, ?, ?, ?)
+	`, addr.String(), ownerType, ownerID, at.UTC()); err != nil {
+		return fmt.Errorf("record tunnel address: %w", err)
+	}
+	return nil
+}
+
+// ListTunnelAddresses returns every held tunnel address in address order.
+func (s *Store) ListTunnelAddresses(ctx context.Context) ([]TunnelAddress, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT t.addr, t.owner_type, t.owner_id, COALESCE(o.name, e.name, ''), t.allocated_at
+		FROM tunnel_addresses t
+		LEFT JOIN origins o ON t.owner_type = 'origin' AND o.id = t.owner_id
+		LEFT JOIN edge_nodes e ON t.owner_type = 'edge' AND e.id = t.owner_id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("list tunnel addresses: %w", err)
+	}
+	defer rows.Close()
+	var out []TunnelAddress
+	for rows.Next() {
+		var a TunnelAddress
+		var addr string
+		if err := rows.Scan(&addr, &a.OwnerType, &a.OwnerID, &a.OwnerName, &a.AllocatedAt); err != nil {
+			return nil, fmt.Errorf("scan tunnel address: %w", err)
+		}
+		if a.Addr, err = ipam.ParseAddr(addr); err != nil {
+			continue
+		}
+		out = append(out, a)
+	}
+	slices.SortFunc(out, func(a, b TunnelAddress) int { return a.Addr.Compare(b.Addr) })
+	return out, rows.Err()
+}
+
+// TunnelAddressConflict is an address configured on more than one origin or
+// edge. New conflicts are refused; these predate address management.
+type TunnelAddressConflict struct {
+	Addr   netip.Addr
+	Owners []TunnelAddress
+}
+
+// TunnelAddressConflicts compares the addresses configured on origins and
+// edges, which may disagree with tunnel_addresses for data written before
+// addresses were managed.
+func (s *Store) TunnelAddressConflicts(ctx context.Context) ([]TunnelAddressConflict, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT wireguard_ip, 'origin', id, name, created_at FROM origins
+		UNION ALL
+		SELECT wg_addr, 'edge', id, name, created_at FROM edge_nodes WHERE wg_addr IS NOT NULL AND wg_addr != ''
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("list configured tunnel addresses: %w", err)
+	}
+	defer rows.Close()
+	byAddr := map[netip.Addr][]TunnelAddress{}
+	for rows.Next() {
+		var a TunnelAddress
+		var addr string
+		if err := rows.Scan(&addr, &a.OwnerType, &a.OwnerID, &a.OwnerName, &a.AllocatedAt); err != nil {
+			return nil, fmt.Errorf("scan configured tunnel address: %w", err)
+		}
+		if a.Addr, err = ipam.ParseAddr(addr); err != nil {
+			continue
+		}
+		byAddr[a.Addr] = append(byAddr[a.Addr], a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var out []TunnelAddressConflict
+	for addr, owners := range byAddr {
+		if len(owners) > 1 {
+			out = append(out, TunnelAddressConflict{Addr: addr, Owners: owners})
+		}
+	}
+	slices.SortFunc(out, func(a, b TunnelAddressConflict) int { return a.Addr.Compare(b.Addr) })
+	return out, nil
+}
@@ -0,0 +1,257 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Webhook delivery states.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook is an outbound subscription. Events holds the event type patterns
+// it receives ("route.created", "edge.*"); an empty list receives everything.
+// Secret holds the stored value, which is sealed when a secrets key is
+// configured; DueWebhookDeliveries hands out the plaintext.
+type Webhook struct {
+	ID        string
+	Name      string
+	URL       string
+	Events    []string
+	Secret    string `json:"-"`
+	CreatedAt time.Time
+}
+
+type CreateWebhookParams struct {
+	Name   string
+	URL    string
+	Events []string
+	Secret string
+}
+
+func (s *Store) CreateWebhook(ctx context.Context, params CreateWebhookParams) (Webhook, error) {
+	secret, err := s.sealSecret(params.Secret, false)
+	if err != nil {
+		return Webhook{}, err
+	}
+	hook := Webhook{
+		ID:        uuid.NewString(),
+		Name:      params.Name,
+		URL:       params.URL,
+		Events:    params.Events,
+		Secret:    secret,
+		CreatedAt: time.Now().UTC(),
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO webhooks (id, name, url, events, secret, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, hook.ID, hook.Name, hook.URL, joinScopes(hook.Events), hook.Secret, hook.CreatedAt)
+	if err != nil {
+		return Webhook{}, fmt.Errorf("insert webhook: %w", err)
+	}
+	return hook, nil
+}
+
+const webhookColumns = `id, name, url, events, secret, created_at`
+
+func scanWebhook(row rowScanner) (Webhook, error) {
+	var h Webhook
+	var events string
+	if err := row.Scan(&h.ID, &h.Name, &h.URL, &events, &h.Secret, &h.CreatedAt); err != nil {
+		return Webhook{}, err
+	}
+	h.Events = splitScopes(events)
+	return h, nil
+}
+
+func (s *Store) WebhookByID(ctx context.Context, id string) (Webhook, error) {
+	h, err := scanWebhook(s.db.QueryRowContext(ctx, `SELECT `+webhookColumns+` FROM webhooks WHERE id = ?`, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Webhook{}, err
+		}
+		return Webhook{}, fmt.Errorf("select webhook: %w", err)
+	}
+	return h, nil
+}
+
+func (s *Store) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+webhookColumns+` FROM webhooks ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("list webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	var out []Webhook
+	for rows.Next() {
+		h, err := scanWebhook(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan webhook: %w", err)
+		}
+		out = append(out, h)
+	}
+	return out, rows.Err()
+}
+
+// DeleteWebhook removes the webhook together with its delivery log.
+func (s *Store) DeleteWebhook(ctx context.Context, id string) error {
+	return s.deleteByID(ctx, "webhooks", id)
+}
+
+// WebhookDelivery is one event queued for, or delivered to, a webhook.
+type WebhookDelivery struct {
+	ID             int64
+	WebhookID      string
+	EventID        int64
+	EventType      string
+	Payload        string `json:"-"`
+	Status         string
+	Attempts       int
+	NextAttemptAt  sql.NullTime
+	LastStatusCode sql.NullInt64
+	LastError      sql.NullString
+	CreatedAt      time.Time
+	DeliveredAt    sql.NullTime
+
+	// URL and Secret are filled in by DueWebhookDeliveries.
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+// EnqueueWebhookDelivery queues payload for delivery at the given time.
+func (s *Store) EnqueueWebhookDelivery(ctx context.Context, webhookID string, ev Event, payload string, at time.Time) error {
+	now := at.UTC()
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload, status, next_attempt_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, webhookID, ev.ID, ev.Type, payload, DeliveryPending, now, now)
+	if err != nil {
+		return fmt.Errorf("insert webhook delivery: %w", err)
+	}
+	return nil
+}
+
+const webhookDeliveryColumns = `d.id, d.webhook_id, d.event_id, d.event_type, d.payload, d.status, d.attempts,
+	d.next_attempt_at, d.last_status_code, d.last_error, d.created_at, d.delivered_at`
+
+func scanWebhookDelivery(row rowScanner, extra ...any) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	dest := []any{&d.ID, &d.WebhookID, &d.EventID, &d.EventType, &d.Payload, &d.Status, &d.Attempts,
+		&d.NextAttemptAt, &d.LastStatusCode, &d.LastError, &d.CreatedAt, &d.DeliveredAt}
+	err := row.Scan(append(dest, extra...)...)
+	return d, err
+}
+
+// DueWebhookDeliveries returns up to limit pending deliveries of a webhook
+// whose next attempt is due, oldest first.
+func (s *Store) DueWebhookDeliveries(ctx context.Context, webhookID string, now time.Time, limit int) ([]WebhookDelivery, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+webhookDeliveryColumns+`, h.url, h.secret
+		FROM webhook_deliveries d
+		JOIN webhooks h ON h.id = d.webhook_id
+		WHERE d.webhook_id = ? AND d.status = ? AND d.next_attempt_at <= ?
+		ORDER BY d.id
+		LIMIT ?
+	`, webhookID, DeliveryPending, now.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("list due webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var out []WebhookDelivery
+	for rows.Next() {
+		var url, secret string
+		d, err := scanWebhookDelivery(rows, &url, &secret)
+		if err != nil {
+			return nil, fmt.Errorf("scan webhook delivery: %w", err)
+		}
+		if secret, err = s.openSecret(secret); err != nil {
+			return nil, fmt.Errorf("open secret of webhook %s: %w", d.WebhookID, err)
+		}
+		d.URL, d.Secret = url, secret
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+// WebhookAttempt is the outcome of one delivery attempt. A zero NextAttemptAt
+// on a failed attempt gives the delivery up.
+type WebhookAttempt struct {
+	Delivered     bool
+	StatusCode    int
+	Error         string
+	At            time.Time
+	NextAttemptAt time.Time
+}
+
+func (s *Store) RecordWebhookAttempt(ctx context.Context, id int64, attempt WebhookAttempt) error {
+	status := DeliveryPending
+	var deliveredAt sql.NullTime
+	switch {
+	case attempt.Delivered:
+		status = DeliveryDelivered
+		deliveredAt = toNullTime(attempt.At)
+		attempt.NextAttemptAt = time.Time{}
+	case attempt.NextAttemptAt.IsZero():
+		status = DeliveryFailed
+	}
+	var statusCode sql.NullInt64
+	if attempt.StatusCode != 0 {
+		statusCode = sql.NullInt64{Int64: int64(attempt.StatusCode), Valid: true}
+	}
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE webhook_deliveries
+		SET status = ?, attempts = attempts + 1, next_attempt_at = ?, last_status_code = ?, last_error = ?, delivered_at = ?
+		WHERE id = ?
+	`, status, toNullTime(attempt.NextAttemptAt), statusCode, nullIfEmpty(attempt.Error), deliveredAt, id)
+	if err != nil {
+		return fmt.Errorf("update webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// PruneWebhookDeliveries deletes delivered and given-up deliveries created
+// before the given time. Pending deliveries are kept until they finish.
+func (s *Store) PruneWebhookDeliveries(ctx context.Context, before time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `
+		DELETE FROM webhook_deliveries WHERE status IN (?, ?) AND created_at < ?
+	`, DeliveryDelivered, DeliveryFailed, before.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("prune webhook deliveries: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// ListWebhookDeliveries returns the most recent deliveries of a webhook,
+// newest first.
+func (s *Store) ListWebhookDeliveries(ctx context.Context, webhookID string, limit int) ([]WebhookDelivery, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+webhookDeliveryColumns+`
+		FROM webhook_deliveries d
+		WHERE d.webhook_id = ?
+		ORDER BY d.id DESC
+		LIMIT ?
+	`, webhookID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("list webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var out []WebhookDelivery
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan webhook delivery: %w", err)
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,266 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// WireGuard key rotation states. A rotation overlaps the old and the new key
+// in every peer list until each peer applied the new one, then completes by
+// retiring the old key.
+const (
+	WGKeyRotationOverlap   = "overlap"
+	WGKeyRotationCompleted = "completed"
+	WGKeyRotationCancelled = "cancelled"
+)
+
+var (
+	// ErrWGKeyRotationInProgress is returned when a node submits a key while
+	// a rotation to a different key is still overlapping.
+	ErrWGKeyRotationInProgress = errors.New("a wireguard key rotation is already in progress")
+	// ErrNoWGPublicKey is returned when a node without a key asks to rotate.
+	ErrNoWGPublicKey = errors.New("no wireguard public key to rotate")
+	// ErrWGKeyUnchanged is returned when the submitted key is the current one.
+	ErrWGKeyUnchanged = errors.New("the new wireguard public key equals the current one")
+)
+
+// WGKeyRotation replaces the WireGuard public key of an origin or an edge.
+type WGKeyRotation struct {
+	ID           string
+	OwnerType    string
+	OwnerID      string
+	OwnerName    string
+	OldPublicKey string
+	NewPublicKey string
+	State        string
+	RequestedBy  sql.NullString
+	StartedAt    time.Time
+	FinishedAt   sql.NullTime
+	// Applied lists the peers that applied a config with the new key.
+	Applied []WGKeyRotationPeer
+}
+
+// WGKeyRotationPeer is a peer that applied the new key of a rotation.
+type WGKeyRotationPeer struct {
+	PeerType  string
+	PeerID    string
+	AppliedAt time.Time
+}
+
+const wgKeyRotationColumns = `r.id, r.owner_type, r.owner_id, COALESCE(o.name, e.name, ''), r.old_public_key, r.new_public_key,
+	r.state, r.requested_by, r.started_at, r.finished_at
+	FROM wg_key_rotations r
+	LEFT JOIN origins o ON r.owner_type = 'origin' AND o.id = r.owner_id
+	LEFT JOIN edge_nodes e ON r.owner_type = 'edge' AND e.id = r.owner_id`
+
+func scanWGKeyRotation(row rowScanner) (WGKeyRotation, error) {
+	var r WGKeyRotation
+	err := row.Scan(&r.ID, &r.OwnerType, &r.OwnerID, &r.OwnerName, &r.OldPublicKey, &r.NewPublicKey,
+		&r.State, &r.RequestedBy, &r.StartedAt, &r.FinishedAt)
+	return r, err
+}
+
+// wgKeyColumn is the column holding the public key of the owner type.
+func wgKeyColumn(ownerType string) (table, column string, err error) {
+	switch ownerType {
+	case TunnelOwnerOrigin:
+		return "origins", "wireguard_public_key", nil
+	case TunnelOwnerEdge:
+		return "edge_nodes", "wg_public_key", nil
+	}
+	return "", "", fmt.Errorf("unknown wireguard key owner %q", ownerType)
+}
+
+// StartWGKeyRotation starts overlapping the owner's key with newKey. A
+// retried submission of the same key returns the running rotation with
+// created false.
+func (s *Store) StartWGKeyRotation(ctx context.Context, ownerType, ownerID, newKey, requestedBy string, at time.Time) (WGKeyRotation, bool, error) {
+	table, column, err := wgKeyColumn(ownerType)
+	if err != nil {
+		return WGKeyRotation{}, false, err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return WGKeyRotation{}, false, fmt.Errorf("begin: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var current sql.NullString
+	if err := tx.QueryRowContext(ctx, `SELECT `+column+` FROM `+table+` WHERE id = ?`, ownerID).Scan(&current); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return WGKeyRotation{}, false, err
+		}
+		return WGKeyRotation{}, false, fmt.Errorf("select wireguard key: %w", err)
+	}
+	var runningID, runningKey string
+	err = tx.QueryRowContext(ctx, `
+		SELECT id, new_public_key FROM wg_key_rotations WHERE owner_type = ? AND owner_id = ? AND state = ?
+	`, ownerType, ownerID, WGKeyRotationOverlap).Scan(&runningID, &runningKey)
+	switch {
+	case err == nil && runningKey == newKey:
+		_ = tx.Rollback()
+		r, err := s.WGKeyRotationByID(ctx, runningID)
+		return r, false, err
+	case err == nil:
+		return WGKeyRotation{}, false, ErrWGKeyRotationInProgress
+	case !errors.Is(err, sql.ErrNoRows):
+		return WGKeyRotation{}, false, fmt.Errorf("select running rotation: %w", err)
+	}
+	if current.String == "" {
+		return WGKeyRotation{}, false, ErrNoWGPublicKey
+	}
+	if current.String == newKey {
+		return WGKeyRotation{}, false, ErrWGKeyUnchanged
+	}
+	id := uuid.NewString()
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO wg_key_rotations (id, owner_type, owner_id, old_public_key, new_public_key, state, requested_by, started_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, id, ownerType, ownerID, current.String, newKey, WGKeyRotationOverlap, nullIfEmpty(requestedBy), at.UTC()); err != nil {
+		return WGKeyRotation{}, false, fmt.Errorf("insert wireguard key rotation: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return WGKeyRotation{}, false, err
+	}
+	s.changed()
+	r, err := s.WGKeyRotationByID(ctx, id)
+	return r, true, err
+}
+
+func (s *Store) WGKeyRotationByID(ctx context.Context, id string) (WGKeyRotation, error) {
+	r, err := scanWGKeyRotation(s.db.QueryRowContext(ctx, `SELECT `+wgKeyRotationColumns+` WHERE r.id = ?`, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return WGKeyRotation{}, err
+		}
+		return WGKeyRotation{}, fmt.Errorf("select wireguard key rotation: %w", err)
+	}
+	if r.Applied, err = s.wgKeyRotationPeers(ctx, id); err != nil {
+		return WGKeyRotation{}, err
+	}
+	return r, nil
+}
+
+// ListWGKeyRotations returns rotations, newest first, optionally only those
+// in state and of one owner.
+func (s *Store) ListWGKeyRotations(ctx context.Context, state, ownerID string) ([]WGKeyRotation, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+wgKeyRotationColumns+`
+		WHERE (? = '' OR r.state = ?) AND (? = '' OR r.owner_id = ?)
+		ORDER BY r.started_at DESC, r.id
+	`, state, state, ownerID, ownerID)
+	if err != nil {
+		return nil, fmt.Errorf("list wireguard key rotations: %w", err)
+	}
+	var out []WGKeyRotation
+	for rows.Next() {
+		r, err := scanWGKeyRotation(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan wireguard key rotation: %w", err)
+		}
+		out = append(out, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range out {
+		if out[i].Applied, err = s.wgKeyRotationPeers(ctx, out[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (s *Store) wgKeyRotationPeers(ctx context.Context, id string) ([]WGKeyRotationPeer, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT peer_type, peer_id, applied_at FROM wg_key_rotation_peers WHERE rotation_id = ? ORDER BY applied_at, peer_id
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("list wireguard key rotation peers: %w", err)
+	}
+	defer rows.Close()
+	out := []WGKeyRotationPeer{}
+	for rows.Next() {
+		var p WGKeyRotationPeer
+		if err := rows.Scan(&p.PeerType, &p.PeerID, &p.AppliedAt); err != nil {
+			return nil, fmt.Errorf("scan wireguard key rotation peer: %w", err)
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// RecordWGKeyRotationPeer notes that a peer applied the new key. Recording a
+// peer twice keeps the first time.
+func (s *Store) RecordWGKeyRotationPeer(ctx context.Context, id, peerType, peerID string, at time.Time) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT OR IGNORE INTO wg_key_rotation_peers (rotation_id, peer_type, peer_id, applied_at) VALUES (?, ?, ?, ?)
+	`, id, peerType, peerID, at.UTC())
+	if err != nil {
+		return fmt.Errorf("record wireguard key rotation peer: %w", err)
+	}
+	return nil
+}
+
+// FinishWGKeyRotation ends an overlapping rotation. Completing it makes the
+// new key the owner's key; cancelling it keeps the old one.
+func (s *Store) FinishWGKeyRotation(ctx context.Context, id, state string, at time.Time) (WGKeyRotation, error) {
+	if state != WGKeyRotationCompleted && state != WGKeyRotationCancelled {
+		return WGKeyRotation{}, fmt.Errorf("invalid wireguard key rotation state %q", state)
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return WGKeyRotation{}, fmt.Errorf("begin: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var ownerType, ownerID, newKey string
+	err = tx.QueryRowContext(ctx, `
+		UPDATE wg_key_rotations SET state = ?, finished_at = ? WHERE id = ? AND state = ?
+		RETURNING owner_type, owner_id, new_public_key
+	`, state, at.UTC(), id, WGKeyRotationOverlap).Scan(&ownerType, &ownerID, &newKey)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return WGKeyRotation{}, err
+		}
+		return WGKeyRotation{}, fmt.Errorf("finish wireguard key rotation: %w", err)
+	}
+	if state == WGKeyRotationCompleted {
+		table, column, err := wgKeyColumn(ownerType)
+		if err != nil {
+			return WGKeyRotation{}, err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE `+table+` SET `+column+` = ? WHERE id = ?`, newKey, ownerID); err != nil {
+			return WGKeyRotation{}, fmt.Errorf("update wireguard key: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return WGKeyRotation{}, err
+	}
+	s.changed()
+	return s.WGKeyRotationByID(ctx, id)
+}
+
+// RecordOriginWGHash stores the peers_hash the origin agent last applied.
+func (s *Store) RecordOriginWGHash(ctx context.Context, id, hash string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE origins SET applied_wg_hash = ? WHERE id = ?`, nullIfEmpty(hash), id)
+	if err != nil {
+		return fmt.Errorf("update origin applied_wg_hash: %w", err)
+	}
+	return nil
+}
+
+// deleteWGKeyRotations drops the rotations of a deleted origin or edge.
+func deleteWGKeyRotations(ctx context.Context, tx *sql.Tx, ownerType, ownerID string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM wg_key_rotations WHERE owner_type = ? AND owner_id = ?`, ownerType, ownerID); err != nil {
+		return fmt.Errorf("delete wireguard key rotations: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Package events records control plane changes in the event log and fans them
+// out to live subscribers such as the SSE stream.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+)
+
+// Event types. The prefix before the dot names the resource.
+const (
+	OriginCreated    = "origin.created"
+	OriginUpdated    = "origin.updated"
+	OriginDeleted    = "origin.deleted"
+	RouteCreated     = "route.created"
+	RouteUpdated     = "route.updated"
+	RouteDeleted     = "route.deleted"
+	EdgeRegistered   = "edge.registered"
+	EdgeApproved     = "edge.approved"
+	EdgeStateChanged = "edge.state_changed"
+	EdgeUpdated      = "edge.updated"
+	EdgeDeleted      = "edge.deleted"
+	EdgeSeen         = "edge.seen"
+	EdgeStale        = "edge.stale"
+	EdgeApplyFailed  = "edge.apply_failed"
+	ConfigGenerated  = "config.generated"
+)
+
+// subscriptionBuffer is how many events a subscriber may lag behind before it
+// is dropped. Dropped subscribers resume from the event log.
+const subscriptionBuffer = 64
+
+type Bus struct {
+	store *db.Store
+
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+func NewBus(store *db.Store) *Bus {
+	return &Bus{store: store, subs: make(map[*Subscription]struct{})}
+}
+
+// Publish appends an event to the log and delivers it to the subscribers.
+// hostname is set for route events so that scoped API keys only see their own
+// routes. The event is recorded even if ctx is cancelled afterwards, since the
+// change it describes has already happened.
+func (b *Bus) Publish(ctx context.Context, typ, hostname string, data any) (db.Event, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return db.Event{}, fmt.Errorf("encode %s event: %w", typ, err)
+	}
+	// Appending under the lock keeps delivery in id order.
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ev, err := b.store.AppendEvent(context.WithoutCancel(ctx), typ, hostname, raw)
+	if err != nil {
+		return db.Event{}, err
+	}
+	for sub := range b.subs {
+		select {
+		case sub.ch <- ev:
+		default:
+			delete(b.subs, sub)
+			close(sub.ch)
+		}
+	}
+	return ev, nil
+}
+
+// Subscribe starts delivering published events. The subscription's channel is
+// closed when it falls too far behind or is closed.
+func (b *Bus) Subscribe() *Subscription {
+	sub := &Subscription{bus: b, ch: make(chan db.Event, subscriptionBuffer)}
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub
+}
+
+type Subscription struct {
+	bus *Bus
+	ch  chan db.Event
+}
+
+func (s *Subscription) Events() <-chan db.Event {
+	return s.ch
+}
+
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if _, ok := s.bus.subs[s]; ok {
+		delete(s.bus.subs, s)
+		close(s.ch)
+	}
+}
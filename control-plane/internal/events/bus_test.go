@@ -0,0 +1,133 @@
+package events
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+)
+
+func newTestBus(t *testing.T) (*Bus, *db.Store) {
+	t.Helper()
+	store, err := db.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return NewBus(store), store
+}
+
+func TestPublishLogsAndDelivers(t *testing.T) {
+	bus, store := newTestBus(t)
+	ctx := context.Background()
+	sub := bus.Subscribe()
+	defer sub.Close()
+
+	first, err := bus.Publish(ctx, RouteCreated, "app.example.com", map[string]string{"id": "r1"})
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if _, err := bus.Publish(ctx, ConfigGenerated, "", map[string]string{"hash": "abc"}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if ev := <-sub.Events(); ev.ID != first.ID || ev.Type != RouteCreated || ev.Hostname != "app.example.com" {
+		t.Fatalf("unexpected first event: %+v", ev)
+	}
+	if ev := <-sub.Events(); ev.Type != ConfigGenerated || string(ev.Data) != `{"hash":"abc"}` {
+		t.Fatalf("unexpected second event: %+v", ev)
+	}
+
+	logged, oldest, err := store.EventsAfter(ctx, first.ID)
+	if err != nil {
+		t.Fatalf("events after: %v", err)
+	}
+	if len(logged) != 1 || logged[0].Type != ConfigGenerated || oldest != first.ID {
+		t.Fatalf("unexpected log: %+v (oldest %d)", logged, oldest)
+	}
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	bus, _ := newTestBus(t)
+	sub := bus.Subscribe()
+	for i := 0; i <= subscriptionBuffer; i++ {
+		if _, err := bus.Publish(context.Background(), EdgeSeen, "", nil); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+	n := 0
+	for range sub.Events() {
+		n++
+	}
+	if n != subscriptionBuffer {
+		t.Fatalf("expected %d buffered events before the drop, got %d", subscriptionBuffer, n)
+	}
+	sub.Close()
+}
+
+func TestEventLogIsBounded(t *testing.T) {
+	bus, store := newTestBus(t)
+	ctx := context.Background()
+	var last db.Event
+	for i := 0; i < db.EventLogSize+5; i++ {
+		ev, err := bus.Publish(ctx, EdgeSeen, "", nil)
+		if err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+		last = ev
+	}
+	logged, oldest, err := store.EventsAfter(ctx, 0)
+	if err != nil {
+		t.Fatalf("events after: %v", err)
+	}
+	if len(logged) != db.EventLogSize || oldest != last.ID-db.EventLogSize+1 {
+		t.Fatalf("expected %d events from %d, got %d from %d", db.EventLogSize, last.ID-db.EventLogSize+1, len(logged), oldest)
+	}
+}
+
+func TestStaleEdgesArePublishedOnce(t *testing.T) {
+	bus, store := newTestBus(t)
+	ctx := context.Background()
+	node, err := store.RegisterEdgeNode(ctx, db.RegisterEdgeNodeParams{TokenPlain: "edge-token", Name: "edge1"})
+	if err != nil {
+		t.Fatalf("register edge: %v", err)
+	}
+	sub := bus.Subscribe()
+	defer sub.Close()
+
+	now := time.Now()
+	if err := bus.publishStaleEdges(ctx, now, time.Minute); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	later := now.Add(2 * time.Minute)
+	if err := bus.publishStaleEdges(ctx, later, time.Minute); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if err := bus.publishStaleEdges(ctx, later, time.Minute); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if ev := <-sub.Events(); ev.Type != EdgeStale || !strings.Contains(string(ev.Data), node.ID) {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+
+	// Seeing the edge again re-arms the check.
+	if err := store.TouchEdgeNode(ctx, node.ID, later); err != nil {
+		t.Fatalf("touch: %v", err)
+	}
+	if err := bus.publishStaleEdges(ctx, later.Add(2*time.Minute), time.Minute); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if ev := <-sub.Events(); ev.Type != EdgeStale {
+		t.Fatalf("expected a second stale event, got %+v", ev)
+	}
+	select {
+	case ev := <-sub.Events():
+		t.Fatalf("unexpected extra event: %+v", ev)
+	default:
+	}
+}
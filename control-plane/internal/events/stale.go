@@ -0,0 +1,46 @@
+package events
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// WatchStaleEdges publishes edge.stale once for every edge that has not
+// contacted the control plane for threshold. It runs until ctx is done.
+func (b *Bus) WatchStaleEdges(ctx context.Context, threshold time.Duration, logger *log.Logger) {
+	interval := min(threshold/4, time.Minute)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := b.publishStaleEdges(ctx, time.Now(), threshold); err != nil {
+			logger.Printf("stale edge check: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (b *Bus) publishStaleEdges(ctx context.Context, now time.Time, threshold time.Duration) error {
+	nodes, err := b.store.MarkStaleEdgeNodes(ctx, now.Add(-threshold), now)
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		lastSeen := node.CreatedAt
+		if node.LastSeen.Valid {
+			lastSeen = node.LastSeen.Time
+		}
+		if _, err := b.Publish(ctx, EdgeStale, "", map[string]any{
+			"id":        node.ID,
+			"name":      node.Name,
+			"last_seen": lastSeen.UTC(),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -10,41 +10,259 @@ import (
 )
 
 type Route struct {
-	Hostname string `json:"hostname"`
-	Upstream string `json:"upstream"`
+	Hostname    string   `json:"hostname"`
+	Wildcard    bool     `json:"wildcard"`
+	PathPrefix  string   `json:"path_prefix"`
+	StripPrefix bool     `json:"strip_prefix"`
+	Upstream    string   `json:"upstream"`
+	LBMethod    string   `json:"lb_method"`
+	Servers     []Server `json:"servers"`
+}
+
+type Server struct {
+	Address string `json:"address"`
+	Weight  int    `json:"weight"`
+	Backup  bool   `json:"backup"`
 }
 
 type Config struct {
-	Map        string  `json:"map"`
+	Map string `json:"map"`
+	// Upstreams holds one named upstream block per route.
+	Upstreams string `json:"upstreams"`
+	// Locations holds, per hostname, the nginx location blocks for that host
+	// ordered longest path prefix first.
+	Locations map[string]string `json:"locations"`
+	// Conf is a self-contained include for the nginx http context: the
+	// upstreams plus one HTTP redirect and one TLS server block per hostname.
+	// It replaces Map, Upstreams and Locations when used.
+	Conf       string   `json:"conf"`
 	Hostnames  []string `json:"hostnames"`
-	Routes     []Route `json:"routes"`
-	ConfigHash string  `json:"config_hash"`
+	Routes     []Route  `json:"routes"`
+	ConfigHash string   `json:"config_hash"`
 }
 
-// BuildConfig creates an nginx map stanza and deterministic route list.
-func BuildConfig(routes []db.RouteWithOrigin) Config {
+// BuildConfig creates a named upstream block per route, an nginx map stanza
+// pointing each hostname's root route at its upstream, per-hostname location
+// blocks for path routing and a deterministic route list. Conf combines them
+// into complete server blocks so edges need no hand-written nginx config.
+//
+// Hostnames may be "*.zone" wildcards. Precedence follows nginx's hostname
+// matching: an exact hostname always beats a wildcard, and among wildcards the
+// one with more labels (the more specific zone) wins. Output is ordered the
+// same way so that the config reads in evaluation order.
+func BuildConfig(input []db.RouteWithOrigin) Config {
+	routes := append([]db.RouteWithOrigin(nil), input...)
 	sort.Slice(routes, func(i, j int) bool {
-		return routes[i].Hostname < routes[j].Hostname
+		if routes[i].Hostname != routes[j].Hostname {
+			return hostBefore(routes[i].Hostname, routes[j].Hostname)
+		}
+		return prefixBefore(pathPrefix(routes[i]), pathPrefix(routes[j]))
 	})
 
 	var sb strings.Builder
-	sb.WriteString("map $host $kokoa_backend {\n    default \"\";\n")
+	sb.WriteString("map $host $kokoa_backend {\n    hostnames;\n    default \"\";\n")
 
+	var ub strings.Builder
 	outRoutes := make([]Route, 0, len(routes))
 	hostnames := make([]string, 0, len(routes))
+	locations := make(map[string]*strings.Builder)
 	for _, r := range routes {
-		upstream := fmt.Sprintf("%s:%d", r.WireguardIP, r.TargetPort)
-		sb.WriteString(fmt.Sprintf("    %s %s;\n", r.Hostname, upstream))
-		outRoutes = append(outRoutes, Route{Hostname: r.Hostname, Upstream: upstream})
-		hostnames = append(hostnames, r.Hostname)
+		prefix := pathPrefix(r)
+		upstream := upstreamName(r.Hostname, prefix)
+		servers := writeUpstream(&ub, upstream, r)
+		if prefix == "/" {
+			sb.WriteString(fmt.Sprintf("    %s %s;\n", r.Hostname, upstream))
+		}
+		outRoutes = append(outRoutes, Route{
+			Hostname:    r.Hostname,
+			Wildcard:    db.IsWildcardHostname(r.Hostname),
+			PathPrefix:  prefix,
+			StripPrefix: r.StripPrefix,
+			Upstream:    upstream,
+			LBMethod:    lbMethod(r),
+			Servers:     servers,
+		})
+
+		loc, ok := locations[r.Hostname]
+		if !ok {
+			loc = &strings.Builder{}
+			locations[r.Hostname] = loc
+			hostnames = append(hostnames, r.Hostname)
+		}
+		writeLocation(loc, prefix, r.StripPrefix, upstream)
 	}
 	sb.WriteString("}\n")
 
-	hash := sha256.Sum256([]byte(sb.String()))
+	hash := sha256.New()
+	hash.Write([]byte(sb.String()))
+	hash.Write([]byte(ub.String()))
+	outLocations := make(map[string]string, len(locations))
+	for _, h := range hostnames {
+		outLocations[h] = locations[h].String()
+		fmt.Fprintf(hash, "# %s\n%s", h, outLocations[h])
+	}
+	conf := buildConf(ub.String(), hostnames, outLocations)
+	hash.Write([]byte(conf))
 	return Config{
 		Map:        sb.String(),
+		Upstreams:  ub.String(),
+		Locations:  outLocations,
+		Conf:       conf,
 		Hostnames:  hostnames,
 		Routes:     outRoutes,
-		ConfigHash: fmt.Sprintf("%x", hash[:]),
+		ConfigHash: fmt.Sprintf("%x", hash.Sum(nil)),
+	}
+}
+
+// upstreamName derives a stable nginx upstream name from the route's hostname
+// and path prefix, which together identify a route.
+func upstreamName(hostname, prefix string) string {
+	sum := sha256.Sum256([]byte(hostname + prefix))
+	return fmt.Sprintf("kokoa_%x", sum[:6])
+}
+
+// writeUpstream renders the upstream block for a route and returns its servers.
+// ip_hash cannot be combined with backup servers; callers validate that.
+func writeUpstream(sb *strings.Builder, name string, r db.RouteWithOrigin) []Server {
+	backends := r.Backends
+	if len(backends) == 0 {
+		backends = []db.RouteBackend{{WireguardIP: r.WireguardIP, TargetPort: r.TargetPort}}
+	}
+	// max_fails=0 is meaningful to nginx (never mark the server down), so only
+	// an unset value falls back to the default.
+	maxFails, failTimeout := 1, r.FailTimeoutSeconds
+	if r.MaxFails != nil {
+		maxFails = *r.MaxFails
+	}
+	if failTimeout == 0 {
+		failTimeout = 10
+	}
+
+	fmt.Fprintf(sb, "# %s%s\nupstream %s {\n", r.Hostname, pathPrefix(r), name)
+	switch lbMethod(r) {
+	case db.LBLeastConn:
+		sb.WriteString("    least_conn;\n")
+	case db.LBIPHash:
+		sb.WriteString("    ip_hash;\n")
+	}
+	servers := make([]Server, 0, len(backends))
+	for _, b := range backends {
+		weight := b.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		srv := Server{Address: fmt.Sprintf("%s:%d", b.WireguardIP, b.TargetPort), Weight: weight, Backup: b.Backup}
+		fmt.Fprintf(sb, "    server %s", srv.Address)
+		if weight != 1 {
+			fmt.Fprintf(sb, " weight=%d", weight)
+		}
+		fmt.Fprintf(sb, " max_fails=%d fail_timeout=%ds", maxFails, failTimeout)
+		if b.Backup {
+			sb.WriteString(" backup")
+		}
+		sb.WriteString(";\n")
+		servers = append(servers, srv)
+	}
+	sb.WriteString("}\n")
+	return servers
+}
+
+func lbMethod(r db.RouteWithOrigin) string {
+	if r.LBMethod == "" {
+		return db.LBRoundRobin
+	}
+	return r.LBMethod
+}
+
+// CertDir is where edges keep certificates, one directory per hostname.
+const CertDir = "/etc/nginx/kokoa/certs"
+
+// CertPaths returns the certificate chain and key paths for hostname. Wildcard
+// hostnames use a "_wildcard.zone" directory since "*" is awkward on disk.
+func CertPaths(hostname string) (cert, key string) {
+	dir := CertDir + "/" + CertDirName(hostname)
+	return dir + "/fullchain.pem", dir + "/privkey.pem"
+}
+
+// CertDirName is the directory below CertDir that holds hostname's files.
+func CertDirName(hostname string) string {
+	if zone, ok := strings.CutPrefix(hostname, "*."); ok {
+		return "_wildcard." + zone
+	}
+	return hostname
+}
+
+// buildConf renders the full include. Proxy headers are set per server so that
+// every location inherits them; locations themselves only carry proxy_pass.
+func buildConf(upstreams string, hostnames []string, locations map[string]string) string {
+	var sb strings.Builder
+	sb.WriteString("# Generated by kokoa-proxy control plane. Do not edit.\n")
+	sb.WriteString("map $http_upgrade $kokoa_connection_upgrade {\n    default upgrade;\n    \"\" close;\n}\n")
+	sb.WriteString(upstreams)
+	for _, h := range hostnames {
+		cert, key := CertPaths(h)
+		fmt.Fprintf(&sb, "server {\n    listen 80;\n    listen [::]:80;\n    server_name %s;\n    return 301 https://$host$request_uri;\n}\n", h)
+		fmt.Fprintf(&sb, "server {\n    listen 443 ssl;\n    listen [::]:443 ssl;\n    server_name %s;\n", h)
+		fmt.Fprintf(&sb, "    ssl_certificate %s;\n    ssl_certificate_key %s;\n\n", cert, key)
+		sb.WriteString(proxyHeaders)
+		for _, line := range strings.SplitAfter(locations[h], "\n") {
+			if line != "" {
+				sb.WriteString("    " + line)
+			}
+		}
+		sb.WriteString("}\n")
+	}
+	return sb.String()
+}
+
+const proxyHeaders = `    proxy_http_version 1.1;
+    proxy_set_header Host $host;
+    proxy_set_header X-Real-IP $remote_addr;
+    proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+    proxy_set_header X-Forwarded-Proto $scheme;
+    proxy_set_header X-Forwarded-Host $host;
+    proxy_set_header Upgrade $http_upgrade;
+    proxy_set_header Connection $kokoa_connection_upgrade;
+
+`
+
+// writeLocation renders a prefix location. With stripPrefix the matched prefix
+// is replaced by "/" before proxying, otherwise the URI is passed unchanged.
+func writeLocation(sb *strings.Builder, prefix string, stripPrefix bool, upstream string) {
+	target := "http://" + upstream
+	if stripPrefix {
+		target += "/"
+	}
+	fmt.Fprintf(sb, "location %s {\n    proxy_pass %s;\n}\n", prefix, target)
+}
+
+func pathPrefix(r db.RouteWithOrigin) string {
+	if r.PathPrefix == "" {
+		return "/"
+	}
+	return r.PathPrefix
+}
+
+// hostBefore orders exact hostnames before wildcards and more specific
+// wildcards before broader ones, falling back to lexical order.
+func hostBefore(a, b string) bool {
+	aWild, bWild := db.IsWildcardHostname(a), db.IsWildcardHostname(b)
+	if aWild != bWild {
+		return !aWild
+	}
+	if aWild {
+		if la, lb := strings.Count(a, "."), strings.Count(b, "."); la != lb {
+			return la > lb
+		}
+	}
+	return a < b
+}
+
+// prefixBefore orders longer prefixes first, then lexically, so output does not
+// depend on insertion order.
+func prefixBefore(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
 	}
+	return a < b
 }
@@ -18,10 +18,171 @@ func TestBuildConfigDeterministic(t *testing.T) {
 	if first.ConfigHash != second.ConfigHash {
 		t.Fatalf("expected deterministic hash, got %s and %s", first.ConfigHash, second.ConfigHash)
 	}
-	if !strings.Contains(first.Map, "a.example.com 10.0.0.3:8081;") {
+	upstream := upstreamName("a.example.com", "/")
+	if !strings.Contains(first.Map, "a.example.com "+upstream+";") {
 		t.Fatalf("missing expected upstream mapping: %s", first.Map)
 	}
+	if !strings.Contains(first.Upstreams, "upstream "+upstream+" {\n    server 10.0.0.3:8081 max_fails=1 fail_timeout=10s;\n}") {
+		t.Fatalf("missing expected upstream block: %s", first.Upstreams)
+	}
 	if len(first.Hostnames) != 2 || first.Hostnames[0] != "a.example.com" {
 		t.Fatalf("hostnames not sorted: %v", first.Hostnames)
 	}
 }
+
+func TestBuildConfigPathRouting(t *testing.T) {
+	input := []db.RouteWithOrigin{
+		{Hostname: "example.com", PathPrefix: "/", TargetPort: 3000, WireguardIP: "10.0.0.2"},
+		{Hostname: "example.com", PathPrefix: "/api/", StripPrefix: true, TargetPort: 8080, WireguardIP: "10.0.0.3"},
+		{Hostname: "example.com", PathPrefix: "/api/v2/", TargetPort: 8081, WireguardIP: "10.0.0.3"},
+		{Hostname: "docs.example.com", PathPrefix: "/guide/", TargetPort: 4000, WireguardIP: "10.0.0.4"},
+	}
+
+	cfg := BuildConfig(input)
+	want := "location /api/v2/ {\n    proxy_pass http://" + upstreamName("example.com", "/api/v2/") + ";\n}\n" +
+		"location /api/ {\n    proxy_pass http://" + upstreamName("example.com", "/api/") + "/;\n}\n" +
+		"location / {\n    proxy_pass http://" + upstreamName("example.com", "/") + ";\n}\n"
+	if got := cfg.Locations["example.com"]; got != want {
+		t.Fatalf("unexpected locations for example.com:\n%s", got)
+	}
+	if !strings.Contains(cfg.Map, "example.com "+upstreamName("example.com", "/")+";") {
+		t.Fatalf("root route missing from map: %s", cfg.Map)
+	}
+	if strings.Contains(cfg.Map, "docs.example.com") {
+		t.Fatalf("host without root route must not be in map: %s", cfg.Map)
+	}
+	if len(cfg.Hostnames) != 2 || cfg.Hostnames[0] != "docs.example.com" {
+		t.Fatalf("hostnames not deduplicated and sorted: %v", cfg.Hostnames)
+	}
+
+	reversed := make([]db.RouteWithOrigin, len(input))
+	for i, r := range input {
+		reversed[len(input)-1-i] = r
+	}
+	if again := BuildConfig(reversed); again.ConfigHash != cfg.ConfigHash {
+		t.Fatalf("hash depends on input order: %s vs %s", cfg.ConfigHash, again.ConfigHash)
+	}
+
+	input[1].StripPrefix = false
+	if changed := BuildConfig(input); changed.ConfigHash == cfg.ConfigHash {
+		t.Fatal("expected hash to change when a location changes")
+	}
+}
+
+func TestBuildConfigWildcardPrecedence(t *testing.T) {
+	input := []db.RouteWithOrigin{
+		{Hostname: "*.example.com", TargetPort: 1, WireguardIP: "10.0.0.2"},
+		{Hostname: "api.dev.example.com", TargetPort: 2, WireguardIP: "10.0.0.2"},
+		{Hostname: "*.dev.example.com", TargetPort: 3, WireguardIP: "10.0.0.2"},
+		{Hostname: "dev.example.com", TargetPort: 4, WireguardIP: "10.0.0.2"},
+		{Hostname: "*.eu.dev.example.com", TargetPort: 5, WireguardIP: "10.0.0.2"},
+	}
+	cfg := BuildConfig(input)
+
+	want := []string{"api.dev.example.com", "dev.example.com", "*.eu.dev.example.com", "*.dev.example.com", "*.example.com"}
+	if strings.Join(cfg.Hostnames, ",") != strings.Join(want, ",") {
+		t.Fatalf("unexpected precedence order: %v", cfg.Hostnames)
+	}
+	if !strings.Contains(cfg.Map, "    hostnames;\n") {
+		t.Fatalf("map must enable hostnames matching for wildcards: %s", cfg.Map)
+	}
+	entry := func(host string) int {
+		return strings.Index(cfg.Map, "    "+host+" "+upstreamName(host, "/")+";")
+	}
+	exact, specific, broad := entry("dev.example.com"), entry("*.eu.dev.example.com"), entry("*.example.com")
+	if exact < 0 || specific < 0 || broad < 0 || !(exact < specific && specific < broad) {
+		t.Fatalf("map entries out of precedence order:\n%s", cfg.Map)
+	}
+	for _, r := range cfg.Routes {
+		if r.Wildcard != strings.HasPrefix(r.Hostname, "*.") {
+			t.Fatalf("wildcard flag wrong for %s", r.Hostname)
+		}
+	}
+}
+
+func TestBuildConfigUpstreamBalancing(t *testing.T) {
+	maxFails, neverDown := 3, 0
+	input := []db.RouteWithOrigin{
+		{
+			Hostname:           "app.example.com",
+			LBMethod:           db.LBLeastConn,
+			MaxFails:           &maxFails,
+			FailTimeoutSeconds: 30,
+			Backends: []db.RouteBackend{
+				{WireguardIP: "10.0.0.2", TargetPort: 8080, Weight: 3},
+				{WireguardIP: "10.0.0.3", TargetPort: 8080, Weight: 1},
+				{WireguardIP: "10.0.0.4", TargetPort: 8080, Weight: 1, Backup: true},
+			},
+		},
+		{
+			Hostname: "sticky.example.com",
+			LBMethod: db.LBIPHash,
+			Backends: []db.RouteBackend{
+				{WireguardIP: "10.0.0.2", TargetPort: 9000, Weight: 1},
+				{WireguardIP: "10.0.0.3", TargetPort: 9000, Weight: 1},
+			},
+		},
+		{
+			Hostname: "tolerant.example.com",
+			MaxFails: &neverDown,
+			Backends: []db.RouteBackend{{WireguardIP: "10.0.0.5", TargetPort: 7000, Weight: 1}},
+		},
+	}
+	cfg := BuildConfig(input)
+
+	want := "upstream " + upstreamName("app.example.com", "/") + " {\n" +
+		"    least_conn;\n" +
+		"    server 10.0.0.2:8080 weight=3 max_fails=3 fail_timeout=30s;\n" +
+		"    server 10.0.0.3:8080 max_fails=3 fail_timeout=30s;\n" +
+		"    server 10.0.0.4:8080 max_fails=3 fail_timeout=30s backup;\n" +
+		"}\n"
+	if !strings.Contains(cfg.Upstreams, want) {
+		t.Fatalf("unexpected upstream block:\n%s", cfg.Upstreams)
+	}
+	if !strings.Contains(cfg.Upstreams, "    ip_hash;\n    server 10.0.0.2:9000 max_fails=1 fail_timeout=10s;\n") {
+		t.Fatalf("expected ip_hash upstream:\n%s", cfg.Upstreams)
+	}
+	if !strings.Contains(cfg.Upstreams, "    server 10.0.0.5:7000 max_fails=0 fail_timeout=10s;\n") {
+		t.Fatalf("expected max_fails=0 to be kept:\n%s", cfg.Upstreams)
+	}
+	if len(cfg.Routes) != 3 || len(cfg.Routes[0].Servers) != 3 || !cfg.Routes[0].Servers[2].Backup {
+		t.Fatalf("unexpected route servers: %+v", cfg.Routes)
+	}
+
+	input[0].Backends[0].Weight = 2
+	if changed := BuildConfig(input); changed.ConfigHash == cfg.ConfigHash {
+		t.Fatal("expected hash to change with backend weight")
+	}
+}
+
+func TestBuildConfigServerBlocks(t *testing.T) {
+	input := []db.RouteWithOrigin{
+		{Hostname: "app.example.com", TargetPort: 8080, WireguardIP: "10.0.0.2"},
+		{Hostname: "app.example.com", PathPrefix: "/ws/", TargetPort: 8081, WireguardIP: "10.0.0.2"},
+		{Hostname: "*.dev.example.com", TargetPort: 3000, WireguardIP: "10.0.0.3"},
+	}
+	cfg := BuildConfig(input)
+
+	if !strings.Contains(cfg.Conf, cfg.Upstreams) {
+		t.Fatal("conf must embed the upstream blocks")
+	}
+	for _, want := range []string{
+		"server_name app.example.com;\n    return 301 https://$host$request_uri;",
+		"listen 443 ssl;",
+		"ssl_certificate /etc/nginx/kokoa/certs/app.example.com/fullchain.pem;",
+		"ssl_certificate_key /etc/nginx/kokoa/certs/_wildcard.dev.example.com/privkey.pem;",
+		"proxy_set_header X-Forwarded-Proto $scheme;",
+		"proxy_set_header Connection $kokoa_connection_upgrade;",
+		"    location /ws/ {\n        proxy_pass http://" + upstreamName("app.example.com", "/ws/") + ";\n    }\n",
+	} {
+		if !strings.Contains(cfg.Conf, want) {
+			t.Fatalf("conf missing %q:\n%s", want, cfg.Conf)
+		}
+	}
+	if strings.Count(cfg.Conf, "listen 443 ssl;") != 2 {
+		t.Fatalf("expected one TLS server per hostname:\n%s", cfg.Conf)
+	}
+	if strings.Index(cfg.Conf, "server_name app.example.com;") > strings.Index(cfg.Conf, "server_name *.dev.example.com;") {
+		t.Fatal("exact hostnames must be rendered before wildcards")
+	}
+}
@@ -0,0 +1,185 @@
+package generator
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+	"github.com/neo/kokoa-proxy/control-plane/internal/ipam"
+)
+
+// DefaultWireGuardPort is the port origins listen on when their endpoint
+// does not name one.
+const DefaultWireGuardPort = 51820
+
+// edgeKeepalive keeps the tunnel from edges, which usually sit behind NAT,
+// open so origins can answer.
+const edgeKeepalive = 25
+
+// WireGuardPeer is one [Peer] section of a node's WireGuard interface.
+type WireGuardPeer struct {
+	ID                  string   `json:"id"`
+	Name                string   `json:"name"`
+	PublicKey           string   `json:"public_key"`
+	Endpoint            string   `json:"endpoint,omitempty"`
+	AllowedIPs          []string `json:"allowed_ips"`
+	PersistentKeepalive int      `json:"persistent_keepalive,omitempty"`
+}
+
+// WireGuardConfig is the interface of an edge or origin with its peers.
+type WireGuardConfig struct {
+	// Address is empty when the node has no tunnel address yet.
+	Address    string `json:"address"`
+	ListenPort int    `json:"listen_port,omitempty"`
+	// PublicKey is the node's own key as the control plane knows it. Agents
+	// switch to a rotated private key once it shows up here.
+	PublicKey string          `json:"public_key,omitempty"`
+	Peers     []WireGuardPeer `json:"peers"`
+	// WGQuick renders the same as a wg-quick config. The private key never
+	// leaves the node: PostUp loads it from /etc/wireguard/<iface>.key.
+	WGQuick string `json:"wg_quick"`
+	// PeersHash changes whenever the rendered config does.
+	PeersHash string `json:"peers_hash"`
+}
+
+// EdgePeers peers an edge with every origin that has a public key. Edges
+// dial origins, so origins without an endpoint are still listed but only
+// reachable once they set one. nextKeys maps origins in a key rotation to
+// their new key; see withNextKeys.
+func EdgePeers(origins []db.Origin, nextKeys map[string]string) []WireGuardPeer {
+	peers := []WireGuardPeer{}
+	for _, o := range origins {
+		addr, err := ipam.ParseAddr(o.WireguardIP)
+		if o.WireguardPublicKey == "" || err != nil {
+			continue
+		}
+		peers = append(peers, WireGuardPeer{
+			ID:                  o.ID,
+			Name:                o.Name,
+			PublicKey:           o.WireguardPublicKey,
+			Endpoint:            o.WireguardEndpoint,
+			AllowedIPs:          []string{ipam.HostPrefix(addr).String()},
+			PersistentKeepalive: edgeKeepalive,
+		})
+	}
+	peers = withNextKeys(peers, nextKeys)
+	sortPeers(peers)
+	return peers
+}
+
+// OriginPeers peers an origin with every serving edge that has a public key
+// and a tunnel address. Pending edges are left out until approved, retired
+// ones for good.
+func OriginPeers(edges []db.EdgeNode, nextKeys map[string]string) []WireGuardPeer {
+	peers := []WireGuardPeer{}
+	for _, e := range edges {
+		if !e.Serving() || !e.WGPublicKey.Valid || !e.WGAddr.Valid {
+			continue
+		}
+		addr, err := ipam.ParseAddr(e.WGAddr.String)
+		if err != nil {
+			continue
+		}
+		peers = append(peers, WireGuardPeer{
+			ID:         e.ID,
+			Name:       e.Name,
+			PublicKey:  e.WGPublicKey.String,
+			AllowedIPs: []string{ipam.HostPrefix(addr).String()},
+		})
+	}
+	peers = withNextKeys(peers, nextKeys)
+	sortPeers(peers)
+	return peers
+}
+
+// withNextKeys adds a second peer for every node rotating its key. It has no
+// allowed IPs, so traffic keeps using the old key while peers learn the new
+// one; the rotation completes by swapping the keys.
+func withNextKeys(peers []WireGuardPeer, nextKeys map[string]string) []WireGuardPeer {
+	for _, p := range peers {
+		next, ok := nextKeys[p.ID]
+		if !ok || next == p.PublicKey {
+			continue
+		}
+		peers = append(peers, WireGuardPeer{
+			ID:                  p.ID,
+			Name:                p.Name + " (next key)",
+			PublicKey:           next,
+			Endpoint:            p.Endpoint,
+			AllowedIPs:          []string{},
+			PersistentKeepalive: p.PersistentKeepalive,
+		})
+	}
+	return peers
+}
+
+// OriginListenPort returns the port of the origin's endpoint, or
+// DefaultWireGuardPort.
+func OriginListenPort(endpoint string) int {
+	if _, port, err := net.SplitHostPort(endpoint); err == nil {
+		if n, err := strconv.Atoi(port); err == nil && n > 0 && n < 65536 {
+			return n
+		}
+	}
+	return DefaultWireGuardPort
+}
+
+// BuildWireGuard renders a node's interface. address may be a bare address or
+// a prefix; listenPort 0 leaves the port to WireGuard. publicKey is the
+// node's key, rendered as a comment.
+func BuildWireGuard(address string, listenPort int, publicKey string, peers []WireGuardPeer) WireGuardConfig {
+	if a, err := netip.ParseAddr(address); err == nil {
+		address = ipam.HostPrefix(a).String()
+	}
+	var sb strings.Builder
+	sb.WriteString("# Generated by the kokoa control plane; local changes are overwritten.\n")
+	sb.WriteString("[Interface]\n")
+	if address != "" {
+		sb.WriteString("Address = " + address + "\n")
+	}
+	if listenPort > 0 {
+		sb.WriteString(fmt.Sprintf("ListenPort = %d\n", listenPort))
+	}
+	if publicKey != "" {
+		sb.WriteString("# PublicKey = " + publicKey + "\n")
+	}
+	sb.WriteString("PostUp = wg set %i private-key /etc/wireguard/%i.key\n")
+	for _, p := range peers {
+		sb.WriteString("\n[Peer]\n")
+		sb.WriteString("# " + p.Name + " (" + p.ID + ")\n")
+		sb.WriteString("PublicKey = " + p.PublicKey + "\n")
+		if len(p.AllowedIPs) > 0 {
+			sb.WriteString("AllowedIPs = " + strings.Join(p.AllowedIPs, ", ") + "\n")
+		}
+		if p.Endpoint != "" {
+			sb.WriteString("Endpoint = " + p.Endpoint + "\n")
+		}
+		if p.PersistentKeepalive > 0 {
+			sb.WriteString(fmt.Sprintf("PersistentKeepalive = %d\n", p.PersistentKeepalive))
+		}
+	}
+	conf := sb.String()
+	sum := sha256.Sum256([]byte(conf))
+	return WireGuardConfig{
+		Address:    address,
+		ListenPort: listenPort,
+		PublicKey:  publicKey,
+		Peers:      peers,
+		WGQuick:    conf,
+		PeersHash:  fmt.Sprintf("%x", sum[:]),
+	}
+}
+
+func sortPeers(peers []WireGuardPeer) {
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Name != peers[j].Name {
+			return peers[i].Name < peers[j].Name
+		}
+		return peers[i].ID < peers[j].ID
+	})
+}
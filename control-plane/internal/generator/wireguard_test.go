@@ -0,0 +1,66 @@
+package generator
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+)
+
+func TestWireGuardPeers(t *testing.T) {
+	origins := []db.Origin{
+		{ID: "o2", Name: "origin-b", WireguardIP: "10.20.0.2", WireguardPublicKey: "keyB", WireguardEndpoint: "b.example.com:51821"},
+		{ID: "o1", Name: "origin-a", WireguardIP: "10.20.0.1", WireguardPublicKey: "keyA"},
+		{ID: "o3", Name: "no-key", WireguardIP: "10.20.0.3"},
+	}
+	peers := EdgePeers(origins, nil)
+	if len(peers) != 2 || peers[0].Name != "origin-a" || peers[1].Endpoint != "b.example.com:51821" || peers[0].AllowedIPs[0] != "10.20.0.1/32" {
+		t.Fatalf("unexpected edge peers: %+v", peers)
+	}
+
+	edges := []db.EdgeNode{
+		{ID: "e1", Name: "edge-1", State: db.EdgeStateActive, WGAddr: sql.NullString{String: "10.20.0.5/32", Valid: true}, WGPublicKey: sql.NullString{String: "keyE", Valid: true}},
+		{ID: "e2", Name: "edge-2", State: db.EdgeStatePending, WGAddr: sql.NullString{String: "10.20.0.6/32", Valid: true}, WGPublicKey: sql.NullString{String: "keyP", Valid: true}},
+		{ID: "e3", Name: "edge-3", State: db.EdgeStateActive, WGPublicKey: sql.NullString{String: "keyN", Valid: true}},
+	}
+	if peers := OriginPeers(edges, nil); len(peers) != 1 || peers[0].ID != "e1" || peers[0].PersistentKeepalive != 0 {
+		t.Fatalf("unexpected origin peers: %+v", peers)
+	}
+
+	config := BuildWireGuard("10.20.0.5/32", 0, "", EdgePeers(origins, nil))
+	for _, want := range []string{
+		"Address = 10.20.0.5/32\n",
+		"PostUp = wg set %i private-key /etc/wireguard/%i.key\n",
+		"PublicKey = keyA\nAllowedIPs = 10.20.0.1/32\nPersistentKeepalive = 25\n",
+		"Endpoint = b.example.com:51821\n",
+	} {
+		if !strings.Contains(config.WGQuick, want) {
+			t.Fatalf("wg-quick config lacks %q:\n%s", want, config.WGQuick)
+		}
+	}
+	if strings.Contains(config.WGQuick, "ListenPort") {
+		t.Fatalf("edges must not pin a listen port:\n%s", config.WGQuick)
+	}
+	if again := BuildWireGuard("10.20.0.5/32", 0, "", EdgePeers(origins, nil)); again.PeersHash != config.PeersHash {
+		t.Fatal("peers hash is not deterministic")
+	}
+	if OriginListenPort("b.example.com:51821") != 51821 || OriginListenPort("") != DefaultWireGuardPort {
+		t.Fatal("unexpected origin listen port")
+	}
+}
+
+func TestWireGuardNextKeys(t *testing.T) {
+	origins := []db.Origin{{ID: "o1", Name: "origin-a", WireguardIP: "10.20.0.1", WireguardPublicKey: "old", WireguardEndpoint: "a.example.com:51820"}}
+	peers := EdgePeers(origins, map[string]string{"o1": "new"})
+	if len(peers) != 2 || peers[0].PublicKey != "old" || peers[1].PublicKey != "new" || len(peers[1].AllowedIPs) != 0 || peers[1].Endpoint != "a.example.com:51820" {
+		t.Fatalf("unexpected peers during rotation: %+v", peers)
+	}
+	config := BuildWireGuard("10.20.0.5/32", 0, "self", peers)
+	if !strings.Contains(config.WGQuick, "# PublicKey = self\n") || !strings.Contains(config.WGQuick, "PublicKey = new\nEndpoint = a.example.com:51820\n") {
+		t.Fatalf("unexpected wg-quick config:\n%s", config.WGQuick)
+	}
+	if BuildWireGuard("10.20.0.5/32", 0, "other", peers).PeersHash == config.PeersHash {
+		t.Fatal("peers hash ignores the node's own key")
+	}
+}
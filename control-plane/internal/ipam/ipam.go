@@ -0,0 +1,99 @@
+// Package ipam does the address arithmetic for the WireGuard tunnel network:
+// parsing the configured pools, picking the next free host address and
+// measuring how full a pool is. Recording who holds an address is left to the
+// store.
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"strings"
+)
+
+// DefaultPool is the tunnel network used when none is configured. It matches
+// the address /origin/install.sh has always given origins set up by hand.
+var DefaultPool = netip.MustParsePrefix("10.20.0.0/24")
+
+// ParsePools parses a comma-separated list of tunnel networks, at most one
+// IPv4 and one IPv6. Host bits are cleared, and networks too small to hold
+// two hosts are rejected.
+func ParsePools(v string) ([]netip.Prefix, error) {
+	var pools []netip.Prefix
+	seen := map[bool]bool{}
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tunnel network %q: %w", part, err)
+		}
+		p = p.Masked()
+		if Size(p) < 2 {
+			return nil, fmt.Errorf("tunnel network %s is too small", p)
+		}
+		if seen[p.Addr().Is4()] {
+			return nil, errors.New("at most one IPv4 and one IPv6 tunnel network can be configured")
+		}
+		seen[p.Addr().Is4()] = true
+		pools = append(pools, p)
+	}
+	if len(pools) == 0 {
+		return nil, errors.New("no tunnel network configured")
+	}
+	return pools, nil
+}
+
+// Size returns the number of host addresses in pool, saturating at
+// math.MaxUint64. The network address is never handed out, and neither is the
+// IPv4 broadcast address.
+func Size(pool netip.Prefix) uint64 {
+	hostBits := pool.Addr().BitLen() - pool.Bits()
+	if hostBits >= 64 {
+		return math.MaxUint64
+	}
+	n := uint64(1)<<hostBits - 1
+	if pool.Addr().Is4() && n > 0 {
+		n--
+	}
+	return n
+}
+
+// Contains reports whether addr is a host address of pool that Next could
+// return.
+func Contains(pool netip.Prefix, addr netip.Addr) bool {
+	pool = pool.Masked()
+	if !pool.Contains(addr) || addr == pool.Addr() {
+		return false
+	}
+	return !(addr.Is4() && !pool.Contains(addr.Next()))
+}
+
+// Next returns the lowest host address of pool for which used returns false.
+func Next(pool netip.Prefix, used func(netip.Addr) bool) (netip.Addr, bool) {
+	pool = pool.Masked()
+	for addr := pool.Addr().Next(); addr.IsValid() && Contains(pool, addr); addr = addr.Next() {
+		if !used(addr) {
+			return addr, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// HostPrefix returns addr as a single-address prefix, the form edges keep
+// their tunnel address in.
+func HostPrefix(addr netip.Addr) netip.Prefix {
+	return netip.PrefixFrom(addr, addr.BitLen())
+}
+
+// ParseAddr accepts a bare address or a prefix such as 10.20.0.3/32 and
+// returns the address. Origins store the former and edges the latter.
+func ParseAddr(v string) (netip.Addr, error) {
+	if p, err := netip.ParsePrefix(v); err == nil {
+		return p.Addr(), nil
+	}
+	return netip.ParseAddr(v)
+}
@@ -0,0 +1,64 @@
+package ipam
+
+import (
+	"math"
+	"net/netip"
+	"testing"
+)
+
+func TestParsePools(t *testing.T) {
+	pools, err := ParsePools("10.20.0.7/24, fd00:20::/64")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(pools) != 2 || pools[0].String() != "10.20.0.0/24" || pools[1].String() != "fd00:20::/64" {
+		t.Fatalf("unexpected pools: %v", pools)
+	}
+	for _, v := range []string{"", "10.20.0.0/24,10.30.0.0/24", "10.20.0.1/32", "10.20.0.0/31", "fd00::/128", "bogus"} {
+		if _, err := ParsePools(v); err == nil {
+			t.Fatalf("expected %q to be rejected", v)
+		}
+	}
+}
+
+func TestSize(t *testing.T) {
+	cases := map[string]uint64{
+		"10.20.0.0/24":   254,
+		"10.20.0.0/30":   2,
+		"fd00::/120":     255,
+		"fd00::/64":      math.MaxUint64,
+		"fd00::/48":      math.MaxUint64,
+		"192.168.0.0/16": 65534,
+	}
+	for v, want := range cases {
+		if got := Size(netip.MustParsePrefix(v)); got != want {
+			t.Fatalf("Size(%s) = %d, want %d", v, got, want)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	pool := netip.MustParsePrefix("10.20.0.0/30")
+	used := map[netip.Addr]bool{}
+	var got []string
+	for {
+		addr, ok := Next(pool, func(a netip.Addr) bool { return used[a] })
+		if !ok {
+			break
+		}
+		used[addr] = true
+		got = append(got, addr.String())
+	}
+	if len(got) != 2 || got[0] != "10.20.0.1" || got[1] != "10.20.0.2" {
+		t.Fatalf("unexpected allocations: %v", got)
+	}
+
+	v6 := netip.MustParsePrefix("fd00:20::/64")
+	addr, ok := Next(v6, func(a netip.Addr) bool { return a == netip.MustParseAddr("fd00:20::1") })
+	if !ok || addr.String() != "fd00:20::2" {
+		t.Fatalf("unexpected IPv6 allocation: %v %v", addr, ok)
+	}
+	if Contains(v6, v6.Addr()) || !Contains(v6, addr) {
+		t.Fatalf("Contains must exclude the network address only")
+	}
+}
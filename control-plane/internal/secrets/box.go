@@ -0,0 +1,278 @@
+// Package secrets encrypts small values, such as private keys, before they are
+// written to the database.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// legacyPrefix marks values sealed directly with a key-encryption key by
+	// earlier releases. They are still opened but never written.
+	legacyPrefix   = "v1:"
+	envelopePrefix = "v2:"
+)
+
+// ErrInvalidKey is returned for keys that are not 32 bytes long.
+var ErrInvalidKey = errors.New("secrets: key must be 32 bytes (base64 or hex encoded)")
+
+// ErrUnknownKey is returned when a value was sealed under a key-encryption key
+// the box does not hold.
+var ErrUnknownKey = errors.New("secrets: value was sealed with an unknown key")
+
+// Box envelope-encrypts values. Every value gets a fresh data key; the value
+// is sealed with the data key and the data key is wrapped with the primary
+// key-encryption key (KEK), both with AES-256-GCM. The output is
+//
+//	v2:<kek id>:<base64 wrapped data key>:<base64 nonce and ciphertext>
+//
+// Previous KEKs are kept to open values sealed before a rotation; Rotate
+// rewraps such values under the primary KEK.
+type Box struct {
+	primary kek
+	keks    map[string]kek
+	// order lists every KEK, primary first, for opening legacy values that
+	// carry no key id.
+	order []kek
+}
+
+type kek struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// NewBox returns a box that seals with primary and can also open values
+// sealed with any of the previous keys.
+func NewBox(primary []byte, previous ...[]byte) (*Box, error) {
+	b := &Box{keks: make(map[string]kek)}
+	for i, key := range append([][]byte{primary}, previous...) {
+		k, err := newKEK(key)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := b.keks[k.id]; dup {
+			continue
+		}
+		if i == 0 {
+			b.primary = k
+		}
+		b.keks[k.id] = k
+		b.order = append(b.order, k)
+	}
+	return b, nil
+}
+
+func newKEK(key []byte) (kek, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return kek{}, err
+	}
+	return kek{id: KeyID(key), aead: aead}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, ErrInvalidKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("secrets: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("secrets: %w", err)
+	}
+	return aead, nil
+}
+
+// KeyID identifies a key-encryption key without revealing it: the first
+// eight bytes of its SHA-256, hex encoded.
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// ParseKey decodes a 32 byte key given as standard base64 or hex.
+func ParseKey(encoded string) ([]byte, error) {
+	encoded = strings.TrimSpace(encoded)
+	if key, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := hex.DecodeString(encoded); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, ErrInvalidKey
+}
+
+// ParseKeys decodes a list of keys separated by commas or newlines, as found
+// in a key file. Blank lines and lines starting with '#' are ignored.
+func ParseKeys(encoded string) ([][]byte, error) {
+	var keys [][]byte
+	for _, line := range strings.Split(encoded, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, field := range strings.Split(line, ",") {
+			if strings.TrimSpace(field) == "" {
+				continue
+			}
+			key, err := ParseKey(field)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// IsSealed reports whether v looks like a value produced by a Box, as
+// opposed to plaintext stored before encryption at rest was enabled.
+func IsSealed(v string) bool {
+	return strings.HasPrefix(v, envelopePrefix) || strings.HasPrefix(v, legacyPrefix)
+}
+
+// PrimaryKeyID returns the id of the key new values are wrapped with.
+func (b *Box) PrimaryKeyID() string {
+	return b.primary.id
+}
+
+func (b *Box) Seal(plaintext []byte) (string, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return "", fmt.Errorf("secrets: data key: %w", err)
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(aead, plaintext, nil)
+	if err != nil {
+		return "", err
+	}
+	return b.wrap(dek, sealed)
+}
+
+func (b *Box) Open(sealed string) ([]byte, error) {
+	if encoded, ok := strings.CutPrefix(sealed, legacyPrefix); ok {
+		return b.openLegacy(encoded)
+	}
+	k, wrapped, data, err := b.parse(sealed)
+	if err != nil {
+		return nil, err
+	}
+	dek, err := open(k.aead, wrapped, []byte(k.id))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+	return open(aead, data, nil)
+}
+
+// NeedsRotation reports whether sealed is not yet wrapped with the primary
+// key.
+func (b *Box) NeedsRotation(sealed string) bool {
+	return !strings.HasPrefix(sealed, envelopePrefix+b.primary.id+":")
+}
+
+// Rotate rewraps sealed under the primary key. Envelope values keep their
+// ciphertext and only get their data key rewrapped; legacy values are opened
+// and sealed again.
+func (b *Box) Rotate(sealed string) (string, error) {
+	if !b.NeedsRotation(sealed) {
+		return sealed, nil
+	}
+	if strings.HasPrefix(sealed, legacyPrefix) {
+		plaintext, err := b.Open(sealed)
+		if err != nil {
+			return "", err
+		}
+		return b.Seal(plaintext)
+	}
+	k, wrapped, data, err := b.parse(sealed)
+	if err != nil {
+		return "", err
+	}
+	dek, err := open(k.aead, wrapped, []byte(k.id))
+	if err != nil {
+		return "", err
+	}
+	return b.wrap(dek, data)
+}
+
+func (b *Box) wrap(dek, data []byte) (string, error) {
+	wrapped, err := seal(b.primary.aead, dek, []byte(b.primary.id))
+	if err != nil {
+		return "", err
+	}
+	return envelopePrefix + b.primary.id + ":" +
+		base64.StdEncoding.EncodeToString(wrapped) + ":" +
+		base64.StdEncoding.EncodeToString(data), nil
+}
+
+func (b *Box) parse(sealed string) (k kek, wrapped, data []byte, err error) {
+	encoded, ok := strings.CutPrefix(sealed, envelopePrefix)
+	if !ok {
+		return kek{}, nil, nil, errors.New("secrets: unsupported format")
+	}
+	parts := strings.Split(encoded, ":")
+	if len(parts) != 3 {
+		return kek{}, nil, nil, errors.New("secrets: malformed envelope")
+	}
+	k, ok = b.keks[parts[0]]
+	if !ok {
+		return kek{}, nil, nil, fmt.Errorf("%w %s", ErrUnknownKey, parts[0])
+	}
+	if wrapped, err = base64.StdEncoding.DecodeString(parts[1]); err != nil {
+		return kek{}, nil, nil, fmt.Errorf("secrets: decode: %w", err)
+	}
+	if data, err = base64.StdEncoding.DecodeString(parts[2]); err != nil {
+		return kek{}, nil, nil, fmt.Errorf("secrets: decode: %w", err)
+	}
+	return k, wrapped, data, nil
+}
+
+func (b *Box) openLegacy(encoded string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("secrets: decode: %w", err)
+	}
+	for _, k := range b.order {
+		if plaintext, err := open(k.aead, raw, nil); err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, errors.New("secrets: open: no key opens the value")
+}
+
+func seal(aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("secrets: nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func open(aead cipher.AEAD, raw, additional []byte) ([]byte, error) {
+	n := aead.NonceSize()
+	if len(raw) < n {
+		return nil, errors.New("secrets: ciphertext too short")
+	}
+	plaintext, err := aead.Open(nil, raw[:n], raw[n:], additional)
+	if err != nil {
+		return nil, fmt.Errorf("secrets: open: %w", err)
+	}
+	return plaintext, nil
+}
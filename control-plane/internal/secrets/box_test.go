@@ -0,0 +1,136 @@
+package secrets
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestBoxRoundTrip(t *testing.T) {
+	key, err := ParseKey("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	if err != nil {
+		t.Fatalf("parse key: %v", err)
+	}
+	box, err := NewBox(key)
+	if err != nil {
+		t.Fatalf("new box: %v", err)
+	}
+	sealed, err := box.Seal([]byte("private key"))
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	if !strings.HasPrefix(sealed, "v2:"+box.PrimaryKeyID()+":") || strings.Contains(sealed, "private key") {
+		t.Fatalf("unexpected sealed value %q", sealed)
+	}
+	plain, err := box.Open(sealed)
+	if err != nil || !bytes.Equal(plain, []byte("private key")) {
+		t.Fatalf("open: %q, %v", plain, err)
+	}
+
+	tampered := sealed[:len(sealed)-2] + "AA"
+	if _, err := box.Open(tampered); err == nil {
+		t.Fatal("expected tampered ciphertext to be rejected")
+	}
+}
+
+func TestParseKeyRejectsShortKeys(t *testing.T) {
+	if _, err := ParseKey("c2hvcnQ="); err != ErrInvalidKey {
+		t.Fatalf("expected ErrInvalidKey, got %v", err)
+	}
+	if _, err := ParseKey(strings.Repeat("ab", 32)); err != nil {
+		t.Fatalf("hex key: %v", err)
+	}
+}
+
+func TestBoxRotation(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+	oldBox, err := NewBox(oldKey)
+	if err != nil {
+		t.Fatalf("new box: %v", err)
+	}
+	sealed, err := oldBox.Seal([]byte("wg private key"))
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+
+	rotated, err := NewBox(newKey, oldKey)
+	if err != nil {
+		t.Fatalf("new box: %v", err)
+	}
+	if !rotated.NeedsRotation(sealed) {
+		t.Fatal("value sealed with the old key should need rotation")
+	}
+	if plain, err := rotated.Open(sealed); err != nil || string(plain) != "wg private key" {
+		t.Fatalf("open with previous key: %q, %v", plain, err)
+	}
+	rewrapped, err := rotated.Rotate(sealed)
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if rotated.NeedsRotation(rewrapped) {
+		t.Fatalf("rotated value %q still needs rotation", rewrapped)
+	}
+	// Only the data key is rewrapped; the ciphertext is untouched.
+	if sealed[strings.LastIndex(sealed, ":"):] != rewrapped[strings.LastIndex(rewrapped, ":"):] {
+		t.Fatal("rotation should keep the value ciphertext")
+	}
+
+	newOnly, err := NewBox(newKey)
+	if err != nil {
+		t.Fatalf("new box: %v", err)
+	}
+	if plain, err := newOnly.Open(rewrapped); err != nil || string(plain) != "wg private key" {
+		t.Fatalf("open after rotation: %q, %v", plain, err)
+	}
+	if _, err := newOnly.Open(sealed); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected ErrUnknownKey for the retired key, got %v", err)
+	}
+}
+
+func TestBoxOpensAndRotatesLegacyValues(t *testing.T) {
+	key := bytes.Repeat([]byte{3}, 32)
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	nonce := make([]byte, aead.NonceSize())
+	_, _ = rand.Read(nonce)
+	legacy := "v1:" + base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte("account key"), nil))
+
+	box, err := NewBox(bytes.Repeat([]byte{4}, 32), key)
+	if err != nil {
+		t.Fatalf("new box: %v", err)
+	}
+	if plain, err := box.Open(legacy); err != nil || string(plain) != "account key" {
+		t.Fatalf("open legacy: %q, %v", plain, err)
+	}
+	rotated, err := box.Rotate(legacy)
+	if err != nil {
+		t.Fatalf("rotate legacy: %v", err)
+	}
+	if box.NeedsRotation(rotated) {
+		t.Fatalf("unexpected format after rotation: %q", rotated)
+	}
+	if plain, err := box.Open(rotated); err != nil || string(plain) != "account key" {
+		t.Fatalf("open rotated: %q, %v", plain, err)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	hexKey := strings.Repeat("ab", 32)
+	b64Key := "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	keys, err := ParseKeys("# primary first\n" + hexKey + "\n\n" + b64Key + ", " + hexKey + "\n")
+	if err != nil {
+		t.Fatalf("parse keys: %v", err)
+	}
+	if len(keys) != 3 {
+		t.Fatalf("expected 3 keys, got %d", len(keys))
+	}
+	if _, err := ParseKeys("not-a-key"); err != ErrInvalidKey {
+		t.Fatalf("expected ErrInvalidKey, got %v", err)
+	}
+}
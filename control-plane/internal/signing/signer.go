@@ -0,0 +1,123 @@
+// Package signing holds the control plane's Ed25519 key that edges use to
+// authenticate the configuration they download.
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+type Signer struct {
+	key ed25519.PrivateKey
+}
+
+func NewSigner(key ed25519.PrivateKey) *Signer {
+	return &Signer{key: key}
+}
+
+// LoadOrCreate reads the PKCS#8 PEM key at path, generating and storing a new
+// key with mode 0600 when the file does not exist.
+func LoadOrCreate(path string) (*Signer, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return create(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("signing: read key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("signing: %s is not a PEM private key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("signing: parse key: %w", err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing: %s is not an Ed25519 key", path)
+	}
+	return NewSigner(key), nil
+}
+
+func create(path string) (*Signer, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("signing: generate key: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("signing: encode key: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("signing: %w", err)
+	}
+	// O_EXCL keeps a concurrently started process from overwriting the key.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("signing: write key: %w", err)
+	}
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		return nil, fmt.Errorf("signing: write key: %w", err)
+	}
+	return NewSigner(key), nil
+}
+
+func (s *Signer) Sign(msg []byte) []byte {
+	return ed25519.Sign(s.key, msg)
+}
+
+// PublicKeyPEM returns the public key in the PKIX PEM form that
+// "openssl pkeyutl -verify -pubin" accepts.
+func (s *Signer) PublicKeyPEM() string {
+	der, err := x509.MarshalPKIXPublicKey(s.key.Public())
+	if err != nil {
+		// Ed25519 public keys always marshal.
+		panic(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// Fingerprint is the hex SHA-256 of the DER public key, for comparing keys
+// out of band.
+func (s *Signer) Fingerprint() string {
+	der, _ := x509.MarshalPKIXPublicKey(s.key.Public())
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// ConfigMessage is the canonical text signed for an edge config response. It
+// binds the config to one edge and one point in time, and covers the exact
+// response body through its SHA-256. Agents rebuild it with printf.
+func ConfigMessage(edgeID, configHash string, generation, issuedAt int64, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	return []byte("kokoa-config-v1\n" +
+		edgeID + "\n" +
+		configHash + "\n" +
+		strconv.FormatInt(generation, 10) + "\n" +
+		strconv.FormatInt(issuedAt, 10) + "\n" +
+		hex.EncodeToString(sum[:]) + "\n")
+}
+
+// CertificatesMessage is the canonical text signed for an edge certificates
+// response. certificatesHash must match the one in the signed config, which
+// ties the downloaded keys to the config they are applied with.
+func CertificatesMessage(edgeID, certificatesHash string, issuedAt int64, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	return []byte("kokoa-certificates-v1\n" +
+		edgeID + "\n" +
+		certificatesHash + "\n" +
+		strconv.FormatInt(issuedAt, 10) + "\n" +
+		hex.EncodeToString(sum[:]) + "\n")
+}
@@ -0,0 +1,52 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOrCreatePersistsKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "signing.key")
+	first, err := LoadOrCreate(path)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("key file should be private: %v, %v", info, err)
+	}
+	second, err := LoadOrCreate(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if first.Fingerprint() != second.Fingerprint() {
+		t.Fatal("reloading produced a different key")
+	}
+}
+
+func TestSignatureVerifiesWithPublicKeyPEM(t *testing.T) {
+	s, err := LoadOrCreate(filepath.Join(t.TempDir(), "signing.key"))
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	block, _ := pem.Decode([]byte(s.PublicKeyPEM()))
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("parse public key: %v", err)
+	}
+	pub := parsed.(ed25519.PublicKey)
+
+	msg := ConfigMessage("edge-1", "abc", 3, 1700000000, []byte(`{"config_hash":"abc"}`+"\n"))
+	sig := s.Sign(msg)
+	if !ed25519.Verify(pub, msg, sig) {
+		t.Fatal("signature does not verify")
+	}
+	other := ConfigMessage("edge-2", "abc", 3, 1700000000, []byte(`{"config_hash":"abc"}`+"\n"))
+	if ed25519.Verify(pub, other, sig) {
+		t.Fatal("signature verified for another edge")
+	}
+}
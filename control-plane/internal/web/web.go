@@ -5,12 +5,18 @@ import (
 	"net/http"
 )
 
+// Config carries the control plane settings that the install scripts embed.
+type Config struct {
+	// SigningPublicKey is the PEM public key edges pin to verify configs.
+	SigningPublicKey string
+}
+
 // Handler serves the UI and helper install scripts.
-func Handler() http.Handler {
+func Handler(cfg Config) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.URL.Path {
 		case "/edge/install.sh":
-			serveInstallScript(w, r)
+			serveInstallScript(w, r, cfg)
 			return
 		case "/edge/poll_config.sh":
 			servePollScript(w, r)
@@ -25,13 +31,13 @@ func Handler() http.Handler {
 	})
 }
 
-func serveInstallScript(w http.ResponseWriter, r *http.Request) {
+func serveInstallScript(w http.ResponseWriter, r *http.Request, cfg Config) {
 	scheme := "http"
 	if r.TLS != nil {
 		scheme = "https"
 	}
 	baseURL := fmt.Sprintf("%s://%s", scheme, r.Host)
-	script := fmt.Sprintf(edgeInstallScript, baseURL, baseURL)
+	script := fmt.Sprintf(edgeInstallScript, baseURL, cfg.SigningPublicKey, baseURL)
 	w.Header().Set("Content-Type", "text/plain")
 	_, _ = w.Write([]byte(script))
 }
@@ -41,9 +47,15 @@ func servePollScript(w http.ResponseWriter, _ *http.Request) {
 	_, _ = w.Write([]byte(edgePollScript))
 }
 
-func serveOriginInstall(w http.ResponseWriter, _ *http.Request) {
+func serveOriginInstall(w http.ResponseWriter, r *http.Request) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	baseURL := fmt.Sprintf("%s://%s", scheme, r.Host)
+	script := fmt.Sprintf(originInstallScript, baseURL)
 	w.Header().Set("Content-Type", "text/plain")
-	_, _ = w.Write([]byte(originInstallScript))
+	_, _ = w.Write([]byte(script))
 }
 
 const indexHTML = `<!DOCTYPE html>
@@ -65,6 +77,8 @@ const indexHTML = `<!DOCTYPE html>
     input, select { width:100%; padding:10px; border-radius:8px; border:1px solid #1f2937; background:#0b1220; color: var(--text); }
     button { margin-top:12px; padding:10px 12px; border-radius:8px; border:none; cursor:pointer; color:#0b1220; font-weight:600; background: linear-gradient(90deg, var(--accent), var(--accent2)); }
     button:hover { filter: brightness(1.05); }
+    .actions button { margin:6px 6px 0 0; padding:4px 10px; font-size:12px; }
+    button.danger { background: var(--danger); color:#fff; }
     .muted { color: var(--muted); font-size:12px; }
     .list { max-height: 360px; overflow-y: auto; }
     .item { padding:10px; border:1px solid #1f2937; border-radius:8px; margin-bottom:8px; background:#0c1322; }
@@ -82,7 +96,11 @@ const indexHTML = `<!DOCTYPE html>
       <h1>kokoa control plane</h1>
       <div class="muted">Origins/Routes/Edges を管理し、Edge がPullする設定を配布します。</div>
     </div>
-    <div class="muted status" id="status">loading...</div>
+    <div>
+      <label for="admin-key">管理 API キー</label>
+      <input id="admin-key" type="password" placeholder="CP_ADMIN_API_KEY" onchange="saveAdminKey()" />
+      <div class="muted status" id="status">loading...</div>
+    </div>
   </header>
 
   <main>
@@ -90,12 +108,14 @@ const indexHTML = `<!DOCTYPE html>
       <h2>Origin 作成</h2>
       <label>名前</label>
       <input id="origin-name" placeholder="origin-1" />
-      <label>WireGuard IP</label>
-      <input id="origin-wg" placeholder="10.0.0.2" />
+      <label>WireGuard IP (空欄ならトンネルネットワークから自動割り当て)</label>
+      <input id="origin-wg" placeholder="auto" />
       <label>WireGuard 公開鍵 (任意)</label>
       <input id="origin-pub" placeholder="" />
-      <label>WireGuard 秘密鍵(暗号化済み) (任意)</label>
-      <input id="origin-priv" placeholder="" />
+      <label>WireGuard Endpoint (任意・Edge から到達できる host:port)</label>
+      <input id="origin-endpoint" placeholder="origin.example.com:51820" />
+      <label>WireGuard 秘密鍵 (任意・サーバー側で暗号化して保存)</label>
+      <input id="origin-priv" type="password" placeholder="" autocomplete="off" />
       <button onclick="createOrigin()">作成</button>
       <div class="error" id="origin-error"></div>
     </section>
@@ -104,10 +124,17 @@ const indexHTML = `<!DOCTYPE html>
       <h2>Route 作成</h2>
       <label>ホスト名</label>
       <input id="route-host" placeholder="app.example.com" />
+      <label>パスプレフィックス (任意, デフォルト /)</label>
+      <input id="route-path" placeholder="/api" />
+      <label><input id="route-strip" type="checkbox" style="width:auto;" /> プレフィックスを除去して転送</label>
       <label>対象 Origin</label>
       <select id="route-origin"></select>
       <label>ターゲットポート</label>
       <input id="route-port" type="number" placeholder="8080" />
+      <label>配置先グループ (カンマ区切り) - 任意、空なら全 Edge</label>
+      <input id="route-groups" placeholder="tokyo,osaka" />
+      <label>配置先ラベル (key=value をカンマ区切り、値なしはキーの有無のみ) - 任意</label>
+      <input id="route-labels" placeholder="tier=public" />
       <button onclick="createRoute()">作成</button>
       <div class="error" id="route-error"></div>
     </section>
@@ -128,37 +155,108 @@ const indexHTML = `<!DOCTYPE html>
     </section>
 
     <section class="card">
-      <h2>Edge 登録</h2>
-      <label>Edge 名</label>
-      <input id="edge-name" placeholder="edge-1" />
-      <label>ブートストラップトークン</label>
-      <input id="edge-bootstrap" placeholder="必須: CP_BOOTSTRAP_TOKEN" />
-      <label>WireGuard IP (例: 10.0.0.3/32) - 任意</label>
-      <input id="edge-wg-addr" placeholder="10.0.0.3/32" />
+      <h2>参加トークン</h2>
+      <label>種類</label>
+      <select id="join-kind">
+        <option value="edge">Edge</option>
+        <option value="origin">Origin</option>
+      </select>
+      <label>Edge 名 - 任意（指定するとこの名前で登録）</label>
+      <input id="join-edge-name" placeholder="edge-1" />
+      <label>グループ - 任意</label>
+      <input id="join-group" placeholder="tokyo" />
+      <label>ラベル (key=value をカンマ区切り) - 任意</label>
+      <input id="join-labels" placeholder="region=ap-northeast-1,tier=public" />
+      <label>使用回数の上限</label>
+      <input id="join-max-uses" type="number" min="1" value="1" />
+      <label>有効期間（時間）</label>
+      <input id="join-ttl-hours" type="number" min="1" value="24" />
+      <label><input id="join-require-approval" type="checkbox" style="width:auto;" /> 登録後に承認を必須にする</label>
+      <label>WireGuard IP (例: 10.0.0.3/32、auto で自動割り当て) - 任意</label>
+      <input id="edge-wg-addr" placeholder="auto" />
       <label>WireGuard Endpoint (例: origin.example.com:51820) - 任意</label>
       <input id="edge-wg-endpoint" placeholder="origin.example.com:51820" />
       <label>Peer Public Key (Originのpubkey) - 任意</label>
       <input id="edge-wg-peer" placeholder="base64 pubkey" />
       <label>Allowed IPs (任意, デフォルト0.0.0.0/0)</label>
       <input id="edge-wg-allowed" placeholder="0.0.0.0/0" />
-      <button onclick="registerEdge()">登録してワンライナー生成</button>
-      <div class="error" id="edge-error"></div>
-      <div class="muted" id="edge-result"></div>
+      <button onclick="createJoinToken()">発行してワンライナー生成</button>
+      <div class="error" id="join-error"></div>
+      <div class="muted" id="join-result"></div>
+      <div class="list" id="join-tokens-list"></div>
+    </section>
+
+    <section class="card">
+      <h2>トンネルネットワーク</h2>
+      <div class="list" id="tunnel-pools"></div>
+      <label>WireGuard 鍵ローテーション (進行中)</label>
+      <div class="list" id="key-rotations"></div>
     </section>
   </main>
 
   <script>
     const statusEl = document.getElementById('status');
+    const adminKeyEl = document.getElementById('admin-key');
+    adminKeyEl.value = localStorage.getItem('kokoa-admin-key') || '';
+
+    function saveAdminKey() {
+      localStorage.setItem('kokoa-admin-key', adminKeyEl.value.trim());
+      init();
+    }
+
     async function fetchJSON(url, opts={}) {
-      const res = await fetch(url, opts);
+      const headers = { ...(opts.headers || {}) };
+      const adminKey = adminKeyEl.value.trim();
+      if (adminKey) headers['X-API-Key'] = adminKey;
+      const res = await fetch(url, { ...opts, headers });
       if (!res.ok) {
         const data = await res.json().catch(() => ({}));
         const msg = data.error || res.statusText;
         throw new Error(msg);
       }
+      if (res.status === 204) return null;
       return res.json();
     }
 
+    // esc escapes text for innerHTML. Names, addresses and keys come from
+    // machines that registered themselves and must never be read as markup.
+    function esc(v) {
+      return String(v).replace(/[&<>"']/g, c => ({ '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;' }[c]));
+    }
+
+    function addActions(div, actions) {
+      const wrap = document.createElement('div');
+      wrap.className = 'actions';
+      actions.forEach(a => {
+        const btn = document.createElement('button');
+        btn.textContent = a.label;
+        if (a.danger) btn.className = 'danger';
+        btn.onclick = async () => {
+          try {
+            await a.run();
+            await init();
+          } catch (e) {
+            statusEl.textContent = 'error: ' + e.message;
+          }
+        };
+        wrap.appendChild(btn);
+      });
+      div.appendChild(wrap);
+    }
+
+    function patchJSON(url, payload) {
+      return fetchJSON(url, {
+        method: 'PATCH',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(payload),
+      });
+    }
+
+    function deleteResource(url, label) {
+      if (!confirm(label + ' を削除しますか？')) return Promise.resolve();
+      return fetchJSON(url, { method: 'DELETE' });
+    }
+
     async function loadOrigins() {
       const data = await fetchJSON('/api/v1/origins/list');
       const listEl = document.getElementById('origins-list');
@@ -169,7 +267,22 @@ const indexHTML = `<!DOCTYPE html>
         const div = document.createElement('div');
         div.className = 'item';
         const cmd = 'curl -fsSL ' + window.location.origin + '/origin/install.sh | WG_ADDR=' + o.WireguardIP + '/32 bash';
-        div.innerHTML = '<strong>' + o.Name + '</strong> <span class="pill">' + o.ID + '</span><br><span class="muted">WG IP: ' + o.WireguardIP + '</span><br><div class="muted">Install: <code style="font-size:11px;">' + cmd + '</code></div>';
+        const enrolled = o.JoinTokenID && o.JoinTokenID.Valid;
+        const lastSeen = o.LastSeen && o.LastSeen.Valid ? new Date(o.LastSeen.Time).toISOString() : 'never';
+        const info = enrolled ? '<br><span class="muted">自己登録 (' + (o.RegisteredFrom && o.RegisteredFrom.Valid ? esc(o.RegisteredFrom.String) : '不明') + ') — last_seen: ' + lastSeen + '</span>' : '<br><div class="muted">Install: <code style="font-size:11px;">' + cmd + '</code></div>';
+        div.innerHTML = '<strong>' + esc(o.Name) + '</strong> <span class="pill">' + esc(o.ID) + '</span><br><span class="muted">WG IP: ' + esc(o.WireguardIP) + ' — Endpoint: ' + esc(o.WireguardEndpoint || '未設定') + '</span>' + info;
+        addActions(div, [
+          { label: '編集', run: () => {
+            const name = prompt('Origin 名', o.Name);
+            if (name === null) return;
+            const wgIP = prompt('WireGuard IP', o.WireguardIP);
+            if (wgIP === null) return;
+            const endpoint = prompt('WireGuard Endpoint (host:port)', o.WireguardEndpoint || '');
+            if (endpoint === null) return;
+            return patchJSON('/api/v1/origins/' + o.ID, { name: name.trim(), wg_ip: wgIP.trim(), wireguard_endpoint: endpoint.trim() });
+          } },
+          { label: '削除', danger: true, run: () => deleteResource('/api/v1/origins/' + o.ID, o.Name + '（関連 Route も削除されます）') },
+        ]);
         listEl.appendChild(div);
         const opt = document.createElement('option');
         opt.value = o.ID;
@@ -188,7 +301,40 @@ const indexHTML = `<!DOCTYPE html>
       data.forEach(r => {
         const div = document.createElement('div');
         div.className = 'item';
-        div.innerHTML = '<strong>' + r.Hostname + '</strong> ➜ ' + r.WireguardIP + ':' + r.TargetPort + '<br><span class="muted">origin: ' + r.OriginName + '</span>';
+        const path = (r.PathPrefix || '/') + (r.StripPrefix ? ' (strip)' : '');
+        const backends = (r.Backends || []).map(b =>
+          esc(b.OriginName) + ' (' + b.WireguardIP + ':' + b.TargetPort + (b.Weight > 1 ? ', weight ' + b.Weight : '') + (b.Backup ? ', backup' : '') + ')'
+        ).join(', ');
+        const placement = formatPlacement(r.Placement);
+        div.innerHTML = '<strong>' + r.Hostname + '</strong><span class="pill">' + path + '</span><span class="pill">' + (r.LBMethod || 'round_robin') + '</span> ➜ ' + r.WireguardIP + ':' + r.TargetPort + '<br><span class="muted">backends: ' + backends + '</span><br><span class="muted">配置: ' + (placement || '全 Edge') + '</span>';
+        addActions(div, [
+          { label: '編集', run: () => {
+            const port = prompt('ターゲットポート', r.TargetPort);
+            if (port === null) return;
+            const originID = prompt('Origin ID（移動する場合は変更）', r.OriginID);
+            if (originID === null) return;
+            return patchJSON('/api/v1/routes/' + r.ID, { target_port: Number(port), origin_id: originID.trim() });
+          } },
+          { label: 'バックエンド追加', run: () => {
+            const originID = prompt('追加する Origin ID');
+            if (!originID) return;
+            const port = prompt('ターゲットポート', r.TargetPort);
+            if (port === null) return;
+            const backup = confirm('バックアップ（フェイルオーバー専用）として追加しますか？');
+            const backends = (r.Backends || []).map(b => ({ origin_id: b.OriginID, target_port: b.TargetPort, weight: b.Weight, backup: b.Backup }));
+            backends.push({ origin_id: originID.trim(), target_port: Number(port), backup });
+            return patchJSON('/api/v1/routes/' + r.ID, { backends });
+          } },
+          { label: '配置変更', run: () => {
+            const p = r.Placement || {};
+            const groups = prompt('配置先グループ (カンマ区切り、空なら制限なし)', (p.groups || []).join(','));
+            if (groups === null) return;
+            const labels = prompt('配置先ラベル (key=value をカンマ区切り、空なら制限なし)', Object.entries(p.labels || {}).map(([k, v]) => v ? k + '=' + v : k).join(','));
+            if (labels === null) return;
+            return patchJSON('/api/v1/routes/' + r.ID, { placement: { groups: parseList(groups), labels: parseLabels(labels) } });
+          } },
+          { label: '削除', danger: true, run: () => deleteResource('/api/v1/routes/' + r.ID, r.Hostname) },
+        ]);
         listEl.appendChild(div);
       });
       if (!data.length) {
@@ -204,8 +350,72 @@ const indexHTML = `<!DOCTYPE html>
         const div = document.createElement('div');
         div.className = 'item';
         const lastSeen = e.LastSeen && e.LastSeen.Time ? new Date(e.LastSeen.Time).toISOString() : 'never';
-        const cmd = 'curl -fsSL ' + window.location.origin + '/edge/install.sh | BOOTSTRAP_TOKEN=<token> bash';
-        div.innerHTML = '<strong>' + (e.Name || 'edge') + '</strong> <span class="pill">' + e.ID + '</span><br><span class="muted">last_seen: ' + lastSeen + '</span><br><div class="muted">Install: <code style="font-size:11px;">' + cmd + '</code></div>';
+        const cmd = 'curl -fsSL ' + window.location.origin + '/edge/install.sh | JOIN_TOKEN=<token> bash';
+        let status = '未報告';
+        if (e.ApplyStatus && e.ApplyStatus.Valid) {
+          status = e.ApplyStatus.String === 'failed' ? '<span class="error">適用失敗</span>' : '適用済み';
+          if (e.ConfigsBehind > 0) status += '（' + e.ConfigsBehind + ' 世代遅れ）';
+          else if (e.ConfigsBehind === 0) status += '（最新）';
+        }
+        const versions = [
+          e.AgentVersion && e.AgentVersion.Valid ? 'agent ' + esc(e.AgentVersion.String) : '',
+          e.NginxVersion && e.NginxVersion.Valid ? 'nginx ' + esc(e.NginxVersion.String) : '',
+          e.UptimeSeconds && e.UptimeSeconds.Valid ? 'uptime ' + Math.floor(e.UptimeSeconds.Int64 / 60) + 'm' : '',
+        ].filter(Boolean).join(' / ');
+        const applyError = e.ApplyError && e.ApplyError.Valid ? '<br><span class="error" style="font-size:12px;">' + esc(e.ApplyError.String) + '</span>' : '';
+        const labels = Object.entries(e.Labels || {}).map(([k, v]) => esc(k) + '=' + esc(v)).join(', ');
+        const grouping = [e.GroupName && e.GroupName.Valid ? 'group ' + esc(e.GroupName.String) : '', labels].filter(Boolean).join(' / ');
+        const pending = e.State === 'pending';
+        const review = pending ? '<br><span class="error">承認待ち</span><span class="muted"> — 登録元 ' + (e.RegisteredFrom && e.RegisteredFrom.Valid ? esc(e.RegisteredFrom.String) : '不明') +
+          '、WireGuard 公開鍵 ' + (e.WGPublicKey && e.WGPublicKey.Valid ? '<code>' + esc(e.WGPublicKey.String) + '</code>' : 'なし') + '</span>' : '';
+        const stateLabels = { cordoned: 'DNS から除外中', draining: 'ドレイン中', retired: '廃止済み' };
+        let lifecycle = '';
+        if (stateLabels[e.State]) {
+          lifecycle = '<br><span class="error">' + stateLabels[e.State] + '</span><span class="muted">' +
+            (e.State === 'draining' && e.DrainUntil && e.DrainUntil.Valid ? ' — ' + new Date(e.DrainUntil.Time).toISOString() + ' に廃止' : '') +
+            (e.StateChangedBy && e.StateChangedBy.Valid ? '（' + esc(e.StateChangedBy.String) + '）' : '') + '</span>';
+        }
+        div.innerHTML = '<strong>' + esc(e.Name || 'edge') + '</strong> <span class="pill">' + esc(e.ID) + '</span>' + review + lifecycle + (grouping ? '<br><span class="muted">' + grouping + '</span>' : '') + '<br><span class="muted">last_seen: ' + lastSeen + '</span><br><span class="muted">状態: ' + status + (versions ? ' — ' + versions : '') + '</span>' + applyError + '<br><div class="muted">Install: <code style="font-size:11px;">' + cmd + '</code></div>';
+        const actions = [];
+        if (pending) {
+          actions.push({ label: '承認', run: () => fetchJSON('/api/v1/edge-nodes/' + e.ID + '/approve', { method: 'POST' }) });
+        }
+        const transition = op => () => fetchJSON('/api/v1/edge-nodes/' + e.ID + '/' + op, { method: 'POST' });
+        if (e.State === 'active') {
+          actions.push({ label: 'DNS から除外', run: transition('cordon') });
+        }
+        if (e.State === 'active' || e.State === 'cordoned') {
+          actions.push({ label: 'ドレイン', run: () => {
+            if (!confirm((e.Name || 'edge') + ' をドレインしますか？期間が過ぎるとトークンが失効します。')) return;
+            return transition('drain')();
+          } });
+        }
+        if (e.State === 'cordoned' || e.State === 'draining') {
+          actions.push({ label: '復帰', run: transition('uncordon') });
+        }
+        if (e.State === 'draining') {
+          actions.push({ label: '今すぐ廃止', danger: true, run: () => {
+            if (!confirm((e.Name || 'edge') + ' を今すぐ廃止しますか？トークンが失効します。')) return;
+            return fetchJSON('/api/v1/edge-nodes/' + e.ID + '/retire', {
+              method: 'POST',
+              headers: { 'Content-Type': 'application/json' },
+              body: JSON.stringify({ force: true }),
+            });
+          } });
+        }
+        addActions(div, actions.concat([
+          { label: '名前変更', run: () => {
+            const name = prompt('Edge 名', e.Name || '');
+            if (name === null) return;
+            return patchJSON('/api/v1/edge-nodes/' + e.ID, { name: name.trim() });
+          } },
+          { label: '公開アドレス', run: () => {
+            const addr = prompt('DNS に載せるアドレス（空なら登録元 IP）', e.PublicAddr && e.PublicAddr.Valid ? e.PublicAddr.String : '');
+            if (addr === null) return;
+            return patchJSON('/api/v1/edge-nodes/' + e.ID, { public_addr: addr.trim() });
+          } },
+          { label: '削除', danger: true, run: () => deleteResource('/api/v1/edge-nodes/' + e.ID, (e.Name || 'edge') + '（トークンも無効になります）') },
+        ]));
         listEl.appendChild(div);
       });
       if (!data.length) {
@@ -221,7 +431,8 @@ const indexHTML = `<!DOCTYPE html>
           name: document.getElementById('origin-name').value.trim(),
           wg_ip: document.getElementById('origin-wg').value.trim(),
           wireguard_public_key: document.getElementById('origin-pub').value.trim(),
-          wireguard_private_key_encrypted: document.getElementById('origin-priv').value.trim(),
+          wireguard_endpoint: document.getElementById('origin-endpoint').value.trim(),
+          wireguard_private_key: document.getElementById('origin-priv').value.trim(),
         };
         await fetchJSON('/api/v1/origins', {
           method: 'POST',
@@ -231,6 +442,7 @@ const indexHTML = `<!DOCTYPE html>
         document.getElementById('origin-name').value = '';
         document.getElementById('origin-wg').value = '';
         document.getElementById('origin-pub').value = '';
+        document.getElementById('origin-endpoint').value = '';
         document.getElementById('origin-priv').value = '';
         await loadOrigins();
       } catch (e) {
@@ -244,8 +456,14 @@ const indexHTML = `<!DOCTYPE html>
       try {
         const payload = {
           hostname: document.getElementById('route-host').value.trim(),
+          path_prefix: document.getElementById('route-path').value.trim(),
+          strip_prefix: document.getElementById('route-strip').checked,
           origin_id: document.getElementById('route-origin').value,
           target_port: Number(document.getElementById('route-port').value),
+          placement: {
+            groups: parseList(document.getElementById('route-groups').value),
+            labels: parseLabels(document.getElementById('route-labels').value),
+          },
         };
         await fetchJSON('/api/v1/routes', {
           method: 'POST',
@@ -253,7 +471,11 @@ const indexHTML = `<!DOCTYPE html>
           body: JSON.stringify(payload),
         });
         document.getElementById('route-host').value = '';
+        document.getElementById('route-path').value = '';
+        document.getElementById('route-strip').checked = false;
         document.getElementById('route-port').value = '';
+        document.getElementById('route-groups').value = '';
+        document.getElementById('route-labels').value = '';
         await loadRoutes();
       } catch (e) {
         errEl.textContent = e.message;
@@ -263,7 +485,8 @@ const indexHTML = `<!DOCTYPE html>
     async function init() {
       statusEl.textContent = 'loading...';
       try {
-        await Promise.all([loadOrigins(), loadRoutes(), loadEdges()]);
+        // Viewer keys cannot list join tokens; the rest of the page still loads.
+        await Promise.all([loadOrigins(), loadRoutes(), loadEdges(), loadTunnelPools(), loadJoinTokens().catch(() => {})]);
         statusEl.textContent = 'ready';
       } catch (e) {
         statusEl.textContent = 'error: ' + e.message;
@@ -271,44 +494,144 @@ const indexHTML = `<!DOCTYPE html>
     }
     init();
 
-    async function registerEdge() {
-      const errEl = document.getElementById('edge-error');
-      const resEl = document.getElementById('edge-result');
+    function parseLabels(text) {
+      const labels = {};
+      text.split(',').map(v => v.trim()).filter(Boolean).forEach(pair => {
+        const i = pair.indexOf('=');
+        if (i < 0) labels[pair] = '';
+        else labels[pair.slice(0, i).trim()] = pair.slice(i + 1).trim();
+      });
+      return labels;
+    }
+
+    function parseList(text) {
+      return text.split(',').map(v => v.trim()).filter(Boolean);
+    }
+
+    function formatPlacement(p) {
+      if (!p) return '';
+      const parts = [];
+      if (p.groups && p.groups.length) parts.push('group ' + p.groups.join(' | '));
+      Object.entries(p.labels || {}).forEach(([k, v]) => parts.push(v ? k + '=' + v : k));
+      return parts.join(', ');
+    }
+
+    async function loadTunnelPools() {
+      const data = await fetchJSON('/api/v2/tunnel/pools');
+      const listEl = document.getElementById('tunnel-pools');
+      listEl.innerHTML = '';
+      data.pools.forEach(p => {
+        const div = document.createElement('div');
+        div.className = 'item';
+        div.innerHTML = '<strong>' + p.cidr + '</strong> <span class="pill">' + p.family + '</span><br><span class="muted">使用中 ' + p.allocated + ' / ' + p.size + '（' + p.utilization.toFixed(1) + '%）</span>';
+        listEl.appendChild(div);
+      });
+      if (data.outside_pools > 0) {
+        const div = document.createElement('div');
+        div.className = 'muted';
+        div.textContent = 'プール外の手動指定アドレス: ' + data.outside_pools + ' 件';
+        listEl.appendChild(div);
+      }
+      data.conflicts.forEach(c => {
+        const div = document.createElement('div');
+        div.className = 'error';
+        div.textContent = 'アドレス重複 ' + c.addr + ': ' + c.owners.map(o => o.owner_type + ' ' + o.owner_name).join(', ');
+        listEl.appendChild(div);
+      });
+      await loadKeyRotations();
+    }
+
+    async function loadKeyRotations() {
+      const data = await fetchJSON('/api/v2/tunnel/key-rotations/list?state=overlap');
+      const listEl = document.getElementById('key-rotations');
+      listEl.innerHTML = '';
+      data.forEach(r => {
+        const div = document.createElement('div');
+        div.className = 'item';
+        const peers = r.peers.map(p => esc(p.name) + (p.applied ? ' ✓' : ' …')).join(', ') || 'なし';
+        div.innerHTML = '<strong>' + esc(r.owner_name) + '</strong> <span class="pill">' + r.owner_type + '</span><br><span class="muted">新しい鍵: ' + esc(r.new_public_key) +
+          '<br>未反映 ' + r.pending + ' / ' + r.peers.length + ' ピア: ' + peers + '</span>';
+        addActions(div, [
+          { label: '強制完了', run: () => confirm('未反映のピアを待たずに古い鍵を廃止しますか？') ? fetchJSON('/api/v2/tunnel/key-rotations/' + r.id + '/complete', { method: 'POST' }) : null },
+          { label: 'キャンセル', danger: true, run: () => fetchJSON('/api/v2/tunnel/key-rotations/' + r.id + '/cancel', { method: 'POST' }) },
+        ]);
+        listEl.appendChild(div);
+      });
+      if (!data.length) {
+        listEl.innerHTML = '<div class="muted">進行中のローテーションはありません</div>';
+      }
+    }
+
+    async function loadJoinTokens() {
+      const data = await fetchJSON('/api/v2/join-tokens/list');
+      const listEl = document.getElementById('join-tokens-list');
+      listEl.innerHTML = '';
+      data.forEach(t => {
+        const div = document.createElement('div');
+        div.className = 'item';
+        let state = '有効';
+        if (t.revoked_at) state = '失効';
+        else if (new Date(t.expires_at) <= new Date()) state = '期限切れ';
+        else if (t.uses >= t.max_uses) state = '使用済み';
+        const consumers = t.consumers.map(c => esc(c.edge_name || c.origin_name)).join(', ') || 'なし';
+        const kind = t.kind === 'origin' ? 'Origin' : 'Edge';
+        div.innerHTML = '<strong>' + esc(t.edge_name || t.group || 'join token') + '</strong> <span class="pill">' + kind + '</span> <span class="pill">' + t.id + '</span><br><span class="muted">' + state + ' — ' + t.uses + '/' + t.max_uses + ' 回使用、期限 ' + new Date(t.expires_at).toISOString() + '</span><br><span class="muted">参加した ' + kind + ': ' + consumers + '</span>';
+        if (state === '有効') {
+          addActions(div, [
+            { label: '失効', danger: true, run: () => confirm('このトークンを失効させますか？') && fetchJSON('/api/v1/join-tokens/' + t.id + '/revoke', { method: 'POST' }) },
+          ]);
+        }
+        listEl.appendChild(div);
+      });
+    }
+
+    async function createJoinToken() {
+      const errEl = document.getElementById('join-error');
+      const resEl = document.getElementById('join-result');
       errEl.textContent = '';
       resEl.textContent = '';
       try {
-        const name = document.getElementById('edge-name').value.trim() || 'edge';
-        const bootstrap = document.getElementById('edge-bootstrap').value.trim();
-        if (!bootstrap) throw new Error('bootstrap token is required');
-        const payload = { name };
-        const resp = await fetchJSON('/api/v1/edge-nodes/register', {
+        const kind = document.getElementById('join-kind').value;
+        if (kind === 'origin') {
+          const resp = await fetchJSON('/api/v1/join-tokens', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({
+              kind,
+              max_uses: Number(document.getElementById('join-max-uses').value) || 1,
+              ttl_seconds: Math.round((Number(document.getElementById('join-ttl-hours').value) || 24) * 3600),
+            }),
+          });
+          const cmd = 'curl -fsSL ' + window.location.origin + '/origin/install.sh | JOIN_TOKEN=' + resp.token + ' ORIGIN_NAME=<name> bash';
+          resEl.innerHTML = '発行しました（トークンは今だけ表示されます）。有効期限: ' + new Date(resp.expires_at).toISOString() + '<br>インストール: <code>' + cmd + '</code>';
+          await loadJoinTokens();
+          return;
+        }
+        const resp = await fetchJSON('/api/v1/join-tokens', {
           method: 'POST',
-          headers: {
-            'Content-Type': 'application/json',
-            'Authorization': 'Bearer ' + bootstrap,
-          },
+          headers: { 'Content-Type': 'application/json' },
           body: JSON.stringify({
-            ...payload,
-            wg_addr: document.getElementById('edge-wg-addr').value.trim(),
-            wg_endpoint: document.getElementById('edge-wg-endpoint').value.trim(),
-            wg_peer_pubkey: document.getElementById('edge-wg-peer').value.trim(),
-            wg_allowed_ips: document.getElementById('edge-wg-allowed').value.trim(),
+            edge_name: document.getElementById('join-edge-name').value.trim(),
+            group: document.getElementById('join-group').value.trim(),
+            labels: parseLabels(document.getElementById('join-labels').value),
+            max_uses: Number(document.getElementById('join-max-uses').value) || 1,
+            ttl_seconds: Math.round((Number(document.getElementById('join-ttl-hours').value) || 24) * 3600),
+            require_approval: document.getElementById('join-require-approval').checked,
           }),
         });
-        const nodeToken = resp.token || '';
         const wgAddr = document.getElementById('edge-wg-addr').value.trim();
         const wgEndpoint = document.getElementById('edge-wg-endpoint').value.trim();
         const wgPeer = document.getElementById('edge-wg-peer').value.trim();
         const wgAllowed = document.getElementById('edge-wg-allowed').value.trim();
         let cmd = 'curl -fsSL ' + window.location.origin + '/edge/install.sh | ';
-        cmd += 'BOOTSTRAP_TOKEN=' + bootstrap + ' ';
+        cmd += 'JOIN_TOKEN=' + resp.token + ' ';
         if (wgAddr) cmd += 'WG_ADDR=' + wgAddr + ' ';
         if (wgEndpoint) cmd += 'WG_ENDPOINT=' + wgEndpoint + ' ';
         if (wgPeer) cmd += 'WG_PEER_PUBKEY=' + wgPeer + ' ';
         if (wgAllowed) cmd += 'WG_ALLOWED_IPS=' + wgAllowed + ' ';
         cmd += 'bash';
-        resEl.innerHTML = '登録完了。Edge ID: ' + (resp.edge_node_id || '') + '<br>NODE_TOKEN: <code>' + nodeToken + '</code><br>インストール: <code>' + cmd + '</code>';
-        await loadEdges();
+        resEl.innerHTML = '発行しました（トークンは今だけ表示されます）。有効期限: ' + new Date(resp.expires_at).toISOString() + '<br>インストール: <code>' + cmd + '</code>';
+        await loadJoinTokens();
       } catch (e) {
         errEl.textContent = e.message;
       }
@@ -321,10 +644,13 @@ const edgeInstallScript = `#!/usr/bin/env bash
 set -euo pipefail
 
 CONTROL_PLANE_URL="${CONTROL_PLANE_URL:-%s}"
-BOOTSTRAP_TOKEN="${BOOTSTRAP_TOKEN:-}"
+# Public key that edge configs are signed with, pinned at install time.
+SIGNING_PUBKEY="%s"
+# JOIN_TOKEN is issued with POST /api/v1/join-tokens; BOOTSTRAP_TOKEN is the
+# deprecated static CP_BOOTSTRAP_TOKEN and accepted in its place.
+JOIN_TOKEN="${JOIN_TOKEN:-${BOOTSTRAP_TOKEN:-}}"
 EDGE_NAME="${EDGE_NAME:-$(hostname -s)}"
 CONFIG_DIR="${CONFIG_DIR:-/etc/nginx/kokoa}"
-EMAIL="${EMAIL:-}"
 NGINX_BIN="${NGINX_BIN:-nginx}"
 WG_IFACE="${WG_IFACE:-wg0}"
 WG_ADDR="${WG_ADDR:-}"
@@ -334,12 +660,12 @@ WG_ALLOWED_IPS="${WG_ALLOWED_IPS:-0.0.0.0/0}"
 
 while [[ $# -gt 0 ]]; do
   case "$1" in
-    --bootstrap-token) BOOTSTRAP_TOKEN="$2"; shift 2;;
+    --join-token|--bootstrap-token) JOIN_TOKEN="$2"; shift 2;;
     --control-plane-url) CONTROL_PLANE_URL="$2"; shift 2;;
     --edge-name) EDGE_NAME="$2"; shift 2;;
     --config-dir) CONFIG_DIR="$2"; shift 2;;
     --nginx-bin) NGINX_BIN="$2"; shift 2;;
-    --email) EMAIL="$2"; shift 2;;
+    --email) shift 2;; # ignored: certificates are issued by the control plane
     --wg-addr) WG_ADDR="$2"; shift 2;;
     --wg-endpoint) WG_ENDPOINT="$2"; shift 2;;
     --wg-peer-pubkey) WG_PEER_PUBKEY="$2"; shift 2;;
@@ -367,18 +693,29 @@ fi
 
 command -v curl >/dev/null 2>&1 || { echo "curl is required"; exit 1; }
 
-require "BOOTSTRAP_TOKEN" "$BOOTSTRAP_TOKEN"
+require "JOIN_TOKEN" "$JOIN_TOKEN"
 
-echo "[1/5] Installing packages (wireguard, nginx, jq, curl)..."
+echo "[1/5] Installing packages (wireguard, nginx, jq, curl, openssl)..."
 apt-get update -y
-apt-get install -y wireguard nginx jq curl
+apt-get install -y wireguard nginx jq curl openssl
 systemctl enable --now nginx >/dev/null 2>&1 || true
 
 echo "[2/5] Registering edge at ${CONTROL_PLANE_URL}..."
+# The edge's WireGuard key is created up front so that its public half can be
+# reviewed when the registration needs approval.
+mkdir -p /etc/wireguard
+if [[ ! -s /etc/wireguard/${WG_IFACE}.key ]]; then
+  (umask 077 && wg genkey > /etc/wireguard/${WG_IFACE}.key)
+fi
+wg pubkey < /etc/wireguard/${WG_IFACE}.key > /etc/wireguard/${WG_IFACE}.pub
+wg_public_key="$(cat /etc/wireguard/${WG_IFACE}.pub)"
+# WG_ADDR=auto lets the control plane allocate the tunnel address.
+register_body="$(jq -n --arg name "$EDGE_NAME" --arg key "$wg_public_key" --arg addr "$WG_ADDR" \
+  '{name: $name, wg_public_key: $key} + (if $addr == "" then {} else {wg_addr: $addr} end)')"
 resp="$(curl -fsS -X POST "${CONTROL_PLANE_URL}/api/v1/edge-nodes/register" \
-  -H "Authorization: Bearer ${BOOTSTRAP_TOKEN}" \
+  -H "Authorization: Bearer ${JOIN_TOKEN}" \
   -H "Content-Type: application/json" \
-  -d "{\"name\":\"${EDGE_NAME}\"}")"
+  -d "$register_body")"
 
 token="$(echo "$resp" | python -c "import sys,json;print(json.load(sys.stdin)['token'])" 2>/dev/null || true)"
 if [[ -z "$token" ]]; then
@@ -388,7 +725,15 @@ if [[ -z "$token" ]]; then
   echo "failed to parse token from response: $resp" >&2
   exit 1
 fi
+edge_id="$(echo "$resp" | jq -r '.edge_node_id' 2>/dev/null || true)"
+assigned_addr="$(echo "$resp" | jq -r '.wg_addr // ""' 2>/dev/null || true)"
+if [[ -n "$assigned_addr" ]]; then
+  WG_ADDR="$assigned_addr"
+fi
 echo "[3/5] Received node token."
+if [[ "$(echo "$resp" | jq -r '.state' 2>/dev/null || true)" == "pending" ]]; then
+  echo "      This edge (${edge_id}) waits for approval and receives no config until an admin approves it."
+fi
 
 echo "[4/5] Installing poller script..."
 mkdir -p /usr/local/bin
@@ -400,19 +745,30 @@ cat >/etc/kokoa-edge.env <<EOF
 CONTROL_PLANE_URL=${CONTROL_PLANE_URL}
 NODE_TOKEN=${token}
 CONFIG_DIR=${CONFIG_DIR}
-EMAIL=${EMAIL}
 NGINX_BIN=${NGINX_BIN}
+EDGE_ID=${edge_id}
 EOF
 
+if [[ -n "$SIGNING_PUBKEY" ]]; then
+  mkdir -p /etc/kokoa-edge
+  echo "$SIGNING_PUBKEY" > /etc/kokoa-edge/config-signing.pub
+  echo "CONFIG_PUBKEY=/etc/kokoa-edge/config-signing.pub" >> /etc/kokoa-edge.env
+fi
+
 if [[ -n "$WG_ADDR" ]]; then
   echo "WG_ADDR=${WG_ADDR}" >> /etc/kokoa-edge.env
 fi
 
+# With a tunnel address but no hand-picked peer, the agent writes the
+# WireGuard config from the peer set the control plane sends (every origin).
+if [[ -n "$WG_ADDR" && -z "$WG_PEER_PUBKEY" ]]; then
+  echo "WG_SYNC=true" >> /etc/kokoa-edge.env
+  echo "WG_IFACE=${WG_IFACE}" >> /etc/kokoa-edge.env
+  echo "[wg] ${WG_IFACE} (${WG_ADDR}) is configured by the agent with peers from the control plane."
 # Optional WireGuard setup if WG_ADDR, WG_ENDPOINT, WG_PEER_PUBKEY provided
-if [[ -n "$WG_ADDR" && -n "$WG_ENDPOINT" && -n "$WG_PEER_PUBKEY" ]]; then
+elif [[ -n "$WG_ADDR" && -n "$WG_ENDPOINT" && -n "$WG_PEER_PUBKEY" ]]; then
   echo "[wg] configuring ${WG_IFACE}..."
   umask 077
-  wg genkey | tee /etc/wireguard/${WG_IFACE}.key | wg pubkey > /etc/wireguard/${WG_IFACE}.pub
   privkey="$(cat /etc/wireguard/${WG_IFACE}.key)"
 
   cat >/etc/wireguard/${WG_IFACE}.conf <<EOF
@@ -430,7 +786,7 @@ EOF
   systemctl enable --now wg-quick@${WG_IFACE}
   echo "WireGuard up on ${WG_IFACE} (${WG_ADDR})"
 else
-  echo "WireGuard packages installed. Skipping config (set WG_ADDR, WG_ENDPOINT, WG_PEER_PUBKEY to auto-configure)."
+  echo "WireGuard packages installed. Skipping config (set WG_ADDR, e.g. WG_ADDR=auto, to auto-configure)."
 fi
 
 if command -v systemctl >/dev/null 2>&1; then
@@ -465,10 +821,31 @@ set -euo pipefail
 CONTROL_PLANE_URL="${CONTROL_PLANE_URL:-}"
 NODE_TOKEN="${NODE_TOKEN:-}"
 CONFIG_DIR="${CONFIG_DIR:-/etc/nginx/kokoa}"
-EMAIL="${EMAIL:-}"
+# TOKEN_FILE holds the token once the agent has renewed it; it takes
+# precedence over NODE_TOKEN.
+TOKEN_FILE="${TOKEN_FILE:-${CONFIG_DIR}/node_token}"
 NGINX_BIN="${NGINX_BIN:-nginx}"
 BACKOFF="${BACKOFF:-5}"
 MAX_BACKOFF="${MAX_BACKOFF:-120}"
+# CONFIG_WAIT is how long (seconds) the control plane holds a config request
+# open waiting for a change before answering 304.
+CONFIG_WAIT="${CONFIG_WAIT:-60}"
+# CONFIG_PUBKEY is the control plane's signing key (pinned by install.sh). When
+# set, configs without a valid signature for this edge are rejected.
+CONFIG_PUBKEY="${CONFIG_PUBKEY:-}"
+EDGE_ID="${EDGE_ID:-}"
+# MAX_CONFIG_AGE is how old (seconds) a signed config may be when received.
+MAX_CONFIG_AGE="${MAX_CONFIG_AGE:-300}"
+# WG_SYNC=true hands the WireGuard interface to the agent: the peer set from
+# the control plane (every origin) is written to WG_CONF and applied.
+WG_SYNC="${WG_SYNC:-false}"
+WG_IFACE="${WG_IFACE:-wg0}"
+WG_CONF="${WG_CONF:-/etc/wireguard/${WG_IFACE}.conf}"
+# WG_KEY is the private key the generated config loads; a rotated key waits
+# in WG_KEY.next until the control plane retires the old one.
+WG_KEY="${WG_KEY:-/etc/wireguard/${WG_IFACE}.key}"
+initial_backoff="$BACKOFF"
+AGENT_VERSION="0.3.0"
 
 log() {
   echo "[kokoa-edge] $*"
@@ -483,64 +860,411 @@ fail_if_empty() {
 }
 
 fail_if_empty CONTROL_PLANE_URL "$CONTROL_PLANE_URL"
+if [[ -s "$TOKEN_FILE" ]]; then
+  NODE_TOKEN="$(cat "$TOKEN_FILE")"
+fi
 fail_if_empty NODE_TOKEN "$NODE_TOKEN"
 
+# renew_token replaces NODE_TOKEN when the control plane announces that it
+# is due (X-Kokoa-Token-Renew) and keeps the new token in TOKEN_FILE.
+renew_token() {
+  local resp token
+  if ! resp="$(curl -fsS -X POST -H "Authorization: Bearer ${NODE_TOKEN}" "${CONTROL_PLANE_URL}/api/v1/edge-nodes/me/token")"; then
+    log "failed to renew node token"
+    return 1
+  fi
+  token="$(echo "$resp" | jq -r '.token // ""')"
+  [[ -n "$token" ]] || return 1
+  (umask 077 && echo "$token" > "${TOKEN_FILE}.tmp") && mv "${TOKEN_FILE}.tmp" "$TOKEN_FILE"
+  NODE_TOKEN="$token"
+  log "renewed node token, expires $(echo "$resp" | jq -r '.token_expires_at // "never"')"
+}
+
+# rotate_wireguard_key generates the next WireGuard key and submits its
+# public half. Peers learn it first; the agent switches once the control
+# plane lists it as this edge's key.
+rotate_wireguard_key() {
+  local next="${WG_KEY}.next" body resp
+  if [[ ! -s "$next" ]]; then
+    (umask 077 && wg genkey > "$next")
+  fi
+  body="$(jq -n --arg key "$(wg pubkey < "$next")" '{public_key: $key}')"
+  if ! resp="$(curl -fsS -X POST -H "Authorization: Bearer ${NODE_TOKEN}" -H "Content-Type: application/json" \
+    -d "$body" "${CONTROL_PLANE_URL}/api/v1/edge-nodes/me/wireguard-key")"; then
+    log "failed to submit the new WireGuard key"
+    return 1
+  fi
+  log "WireGuard key rotation $(echo "$resp" | jq -r '.id'): $(echo "$resp" | jq -r '.state'), $(echo "$resp" | jq -r '.pending') peers pending"
+}
+
+if [[ "${1:-}" == "rotate-wireguard-key" ]]; then
+  rotate_wireguard_key
+  exit 0
+fi
+
+# switch_wireguard_key moves to the rotated key once the config names it.
+switch_wireguard_key() {
+  local next="${WG_KEY}.next" want
+  [[ -s "$next" ]] || return 0
+  want="$(echo "$response" | jq -r '.wireguard.public_key // ""')"
+  if [[ -z "$want" || "$want" != "$(wg pubkey < "$next")" ]]; then
+    return 0
+  fi
+  mv "$next" "$WG_KEY"
+  if ! wg set "$WG_IFACE" private-key "$WG_KEY"; then
+    log "failed to load the rotated WireGuard key into ${WG_IFACE}"
+    return 1
+  fi
+  log "switched ${WG_IFACE} to the rotated WireGuard key"
+}
+
+# sync_wireguard writes the rendered WireGuard config when it changed. Peers
+# are synced into the running interface; an address change restarts it.
+# wg_hash is the peers hash of the config in place, reported as applied.
+sync_wireguard() {
+  local conf old_addr new_addr
+  conf="$(echo "$response" | jq -r '.wireguard.wg_quick // ""')"
+  [[ -n "$conf" ]] || return 0
+  if [[ -f "$WG_CONF" && "$(cat "$WG_CONF")" == "$conf" ]]; then
+    wg_hash="$(echo "$response" | jq -r '.wireguard.peers_hash // ""')"
+    switch_wireguard_key
+    return
+  fi
+  old_addr="$(sed -n 's/^Address = //p' "$WG_CONF" 2>/dev/null || true)"
+  (umask 077 && echo "$conf" > "${WG_CONF}.tmp") && mv "${WG_CONF}.tmp" "$WG_CONF"
+  new_addr="$(sed -n 's/^Address = //p' "$WG_CONF")"
+  if ip link show "$WG_IFACE" >/dev/null 2>&1 && [[ "$old_addr" == "$new_addr" ]]; then
+    if ! wg syncconf "$WG_IFACE" <(wg-quick strip "$WG_IFACE"); then
+      log "failed to sync WireGuard peers on ${WG_IFACE}"
+      return 1
+    fi
+  else
+    wg-quick down "$WG_IFACE" >/dev/null 2>&1 || true
+    if ! wg-quick up "$WG_IFACE"; then
+      log "failed to bring up ${WG_IFACE}"
+      return 1
+    fi
+  fi
+  wg_hash="$(echo "$response" | jq -r '.wireguard.peers_hash // ""')"
+  log "applied WireGuard config with $(echo "$response" | jq -r '.wireguard.peers | length') peers"
+  switch_wireguard_key
+}
+
+# ensure_cert creates a short-lived self-signed placeholder so that nginx can
+# load the server block of a hostname whose certificate is not issued yet.
+ensure_cert() {
+  local host="$1" dir
+  dir="${CONFIG_DIR}/certs/${host/#\*./_wildcard.}"
+  [[ -f "${dir}/fullchain.pem" ]] && return 0
+  mkdir -p "$dir"
+  openssl req -x509 -nodes -newkey rsa:2048 -days 7 -subj "/CN=${host}" \
+    -keyout "${dir}/privkey.pem" -out "${dir}/fullchain.pem" >/dev/null 2>&1 \
+    || log "failed to create placeholder certificate for ${host}"
+}
+
+# sync_certs downloads the certificates issued by the control plane into
+# CONFIG_DIR/certs/<dir>/, which the generated server blocks reference. It
+# writes nothing unless the response is for the certificates_hash of the
+# verified config passed as $1 and, with CONFIG_PUBKEY, carries a valid
+# signature for this edge.
+sync_certs() {
+  local want_hash="$1" certs_file certs_headers certs_hash sig edge_id issued_at now msg_file sig_file dir
+  certs_file="$(mktemp)"
+  certs_headers="$(mktemp)"
+  if ! curl -fsS -D "$certs_headers" -o "$certs_file" -H "Authorization: Bearer ${NODE_TOKEN}" \
+    "${CONTROL_PLANE_URL}/api/v1/edge-nodes/me/certificates"; then
+    rm -f "$certs_file" "$certs_headers"
+    return 1
+  fi
+  sig="$(sed -n 's/^[Xx]-[Kk]okoa-[Ss]ignature: *\([^[:space:]]*\).*/\1/p' "$certs_headers")"
+  rm -f "$certs_headers"
+  certs_hash="$(jq -r '.certificates_hash // ""' "$certs_file")"
+  if [[ "$certs_hash" != "$want_hash" ]]; then
+    rm -f "$certs_file"
+    log "rejecting certificates hash=${certs_hash}: the signed config expects ${want_hash}"
+    return 1
+  fi
+  if [[ -n "$CONFIG_PUBKEY" ]]; then
+    edge_id="$(jq -r '.edge_id // ""' "$certs_file")"
+    issued_at="$(jq -r '.issued_at // 0' "$certs_file")"
+    msg_file="$(mktemp)"
+    sig_file="$(mktemp)"
+    printf 'kokoa-certificates-v1\n%s\n%s\n%s\n%s\n' "$edge_id" "$certs_hash" "$issued_at" \
+      "$(sha256sum "$certs_file" | cut -d' ' -f1)" > "$msg_file"
+    if [[ -z "$sig" ]] || ! echo "$sig" | base64 -d > "$sig_file" 2>/dev/null \
+      || ! openssl pkeyutl -verify -pubin -inkey "$CONFIG_PUBKEY" -rawin -in "$msg_file" -sigfile "$sig_file" >/dev/null 2>&1; then
+      rm -f "$certs_file" "$msg_file" "$sig_file"
+      log "rejecting certificates without a valid signature"
+      return 1
+    fi
+    rm -f "$msg_file" "$sig_file"
+    now="$(date +%s)"
+    if [[ "$edge_id" != "$EDGE_ID" ]] || (( issued_at < now - MAX_CONFIG_AGE || issued_at > now + MAX_CONFIG_AGE )); then
+      rm -f "$certs_file"
+      log "rejecting certificates signed for edge ${edge_id} at ${issued_at}"
+      return 1
+    fi
+  fi
+  while IFS= read -r dir; do
+    [[ -n "$dir" ]] || continue
+    mkdir -p "${CONFIG_DIR}/certs/${dir}"
+    (
+      umask 077
+      jq -r --arg d "$dir" '.certificates[] | select(.dir == $d) | .fullchain_pem' "$certs_file" > "${CONFIG_DIR}/certs/${dir}/fullchain.pem.new"
+      jq -r --arg d "$dir" '.certificates[] | select(.dir == $d) | .privkey_pem' "$certs_file" > "${CONFIG_DIR}/certs/${dir}/privkey.pem.new"
+    )
+    mv "${CONFIG_DIR}/certs/${dir}/fullchain.pem.new" "${CONFIG_DIR}/certs/${dir}/fullchain.pem"
+    mv "${CONFIG_DIR}/certs/${dir}/privkey.pem.new" "${CONFIG_DIR}/certs/${dir}/privkey.pem"
+  done < <(jq -r '.certificates[].dir' "$certs_file")
+  rm -f "$certs_file"
+}
+
+# report_status is the heartbeat: it tells the control plane which config is
+# applied and, after a failed apply, why nginx rejected the new one.
+report_status() {
+  local body nginx_version
+  nginx_version="$($NGINX_BIN -v 2>&1 | sed -n 's|.*nginx/\([^ ]*\).*|\1|p' || true)"
+  body="$(jq -n --arg hash "$previous_hash" --arg status "$apply_status" --arg error "$apply_error" \
+    --arg agent "$AGENT_VERSION" --arg nginx "$nginx_version" --argjson uptime "$(( $(date +%s) - started_at ))" --arg wg "$wg_hash" \
+    '{config_hash: $hash, apply_status: $status, apply_error: $error, agent_version: $agent, nginx_version: $nginx, uptime_seconds: $uptime, wireguard_hash: $wg}')"
+  curl -fsS -X POST -H "Authorization: Bearer ${NODE_TOKEN}" -H "Content-Type: application/json" \
+    -d "$body" "${CONTROL_PLANE_URL}/api/v1/edge-nodes/me/status" >/dev/null 2>&1 || log "failed to report status"
+}
+
+# verify_config checks the signature of the config in $body_file and rejects
+# configs for another edge, older than the last one applied (replays and
+# out-of-order responses) or too old to be a fresh response.
+verify_config() {
+  local sig="$1" edge_id config_hash generation issued_at now msg_file sig_file
+  if [[ -z "$CONFIG_PUBKEY" ]]; then
+    return 0
+  fi
+  if [[ -z "$sig" ]]; then
+    log "rejecting unsigned config"
+    return 1
+  fi
+  edge_id="$(jq -r '.edge_id // ""' "$body_file")"
+  config_hash="$(jq -r '.config_hash // ""' "$body_file")"
+  generation="$(jq -r '.generation // 0' "$body_file")"
+  issued_at="$(jq -r '.issued_at // 0' "$body_file")"
+  msg_file="$(mktemp)"
+  sig_file="$(mktemp)"
+  printf 'kokoa-config-v1\n%s\n%s\n%s\n%s\n%s\n' "$edge_id" "$config_hash" "$generation" "$issued_at" \
+    "$(sha256sum "$body_file" | cut -d' ' -f1)" > "$msg_file"
+  if ! echo "$sig" | base64 -d > "$sig_file" 2>/dev/null \
+    || ! openssl pkeyutl -verify -pubin -inkey "$CONFIG_PUBKEY" -rawin -in "$msg_file" -sigfile "$sig_file" >/dev/null 2>&1; then
+    rm -f "$msg_file" "$sig_file"
+    log "rejecting config with an invalid signature"
+    return 1
+  fi
+  rm -f "$msg_file" "$sig_file"
+  if [[ -z "$EDGE_ID" ]]; then
+    # Installs that predate EDGE_ID pin the first verified edge id.
+    EDGE_ID="$edge_id"
+    echo "$EDGE_ID" > "${CONFIG_DIR}/edge_id"
+  fi
+  now="$(date +%s)"
+  if [[ "$edge_id" != "$EDGE_ID" ]]; then
+    log "rejecting config signed for edge ${edge_id}"
+    return 1
+  fi
+  if (( generation < last_generation || issued_at < last_issued_at )); then
+    log "rejecting config generation ${generation} issued at ${issued_at}: older than the last one received"
+    return 1
+  fi
+  if (( issued_at < now - MAX_CONFIG_AGE || issued_at > now + MAX_CONFIG_AGE )); then
+    log "rejecting config issued at ${issued_at}: outside ${MAX_CONFIG_AGE}s of the local clock"
+    return 1
+  fi
+  last_generation="$generation"
+  last_issued_at="$issued_at"
+  echo "${last_generation} ${last_issued_at}" > "${CONFIG_DIR}/config_generation"
+}
+
 mkdir -p "$CONFIG_DIR"
 
+started_at="$(date +%s)"
+wg_hash=""
 previous_hash=""
+apply_status=""
+apply_error=""
 if [[ -f "$CONFIG_DIR/config_hash" ]]; then
   previous_hash="$(cat "$CONFIG_DIR/config_hash")"
+  apply_status="applied"
+fi
+if [[ -z "$EDGE_ID" && -f "$CONFIG_DIR/edge_id" ]]; then
+  EDGE_ID="$(cat "$CONFIG_DIR/edge_id")"
 fi
+last_generation=0
+last_issued_at=0
+if [[ -f "$CONFIG_DIR/config_generation" ]]; then
+  read -r last_generation last_issued_at < "$CONFIG_DIR/config_generation" || true
+fi
+previous_certs_hash=""
+if [[ -f "$CONFIG_DIR/certificates_hash" ]]; then
+  previous_certs_hash="$(cat "$CONFIG_DIR/certificates_hash")"
+fi
+
+# etag is the version of the last config handled. Once known, requests long
+# poll: the control plane answers when the config changes or with 304 after
+# CONFIG_WAIT seconds.
+etag=""
+headers_file="$(mktemp)"
+body_file="$(mktemp)"
+trap 'rm -f "$headers_file" "$body_file"' EXIT
 
 while true; do
-  tmp_map="$(mktemp)"
-  response="$(curl -fsS -H "Authorization: Bearer ${NODE_TOKEN}" "${CONTROL_PLANE_URL}/api/v1/edge-nodes/me/config" || true)"
-  if [[ -z "$response" ]]; then
-    log "failed to fetch config, backing off ${BACKOFF}s"
+  url="${CONTROL_PLANE_URL}/api/v1/edge-nodes/me/config"
+  if [[ -n "$etag" ]]; then
+    url="${url}?wait=${CONFIG_WAIT}s&since=${etag}"
+  fi
+  : > "$body_file"
+  status_code="$(curl -sS --max-time $(( CONFIG_WAIT + 30 )) -D "$headers_file" -o "$body_file" -w '%{http_code}' \
+    -H "Authorization: Bearer ${NODE_TOKEN}" ${etag:+-H "If-None-Match: \"${etag}\""} "$url" || true)"
+  response="$(cat "$body_file")"
+  if grep -qi '^x-kokoa-token-renew: *true' "$headers_file"; then
+    renew_token || true
+  fi
+  if [[ "$status_code" == "401" ]]; then
+    log "node token was rejected (revoked or expired); install a new token or TOKEN_FILE"
+  fi
+  if [[ "$status_code" == "403" ]]; then
+    log "edge is waiting for approval on the control plane"
+  fi
+  if [[ "$status_code" == "304" ]]; then
+    BACKOFF="$initial_backoff"
+    report_status
+    continue
+  fi
+  if [[ "$status_code" != "200" || -z "$response" ]]; then
+    log "failed to fetch config (status ${status_code:-none}), backing off ${BACKOFF}s"
     sleep "$BACKOFF"
     BACKOFF=$(( BACKOFF * 2 ))
     if (( BACKOFF > MAX_BACKOFF )); then BACKOFF="$MAX_BACKOFF"; fi
     continue
   fi
-  BACKOFF="${BACKOFF:-5}"
+  BACKOFF="$initial_backoff"
+  new_etag="$(sed -n 's/^[Ee][Tt][Aa][Gg]: *"\([^"]*\)".*/\1/p' "$headers_file")"
+  signature="$(sed -n 's/^[Xx]-[Kk]okoa-[Ss]ignature: *\([^[:space:]]*\).*/\1/p' "$headers_file")"
+  if ! verify_config "$signature"; then
+    apply_status="failed"
+    apply_error="rejected config: signature or freshness check failed"
+    report_status
+    sleep "$BACKOFF"
+    continue
+  fi
+
+  certs_hash="$(echo "$response" | jq -r '.certificates_hash // ""')"
+  certs_changed=0
+  if [[ -n "$certs_hash" && "$certs_hash" != "$previous_certs_hash" ]]; then
+    if sync_certs "$certs_hash"; then
+      previous_certs_hash="$certs_hash"
+      echo "$certs_hash" > "${CONFIG_DIR}/certificates_hash"
+      certs_changed=1
+    else
+      # Leave etag alone so the next request returns the config again.
+      log "failed to sync certificates, retrying in 30s"
+      sleep 30
+      continue
+    fi
+  fi
+
+  if [[ "$WG_SYNC" == "true" ]]; then
+    sync_wireguard || true
+  fi
 
   config_hash="$(echo "$response" | jq -r '.config_hash')"
   if [[ -n "$previous_hash" && "$config_hash" == "$previous_hash" ]]; then
-    sleep 30
+    if (( certs_changed )); then
+      log "applied new certificates hash=${certs_hash}"
+      if [[ "$NGINX_BIN" != "true" ]]; then
+        $NGINX_BIN -s reload >/dev/null 2>&1 || true
+      fi
+    fi
+    report_status
+    etag="$new_etag"
     continue
   fi
 
-  echo "$response" | jq -r '.nginx_map' > "$tmp_map"
-  if [[ "$NGINX_BIN" != "true" ]]; then
-    if ! $NGINX_BIN -t >/dev/null 2>&1; then
-      log "nginx config test failed, keeping previous config"
-      rm -f "$tmp_map"
-      sleep 30
-      continue
+  tmp_dir="$(mktemp -d)"
+  echo "$response" | jq -r '.nginx_map' > "${tmp_dir}/map.conf"
+  echo "$response" | jq -r '.upstreams // ""' > "${tmp_dir}/upstreams.conf"
+  # kokoa.conf is the complete include (upstreams + server blocks); the
+  # files above remain for setups with hand-written server blocks.
+  echo "$response" | jq -r '.nginx_conf // ""' > "${tmp_dir}/kokoa.conf"
+  # Per-hostname location blocks; include them from the host's server block.
+  mkdir -p "${tmp_dir}/locations"
+  while IFS= read -r host; do
+    [[ -n "$host" ]] || continue
+    echo "$response" | jq -r --arg h "$host" '.locations[$h]' > "${tmp_dir}/locations/${host}.conf"
+  done < <(echo "$response" | jq -r '.locations // {} | keys[]')
+  while IFS= read -r host; do
+    [[ -n "$host" ]] || continue
+    ensure_cert "$host"
+  done < <(echo "$response" | jq -r '.hostnames // [] | .[]')
+
+  # Swap the new files in and validate them; nginx -t only sees files in
+  # place. On failure the previous files are restored.
+  backup_dir="$(mktemp -d)"
+  for f in map.conf upstreams.conf kokoa.conf locations; do
+    if [[ -e "${CONFIG_DIR}/${f}" ]]; then
+      mv "${CONFIG_DIR}/${f}" "${backup_dir}/${f}"
     fi
+    mv "${tmp_dir}/${f}" "${CONFIG_DIR}/${f}"
+  done
+  rm -rf "$tmp_dir"
+  if ! test_output="$([[ "$NGINX_BIN" == "true" ]] || $NGINX_BIN -t 2>&1)"; then
+    log "nginx config test failed, keeping previous config"
+    for f in map.conf upstreams.conf kokoa.conf locations; do
+      rm -rf "${CONFIG_DIR:?}/${f}"
+      if [[ -e "${backup_dir}/${f}" ]]; then
+        mv "${backup_dir}/${f}" "${CONFIG_DIR}/${f}"
+      fi
+    done
+    rm -rf "$backup_dir"
+    apply_status="failed"
+    apply_error="config ${config_hash}: ${test_output}"
+    report_status
+    # Wait for the next change rather than retrying a config nginx rejected.
+    etag="$new_etag"
+    continue
   fi
+  rm -rf "$backup_dir"
 
-  mv "$tmp_map" "${CONFIG_DIR}/map.conf"
   echo "$config_hash" > "${CONFIG_DIR}/config_hash"
+  previous_hash="$config_hash"
+  apply_status="applied"
+  apply_error=""
   log "applied new config hash=${config_hash}"
   if [[ "$NGINX_BIN" != "true" ]]; then
     $NGINX_BIN -s reload >/dev/null 2>&1 || true
   fi
-
-  # TLS retrieval is left as a TODO placeholder for certbot integration.
-  sleep 30
+  report_status
+  etag="$new_etag"
 done
 `
 
 const originInstallScript = `#!/usr/bin/env bash
 set -euo pipefail
 
+# With JOIN_TOKEN (an origin join token from POST /api/v1/join-tokens) the
+# origin registers itself and gets its tunnel address from the control plane.
+# Without it, WG_ADDR is configured as given.
+CONTROL_PLANE_URL="${CONTROL_PLANE_URL:-%s}"
+JOIN_TOKEN="${JOIN_TOKEN:-}"
+ORIGIN_NAME="${ORIGIN_NAME:-$(hostname)}"
+# WG_ENDPOINT is the host:port edges reach this origin at.
+WG_ENDPOINT="${WG_ENDPOINT:-}"
 WG_IFACE="${WG_IFACE:-wg0}"
 WG_PORT="${WG_PORT:-51820}"
 WG_ADDR="${WG_ADDR:-10.20.0.1/24}"
 
 while [[ $# -gt 0 ]]; do
   case "$1" in
+    --control-plane) CONTROL_PLANE_URL="$2"; shift 2;;
+    --join-token) JOIN_TOKEN="$2"; shift 2;;
+    --name) ORIGIN_NAME="$2"; shift 2;;
+    --endpoint) WG_ENDPOINT="$2"; shift 2;;
     --iface) WG_IFACE="$2"; shift 2;;
     --port) WG_PORT="$2"; shift 2;;
     --addr) WG_ADDR="$2"; shift 2;;
@@ -555,10 +1279,114 @@ if [[ $EUID -ne 0 ]]; then
 fi
 
 apt-get update -y
-apt-get install -y wireguard qrencode
+apt-get install -y wireguard qrencode curl jq
 
 umask 077
 wg genkey | tee /etc/wireguard/privatekey | wg pubkey > /etc/wireguard/publickey
+# Generated configs load the key from /etc/wireguard/<iface>.key.
+cp /etc/wireguard/privatekey /etc/wireguard/${WG_IFACE}.key
+
+if [[ -n "$JOIN_TOKEN" ]]; then
+  if [[ -z "$WG_ENDPOINT" ]]; then
+    echo "WG_ENDPOINT is not set; edges cannot reach this origin until its wireguard_endpoint is set." >&2
+  fi
+  resp=$(curl -fsSL -X POST "${CONTROL_PLANE_URL}/api/v1/origins/register" \
+    -H "Authorization: Bearer ${JOIN_TOKEN}" \
+    -H "Content-Type: application/json" \
+    -d "$(jq -n --arg name "$ORIGIN_NAME" --arg key "$(cat /etc/wireguard/publickey)" --arg endpoint "$WG_ENDPOINT" \
+      '{name: $name, wireguard_public_key: $key} + (if $endpoint == "" then {} else {wireguard_endpoint: $endpoint} end)')")
+  ORIGIN_ID=$(echo "$resp" | jq -r '.origin_id')
+  ORIGIN_TOKEN=$(echo "$resp" | jq -r '.token')
+  WG_IP=$(echo "$resp" | jq -r '.wg_ip')
+
+  cat >/etc/kokoa-origin.env <<EOF
+CONTROL_PLANE_URL=${CONTROL_PLANE_URL}
+ORIGIN_ID=${ORIGIN_ID}
+ORIGIN_TOKEN=${ORIGIN_TOKEN}
+WG_IFACE=${WG_IFACE}
+EOF
+  chmod 600 /etc/kokoa-origin.env
+
+  # The agent sends a heartbeat and keeps the WireGuard peers (every edge)
+  # in sync with the control plane.
+  cat >/usr/local/bin/kokoa-origin-agent.sh <<'EOF'
+#!/usr/bin/env bash
+set -euo pipefail
+conf="/etc/wireguard/${WG_IFACE}.conf"
+key="/etc/wireguard/${WG_IFACE}.key"
+auth="Authorization: Bearer ${ORIGIN_TOKEN}"
+
+# "kokoa-origin-agent.sh rotate-key" submits a new WireGuard key. Edges learn
+# it first; the agent switches once the control plane retired the old key.
+if [[ "${1:-}" == "rotate-key" ]]; then
+  [[ -s "${key}.next" ]] || (umask 077 && wg genkey > "${key}.next")
+  curl -fsS -X POST -H "$auth" -H "Content-Type: application/json" \
+    -d "{\"public_key\":\"$(wg pubkey < "${key}.next")\"}" "${CONTROL_PLANE_URL}/api/v1/origins/me/wireguard-key"
+  echo
+  exit 0
+fi
+
+tmp="$(mktemp)"
+headers="$(mktemp)"
+trap 'rm -f "$tmp" "$headers"' EXIT
+wg_hash=""
+if curl -fsS -D "$headers" -H "$auth" "${CONTROL_PLANE_URL}/api/v1/origins/me/wireguard?format=wg-quick" -o "$tmp" && [[ -s "$tmp" ]]; then
+  if ! cmp -s "$tmp" "$conf"; then
+    old_addr="$(sed -n 's/^Address = //p' "$conf" 2>/dev/null || true)"
+    install -m 600 "$tmp" "$conf"
+    if ip link show "$WG_IFACE" >/dev/null 2>&1 && [[ "$old_addr" == "$(sed -n 's/^Address = //p' "$conf")" ]]; then
+      wg syncconf "$WG_IFACE" <(wg-quick strip "$WG_IFACE")
+    else
+      systemctl restart "wg-quick@${WG_IFACE}"
+    fi
+    echo "applied WireGuard config with $(grep -c '^\[Peer\]' "$conf" || true) peers"
+  fi
+  if [[ -s "${key}.next" ]] && grep -qxF "# PublicKey = $(wg pubkey < "${key}.next")" "$conf"; then
+    mv "${key}.next" "$key"
+    wg set "$WG_IFACE" private-key "$key"
+    echo "switched ${WG_IFACE} to the rotated WireGuard key"
+  fi
+  # The ETag is the peers hash; reporting it tells key rotations this
+  # origin runs the current peers.
+  wg_hash="$(sed -n 's/^[Ee][Tt][Aa][Gg]: *"\([^"]*\)".*/\1/p' "$headers")"
+fi
+curl -fsS -X POST -H "$auth" -H "Content-Type: application/json" \
+  -d "{\"wireguard_hash\":\"${wg_hash}\"}" "${CONTROL_PLANE_URL}/api/v1/origins/me/heartbeat" || true
+EOF
+  chmod +x /usr/local/bin/kokoa-origin-agent.sh
+
+  cat >/etc/systemd/system/kokoa-origin-agent.service <<'EOF'
+[Unit]
+Description=kokoa origin agent (heartbeat and WireGuard peers)
+After=network-online.target
+
+[Service]
+Type=oneshot
+EnvironmentFile=/etc/kokoa-origin.env
+ExecStart=/usr/local/bin/kokoa-origin-agent.sh
+EOF
+
+  cat >/etc/systemd/system/kokoa-origin-agent.timer <<'EOF'
+[Unit]
+Description=Run the kokoa origin agent every minute
+
+[Timer]
+OnBootSec=30s
+OnUnitActiveSec=60s
+
+[Install]
+WantedBy=timers.target
+EOF
+  set -a
+  . /etc/kokoa-origin.env
+  set +a
+  /usr/local/bin/kokoa-origin-agent.sh
+  systemctl daemon-reload
+  systemctl enable wg-quick@${WG_IFACE}
+  systemctl enable --now kokoa-origin-agent.timer
+  echo "registered origin ${ORIGIN_NAME} (${ORIGIN_ID}) with tunnel address ${WG_IP}"
+  exit 0
+fi
 
 cat >/etc/wireguard/${WG_IFACE}.conf <<EOF
 [Interface]
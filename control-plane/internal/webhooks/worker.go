@@ -0,0 +1,329 @@
+// Package webhooks delivers events to the webhook subscriptions stored in the
+// database, retrying failed deliveries with exponential backoff.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+	"github.com/neo/kokoa-proxy/control-plane/internal/events"
+)
+
+const (
+	// MaxAttempts is how often a delivery is tried before it is given up.
+	MaxAttempts = 8
+
+	// DeliveryRetention is how long finished deliveries stay in the log.
+	DeliveryRetention = 7 * 24 * time.Hour
+
+	minRetryDelay = 10 * time.Second
+	maxRetryDelay = time.Hour
+	pollInterval  = 5 * time.Second
+	pruneInterval = time.Hour
+	batchSize     = 50
+	// maxSenders is how many webhooks are sent to at the same time.
+	maxSenders = 8
+)
+
+// Worker turns published events into deliveries and sends them. Each webhook
+// is sent to by one goroutine at a time, so a slow receiver only delays its
+// own deliveries.
+type Worker struct {
+	store  *db.Store
+	bus    *events.Bus
+	client *http.Client
+	logger *log.Logger
+	now    func() time.Time
+
+	senders chan struct{}
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	// sending holds the webhooks with a running sender.
+	sending map[string]bool
+}
+
+func NewWorker(store *db.Store, bus *events.Bus, logger *log.Logger) *Worker {
+	return &Worker{
+		store:   store,
+		bus:     bus,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		logger:  logger,
+		now:     time.Now,
+		senders: make(chan struct{}, maxSenders),
+		sending: map[string]bool{},
+	}
+}
+
+// Run delivers events until ctx is done. Events published while the worker
+// was not subscribed, e.g. after it fell behind, are read back from the event
+// log.
+func (w *Worker) Run(ctx context.Context) {
+	defer w.wg.Wait()
+	var lastID int64
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	prune := time.NewTicker(pruneInterval)
+	defer prune.Stop()
+	w.prune(ctx)
+	for {
+		sub := w.bus.Subscribe()
+		if lastID > 0 {
+			backlog, _, err := w.store.EventsAfter(ctx, lastID)
+			if err != nil {
+				w.logger.Printf("webhooks: read event log: %v", err)
+			}
+			for _, ev := range backlog {
+				w.enqueue(ctx, ev)
+				lastID = ev.ID
+			}
+			w.deliverDue(ctx)
+		}
+	receive:
+		for {
+			select {
+			case <-ctx.Done():
+				sub.Close()
+				return
+			case ev, ok := <-sub.Events():
+				if !ok {
+					break receive
+				}
+				if ev.ID <= lastID {
+					continue
+				}
+				w.enqueue(ctx, ev)
+				lastID = ev.ID
+				w.deliverDue(ctx)
+			case <-ticker.C:
+				w.deliverDue(ctx)
+			case <-prune.C:
+				w.prune(ctx)
+			}
+		}
+	}
+}
+
+// payload is the JSON body posted to receivers. Text makes the body usable
+// as-is by Slack and Mattermost incoming webhooks.
+type payload struct {
+	Text  string       `json:"text"`
+	Event eventPayload `json:"event"`
+}
+
+type eventPayload struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// enqueue queues ev for every webhook subscribed to its type.
+func (w *Worker) enqueue(ctx context.Context, ev db.Event) {
+	hooks, err := w.store.ListWebhooks(ctx)
+	if err != nil {
+		w.logger.Printf("webhooks: list webhooks: %v", err)
+		return
+	}
+	var body []byte
+	for _, hook := range hooks {
+		if !Matches(hook.Events, ev.Type) {
+			continue
+		}
+		if body == nil {
+			body, err = json.Marshal(payload{
+				Text:  summary(ev),
+				Event: eventPayload{ID: ev.ID, Type: ev.Type, CreatedAt: ev.CreatedAt, Data: ev.Data},
+			})
+			if err != nil {
+				w.logger.Printf("webhooks: encode event %d: %v", ev.ID, err)
+				return
+			}
+		}
+		if err := w.store.EnqueueWebhookDelivery(ctx, hook.ID, ev, string(body), w.now()); err != nil {
+			w.logger.Printf("webhooks: %v", err)
+		}
+	}
+}
+
+// deliverDue starts a sender for every webhook that has none running. It
+// does not wait for them to finish.
+func (w *Worker) deliverDue(ctx context.Context) {
+	hooks, err := w.store.ListWebhooks(ctx)
+	if err != nil {
+		w.logger.Printf("webhooks: list webhooks: %v", err)
+		return
+	}
+	for _, hook := range hooks {
+		w.mu.Lock()
+		if w.sending[hook.ID] {
+			w.mu.Unlock()
+			continue
+		}
+		w.sending[hook.ID] = true
+		w.mu.Unlock()
+		w.wg.Add(1)
+		go func(id string) {
+			defer w.wg.Done()
+			defer func() {
+				w.mu.Lock()
+				delete(w.sending, id)
+				w.mu.Unlock()
+			}()
+			select {
+			case w.senders <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-w.senders }()
+			w.deliverWebhook(ctx, id)
+		}(hook.ID)
+	}
+}
+
+// deliverWebhook sends the due deliveries of one webhook in order. It stops
+// at the first failed attempt: the receiver is likely down, and the rest are
+// tried again on the next poll.
+func (w *Worker) deliverWebhook(ctx context.Context, webhookID string) {
+	for {
+		due, err := w.store.DueWebhookDeliveries(ctx, webhookID, w.now(), batchSize)
+		if err != nil {
+			w.logger.Printf("webhooks: %v", err)
+			return
+		}
+		for _, d := range due {
+			if ctx.Err() != nil {
+				return
+			}
+			attempt := w.send(ctx, d)
+			if err := w.store.RecordWebhookAttempt(ctx, d.ID, attempt); err != nil {
+				w.logger.Printf("webhooks: %v", err)
+				return
+			}
+			if !attempt.Delivered {
+				return
+			}
+		}
+		if len(due) < batchSize {
+			return
+		}
+	}
+}
+
+// prune drops finished deliveries older than DeliveryRetention.
+func (w *Worker) prune(ctx context.Context) {
+	if _, err := w.store.PruneWebhookDeliveries(ctx, w.now().Add(-DeliveryRetention)); err != nil {
+		w.logger.Printf("webhooks: %v", err)
+	}
+}
+
+func (w *Worker) send(ctx context.Context, d db.WebhookDelivery) db.WebhookAttempt {
+	now := w.now()
+	attempt := db.WebhookAttempt{At: now}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader([]byte(d.Payload)))
+	if err == nil {
+		timestamp := strconv.FormatInt(now.Unix(), 10)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "kokoa-proxy-webhooks")
+		req.Header.Set("X-Kokoa-Event", d.EventType)
+		req.Header.Set("X-Kokoa-Delivery", strconv.FormatInt(d.ID, 10))
+		req.Header.Set("X-Kokoa-Timestamp", timestamp)
+		req.Header.Set("X-Kokoa-Signature", "sha256="+Sign(d.Secret, timestamp, []byte(d.Payload)))
+		var resp *http.Response
+		resp, err = w.client.Do(req)
+		if err == nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+			attempt.StatusCode = resp.StatusCode
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				attempt.Delivered = true
+				return attempt
+			}
+			err = fmt.Errorf("receiver responded %s", resp.Status)
+		}
+	}
+	attempt.Error = err.Error()
+	if d.Attempts+1 < MaxAttempts {
+		attempt.NextAttemptAt = now.Add(retryDelay(d.Attempts + 1))
+	}
+	return attempt
+}
+
+// Sign returns the hex HMAC-SHA256 of "<timestamp>.<body>" that receivers
+// compare against X-Kokoa-Signature. Covering the timestamp lets them reject
+// replayed deliveries.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryDelay doubles from minRetryDelay after every failed attempt, up to
+// maxRetryDelay.
+func retryDelay(failures int) time.Duration {
+	d := minRetryDelay
+	for i := 1; i < failures && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	return min(d, maxRetryDelay)
+}
+
+// Matches reports whether an event type is selected by patterns. A pattern is
+// an event type or a glob such as "edge.*"; no patterns select everything.
+func Matches(patterns []string, eventType string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, eventType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidPattern reports whether p is a well-formed event pattern.
+func ValidPattern(p string) bool {
+	_, err := path.Match(p, "")
+	return p != "" && err == nil
+}
+
+// summary is a one-line description of ev for chat receivers.
+func summary(ev db.Event) string {
+	// Payloads are v2 resources or event-specific maps, both snake_case.
+	var data struct {
+		ID         string `json:"id"`
+		Name       string `json:"name"`
+		Hostname   string `json:"hostname"`
+		ConfigHash string `json:"config_hash"`
+		ApplyError string `json:"apply_error"`
+	}
+	_ = json.Unmarshal(ev.Data, &data)
+	subject := data.Hostname
+	for _, v := range []string{data.Name, data.ConfigHash, data.ID} {
+		if subject == "" {
+			subject = v
+		}
+	}
+	text := "[kokoa-proxy] " + ev.Type
+	if subject != "" {
+		text += ": " + subject
+	}
+	if data.ApplyError != "" {
+		text += " (" + data.ApplyError + ")"
+	}
+	return text
+}
@@ -0,0 +1,282 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/neo/kokoa-proxy/control-plane/internal/db"
+	"github.com/neo/kokoa-proxy/control-plane/internal/events"
+)
+
+type receiver struct {
+	mu       sync.Mutex
+	failures int
+	bodies   []payload
+	verified []bool
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.failures > 0 {
+		rc.failures--
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	var p payload
+	_ = json.Unmarshal(body, &p)
+	rc.bodies = append(rc.bodies, p)
+	want := "sha256=" + Sign("s3cret", r.Header.Get("X-Kokoa-Timestamp"), body)
+	rc.verified = append(rc.verified, r.Header.Get("X-Kokoa-Signature") == want)
+}
+
+func newTestWorker(t *testing.T) (*Worker, *db.Store, *events.Bus) {
+	t.Helper()
+	store, err := db.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	bus := events.NewBus(store)
+	return NewWorker(store, bus, log.New(io.Discard, "", 0)), store, bus
+}
+
+func TestDeliveryRetriesWithBackoff(t *testing.T) {
+	rc := &receiver{failures: 2}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+	w, store, bus := newTestWorker(t)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	w.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	hook, err := store.CreateWebhook(ctx, db.CreateWebhookParams{Name: "ops", URL: ts.URL, Events: []string{"route.created", "edge.*"}, Secret: "s3cret"})
+	if err != nil {
+		t.Fatalf("create webhook: %v", err)
+	}
+	for _, typ := range []string{events.RouteCreated, events.OriginCreated} {
+		ev, err := bus.Publish(ctx, typ, "app.example.com", map[string]string{"hostname": "app.example.com"})
+		if err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+		w.enqueue(ctx, ev)
+	}
+
+	w.deliverDue(ctx)
+	w.wg.Wait()
+	deliveries, err := store.ListWebhookDeliveries(ctx, hook.ID, 10)
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("expected one filtered delivery, got %+v (%v)", deliveries, err)
+	}
+	d := deliveries[0]
+	if d.Status != db.DeliveryPending || d.Attempts != 1 || d.LastStatusCode.Int64 != http.StatusBadGateway || !d.NextAttemptAt.Time.Equal(now.Add(minRetryDelay)) {
+		t.Fatalf("unexpected delivery after first failure: %+v", d)
+	}
+
+	// Not due yet, then due after the first backoff; the second retry waits twice as long.
+	w.deliverDue(ctx)
+	w.wg.Wait()
+	now = now.Add(minRetryDelay)
+	w.deliverDue(ctx)
+	w.wg.Wait()
+	deliveries, _ = store.ListWebhookDeliveries(ctx, hook.ID, 10)
+	if d := deliveries[0]; d.Attempts != 2 || !d.NextAttemptAt.Time.Equal(now.Add(2*minRetryDelay)) {
+		t.Fatalf("unexpected delivery after second failure: %+v", d)
+	}
+	now = now.Add(2 * minRetryDelay)
+	w.deliverDue(ctx)
+	w.wg.Wait()
+	deliveries, _ = store.ListWebhookDeliveries(ctx, hook.ID, 10)
+	if d := deliveries[0]; d.Status != db.DeliveryDelivered || d.Attempts != 3 || !d.DeliveredAt.Valid {
+		t.Fatalf("expected delivery to succeed: %+v", d)
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if len(rc.bodies) != 1 || !rc.verified[0] {
+		t.Fatalf("expected one signed delivery, got %+v %v", rc.bodies, rc.verified)
+	}
+	if p := rc.bodies[0]; p.Event.Type != events.RouteCreated || p.Text != "[kokoa-proxy] route.created: app.example.com" {
+		t.Fatalf("unexpected payload: %+v", p)
+	}
+}
+
+func TestDeliveryGivesUp(t *testing.T) {
+	rc := &receiver{failures: MaxAttempts}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+	w, store, bus := newTestWorker(t)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	w.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	hook, err := store.CreateWebhook(ctx, db.CreateWebhookParams{Name: "ops", URL: ts.URL, Secret: "s3cret"})
+	if err != nil {
+		t.Fatalf("create webhook: %v", err)
+	}
+	ev, err := bus.Publish(ctx, events.EdgeApplyFailed, "", map[string]string{"name": "edge1", "apply_error": "nginx: [emerg]"})
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	w.enqueue(ctx, ev)
+	for i := 0; i < MaxAttempts; i++ {
+		w.deliverDue(ctx)
+		w.wg.Wait()
+		now = now.Add(maxRetryDelay)
+	}
+	deliveries, _ := store.ListWebhookDeliveries(ctx, hook.ID, 10)
+	if d := deliveries[0]; d.Status != db.DeliveryFailed || d.Attempts != MaxAttempts || d.NextAttemptAt.Valid {
+		t.Fatalf("expected delivery to be given up: %+v", d)
+	}
+	if got := retryDelay(100); got != maxRetryDelay {
+		t.Fatalf("retry delay should be capped, got %s", got)
+	}
+}
+
+func TestSlowReceiverDoesNotDelayOthers(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	rc := &receiver{}
+	fast := httptest.NewServer(rc)
+	defer fast.Close()
+	w, store, bus := newTestWorker(t)
+	ctx := context.Background()
+
+	for _, url := range []string{fast.URL, slow.URL} {
+		if _, err := store.CreateWebhook(ctx, db.CreateWebhookParams{Name: "hook", URL: url, Secret: "s3cret"}); err != nil {
+			t.Fatalf("create webhook: %v", err)
+		}
+	}
+	ev, err := bus.Publish(ctx, events.EdgeStale, "", map[string]string{"name": "edge1"})
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	w.enqueue(ctx, ev)
+	w.deliverDue(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rc.mu.Lock()
+		n := len(rc.bodies)
+		rc.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("delivery to the fast receiver waited for the slow one")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPruneKeepsPendingDeliveries(t *testing.T) {
+	w, store, bus := newTestWorker(t)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	w.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	hook, err := store.CreateWebhook(ctx, db.CreateWebhookParams{Name: "ops", URL: "http://127.0.0.1:1", Secret: "s3cret"})
+	if err != nil {
+		t.Fatalf("create webhook: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		ev, err := bus.Publish(ctx, events.EdgeStale, "", map[string]string{"name": "edge1"})
+		if err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+		w.enqueue(ctx, ev)
+	}
+	due, err := store.DueWebhookDeliveries(ctx, hook.ID, now, 10)
+	if err != nil || len(due) != 3 {
+		t.Fatalf("due deliveries: %d (%v)", len(due), err)
+	}
+	for i, attempt := range []db.WebhookAttempt{{Delivered: true, At: now}, {Error: "gone", At: now}} {
+		if err := store.RecordWebhookAttempt(ctx, due[i].ID, attempt); err != nil {
+			t.Fatalf("record attempt: %v", err)
+		}
+	}
+
+	w.prune(ctx)
+	if got, _ := store.ListWebhookDeliveries(ctx, hook.ID, 10); len(got) != 3 {
+		t.Fatalf("recent deliveries were pruned: %+v", got)
+	}
+	now = now.Add(DeliveryRetention + time.Minute)
+	w.prune(ctx)
+	got, _ := store.ListWebhookDeliveries(ctx, hook.ID, 10)
+	if len(got) != 1 || got[0].ID != due[2].ID || got[0].Status != db.DeliveryPending {
+		t.Fatalf("expected only the pending delivery to remain: %+v", got)
+	}
+}
+
+func TestRunDeliversPublishedEvents(t *testing.T) {
+	rc := &receiver{}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+	w, store, bus := newTestWorker(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := store.CreateWebhook(ctx, db.CreateWebhookParams{Name: "ops", URL: ts.URL, Events: []string{"edge.stale"}, Secret: "s3cret"}); err != nil {
+		t.Fatalf("create webhook: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		// Publish until the worker has subscribed and delivered.
+		if _, err := bus.Publish(ctx, events.EdgeStale, "", map[string]string{"name": "edge1"}); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		rc.mu.Lock()
+		n := len(rc.bodies)
+		rc.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("event was not delivered")
+		}
+	}
+	cancel()
+	<-done
+}
+
+func TestMatches(t *testing.T) {
+	cases := []struct {
+		patterns []string
+		typ      string
+		want     bool
+	}{
+		{nil, "route.created", true},
+		{[]string{"route.created"}, "route.created", true},
+		{[]string{"route.created"}, "route.deleted", false},
+		{[]string{"edge.*"}, "edge.stale", true},
+		{[]string{"edge.*"}, "config.generated", false},
+		{[]string{"*"}, "config.generated", true},
+	}
+	for _, c := range cases {
+		if got := Matches(c.patterns, c.typ); got != c.want {
+			t.Errorf("Matches(%v, %q) = %v, want %v", c.patterns, c.typ, got, c.want)
+		}
+	}
+}
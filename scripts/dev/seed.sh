@@ -2,7 +2,7 @@
 set -euo pipefail
 
 BASE_URL="${BASE_URL:-http://localhost:8080}"
-BOOT_TOKEN="${BOOT_TOKEN:-changeme-bootstrap-token}"
+ADMIN_KEY="${ADMIN_KEY:-changeme-admin-key}"
 
 require() {
   local name="$1" value="$2"
@@ -12,25 +12,34 @@ require() {
   fi
 }
 
-require "BOOT_TOKEN" "$BOOT_TOKEN"
+require "ADMIN_KEY" "$ADMIN_KEY"
+
+echo "creating join token..."
+join_resp="$(curl -fsS -X POST "${BASE_URL}/api/v2/join-tokens" \
+  -H "X-API-Key: ${ADMIN_KEY}" \
+  -H "Content-Type: application/json" \
+  -d '{"description":"seed","ttl_seconds":600}')"
+join_token="$(echo "$join_resp" | python -c "import sys, json; print(json.load(sys.stdin)['token'])")"
 
 echo "registering edge..."
 edge_resp="$(curl -fsS -X POST "${BASE_URL}/api/v1/edge-nodes/register" \
-  -H "Authorization: Bearer ${BOOT_TOKEN}" \
+  -H "Authorization: Bearer ${join_token}" \
   -H "Content-Type: application/json" \
   -d '{"name":"edge-seed"}')"
 echo "edge response: $edge_resp"
 node_token="$(echo "$edge_resp" | python -c "import sys, json; print(json.load(sys.stdin)['token'])")"
 
 echo "creating origin..."
-origin_resp="$(curl -fsS -X POST "${BASE_URL}/api/v1/origins" \
+origin_resp="$(curl -fsS -X POST "${BASE_URL}/api/v2/origins" \
+  -H "X-API-Key: ${ADMIN_KEY}" \
   -H "Content-Type: application/json" \
   -d '{"name":"origin-seed","wg_ip":"10.0.0.2"}')"
 echo "origin response: $origin_resp"
-origin_id="$(echo "$origin_resp" | python -c "import sys, json; print(json.load(sys.stdin)['ID'])")"
+origin_id="$(echo "$origin_resp" | python -c "import sys, json; print(json.load(sys.stdin)['id'])")"
 
 echo "creating route..."
-route_resp="$(curl -fsS -X POST "${BASE_URL}/api/v1/routes" \
+route_resp="$(curl -fsS -X POST "${BASE_URL}/api/v2/routes" \
+  -H "X-API-Key: ${ADMIN_KEY}" \
   -H "Content-Type: application/json" \
   -d "{\"hostname\":\"seed.example.com\",\"origin_id\":\"${origin_id}\",\"target_port\":8080}")"
 echo "route response: $route_resp"
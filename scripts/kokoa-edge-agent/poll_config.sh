@@ -4,10 +4,31 @@ set -euo pipefail
 CONTROL_PLANE_URL="${CONTROL_PLANE_URL:-}"
 NODE_TOKEN="${NODE_TOKEN:-}"
 CONFIG_DIR="${CONFIG_DIR:-/etc/nginx/kokoa}"
-EMAIL="${EMAIL:-}"
+# TOKEN_FILE holds the token once the agent has renewed it; it takes
+# precedence over NODE_TOKEN.
+TOKEN_FILE="${TOKEN_FILE:-${CONFIG_DIR}/node_token}"
 NGINX_BIN="${NGINX_BIN:-nginx}"
 BACKOFF="${BACKOFF:-5}"
 MAX_BACKOFF="${MAX_BACKOFF:-120}"
+# CONFIG_WAIT is how long (seconds) the control plane holds a config request
+# open waiting for a change before answering 304.
+CONFIG_WAIT="${CONFIG_WAIT:-60}"
+# CONFIG_PUBKEY is the control plane's signing key (pinned by install.sh). When
+# set, configs without a valid signature for this edge are rejected.
+CONFIG_PUBKEY="${CONFIG_PUBKEY:-}"
+EDGE_ID="${EDGE_ID:-}"
+# MAX_CONFIG_AGE is how old (seconds) a signed config may be when received.
+MAX_CONFIG_AGE="${MAX_CONFIG_AGE:-300}"
+# WG_SYNC=true hands the WireGuard interface to the agent: the peer set from
+# the control plane (every origin) is written to WG_CONF and applied.
+WG_SYNC="${WG_SYNC:-false}"
+WG_IFACE="${WG_IFACE:-wg0}"
+WG_CONF="${WG_CONF:-/etc/wireguard/${WG_IFACE}.conf}"
+# WG_KEY is the private key the generated config loads; a rotated key waits
+# in WG_KEY.next until the control plane retires the old one.
+WG_KEY="${WG_KEY:-/etc/wireguard/${WG_IFACE}.key}"
+initial_backoff="$BACKOFF"
+AGENT_VERSION="0.3.0"
 
 log() {
   echo "[kokoa-edge] $*"
@@ -22,46 +43,381 @@ fail_if_empty() {
 }
 
 fail_if_empty CONTROL_PLANE_URL "$CONTROL_PLANE_URL"
+if [[ -s "$TOKEN_FILE" ]]; then
+  NODE_TOKEN="$(cat "$TOKEN_FILE")"
+fi
 fail_if_empty NODE_TOKEN "$NODE_TOKEN"
 
+# renew_token replaces NODE_TOKEN when the control plane announces that it
+# is due (X-Kokoa-Token-Renew) and keeps the new token in TOKEN_FILE.
+renew_token() {
+  local resp token
+  if ! resp="$(curl -fsS -X POST -H "Authorization: Bearer ${NODE_TOKEN}" "${CONTROL_PLANE_URL}/api/v1/edge-nodes/me/token")"; then
+    log "failed to renew node token"
+    return 1
+  fi
+  token="$(echo "$resp" | jq -r '.token // ""')"
+  [[ -n "$token" ]] || return 1
+  (umask 077 && echo "$token" > "${TOKEN_FILE}.tmp") && mv "${TOKEN_FILE}.tmp" "$TOKEN_FILE"
+  NODE_TOKEN="$token"
+  log "renewed node token, expires $(echo "$resp" | jq -r '.token_expires_at // "never"')"
+}
+
+# rotate_wireguard_key generates the next WireGuard key and submits its
+# public half. Peers learn it first; the agent switches once the control
+# plane lists it as this edge's key.
+rotate_wireguard_key() {
+  local next="${WG_KEY}.next" body resp
+  if [[ ! -s "$next" ]]; then
+    (umask 077 && wg genkey > "$next")
+  fi
+  body="$(jq -n --arg key "$(wg pubkey < "$next")" '{public_key: $key}')"
+  if ! resp="$(curl -fsS -X POST -H "Authorization: Bearer ${NODE_TOKEN}" -H "Content-Type: application/json" \
+    -d "$body" "${CONTROL_PLANE_URL}/api/v1/edge-nodes/me/wireguard-key")"; then
+    log "failed to submit the new WireGuard key"
+    return 1
+  fi
+  log "WireGuard key rotation $(echo "$resp" | jq -r '.id'): $(echo "$resp" | jq -r '.state'), $(echo "$resp" | jq -r '.pending') peers pending"
+}
+
+if [[ "${1:-}" == "rotate-wireguard-key" ]]; then
+  rotate_wireguard_key
+  exit 0
+fi
+
+# switch_wireguard_key moves to the rotated key once the config names it.
+switch_wireguard_key() {
+  local next="${WG_KEY}.next" want
+  [[ -s "$next" ]] || return 0
+  want="$(echo "$response" | jq -r '.wireguard.public_key // ""')"
+  if [[ -z "$want" || "$want" != "$(wg pubkey < "$next")" ]]; then
+    return 0
+  fi
+  mv "$next" "$WG_KEY"
+  if ! wg set "$WG_IFACE" private-key "$WG_KEY"; then
+    log "failed to load the rotated WireGuard key into ${WG_IFACE}"
+    return 1
+  fi
+  log "switched ${WG_IFACE} to the rotated WireGuard key"
+}
+
+# sync_wireguard writes the rendered WireGuard config when it changed. Peers
+# are synced into the running interface; an address change restarts it.
+# wg_hash is the peers hash of the config in place, reported as applied.
+sync_wireguard() {
+  local conf old_addr new_addr
+  conf="$(echo "$response" | jq -r '.wireguard.wg_quick // ""')"
+  [[ -n "$conf" ]] || return 0
+  if [[ -f "$WG_CONF" && "$(cat "$WG_CONF")" == "$conf" ]]; then
+    wg_hash="$(echo "$response" | jq -r '.wireguard.peers_hash // ""')"
+    switch_wireguard_key
+    return
+  fi
+  old_addr="$(sed -n 's/^Address = //p' "$WG_CONF" 2>/dev/null || true)"
+  (umask 077 && echo "$conf" > "${WG_CONF}.tmp") && mv "${WG_CONF}.tmp" "$WG_CONF"
+  new_addr="$(sed -n 's/^Address = //p' "$WG_CONF")"
+  if ip link show "$WG_IFACE" >/dev/null 2>&1 && [[ "$old_addr" == "$new_addr" ]]; then
+    if ! wg syncconf "$WG_IFACE" <(wg-quick strip "$WG_IFACE"); then
+      log "failed to sync WireGuard peers on ${WG_IFACE}"
+      return 1
+    fi
+  else
+    wg-quick down "$WG_IFACE" >/dev/null 2>&1 || true
+    if ! wg-quick up "$WG_IFACE"; then
+      log "failed to bring up ${WG_IFACE}"
+      return 1
+    fi
+  fi
+  wg_hash="$(echo "$response" | jq -r '.wireguard.peers_hash // ""')"
+  log "applied WireGuard config with $(echo "$response" | jq -r '.wireguard.peers | length') peers"
+  switch_wireguard_key
+}
+
+# ensure_cert creates a short-lived self-signed placeholder so that nginx can
+# load the server block of a hostname whose certificate is not issued yet.
+ensure_cert() {
+  local host="$1" dir
+  dir="${CONFIG_DIR}/certs/${host/#\*./_wildcard.}"
+  [[ -f "${dir}/fullchain.pem" ]] && return 0
+  mkdir -p "$dir"
+  openssl req -x509 -nodes -newkey rsa:2048 -days 7 -subj "/CN=${host}" \
+    -keyout "${dir}/privkey.pem" -out "${dir}/fullchain.pem" >/dev/null 2>&1 \
+    || log "failed to create placeholder certificate for ${host}"
+}
+
+# sync_certs downloads the certificates issued by the control plane into
+# CONFIG_DIR/certs/<dir>/, which the generated server blocks reference. It
+# writes nothing unless the response is for the certificates_hash of the
+# verified config passed as $1 and, with CONFIG_PUBKEY, carries a valid
+# signature for this edge.
+sync_certs() {
+  local want_hash="$1" certs_file certs_headers certs_hash sig edge_id issued_at now msg_file sig_file dir
+  certs_file="$(mktemp)"
+  certs_headers="$(mktemp)"
+  if ! curl -fsS -D "$certs_headers" -o "$certs_file" -H "Authorization: Bearer ${NODE_TOKEN}" \
+    "${CONTROL_PLANE_URL}/api/v1/edge-nodes/me/certificates"; then
+    rm -f "$certs_file" "$certs_headers"
+    return 1
+  fi
+  sig="$(sed -n 's/^[Xx]-[Kk]okoa-[Ss]ignature: *\([^[:space:]]*\).*/\1/p' "$certs_headers")"
+  rm -f "$certs_headers"
+  certs_hash="$(jq -r '.certificates_hash // ""' "$certs_file")"
+  if [[ "$certs_hash" != "$want_hash" ]]; then
+    rm -f "$certs_file"
+    log "rejecting certificates hash=${certs_hash}: the signed config expects ${want_hash}"
+    return 1
+  fi
+  if [[ -n "$CONFIG_PUBKEY" ]]; then
+    edge_id="$(jq -r '.edge_id // ""' "$certs_file")"
+    issued_at="$(jq -r '.issued_at // 0' "$certs_file")"
+    msg_file="$(mktemp)"
+    sig_file="$(mktemp)"
+    printf 'kokoa-certificates-v1\n%s\n%s\n%s\n%s\n' "$edge_id" "$certs_hash" "$issued_at" \
+      "$(sha256sum "$certs_file" | cut -d' ' -f1)" > "$msg_file"
+    if [[ -z "$sig" ]] || ! echo "$sig" | base64 -d > "$sig_file" 2>/dev/null \
+      || ! openssl pkeyutl -verify -pubin -inkey "$CONFIG_PUBKEY" -rawin -in "$msg_file" -sigfile "$sig_file" >/dev/null 2>&1; then
+      rm -f "$certs_file" "$msg_file" "$sig_file"
+      log "rejecting certificates without a valid signature"
+      return 1
+    fi
+    rm -f "$msg_file" "$sig_file"
+    now="$(date +%s)"
+    if [[ "$edge_id" != "$EDGE_ID" ]] || (( issued_at < now - MAX_CONFIG_AGE || issued_at > now + MAX_CONFIG_AGE )); then
+      rm -f "$certs_file"
+      log "rejecting certificates signed for edge ${edge_id} at ${issued_at}"
+      return 1
+    fi
+  fi
+  while IFS= read -r dir; do
+    [[ -n "$dir" ]] || continue
+    mkdir -p "${CONFIG_DIR}/certs/${dir}"
+    (
+      umask 077
+      jq -r --arg d "$dir" '.certificates[] | select(.dir == $d) | .fullchain_pem' "$certs_file" > "${CONFIG_DIR}/certs/${dir}/fullchain.pem.new"
+      jq -r --arg d "$dir" '.certificates[] | select(.dir == $d) | .privkey_pem' "$certs_file" > "${CONFIG_DIR}/certs/${dir}/privkey.pem.new"
+    )
+    mv "${CONFIG_DIR}/certs/${dir}/fullchain.pem.new" "${CONFIG_DIR}/certs/${dir}/fullchain.pem"
+    mv "${CONFIG_DIR}/certs/${dir}/privkey.pem.new" "${CONFIG_DIR}/certs/${dir}/privkey.pem"
+  done < <(jq -r '.certificates[].dir' "$certs_file")
+  rm -f "$certs_file"
+}
+
+# report_status is the heartbeat: it tells the control plane which config is
+# applied and, after a failed apply, why nginx rejected the new one.
+report_status() {
+  local body nginx_version
+  nginx_version="$($NGINX_BIN -v 2>&1 | sed -n 's|.*nginx/\([^ ]*\).*|\1|p' || true)"
+  body="$(jq -n --arg hash "$previous_hash" --arg status "$apply_status" --arg error "$apply_error" \
+    --arg agent "$AGENT_VERSION" --arg nginx "$nginx_version" --argjson uptime "$(( $(date +%s) - started_at ))" --arg wg "$wg_hash" \
+    '{config_hash: $hash, apply_status: $status, apply_error: $error, agent_version: $agent, nginx_version: $nginx, uptime_seconds: $uptime, wireguard_hash: $wg}')"
+  curl -fsS -X POST -H "Authorization: Bearer ${NODE_TOKEN}" -H "Content-Type: application/json" \
+    -d "$body" "${CONTROL_PLANE_URL}/api/v1/edge-nodes/me/status" >/dev/null 2>&1 || log "failed to report status"
+}
+
+# verify_config checks the signature of the config in $body_file and rejects
+# configs for another edge, older than the last one applied (replays and
+# out-of-order responses) or too old to be a fresh response.
+verify_config() {
+  local sig="$1" edge_id config_hash generation issued_at now msg_file sig_file
+  if [[ -z "$CONFIG_PUBKEY" ]]; then
+    return 0
+  fi
+  if [[ -z "$sig" ]]; then
+    log "rejecting unsigned config"
+    return 1
+  fi
+  edge_id="$(jq -r '.edge_id // ""' "$body_file")"
+  config_hash="$(jq -r '.config_hash // ""' "$body_file")"
+  generation="$(jq -r '.generation // 0' "$body_file")"
+  issued_at="$(jq -r '.issued_at // 0' "$body_file")"
+  msg_file="$(mktemp)"
+  sig_file="$(mktemp)"
+  printf 'kokoa-config-v1\n%s\n%s\n%s\n%s\n%s\n' "$edge_id" "$config_hash" "$generation" "$issued_at" \
+    "$(sha256sum "$body_file" | cut -d' ' -f1)" > "$msg_file"
+  if ! echo "$sig" | base64 -d > "$sig_file" 2>/dev/null \
+    || ! openssl pkeyutl -verify -pubin -inkey "$CONFIG_PUBKEY" -rawin -in "$msg_file" -sigfile "$sig_file" >/dev/null 2>&1; then
+    rm -f "$msg_file" "$sig_file"
+    log "rejecting config with an invalid signature"
+    return 1
+  fi
+  rm -f "$msg_file" "$sig_file"
+  if [[ -z "$EDGE_ID" ]]; then
+    # Installs that predate EDGE_ID pin the first verified edge id.
+    EDGE_ID="$edge_id"
+    echo "$EDGE_ID" > "${CONFIG_DIR}/edge_id"
+  fi
+  now="$(date +%s)"
+  if [[ "$edge_id" != "$EDGE_ID" ]]; then
+    log "rejecting config signed for edge ${edge_id}"
+    return 1
+  fi
+  if (( generation < last_generation || issued_at < last_issued_at )); then
+    log "rejecting config generation ${generation} issued at ${issued_at}: older than the last one received"
+    return 1
+  fi
+  if (( issued_at < now - MAX_CONFIG_AGE || issued_at > now + MAX_CONFIG_AGE )); then
+    log "rejecting config issued at ${issued_at}: outside ${MAX_CONFIG_AGE}s of the local clock"
+    return 1
+  fi
+  last_generation="$generation"
+  last_issued_at="$issued_at"
+  echo "${last_generation} ${last_issued_at}" > "${CONFIG_DIR}/config_generation"
+}
+
 mkdir -p "$CONFIG_DIR"
 
+started_at="$(date +%s)"
+wg_hash=""
 previous_hash=""
+apply_status=""
+apply_error=""
 if [[ -f "$CONFIG_DIR/config_hash" ]]; then
   previous_hash="$(cat "$CONFIG_DIR/config_hash")"
+  apply_status="applied"
+fi
+if [[ -z "$EDGE_ID" && -f "$CONFIG_DIR/edge_id" ]]; then
+  EDGE_ID="$(cat "$CONFIG_DIR/edge_id")"
+fi
+last_generation=0
+last_issued_at=0
+if [[ -f "$CONFIG_DIR/config_generation" ]]; then
+  read -r last_generation last_issued_at < "$CONFIG_DIR/config_generation" || true
+fi
+previous_certs_hash=""
+if [[ -f "$CONFIG_DIR/certificates_hash" ]]; then
+  previous_certs_hash="$(cat "$CONFIG_DIR/certificates_hash")"
 fi
 
+# etag is the version of the last config handled. Once known, requests long
+# poll: the control plane answers when the config changes or with 304 after
+# CONFIG_WAIT seconds.
+etag=""
+headers_file="$(mktemp)"
+body_file="$(mktemp)"
+trap 'rm -f "$headers_file" "$body_file"' EXIT
+
 while true; do
-  tmp_map="$(mktemp)"
-  response="$(curl -fsS -H "Authorization: Bearer ${NODE_TOKEN}" "${CONTROL_PLANE_URL}/api/v1/edge-nodes/me/config" || true)"
-  if [[ -z "$response" ]]; then
-    log "failed to fetch config, backing off ${BACKOFF}s"
+  url="${CONTROL_PLANE_URL}/api/v1/edge-nodes/me/config"
+  if [[ -n "$etag" ]]; then
+    url="${url}?wait=${CONFIG_WAIT}s&since=${etag}"
+  fi
+  : > "$body_file"
+  status_code="$(curl -sS --max-time $(( CONFIG_WAIT + 30 )) -D "$headers_file" -o "$body_file" -w '%{http_code}' \
+    -H "Authorization: Bearer ${NODE_TOKEN}" ${etag:+-H "If-None-Match: \"${etag}\""} "$url" || true)"
+  response="$(cat "$body_file")"
+  if grep -qi '^x-kokoa-token-renew: *true' "$headers_file"; then
+    renew_token || true
+  fi
+  if [[ "$status_code" == "401" ]]; then
+    log "node token was rejected (revoked or expired); install a new token or TOKEN_FILE"
+  fi
+  if [[ "$status_code" == "403" ]]; then
+    log "edge is waiting for approval on the control plane"
+  fi
+  if [[ "$status_code" == "304" ]]; then
+    BACKOFF="$initial_backoff"
+    report_status
+    continue
+  fi
+  if [[ "$status_code" != "200" || -z "$response" ]]; then
+    log "failed to fetch config (status ${status_code:-none}), backing off ${BACKOFF}s"
     sleep "$BACKOFF"
     BACKOFF=$(( BACKOFF * 2 ))
     if (( BACKOFF > MAX_BACKOFF )); then BACKOFF="$MAX_BACKOFF"; fi
     continue
   fi
-  BACKOFF="${BACKOFF:-5}"
+  BACKOFF="$initial_backoff"
+  new_etag="$(sed -n 's/^[Ee][Tt][Aa][Gg]: *"\([^"]*\)".*/\1/p' "$headers_file")"
+  signature="$(sed -n 's/^[Xx]-[Kk]okoa-[Ss]ignature: *\([^[:space:]]*\).*/\1/p' "$headers_file")"
+  if ! verify_config "$signature"; then
+    apply_status="failed"
+    apply_error="rejected config: signature or freshness check failed"
+    report_status
+    sleep "$BACKOFF"
+    continue
+  fi
+
+  certs_hash="$(echo "$response" | jq -r '.certificates_hash // ""')"
+  certs_changed=0
+  if [[ -n "$certs_hash" && "$certs_hash" != "$previous_certs_hash" ]]; then
+    if sync_certs "$certs_hash"; then
+      previous_certs_hash="$certs_hash"
+      echo "$certs_hash" > "${CONFIG_DIR}/certificates_hash"
+      certs_changed=1
+    else
+      # Leave etag alone so the next request returns the config again.
+      log "failed to sync certificates, retrying in 30s"
+      sleep 30
+      continue
+    fi
+  fi
+
+  if [[ "$WG_SYNC" == "true" ]]; then
+    sync_wireguard || true
+  fi
 
   config_hash="$(echo "$response" | jq -r '.config_hash')"
   if [[ -n "$previous_hash" && "$config_hash" == "$previous_hash" ]]; then
-    sleep 30
+    if (( certs_changed )); then
+      log "applied new certificates hash=${certs_hash}"
+      $NGINX_BIN -s reload >/dev/null 2>&1 || true
+    fi
+    report_status
+    etag="$new_etag"
     continue
   fi
 
-  echo "$response" | jq -r '.nginx_map' > "$tmp_map"
-  if ! $NGINX_BIN -t >/dev/null 2>&1; then
+  tmp_dir="$(mktemp -d)"
+  echo "$response" | jq -r '.nginx_map' > "${tmp_dir}/map.conf"
+  echo "$response" | jq -r '.upstreams // ""' > "${tmp_dir}/upstreams.conf"
+  # kokoa.conf is the complete include (upstreams + server blocks); the
+  # files above remain for setups with hand-written server blocks.
+  echo "$response" | jq -r '.nginx_conf // ""' > "${tmp_dir}/kokoa.conf"
+  # Per-hostname location blocks; include them from the host's server block.
+  mkdir -p "${tmp_dir}/locations"
+  while IFS= read -r host; do
+    [[ -n "$host" ]] || continue
+    echo "$response" | jq -r --arg h "$host" '.locations[$h]' > "${tmp_dir}/locations/${host}.conf"
+  done < <(echo "$response" | jq -r '.locations // {} | keys[]')
+  while IFS= read -r host; do
+    [[ -n "$host" ]] || continue
+    ensure_cert "$host"
+  done < <(echo "$response" | jq -r '.hostnames // [] | .[]')
+
+  # Swap the new files in and validate them; nginx -t only sees files in
+  # place. On failure the previous files are restored.
+  backup_dir="$(mktemp -d)"
+  for f in map.conf upstreams.conf kokoa.conf locations; do
+    if [[ -e "${CONFIG_DIR}/${f}" ]]; then
+      mv "${CONFIG_DIR}/${f}" "${backup_dir}/${f}"
+    fi
+    mv "${tmp_dir}/${f}" "${CONFIG_DIR}/${f}"
+  done
+  rm -rf "$tmp_dir"
+  if ! test_output="$($NGINX_BIN -t 2>&1)"; then
     log "nginx config test failed, keeping previous config"
-    rm -f "$tmp_map"
-    sleep 30
+    for f in map.conf upstreams.conf kokoa.conf locations; do
+      rm -rf "${CONFIG_DIR:?}/${f}"
+      if [[ -e "${backup_dir}/${f}" ]]; then
+        mv "${backup_dir}/${f}" "${CONFIG_DIR}/${f}"
+      fi
+    done
+    rm -rf "$backup_dir"
+    apply_status="failed"
+    apply_error="config ${config_hash}: ${test_output}"
+    report_status
+    # Wait for the next change rather than retrying a config nginx rejected.
+    etag="$new_etag"
     continue
   fi
+  rm -rf "$backup_dir"
 
-  mv "$tmp_map" "${CONFIG_DIR}/map.conf"
   echo "$config_hash" > "${CONFIG_DIR}/config_hash"
+  previous_hash="$config_hash"
+  apply_status="applied"
+  apply_error=""
   log "applied new config hash=${config_hash}"
   $NGINX_BIN -s reload >/dev/null 2>&1 || true
-
-  # TLS retrieval is left as a TODO placeholder for certbot integration.
-  sleep 30
+  report_status
+  etag="$new_etag"
 done